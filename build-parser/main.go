@@ -18,7 +18,7 @@ func main() {
 	checkDir("../server")
 	checkDir("../client")
 	checkDir("../certs")
-	checkDir("../iptables")
+	checkDir("../firewall")
 	checkDir("../setcap")
 	if fmtCount > 0 {
 		panic("YOU HAVE DEBUG PRINTS IN THE BUILD")
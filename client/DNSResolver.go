@@ -1,13 +1,11 @@
 package client
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -26,19 +24,7 @@ func CleanDNSCache() {
 	}()
 	defer RecoverAndLog()
 
-	INFO("Cleaning DNS cache")
-	DNSCache.Range(func(key string, value any) bool {
-		dr, ok := value.(*DNSReply)
-		if !ok {
-			return true
-		}
-
-		if time.Since(dr.Expires).Seconds() > 1 {
-			DNSCache.Delete(key)
-		}
-
-		return true
-	})
+	DNSCache.Clean()
 }
 
 // func updateDNSHandlerInterface(dnsInterface net.IP) {
@@ -66,9 +52,19 @@ func InitDNSHandler() {
 
 func StartUDPDNSHandler() {
 	defer RecoverAndLog()
+	startDNSServer(&UDPDNSServer, "udp4")
+}
 
-	udpHandler := dns.NewServeMux()
-	udpHandler.HandleFunc(".", DNSQuery)
+// StartTCPDNSHandler serves the same queries over TCP, clients retry
+// over TCP when a UDP reply is truncated.
+func StartTCPDNSHandler() {
+	defer RecoverAndLog()
+	startDNSServer(&TCPDNSServer, "tcp4")
+}
+
+func startDNSServer(server *atomic.Pointer[dns.Server], network string) {
+	handler := dns.NewServeMux()
+	handler.HandleFunc(".", DNSQuery)
 
 	conf := CONFIG.Load()
 	ip := conf.DNSServerIP
@@ -81,22 +77,75 @@ func StartUDPDNSHandler() {
 		port = DefaultDNSPort
 	}
 
-	UDPDNSServer.Store(&dns.Server{
+	server.Store(&dns.Server{
 		Addr:         ip + ":" + port,
-		Net:          "udp4",
-		Handler:      udpHandler,
+		Net:          network,
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 	})
 
-	err := UDPDNSServer.Load().ListenAndServe()
+	err := server.Load().ListenAndServe()
 	if err != nil {
-		ERROR("DNS SERVER SHUTDOWN: ", err)
+		ERROR("DNS SERVER SHUTDOWN (", network, "): ", err)
+	}
+}
+
+// tcpDNSClient returns a TCP copy of c, the local address of the
+// dialer is kept so queries still leave through the same interface.
+func tcpDNSClient(c *dns.Client) *dns.Client {
+	tc := &dns.Client{
+		Net:          "tcp",
+		Timeout:      c.Timeout,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+	}
+	if c.Dialer != nil {
+		d := *c.Dialer
+		if addr, ok := d.LocalAddr.(*net.UDPAddr); ok {
+			d.LocalAddr = &net.TCPAddr{IP: addr.IP}
+		}
+		tc.Dialer = &d
 	}
+	return tc
 }
 
-func ResolveDomainLocal(tun *TUN, m *dns.Msg, w dns.ResponseWriter) {
-	if len(tun.ServerResponse.DNSServers) == 0 {
+// exchangeDNS sends the query over UDP and repeats it over TCP if
+// the reply is truncated.
+func exchangeDNS(c *dns.Client, m *dns.Msg, address string) (r *dns.Msg, err error) {
+	r, _, err = c.Exchange(m, address)
+	if err != nil || !r.Truncated {
+		return r, err
+	}
+
+	DEBUG("DNS reply truncated, retrying over TCP: ", m.Question[0].Name)
+	tr, _, terr := tcpDNSClient(c).Exchange(m, address)
+	if terr != nil {
+		// The truncated reply makes the client retry over TCP
+		DEBUG("DNS over TCP failed: ", m.Question[0].Name, " ", terr)
+		return r, nil
+	}
+	return tr, nil
+}
+
+// writeDNSReply truncates replies to UDP clients to the buffer size
+// in their EDNS0 record, or 512 bytes without one. The TC bit tells
+// the client to retry over TCP.
+func writeDNSReply(w dns.ResponseWriter, req *dns.Msg, r *dns.Msg) error {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		r.Truncate(size)
+	}
+	return w.WriteMsg(r)
+}
+
+func ResolveDomainLocal(tun *TUN, profile *DNSProfile, m *dns.Msg, w dns.ResponseWriter) {
+	upstreams := tun.dnsUpstreams.Load()
+	if upstreams == nil {
 		return
 	}
 
@@ -113,8 +162,10 @@ func ResolveDomainLocal(tun *TUN, m *dns.Msg, w dns.ResponseWriter) {
 	defer func() {
 		meta := tun.meta.Load()
 		if err != nil {
+			logDNSQuery(m, start, profile, tun, server, DNSResultFailed, "")
 			ERROR("DNS: ", m.Question[0].Name, " || ", fmt.Sprintf("(%d)ms ", time.Since(start).Milliseconds()), " || ", meta.Tag, " || ", err)
 		} else {
+			logDNSQuery(m, start, profile, tun, server, DNSResultResolved, "")
 			if conf.LogAllDomains {
 				INFO("DNS: ", m.Question[0].Name, fmt.Sprintf("(%d)ms ", time.Since(start).Milliseconds()), " @ ", meta.Tag, " @ ", server)
 			}
@@ -124,27 +175,23 @@ func ResolveDomainLocal(tun *TUN, m *dns.Msg, w dns.ResponseWriter) {
 		}
 	}()
 
-	r, _, err = tun.localDNSClient.Exchange(m, tun.ServerResponse.DNSServers[0]+":53")
-	server = tun.ServerResponse.DNSServers[0]
-
-	if err != nil && len(tun.ServerResponse.DNSServers) > 1 {
-		r, _, err = tun.localDNSClient.Exchange(m, tun.ServerResponse.DNSServers[1]+":53")
-		server = tun.ServerResponse.DNSServers[1]
+	r, upstream, err := upstreams.Exchange(m)
+	if upstream != nil {
+		server = upstream.URL
 	}
-
 	if err != nil {
 		return
 	}
 
-	CacheDnsReply(r)
-	err = w.WriteMsg(r)
+	CacheDnsReply(r, tun, "")
+	err = writeDNSReply(w, m, r)
 	w.Close()
 	if err != nil {
 		ERROR("Unable to  write dns reply:", err)
 	}
 }
 
-func ResolveDomain(m *dns.Msg, w dns.ResponseWriter) (err error) {
+func ResolveDomain(m *dns.Msg, w dns.ResponseWriter, profile *DNSProfile) (err error) {
 	if GlobalBlockEnabled(m, w) {
 		DEBUG("global dns lock enabled due to connection switching")
 		return fmt.Errorf("dns lock enabled")
@@ -153,12 +200,15 @@ func ResolveDomain(m *dns.Msg, w dns.ResponseWriter) (err error) {
 	start := time.Now()
 	var r *dns.Msg
 	var server string
+	result := DNSResultResolved
 	conf := CONFIG.Load()
 
 	defer func() {
 		if err != nil {
+			logDNSQuery(m, start, profile, nil, server, DNSResultFailed, "")
 			ERROR("DNS: ", m.Question[0].Name+" >> ", fmt.Sprintf("(%d)ms >>  ", time.Since(start).Milliseconds()), err)
 		} else {
+			logDNSQuery(m, start, profile, nil, server, result, "")
 			if conf.LogAllDomains {
 				INFO("DNS: ", m.Question[0].Name, fmt.Sprintf("(%d)ms ", time.Since(start).Milliseconds()), " @  ", server)
 			}
@@ -168,19 +218,36 @@ func ResolveDomain(m *dns.Msg, w dns.ResponseWriter) (err error) {
 		}
 	}()
 
-	r, _, err = DNSClient.Exchange(m, conf.DNS1Default+":53")
-	server = conf.DNS1Default
-	if err != nil && conf.DNS2Default != "" {
-		r, _, err = DNSClient.Exchange(m, conf.DNS2Default+":53")
-		server = conf.DNS2Default
+	upstreams, err := dnsUpstreamsForProfile(conf, profile)
+	if err != nil {
+		return
+	}
+	query := m
+	if conf.DNSSEC {
+		query = dnssecQuery(m)
+	}
+	r, upstream, err := upstreams.Exchange(query)
+	if upstream != nil {
+		server = upstream.URL
 	}
-
 	if err != nil {
 		return
 	}
 
-	CacheDnsReply(r)
-	err = w.WriteMsg(r)
+	if conf.DNSSEC {
+		if verr := validateDNSReply(conf, m, r); verr != nil {
+			ERROR("DNSSEC validation failed: ", m.Question[0].Name, " >> ", verr)
+			result = DNSResultBogus
+			r = new(dns.Msg)
+			r.SetRcode(m, dns.RcodeServerFailure)
+			err = writeDNSReply(w, m, r)
+			w.Close()
+			return err
+		}
+	}
+
+	CacheDnsReply(r, nil, dnsCacheScope(profile))
+	err = writeDNSReply(w, m, r)
 	w.Close()
 	if err != nil {
 		ERROR("Unable to  write dns reply:", err)
@@ -194,37 +261,8 @@ func ProcessDNSMsg(m *dns.Msg, DNS *types.DNSRecord) (rm *dns.Msg) {
 	rm.Authoritative = true
 	rm.Compress = true
 
-	for i := range rm.Question {
-		switch rm.Question[i].Qtype {
-		case dns.TypeA:
-			if len(DNS.IP) > 0 {
-				for ii := range DNS.IP {
-					rm.Answer = append(rm.Answer, &dns.A{
-						Hdr: dns.RR_Header{
-							Class:  dns.TypeA,
-							Rrtype: dns.ClassINET,
-							Name:   rm.Question[i].Name,
-							Ttl:    5,
-						},
-						A: net.ParseIP(DNS.IP[ii]).To4(),
-					})
-				}
-			}
-		case dns.TypeTXT:
-			if len(DNS.TXT) > 0 {
-				for ii := range DNS.TXT {
-					rm.Answer = append(rm.Answer, &dns.TXT{
-						Hdr: dns.RR_Header{
-							Class:  dns.ClassNONE,
-							Rrtype: dns.TypeTXT,
-							Name:   rm.Question[i].Name,
-							Ttl:    30,
-						},
-						Txt: []string{DNS.TXT[ii]},
-					})
-				}
-			}
-		}
+	for _, q := range rm.Question {
+		rm.Answer = append(rm.Answer, dnsRecordAnswers(q, DNS)...)
 	}
 
 	return
@@ -242,62 +280,36 @@ func GlobalBlockEnabled(m *dns.Msg, w dns.ResponseWriter) bool {
 
 func DNSQuery(w dns.ResponseWriter, m *dns.Msg) {
 	defer RecoverAndLog()
+	start := time.Now()
 
 	// if isAppDNS(m, w) {
 	// 	return
 	// }
 
-	if !isValidDomain(m, w) {
+	if answerReverseLookup(m, w) {
 		return
 	}
 
-	if DNSCacheCheck(m, w) {
+	if !isValidDomain(m, w) {
 		return
 	}
 
+	// Devices using the client as their resolver can have their own profile
+	profile := findDNSProfile(w.RemoteAddr())
+
 	// Check if domain is whitelisted first - whitelisted domains bypass blocklists
-	whitelisted := isWhitelisted(m)
+	whitelisted := isWhitelisted(m, profile)
 	var blocked bool
 	var tag string
 	if !whitelisted {
-		blocked, tag = isBlocked(m)
+		blocked, tag = isBlocked(m, profile)
 	}
 
-	var DNSTunnel *TUN
-	var ServerDNS *types.DNSRecord
-	tunnelMapRange(func(tun *TUN) bool {
-		if tun.GetState() != TUN_Connected {
-			return true
-		}
-
-		meta := tun.meta.Load()
-		if meta == nil {
-			return true
-		}
-
-		if meta.DNSBlocking && blocked {
-			return true
-		}
-
-		if tun.ServerResponse == nil {
-			return true
-		}
-
-		ServerDNS = DNSAMapping(tun.ServerResponse.DNSRecords, m.Question[0].Name)
-		if ServerDNS != nil {
-			DNSTunnel = tun
-			return false
-		}
-
-		return true
-	})
-
 	conf := CONFIG.Load()
-	if ServerDNS == nil {
-		ServerDNS = DNSAMapping(conf.DNSRecords, m.Question[0].Name)
-	}
+	ServerDNS, DNSTunnel := findDNSRecord(m.Question[0].Name, blocked)
 
 	if blocked && ServerDNS == nil {
+		logDNSQuery(m, start, profile, nil, "", DNSResultBlocked, tag)
 		if conf.DNSstats {
 			IncrementDNSStats(m.Question[0].Name, true, tag, nil)
 		}
@@ -314,19 +326,18 @@ func DNSQuery(w dns.ResponseWriter, m *dns.Msg) {
 		return
 	}
 
-	if ServerDNS != nil {
-		hasInfo := false
-		if len(ServerDNS.IP) > 0 {
-			hasInfo = true
-		} else if len(ServerDNS.TXT) > 0 {
-			hasInfo = true
-		}
+	// The cache is checked after the block lists since they can be
+	// different for every profile
+	if DNSCacheCheck(m, w, start, profile) {
+		return
+	}
 
-		if !hasInfo {
+	if ServerDNS != nil {
+		if !ServerDNS.HasAnswers() {
 			DEBUG("Redirect DNS to VPN: ", m.Question[0].Name)
 			// Redirect DNS query to local VPN network if we
 			// have the domain on record but no records.
-			ResolveDomainLocal(DNSTunnel, m, w)
+			ResolveDomainLocal(DNSTunnel, profile, m, w)
 			return
 		}
 
@@ -340,12 +351,14 @@ func DNSQuery(w dns.ResponseWriter, m *dns.Msg) {
 		}
 
 		outMsg := ProcessDNSMsg(m, ServerDNS)
-		err := w.WriteMsg(outMsg)
+		resolveCNAME(DNSTunnel, profile, outMsg, ServerDNS)
+		err := writeDNSReply(w, m, outMsg)
 		if err != nil {
 			ERROR("Unable to  write dns reply:", err)
 		}
 
 		w.Close()
+		logDNSQuery(m, start, profile, DNSTunnel, "", DNSResultLocal, tag)
 		if conf.DNSstats {
 			IncrementDNSStats(m.Question[0].Name, false, tag, outMsg.Answer)
 		}
@@ -353,6 +366,12 @@ func DNSQuery(w dns.ResponseWriter, m *dns.Msg) {
 
 	}
 
+	if routeTunnel, route := findDNSRoute(m.Question[0].Name); routeTunnel != nil {
+		DEBUG("DNS route ", route.Domain, " >> ", m.Question[0].Name)
+		ResolveDomainLocal(routeTunnel, profile, m, w)
+		return
+	}
+
 	if strings.HasSuffix(m.Question[0].Name, ".lan.") {
 		INFO("Dropping query for: ", m.Question[0].Name)
 		err := w.WriteMsg(m)
@@ -364,16 +383,9 @@ func DNSQuery(w dns.ResponseWriter, m *dns.Msg) {
 		return
 	}
 
-	if conf.DNSOverHTTPS {
-		err := ResolveDNSAsHTTPS(m, w)
-		if err != nil {
-			_ = w.WriteMsg(m)
-		}
-	} else {
-		err := ResolveDomain(m, w)
-		if err != nil {
-			_ = w.WriteMsg(m)
-		}
+	err := ResolveDomain(m, w, profile)
+	if err != nil {
+		_ = w.WriteMsg(m)
 	}
 }
 
@@ -403,43 +415,19 @@ DONE:
 	return true
 }
 
-func CacheDnsReply(reply *dns.Msg) {
-	if len(reply.Answer) == 0 {
-		return
-	}
-
-	name := reply.Question[0].Name + strconv.FormatUint(uint64(reply.Question[0].Qtype), 10)
-	RP := new(DNSReply)
-	RP.A = make([]dns.RR, len(reply.Answer))
-	copy(RP.A, reply.Answer)
-	TTL := int(reply.Answer[0].Header().Ttl)
-	RP.Expires = time.Now().Add(time.Second * time.Duration(TTL))
-	DNSCache.Store(name, RP)
+func CacheDnsReply(reply *dns.Msg, tun *TUN, scope string) {
+	DNSCache.Store(reply, tun, scope)
 }
 
-func DNSCacheCheck(m *dns.Msg, w dns.ResponseWriter) bool {
-	nameAndType := m.Question[0].Name + strconv.FormatUint(uint64(m.Question[0].Qtype), 10)
-
-	value, ok := DNSCache.Load(nameAndType)
-	if !ok {
-		return false
-	}
-	cachedReply, ok := value.(*DNSReply)
+func DNSCacheCheck(m *dns.Msg, w dns.ResponseWriter, start time.Time, profile *DNSProfile) bool {
+	rm, expires, ok := DNSCache.Reply(m, dnsCacheScope(profile))
 	if !ok {
 		return false
 	}
 
-	if time.Since(cachedReply.Expires) > 1 {
-		return false
-	}
-
-	m.Answer = cachedReply.A
-	m.Response = true
-	m.Authoritative = true
-	m.RecursionAvailable = false
-
-	_ = w.WriteMsg(m)
+	_ = writeDNSReply(w, m, rm)
 	w.Close()
+	logDNSQuery(m, start, profile, nil, "", DNSResultCached, "")
 	conf := CONFIG.Load()
 	if conf.LogAllDomains {
 		INFO(
@@ -448,120 +436,30 @@ func DNSCacheCheck(m *dns.Msg, w dns.ResponseWriter) bool {
 			" | TYPE: ",
 			strconv.FormatUint(uint64(m.Question[0].Qtype), 10),
 			" | Expires(seconds): ",
-			fmt.Sprintf("%.2f", time.Until(cachedReply.Expires).Seconds()),
+			fmt.Sprintf("%.2f", time.Until(expires).Seconds()),
 		)
 	}
 
-	IncrementDNSStats(m.Question[0].Name, false, "", cachedReply.A)
+	IncrementDNSStats(m.Question[0].Name, false, "", rm.Answer)
 	return true
 }
 
-func isBlocked(m *dns.Msg) (ok bool, tag string) {
-	name := strings.TrimSuffix(m.Question[0].Name, ".")
-	bl := DNSBlockList.Load()
-	if bl == nil {
+func isBlocked(m *dns.Msg, profile *DNSProfile) (ok bool, tag string) {
+	if profile != nil && profile.DisableBlocking {
 		return false, ""
 	}
-
-	blocked, ok := (*bl).Load(name)
-	if ok && blocked {
-		tag = "blocked"
-	}
-
-	return ok, tag
-}
-
-func isWhitelisted(m *dns.Msg) bool {
-	name := strings.TrimSuffix(m.Question[0].Name, ".")
-	wl := DNSWhiteList.Load()
-	if wl == nil {
-		return false
+	matcher := profileMatcher(&dnsProfileBlockLists, DNSBlockList.Load(), profile)
+	rule, ok := matcher.Match(m.Question[0].Name)
+	if !ok {
+		return false, ""
 	}
-
-	whitelisted, ok := (*wl).Load(name)
-	return ok && whitelisted
+	return true, rule.Tag
 }
 
-func ResolveDNSAsHTTPS(m *dns.Msg, w dns.ResponseWriter) (err error) {
-	if GlobalBlockEnabled(m, w) {
-		DEBUG("global dns lock enabled due to connection switching")
-		return fmt.Errorf("dns lock enabled")
-	}
-
-	conf := CONFIG.Load()
-	start := time.Now()
-	x, err := m.Pack()
-	if err != nil {
-		ERROR("unable to prepare DNS msg as HTTPS msg")
-		return err
-	}
-
-	cln := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			IdleConnTimeout:     10 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
-	}
-
-	var req1 *http.Request
-	var req2 *http.Request
-	server := conf.DNS1Default
-	req1, err = http.NewRequest("POST", "https://"+conf.DNS1Default+"/dns-query", bytes.NewBuffer(x))
-	if err != nil {
-		ERROR("unable to create http.request for DNS query")
-		return err
-	}
-
-	req1.Header.Add("accept", "application/dns-message")
-	req1.Header.Add("content-type", "application/dns-message")
-	resp, err := cln.Do(req1)
-	if err != nil {
-
-		if conf.DNS2Default != "" {
-			server = conf.DNS2Default
-			req2, err = http.NewRequest("POST", "https://"+conf.DNS2Default+"/dns-query", bytes.NewBuffer(x))
-			if err != nil {
-				ERROR("unable to create http.request for DNS query")
-				return err
-			}
-
-			req2.Header.Add("accept", "application/dns-message")
-			req2.Header.Add("content-type", "application/dns-message")
-			resp, err = cln.Do(req2)
-		}
-
-		if err != nil {
-			if resp != nil {
-				ERROR("unable to query dns over https: ", m.Question[0].Name, " code: ", resp.StatusCode)
-			} else {
-				ERROR("unable to query dns over https: ", m.Question[0].Name, " err: ", err)
-			}
-			return err
-		}
-	}
-
-	bb, err := io.ReadAll(resp.Body)
-	if err != nil {
-		ERROR("Unable to read DNS over HTTP response body:", err)
-		return err
-	}
-
-	newx := new(dns.Msg)
-	newx.Unpack(bb)
-	CacheDnsReply(newx)
-	err = w.WriteMsg(newx)
-	w.Close()
-	if err != nil {
-		ERROR("Unable to  write dns reply:", err)
-		return err
-	}
-
-	INFO("DNS(https): ", m.Question[0].Name, fmt.Sprintf("(%d)ms ", time.Since(start).Milliseconds()), " @  ", server)
-	if conf.DNSstats {
-		IncrementDNSStats(m.Question[0].Name, false, "", newx.Answer)
-	}
-	return nil
+func isWhitelisted(m *dns.Msg, profile *DNSProfile) bool {
+	matcher := profileMatcher(&dnsProfileWhiteLists, DNSWhiteList.Load(), profile)
+	_, ok := matcher.Match(m.Question[0].Name)
+	return ok
 }
 
 func IncrementDNSStats(domain string, blocked bool, tag string, answers []dns.RR) {
@@ -583,6 +481,9 @@ func IncrementDNSStats(domain string, blocked bool, tag string, answers []dns.RR
 	dnsStats.Tag = tag
 	dnsStats.Count++
 	dnsStats.LastSeen = tn
+	// Only the answers from the last reply are kept, the query log has
+	// the history
+	dnsStats.Answers = nil
 	for _, v := range answers {
 		dnsStats.Answers = append(dnsStats.Answers, v.String())
 	}
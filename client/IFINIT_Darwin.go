@@ -268,14 +268,14 @@ func (t *TInterface) Connect(tun *TUN) (err error) {
 		}
 	}
 
-	if tun.ServerResponse.LAN != nil && tun.ServerResponse.LAN.Nat != "" {
-		err = IP_AddRoute(tun.ServerResponse.LAN.Nat, "", t.IPv4Address, "0")
+	if tun.ServerResponse().LAN != nil && tun.ServerResponse().LAN.Nat != "" {
+		err = IP_AddRoute(tun.ServerResponse().LAN.Nat, "", t.IPv4Address, "0")
 		if err != nil {
 			return err
 		}
 	}
 
-	for _, n := range tun.ServerResponse.Networks {
+	for _, n := range tun.ServerResponse().Networks {
 		if n.Nat != "" {
 			err = IP_AddRoute(n.Nat, "", t.IPv4Address, "0")
 			if err != nil {
@@ -284,7 +284,7 @@ func (t *TInterface) Connect(tun *TUN) (err error) {
 		}
 	}
 
-	for _, v := range tun.ServerResponse.Routes {
+	for _, v := range tun.ServerResponse().Routes {
 		err = IP_AddRoute(v.Address, "", t.IPv4Address, v.Metric)
 		if err != nil {
 			return err
@@ -325,30 +325,29 @@ func (t *TInterface) Disconnect(tun *TUN) (err error) {
 		}
 	}
 
-	if tun.ServerResponse.LAN != nil && tun.ServerResponse.LAN.Nat != "" {
-		err = IP_DelRoute(tun.ServerResponse.LAN.Nat, t.IPv4Address, "0")
-		if err != nil {
-			return err
+	// A failed route removal does not stop the cleanup, the route
+	// may already have been removed by a site network update.
+	delRoute := func(address string, metric string) {
+		if rerr := IP_DelRoute(address, t.IPv4Address, metric); rerr != nil {
+			err = rerr
 		}
 	}
-
-	for _, n := range tun.ServerResponse.Networks {
+	sr := tun.ServerResponse()
+	if sr == nil {
+		return
+	}
+	if sr.LAN != nil && sr.LAN.Nat != "" {
+		delRoute(sr.LAN.Nat, "0")
+	}
+	for _, n := range sr.Networks {
 		if n.Nat != "" {
-			err = IP_DelRoute(n.Nat, t.IPv4Address, "0")
-			if err != nil {
-				return err
-			}
+			delRoute(n.Nat, "0")
 		}
 	}
-
-	for _, r := range tun.ServerResponse.Routes {
-		err = IP_DelRoute(r.Address, t.IPv4Address, r.Metric)
-		if err != nil {
-			return err
-		}
+	for _, r := range sr.Routes {
+		delRoute(r.Address, r.Metric)
 	}
-
-	return nil
+	return
 }
 
 func IP_AddDefaultRoute(gateway string) (err error) {
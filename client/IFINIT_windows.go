@@ -710,14 +710,14 @@ func (t *TInterface) Connect(tun *TUN) (err error) {
 	// _ = DNS_Del(strconv.Itoa(DEFAULT_INTERFACE_ID))
 	// err = DNS_Set(strconv.Itoa(DEFAULT_INTERFACE_ID), "127.0.0.1", "1")
 
-	if tun.ServerResponse.LAN != nil && tun.ServerResponse.LAN.Nat != "" {
-		err = IP_AddRoute(tun.ServerResponse.LAN.Nat, meta.IFName, t.IPv4Address, "0")
+	if tun.ServerResponse().LAN != nil && tun.ServerResponse().LAN.Nat != "" {
+		err = IP_AddRoute(tun.ServerResponse().LAN.Nat, meta.IFName, t.IPv4Address, "0")
 		if err != nil {
 			return err
 		}
 	}
 
-	for _, n := range tun.ServerResponse.Networks {
+	for _, n := range tun.ServerResponse().Networks {
 		if n.Nat != "" {
 			err = IP_AddRoute(n.Nat, meta.IFName, t.IPv4Address, "0")
 			if err != nil {
@@ -726,7 +726,7 @@ func (t *TInterface) Connect(tun *TUN) (err error) {
 		}
 	}
 
-	for _, v := range tun.ServerResponse.Routes {
+	for _, v := range tun.ServerResponse().Routes {
 		err = IP_AddRoute(v.Address, meta.IFName, t.IPv4Address, v.Metric)
 		if err != nil {
 			return err
@@ -783,26 +783,27 @@ func (t *TInterface) Disconnect(tun *TUN) (err error) {
 		}
 	}
 
-	if tun.ServerResponse.LAN != nil && tun.ServerResponse.LAN.Nat != "" {
-		err = IP_DelRoute(tun.ServerResponse.LAN.Nat, t.IPv4Address, "0")
-		if err != nil {
-			return err
+	// A failed route removal does not stop the cleanup, the route
+	// may already have been removed by a site network update.
+	delRoute := func(address string, metric string) {
+		if rerr := IP_DelRoute(address, t.IPv4Address, metric); rerr != nil {
+			err = rerr
 		}
 	}
-
-	for _, n := range tun.ServerResponse.Networks {
+	sr := tun.ServerResponse()
+	if sr == nil {
+		return
+	}
+	if sr.LAN != nil && sr.LAN.Nat != "" {
+		delRoute(sr.LAN.Nat, "0")
+	}
+	for _, n := range sr.Networks {
 		if n.Nat != "" {
-			err = IP_DelRoute(n.Nat, t.IPv4Address, "0")
-			if err != nil {
-				return err
-			}
+			delRoute(n.Nat, "0")
 		}
 	}
-	for _, r := range tun.ServerResponse.Routes {
-		err = IP_DelRoute(r.Address, t.IPv4Address, r.Metric)
-		if err != nil {
-			return err
-		}
+	for _, r := range sr.Routes {
+		delRoute(r.Address, r.Metric)
 	}
 	return
 }
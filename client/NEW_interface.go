@@ -23,14 +23,36 @@ func cliPublicConnect(metaTag string) (err error) {
 	if cs == nil {
 		DEBUG("No control server found")
 	}
+
+	// A draining server can name the server to move to, it is tried
+	// once before the servers in the config.
+	serverID := conf.CLIConfig.ServerID
+	target, migrating := migrateTargets.LoadAndDelete(metaTag)
+	if migrating {
+		serverID = target.(string)
+	}
+
+	if len(conf.CLIConfig.ServerIDs) > 0 && !migrating {
+		err = connectToBestServer(cs, conf.CLIConfig, metaTag)
+		if err != nil {
+			ERROR("Connecting using cli config failed, err:", err)
+		}
+		return err
+	}
 	code, err := PublicConnect(&ConnectionRequest{
 		Server:    cs,
 		Tag:       metaTag,
-		ServerID:  conf.CLIConfig.ServerID,
+		ServerID:  serverID,
 		DeviceKey: conf.CLIConfig.DeviceID,
+
+		SkipUnavailable: true,
 	})
 	if err != nil {
 		ERROR("Connecting using cli config failed, code:", code, "err:", err)
+		if migrating && len(conf.CLIConfig.ServerIDs) > 0 {
+			markServerFailed(serverID)
+			return cliPublicConnect(metaTag)
+		}
 	}
 
 	return err
@@ -157,7 +179,10 @@ func PingConnections() {
 		}
 
 		ping := tun.pingTime.Load()
-		if time.Since(*ping).Seconds() > 45 || err != nil || tun.needsReconnect.Load() {
+		if time.Since(*ping).Seconds() > 45 || err != nil {
+			tun.serverFailed()
+		}
+		if tun.needsReconnect.Load() {
 			if meta.AutoReconnect {
 				DEBUG("45+ Seconds since ping from ", meta.Tag, " attempting reconnection")
 				if conf.CLIConfig != nil {
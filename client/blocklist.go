@@ -1,8 +1,6 @@
 package client
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,10 +8,21 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/puzpuzpuz/xsync/v3"
 )
 
+// listRules keeps the rules of every list, enabled or not, so DNS
+// profiles can build their own matchers.
+type listRules struct {
+	lock  sync.Mutex
+	rules map[string][]*domainRule
+}
+
+func (l *listRules) set(tag string, rules []*domainRule) {
+	l.lock.Lock()
+	l.rules[tag] = rules
+	l.lock.Unlock()
+}
+
 func reloadBlockLists(sleep bool) {
 	defer RecoverAndLog()
 	if sleep {
@@ -41,24 +50,25 @@ func reloadBlockLists(sleep bool) {
 	if badList {
 		config.DNSBlockLists = GetDefaultBlockLists()
 	}
-	newMap := xsync.NewMapOf[string, bool]()
+	lists := &listRules{rules: make(map[string][]*domainRule)}
 
 	wg := new(sync.WaitGroup)
 	for i := range config.DNSBlockLists {
 		wg.Add(1)
-		go processBlockList(i, wg, newMap)
+		go processBlockList(i, wg, lists)
 	}
 	wg.Wait()
 
 	DEBUG("finished updating blocklists")
-	DNSBlockList.Store(&newMap)
+	dnsBlockListRules.Store(lists)
+	applyBlockLists(true)
 	err := writeConfigToDisk()
 	if err != nil {
 		ERROR("unable to write config to disk post blocklist update", err)
 	}
 }
 
-func processBlockList(index int, wg *sync.WaitGroup, nm *xsync.MapOf[string, bool]) {
+func processBlockList(index int, wg *sync.WaitGroup, lists *listRules) {
 	defer func() {
 		wg.Done()
 	}()
@@ -107,25 +117,14 @@ func processBlockList(index int, wg *sync.WaitGroup, nm *xsync.MapOf[string, boo
 		return
 	}
 
-	bl.Count = 0
-	var badLines int
-	buff := bytes.NewBuffer(listBytes)
-	scanner := bufio.NewScanner(buff)
-	for scanner.Scan() {
-		d := scanner.Text()
-		if CheckIfPlainDomain(d) {
-			if bl.Enabled {
-				nm.Store(d, true)
-			}
-			bl.Count++
-		} else {
-			badLines++
-		}
-	}
+	rules, rejected := parseDomainList(listBytes, bl.Tag)
+	lists.set(lowerTag, rules)
+	bl.Count = len(rules)
+	bl.Rejected = rejected
 
 	bl.LastDownload = time.Now()
-	if badLines > 0 {
-		DEBUG(badLines, " invalid lines in list: ", bl.URL)
+	if rejected > 0 {
+		DEBUG(rejected, " invalid lines in list: ", bl.URL)
 	}
 	config.DNSBlockLists[index] = bl
 }
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Block lists can be limited to time windows and to the time a tunnel
+// is connected, and blocking can be paused for a while through the API.
+// The rules of every list are kept after a reload so the matchers are
+// rebuilt from memory when the set of active lists changes.
+
+type BlockListSchedule struct {
+	// Days are mon, tue, wed, thu, fri, sat and sun, empty is every day
+	Days []string
+	// Start and End are HH:MM in local time, a window that ends before
+	// it starts runs past midnight
+	Start string
+	End   string
+}
+
+// blockListPauseAll is the pause key for every block list
+const blockListPauseAll = ""
+
+var (
+	dnsBlockListRules  atomic.Pointer[listRules]
+	dnsBlockListActive atomic.Pointer[string]
+)
+
+var blockListDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseClock returns the minutes since midnight
+func parseClock(clock string) (minutes int, err error) {
+	h, m, ok := strings.Cut(clock, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	hours, err := strconv.Atoi(h)
+	if err != nil || hours < 0 || hours > 23 {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	mins, err := strconv.Atoi(m)
+	if err != nil || mins < 0 || mins > 59 {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	return hours*60 + mins, nil
+}
+
+func (s *BlockListSchedule) validate() error {
+	for _, d := range s.Days {
+		if _, ok := blockListDays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day: %s", d)
+		}
+	}
+	if _, err := parseClock(s.Start); err != nil {
+		return err
+	}
+	_, err := parseClock(s.End)
+	return err
+}
+
+func validateBlockListSchedules(lists []*BlockList) error {
+	for _, bl := range lists {
+		if bl == nil {
+			continue
+		}
+		for _, s := range bl.Schedules {
+			if s == nil {
+				continue
+			}
+			if err := s.validate(); err != nil {
+				return fmt.Errorf("block list %s: %w", bl.Tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BlockListSchedule) active(now time.Time) bool {
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return false
+	}
+
+	day := now.Weekday()
+	minute := now.Hour()*60 + now.Minute()
+	if end <= start && minute < end {
+		// The part after midnight belongs to the window of the day before
+		day = (day + 6) % 7
+	}
+	if len(s.Days) > 0 {
+		found := false
+		for _, d := range s.Days {
+			if blockListDays[strings.ToLower(d)] == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+func blockListPaused(tag string, now time.Time) bool {
+	for _, key := range []string{blockListPauseAll, strings.ToLower(tag)} {
+		if until, ok := DNSBlockPauses.Load(key); ok && now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+func tunnelConnected(tag string) (connected bool) {
+	tunnelMapRange(func(tun *TUN) bool {
+		meta := tun.meta.Load()
+		if meta != nil && meta.Tag == tag && tun.GetState() == TUN_Connected {
+			connected = true
+			return false
+		}
+		return true
+	})
+	return connected
+}
+
+// active reports whether the list applies now, Enabled is not checked
+// since DNS profiles can use lists that are not enabled.
+func (bl *BlockList) active(now time.Time) bool {
+	if blockListPaused(bl.Tag, now) {
+		return false
+	}
+	if bl.Tunnel != "" && !tunnelConnected(bl.Tunnel) {
+		return false
+	}
+	if len(bl.Schedules) == 0 {
+		return true
+	}
+	for _, s := range bl.Schedules {
+		if s != nil && s.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// PauseBlockLists stops the list with the tag from blocking for the
+// duration, an empty tag pauses every list and zero resumes blocking.
+func PauseBlockLists(tag string, d time.Duration) {
+	tag = strings.ToLower(tag)
+	if d <= 0 {
+		DNSBlockPauses.Delete(tag)
+	} else {
+		DNSBlockPauses.Store(tag, time.Now().Add(d))
+	}
+	applyBlockLists(false)
+}
+
+// applyBlockLists swaps the block list matchers when the set of active
+// lists has changed, or always with force.
+func applyBlockLists(force bool) {
+	lists := dnsBlockListRules.Load()
+	if lists == nil {
+		return
+	}
+	conf := CONFIG.Load()
+	now := time.Now()
+
+	rules := make(map[string][]*domainRule)
+	var key strings.Builder
+	for _, bl := range conf.DNSBlockLists {
+		if bl == nil || !bl.active(now) {
+			continue
+		}
+		tag := strings.ToLower(bl.Tag)
+		rules[tag] = lists.rules[tag]
+		key.WriteString(tag)
+		if bl.Enabled {
+			key.WriteString("+")
+		}
+		key.WriteString(",")
+	}
+
+	active := key.String()
+	if old := dnsBlockListActive.Load(); !force && old != nil && *old == active {
+		return
+	}
+	dnsBlockListActive.Store(&active)
+
+	matcher := new(domainMatcher)
+	for _, bl := range conf.DNSBlockLists {
+		if bl != nil && bl.Enabled {
+			matcher.Add(rules[strings.ToLower(bl.Tag)]...)
+		}
+	}
+	DNSBlockList.Store(matcher)
+
+	profiles := buildProfileMatchers(conf.DNSProfiles, rules, func(p *DNSProfile) []string {
+		return p.BlockLists
+	})
+	dnsProfileBlockLists.Store(&profiles)
+	DEBUG("Active block lists: ", active)
+}
+
+// ScheduleBlockLists applies block list schedules and pauses
+func ScheduleBlockLists() {
+	defer func() {
+		time.Sleep(30 * time.Second)
+	}()
+	defer RecoverAndLog()
+
+	applyBlockLists(false)
+}
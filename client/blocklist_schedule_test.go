@@ -0,0 +1,140 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockListScheduleActive(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+
+	tests := []struct {
+		name     string
+		schedule *BlockListSchedule
+		now      time.Time
+		active   bool
+	}{
+		{name: "inside window", schedule: &BlockListSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, now: at(1, 9, 0), active: true},
+		{name: "window end", schedule: &BlockListSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, now: at(1, 17, 0)},
+		{name: "before window", schedule: &BlockListSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, now: at(2, 8, 59)},
+		{name: "weekend", schedule: &BlockListSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, now: at(6, 12, 0)},
+		{name: "every day", schedule: &BlockListSchedule{Start: "09:00", End: "17:00"}, now: at(7, 12, 0), active: true},
+		{name: "overnight before midnight", schedule: &BlockListSchedule{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}, now: at(5, 23, 30), active: true},
+		{name: "overnight after midnight", schedule: &BlockListSchedule{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, now: at(6, 5, 59), active: true},
+		{name: "overnight from the wrong day", schedule: &BlockListSchedule{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, now: at(5, 5, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if active := tt.schedule.active(tt.now); active != tt.active {
+				t.Errorf("expected active=%v, got %v", tt.active, active)
+			}
+		})
+	}
+}
+
+func TestValidateBlockListSchedules(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule *BlockListSchedule
+		valid    bool
+	}{
+		{name: "valid", schedule: &BlockListSchedule{Days: []string{"Sat", "sun"}, Start: "00:00", End: "23:59"}, valid: true},
+		{name: "invalid day", schedule: &BlockListSchedule{Days: []string{"monday"}, Start: "09:00", End: "17:00"}},
+		{name: "invalid start", schedule: &BlockListSchedule{Start: "24:00", End: "17:00"}},
+		{name: "invalid end", schedule: &BlockListSchedule{Start: "09:00", End: "17"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBlockListSchedules([]*BlockList{{Tag: "SocialMedia", Schedules: []*BlockListSchedule{tt.schedule}}})
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid=%v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestApplyBlockLists(t *testing.T) {
+	originalConfig := CONFIG.Load()
+	originalBlockList := DNSBlockList.Load()
+	originalProfiles := dnsProfileBlockLists.Load()
+	originalRules := dnsBlockListRules.Load()
+	defer func() {
+		CONFIG.Store(originalConfig)
+		DNSBlockList.Store(originalBlockList)
+		dnsProfileBlockLists.Store(originalProfiles)
+		dnsBlockListRules.Store(originalRules)
+		dnsBlockListActive.Store(nil)
+		DNSBlockPauses.Clear()
+	}()
+
+	ads := &BlockList{Tag: "Ads", Enabled: true}
+	social := &BlockList{Tag: "SocialMedia", Enabled: true}
+	work := &BlockList{Tag: "Work", Enabled: true, Tunnel: "office"}
+	conf := DefaultConfig()
+	conf.DNSBlockLists = []*BlockList{ads, social, work}
+	CONFIG.Store(conf)
+
+	lists := &listRules{rules: make(map[string][]*domainRule)}
+	for tag, domain := range map[string]string{"ads": "ads.example.com", "socialmedia": "social.example.com", "work": "work.example.com"} {
+		rules, _ := parseDomainList([]byte(domain), tag)
+		lists.set(tag, rules)
+	}
+	dnsBlockListRules.Store(lists)
+	applyBlockLists(true)
+
+	blocked := func(domain string) bool {
+		m := new(dns.Msg)
+		m.SetQuestion(domain, dns.TypeA)
+		blocked, _ := isBlocked(m, nil)
+		return blocked
+	}
+
+	tests := []struct {
+		name    string
+		update  func()
+		domain  string
+		blocked bool
+	}{
+		{name: "list without schedule", domain: "ads.example.com.", blocked: true},
+		{name: "tunnel not connected", domain: "work.example.com."},
+		{
+			name:   "all day schedule",
+			update: func() { social.Schedules = []*BlockListSchedule{{Start: "00:00", End: "00:00"}} },
+			domain: "social.example.com.", blocked: true,
+		},
+		{
+			name: "schedule ended",
+			update: func() {
+				now := time.Now().Add(-2 * time.Minute)
+				social.Schedules = []*BlockListSchedule{{Start: now.Format("15:04"), End: now.Add(time.Minute).Format("15:04")}}
+			},
+			domain: "social.example.com.",
+		},
+		{name: "paused", update: func() { PauseBlockLists("ads", time.Hour) }, domain: "ads.example.com."},
+		{name: "resumed", update: func() { PauseBlockLists("ads", 0) }, domain: "ads.example.com.", blocked: true},
+		{name: "everything paused", update: func() { PauseBlockLists("", time.Hour) }, domain: "ads.example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.update != nil {
+				tt.update()
+				applyBlockLists(false)
+			}
+			if b := blocked(tt.domain); b != tt.blocked {
+				t.Errorf("expected blocked=%v, got %v", tt.blocked, b)
+			}
+		})
+	}
+}
@@ -145,6 +145,10 @@ func DefaultConfig() *configV2 {
 		LogBlockedDomains:    true,
 		LogAllDomains:        true,
 		DNSstats:             true,
+		DNSCacheSize:         defaultDNSCacheSize,
+		DNSCacheMaxTTL:       defaultDNSCacheMaxTTL,
+		DNSQueryLogSize:      defaultDNSLogSize,
+		DNSQueryLogRetention: defaultDNSLogRetention,
 		DNSBlockLists:        GetDefaultBlockLists(),
 		DNSWhiteLists:        GetDefaultWhiteLists(),
 		APIIP:                "127.0.0.1",
@@ -337,12 +341,31 @@ func SetConfig(config *configV2) (err error) {
 
 	oldConf := CONFIG.Load()
 
+	for _, v := range config.DNSUpstreams {
+		if _, err = parseDNSUpstream(v); err != nil {
+			return err
+		}
+	}
+	if _, err = parseTrustAnchors(config.DNSSECTrustAnchors); err != nil {
+		return err
+	}
+	if err = validateDNSProfiles(config.DNSProfiles); err != nil {
+		return err
+	}
+	if err = validateBlockListSchedules(config.DNSBlockLists); err != nil {
+		return err
+	}
+
 	dnsChange := oldConf.DNSServerIP != config.DNSServerIP ||
 		oldConf.DNSServerPort != config.DNSServerPort
 
 	if dnsChange {
-		dnsserver := UDPDNSServer.Load()
-		_ = dnsserver.Shutdown()
+		if dnsserver := UDPDNSServer.Load(); dnsserver != nil {
+			_ = dnsserver.Shutdown()
+		}
+		if dnsserver := TCPDNSServer.Load(); dnsserver != nil {
+			_ = dnsserver.Shutdown()
+		}
 	}
 
 	apiChange := oldConf.APIPort != config.APIPort ||
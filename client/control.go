@@ -0,0 +1,214 @@
+package client
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// controlQueueSize is the number of control messages that can wait
+// for the control worker before the server reader blocks.
+const controlQueueSize = 256
+
+// handleControlMessages applies control messages one at a time in the
+// order the server sent them, so an older site network or port block
+// update can not overwrite a newer one. It returns when queue is closed.
+func (t *TUN) handleControlMessages(queue <-chan []byte) {
+	for packet := range queue {
+		t.HandleControlMessage(packet)
+	}
+}
+
+// HandleControlMessage processes in-band control messages sent by the server
+func (t *TUN) HandleControlMessage(packet []byte) {
+	defer RecoverAndLog()
+
+	switch types.ControlMessageType(packet[1]) {
+	case types.ControlSiteNetworks:
+		msg := new(types.SiteNetworksMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			ERROR("invalid site networks message:", err)
+			return
+		}
+		err = t.UpdateSiteNetworks(msg.Networks)
+		if err != nil {
+			ERROR("unable to update site networks:", err)
+		}
+	case types.ControlP2POffer, types.ControlP2PAnswer:
+		msg := new(types.P2PHandshakeMessage)
+		mt, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			ERROR("invalid p2p handshake message:", err)
+			return
+		}
+		if mt == types.ControlP2POffer {
+			t.handleP2POffer(msg)
+		} else {
+			t.handleP2PAnswer(msg)
+		}
+	case types.ControlPortBlocks:
+		msg := new(types.PortBlocksMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			ERROR("invalid port blocks message:", err)
+			return
+		}
+		t.UpdatePortBlocks(msg.Blocks)
+	case types.ControlConfigUpdate:
+		msg := new(types.ConfigUpdateMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			ERROR("invalid config update message:", err)
+			return
+		}
+		err = t.UpdateServerConfig(msg)
+		if err != nil {
+			ERROR("unable to apply config update:", err)
+		}
+	case types.ControlMigrate:
+		msg := new(types.MigrateMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			ERROR("invalid migrate message:", err)
+			return
+		}
+		t.Migrate(msg)
+	case types.ControlKick:
+		msg := new(types.KickMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			ERROR("invalid kick message:", err)
+			return
+		}
+		t.Kicked(msg)
+	default:
+		DEBUG("unknown control message:", packet[1])
+	}
+}
+
+// Migrate ends the session on a draining server and lets the ping loop
+// reconnect, to the server in the message if it contains one. Tunnels
+// without AutoReconnect are disconnected instead.
+func (t *TUN) Migrate(msg *types.MigrateMessage) {
+	meta := t.meta.Load()
+	if meta != nil {
+		INFO("server asked ", meta.Tag, " to migrate: ", msg.Reason)
+	}
+
+	if msg.ServerID != "" && t.CR != nil && t.CR.ServerID != msg.ServerID {
+		// The draining server is ranked last until it has recovered
+		markServerFailed(t.CR.ServerID)
+		if meta != nil {
+			migrateTargets.Store(meta.Tag, msg.ServerID)
+		}
+		t.CR.ServerID = msg.ServerID
+		t.CR.ServerIP = ""
+		t.CR.ServerPort = ""
+		t.CR.ServerPubKey = ""
+		t.CR.ServerPubKeys = nil
+	}
+
+	err := t.sendControlMessage(types.ControlDisconnect, nil)
+	if err != nil {
+		DEBUG("unable to send disconnect message:", err)
+	}
+	t.needsReconnect.Store(true)
+}
+
+// Kicked disconnects the tunnel after the server removed the session,
+// the tunnel is not reconnected.
+func (t *TUN) Kicked(msg *types.KickMessage) {
+	meta := t.meta.Load()
+	if meta != nil {
+		ERROR("server removed the session for ", meta.Tag, ": ", msg.Reason)
+	}
+	t.sessionRemoved.Store(true)
+	t.needsReconnect.Store(false)
+	_ = Disconnect(t.ID, false)
+}
+
+// UpdateServerConfig applies settings changed by a server config reload.
+// Routes, DNS records, DNS servers and DNS routes set on the tunnel
+// take priority over the server, the same way they do when connecting.
+// The DNS resolver reads the server response at any time, so the
+// changes are made to a copy that replaces it.
+func (t *TUN) UpdateServerConfig(msg *types.ConfigUpdateMessage) (err error) {
+	meta := t.meta.Load()
+	tunif := t.tunnel.Load()
+	old := t.ServerResponse()
+	if meta == nil {
+		return errors.New("no tunnel meta")
+	}
+	if tunif == nil || old == nil {
+		return errors.New("no tunnel interface")
+	}
+
+	sr := *old
+	sr.AvailableMbps = msg.AvailableMbps
+	sr.AvailableUserMbps = msg.AvailableUserMbps
+	sr.InternetAccess = msg.InternetAccess
+	sr.LocalNetworkAccess = msg.LocalNetworkAccess
+
+	if len(meta.DNSRecords) == 0 {
+		sr.DNSRecords = msg.DNSRecords
+	}
+	if len(meta.DNSServers) == 0 {
+		if len(msg.DNSServers) > 0 {
+			sr.DNSServers = msg.DNSServers
+		} else {
+			conf := CONFIG.Load()
+			sr.DNSServers = []string{conf.DNS1Default, conf.DNS2Default}
+		}
+	}
+	if len(meta.DNSRoutes) == 0 {
+		sr.DNSRoutes = msg.DNSRoutes
+	}
+
+	if len(meta.Routes) == 0 {
+		// The site networks in the server response are kept current by
+		// UpdateSiteNetworks, which runs on the same control worker.
+		sr.Routes = t.updateServerRoutes(meta, tunif, old.Routes, msg.Routes, old.SiteNetworks)
+	}
+	t.serverResponse.Store(&sr)
+
+	if len(meta.DNSServers) == 0 {
+		if rerr := t.resetDNSUpstreams(); rerr != nil {
+			ERROR("unable to update DNS servers for tunnel:", meta.Tag, rerr)
+		}
+	}
+	DEBUG("server config updated for tunnel:", meta.Tag)
+	return nil
+}
+
+// updateServerRoutes replaces the routes sent by the server and
+// returns the routes that are now installed.
+func (t *TUN) updateServerRoutes(meta *TunnelMETA, tunif *TInterface, oldRoutes []*types.Route, newRoutes []*types.Route, sites []*types.Network) []*types.Route {
+	routes := slices.Clone(newRoutes)
+	for _, v := range sites {
+		routes = append(routes, &types.Route{
+			Address: v.Network,
+			Metric:  "0",
+		})
+	}
+
+	sameRoute := func(a, b *types.Route) bool {
+		return a.Address == b.Address && a.Metric == b.Metric
+	}
+	for _, o := range oldRoutes {
+		if !slices.ContainsFunc(routes, func(n *types.Route) bool { return sameRoute(o, n) }) {
+			_ = IP_DelRoute(o.Address, tunif.IPv4Address, o.Metric)
+		}
+	}
+	for _, n := range routes {
+		if slices.ContainsFunc(oldRoutes, func(o *types.Route) bool { return sameRoute(o, n) }) {
+			continue
+		}
+		err := IP_AddRoute(n.Address, meta.IFName, tunif.IPv4Address, n.Metric)
+		if err != nil {
+			ERROR("unable to add route:", n.Address, err)
+		}
+	}
+	return routes
+}
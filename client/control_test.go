@@ -0,0 +1,140 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      *types.MigrateMessage
+		serverID string
+		serverIP string
+		moved    bool
+	}{
+		{"same server", &types.MigrateMessage{}, "a", "10.0.0.1", false},
+		{"other server", &types.MigrateMessage{ServerID: "b"}, "b", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun := &TUN{CR: &ConnectionRequest{
+				ServerID:     "a",
+				ServerIP:     "10.0.0.1",
+				ServerPubKey: "pem",
+			}}
+			tun.meta.Store(&TunnelMETA{Tag: "migrate"})
+			defer failedServers.Delete("a")
+			defer migrateTargets.Delete("migrate")
+			tun.Migrate(tt.msg)
+
+			if !tun.needsReconnect.Load() {
+				t.Error("tunnel was not marked for reconnection")
+			}
+			if tun.CR.ServerID != tt.serverID || tun.CR.ServerIP != tt.serverIP {
+				t.Errorf("expected server %q (%q), got %q (%q)", tt.serverID, tt.serverIP, tun.CR.ServerID, tun.CR.ServerIP)
+			}
+			if serverFailedRecently("a") != tt.moved {
+				t.Errorf("expected the draining server to be marked failed=%v", tt.moved)
+			}
+			if target, ok := migrateTargets.Load("migrate"); ok != tt.moved || (ok && target != "b") {
+				t.Errorf("unexpected migrate target %v", target)
+			}
+		})
+	}
+}
+
+func TestKicked(t *testing.T) {
+	tun := &TUN{CR: &ConnectionRequest{ServerID: "a"}}
+	tun.needsReconnect.Store(true)
+	tun.Kicked(&types.KickMessage{Reason: "test"})
+
+	if tun.needsReconnect.Load() {
+		t.Error("a kicked tunnel should not reconnect")
+	}
+	if !tun.sessionRemoved.Load() {
+		t.Error("tunnel was not marked as removed by the server")
+	}
+}
+
+func TestUpdateServerConfig(t *testing.T) {
+	tun := &TUN{ID: "office"}
+	tun.meta.Store(&TunnelMETA{
+		Tag:        "office",
+		Routes:     []*types.Route{{Address: "10.0.0.0/8"}},
+		DNSServers: []string{"10.0.0.53"},
+	})
+	tun.tunnel.Store(&TInterface{})
+	tun.serverResponse.Store(&types.ServerConnectResponse{
+		DNSRecords: []*types.DNSRecord{{Domain: "old.office.lan", IP: []string{"10.0.0.1"}}},
+	})
+	tun.SetState(TUN_Connected)
+	TunnelMap.Store(tun.ID, tun)
+	defer TunnelMap.Delete(tun.ID)
+
+	// The resolver reads the server response while it is updated
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 1000 {
+			findDNSRecord("old.office.lan.", false)
+			reverseDNSRecords(net.ParseIP("10.0.0.1"))
+			findDNSRoute("host.office.lan.")
+		}
+	}()
+
+	old := tun.ServerResponse()
+	for i := range 100 {
+		err := tun.UpdateServerConfig(&types.ConfigUpdateMessage{
+			AvailableMbps: i,
+			DNSRecords:    []*types.DNSRecord{{Domain: "new.office.lan", IP: []string{"10.0.0.2"}}},
+			DNSRoutes:     []*types.DNSRoute{{Domain: "office.lan"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if len(old.DNSRecords) != 1 || old.DNSRecords[0].Domain != "old.office.lan" {
+		t.Error("the previous server response was changed")
+	}
+	if record, _ := findDNSRecord("new.office.lan.", false); record == nil {
+		t.Error("updated DNS record was not found")
+	}
+	if routed, _ := findDNSRoute("host.office.lan."); routed != tun {
+		t.Error("updated DNS route was not used")
+	}
+	if sr := tun.ServerResponse(); sr.AvailableMbps != 99 || len(sr.DNSServers) != 0 {
+		t.Errorf("unexpected server response: %+v", sr)
+	}
+
+	if err := new(TUN).UpdateServerConfig(&types.ConfigUpdateMessage{}); err == nil {
+		t.Error("expected an error for a tunnel without meta")
+	}
+}
+
+func TestHandleControlMessages_Order(t *testing.T) {
+	tun := newPortTestTUN(2000, 2001)
+
+	queue := make(chan []byte, controlQueueSize)
+	for i := range 50 {
+		packet, err := types.MarshalControlMessage(types.ControlPortBlocks, &types.PortBlocksMessage{
+			Blocks: []types.PortBlock{{StartPort: 2000, EndPort: 2001}, {StartPort: uint16(3000 + i), EndPort: uint16(3000 + i)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue <- packet
+	}
+	close(queue)
+	tun.handleControlMessages(queue)
+
+	blocks := tun.getPortBlocks()
+	if len(blocks) != 2 || blocks[1].StartPort != 3049 {
+		t.Errorf("expected the last port block update to be applied, got %d blocks", len(blocks))
+	}
+}
@@ -0,0 +1,350 @@
+package client
+
+import (
+	"container/list"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The DNS cache keeps up to DNSCacheSize replies, the least recently
+// used reply is removed when the cache is full. Every record keeps its
+// own TTL, clamped to DNSCacheMinTTL and DNSCacheMaxTTL, and the TTLs
+// are decreased when a reply is served from the cache. NXDOMAIN and
+// NODATA replies are cached for the SOA minimum (RFC 2308). A reply
+// that has been served dnsPrefetchHits times is refreshed in the
+// background when less than dnsPrefetchPercent of its TTL is left.
+
+const (
+	defaultDNSCacheSize   = 10000
+	defaultDNSCacheMaxTTL = 86400
+	dnsPrefetchHits       = 3
+	dnsPrefetchPercent    = 10
+)
+
+type dnsCacheEntry struct {
+	key         string
+	name        string
+	qtype       uint16
+	rcode       int
+	validated   bool
+	answer      []dns.RR
+	ns          []dns.RR
+	stored      time.Time
+	expires     time.Time
+	tunnelID    string
+	scope       string
+	hits        int
+	prefetching bool
+}
+
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	negativeHits atomic.Uint64
+	prefetches   atomic.Uint64
+	evictions    atomic.Uint64
+}
+
+type DNSCacheStats struct {
+	Entries      int
+	Capacity     int
+	Hits         uint64
+	Misses       uint64
+	NegativeHits uint64
+	Prefetches   uint64
+	Evictions    uint64
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// dnsCacheKey returns the key for the query, scope is the DNS profile
+// for replies from the upstreams of a profile.
+func dnsCacheKey(scope string, name string, qtype uint16) string {
+	return scope + "|" + strings.ToLower(name) + strconv.FormatUint(uint64(qtype), 10)
+}
+
+func dnsCacheSize(conf *configV2) int {
+	if conf.DNSCacheSize <= 0 {
+		return defaultDNSCacheSize
+	}
+	return conf.DNSCacheSize
+}
+
+func clampDNSTTL(conf *configV2, ttl uint32) uint32 {
+	maxTTL := uint32(defaultDNSCacheMaxTTL)
+	if conf.DNSCacheMaxTTL > 0 {
+		maxTTL = uint32(conf.DNSCacheMaxTTL)
+	}
+	if conf.DNSCacheMinTTL > 0 && ttl < uint32(conf.DNSCacheMinTTL) {
+		ttl = uint32(conf.DNSCacheMinTTL)
+	}
+	return min(ttl, maxTTL)
+}
+
+// dnsReplyTTL returns how long the reply can be cached, negative
+// replies without a SOA record are not cached.
+func dnsReplyTTL(r *dns.Msg) (ttl uint32, ok bool) {
+	switch {
+	case r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0:
+		ttl = r.Answer[0].Header().Ttl
+		for _, rr := range r.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return ttl, true
+	case r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError:
+		for _, rr := range r.Ns {
+			if soa, isSOA := rr.(*dns.SOA); isSOA {
+				return min(soa.Hdr.Ttl, soa.Minttl), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Store caches the reply, tun is the tunnel the reply came from
+func (c *dnsCache) Store(r *dns.Msg, tun *TUN, scope string) {
+	if r == nil || r.Truncated || len(r.Question) == 0 {
+		return
+	}
+	ttl, ok := dnsReplyTTL(r)
+	if !ok {
+		return
+	}
+
+	conf := CONFIG.Load()
+	ttl = clampDNSTTL(conf, ttl)
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	q := r.Question[0]
+	e := &dnsCacheEntry{
+		key:       dnsCacheKey(scope, q.Name, q.Qtype),
+		name:      q.Name,
+		qtype:     q.Qtype,
+		rcode:     r.Rcode,
+		validated: r.AuthenticatedData,
+		stored:    now,
+		expires:   now.Add(time.Duration(ttl) * time.Second),
+		scope:     scope,
+	}
+	if tun != nil {
+		e.tunnelID = tun.ID
+	}
+	for _, rr := range r.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = max(clampDNSTTL(conf, rr.Header().Ttl), ttl)
+		e.answer = append(e.answer, rr)
+	}
+	if len(r.Answer) == 0 {
+		for _, rr := range r.Ns {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = ttl
+			e.ns = append(e.ns, rr)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		e.hits = el.Value.(*dnsCacheEntry).hits
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+
+	size := dnsCacheSize(conf)
+	for c.lru.Len() > size {
+		c.removeLocked(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *dnsCache) removeLocked(el *list.Element) {
+	delete(c.entries, el.Value.(*dnsCacheEntry).key)
+	c.lru.Remove(el)
+}
+
+func decayDNSTTL(rrs []dns.RR, elapsed uint32) (out []dns.RR) {
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		h := rr.Header()
+		if h.Ttl > elapsed {
+			h.Ttl -= elapsed
+		} else {
+			h.Ttl = 0
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// Reply returns the cached reply to the query
+func (c *dnsCache) Reply(m *dns.Msg, scope string) (rm *dns.Msg, expires time.Time, ok bool) {
+	q := m.Question[0]
+	key := dnsCacheKey(scope, q.Name, q.Qtype)
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, expires, false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	if !now.Before(e.expires) {
+		c.removeLocked(el)
+		c.misses.Add(1)
+		return nil, expires, false
+	}
+
+	elapsed := uint32(now.Sub(e.stored).Seconds())
+	rm = new(dns.Msg)
+	rm.SetReply(m)
+	rm.Rcode = e.rcode
+	rm.RecursionAvailable = true
+	rm.AuthenticatedData = e.validated
+	rm.Answer = decayDNSTTL(e.answer, elapsed)
+	rm.Ns = decayDNSTTL(e.ns, elapsed)
+	if !dnssecOK(m) {
+		rm.Answer = slices.DeleteFunc(rm.Answer, func(rr dns.RR) bool { return dnssecRecord(rr, q.Qtype) })
+		rm.Ns = slices.DeleteFunc(rm.Ns, func(rr dns.RR) bool { return dnssecRecord(rr, q.Qtype) })
+	}
+
+	e.hits++
+	c.lru.MoveToFront(el)
+	c.hits.Add(1)
+	if len(e.answer) == 0 {
+		c.negativeHits.Add(1)
+	}
+
+	if !e.prefetching && e.hits >= dnsPrefetchHits && !CONFIG.Load().DisableDNSPrefetch {
+		total := e.expires.Sub(e.stored)
+		if e.expires.Sub(now)*100 <= total*dnsPrefetchPercent {
+			e.prefetching = true
+			go c.prefetch(e.name, e.qtype, e.tunnelID, e.scope)
+		}
+	}
+	return rm, e.expires, true
+}
+
+// prefetch refreshes the reply from where it came from, replies from a
+// tunnel that is no longer connected are removed instead so the query
+// is not sent to the default upstreams.
+func (c *dnsCache) prefetch(name string, qtype uint16, tunnelID string, scope string) {
+	defer RecoverAndLog()
+	key := dnsCacheKey(scope, name, qtype)
+	var tun *TUN
+	if tunnelID != "" {
+		tun = connectedTunnel(tunnelID)
+		if tun == nil {
+			c.remove(key)
+			return
+		}
+	}
+	var profile *DNSProfile
+	if scope != "" {
+		profile = dnsProfileByTag(scope)
+	}
+
+	r, err := lookupDNS(tun, profile, name, qtype)
+	if err != nil {
+		DEBUG("DNS prefetch failed: ", name, " >> ", err)
+		c.lock.Lock()
+		if el, ok := c.entries[key]; ok {
+			el.Value.(*dnsCacheEntry).prefetching = false
+		}
+		c.lock.Unlock()
+		return
+	}
+	if tun != nil && connectedTunnel(tunnelID) == nil {
+		// The tunnel disconnected during the lookup
+		c.remove(key)
+		return
+	}
+	c.prefetches.Add(1)
+	c.Store(r, tun, scope)
+}
+
+func connectedTunnel(tunnelID string) *TUN {
+	tun, ok := TunnelMap.Load(tunnelID)
+	if !ok || tun.GetState() != TUN_Connected {
+		return nil
+	}
+	return tun
+}
+
+func (c *dnsCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// RemoveTunnel removes the replies that came from the tunnel
+func (c *dnsCache) RemoveTunnel(tunnelID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*dnsCacheEntry).tunnelID == tunnelID {
+			c.removeLocked(el)
+		}
+		el = prev
+	}
+}
+
+// Clean removes expired replies
+func (c *dnsCache) Clean() {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if !now.Before(el.Value.(*dnsCacheEntry).expires) {
+			c.removeLocked(el)
+		}
+		el = prev
+	}
+}
+
+func (c *dnsCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *dnsCache) Stats() *DNSCacheStats {
+	c.lock.Lock()
+	entries := c.lru.Len()
+	c.lock.Unlock()
+	return &DNSCacheStats{
+		Entries:      entries,
+		Capacity:     dnsCacheSize(CONFIG.Load()),
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Prefetches:   c.prefetches.Load(),
+		Evictions:    c.evictions.Load(),
+	}
+}
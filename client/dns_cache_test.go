@@ -0,0 +1,185 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testDNSAnswer(name string, ttl uint32, ip string) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(ip).To4(),
+	}
+}
+
+func testSOA(zone string, ttl uint32, minttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns." + zone,
+		Mbox:   "hostmaster." + zone,
+		Minttl: minttl,
+	}
+}
+
+func TestDNSReplyTTL(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	tests := []struct {
+		name      string
+		rcode     int
+		answer    []dns.RR
+		ns        []dns.RR
+		ttl       uint32
+		cacheable bool
+	}{
+		{
+			name:      "lowest answer TTL",
+			answer:    []dns.RR{testDNSAnswer("example.com.", 300, "10.0.0.1"), testDNSAnswer("example.com.", 60, "10.0.0.2")},
+			ttl:       60,
+			cacheable: true,
+		},
+		{
+			name:      "NXDOMAIN uses the SOA minimum",
+			rcode:     dns.RcodeNameError,
+			ns:        []dns.RR{testSOA("example.com.", 3600, 900)},
+			ttl:       900,
+			cacheable: true,
+		},
+		{
+			name:      "NODATA uses the SOA TTL when it is lower",
+			ns:        []dns.RR{testSOA("example.com.", 120, 900)},
+			ttl:       120,
+			cacheable: true,
+		},
+		{
+			name:  "negative reply without SOA",
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "server failure",
+			rcode: dns.RcodeServerFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetRcode(req, tt.rcode)
+			r.Answer = tt.answer
+			r.Ns = tt.ns
+			ttl, ok := dnsReplyTTL(r)
+			if ok != tt.cacheable || ttl != tt.ttl {
+				t.Errorf("expected %d %v, got %d %v", tt.ttl, tt.cacheable, ttl, ok)
+			}
+		})
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	originalConfig := CONFIG.Load()
+	defer CONFIG.Store(originalConfig)
+	conf := DefaultConfig()
+	conf.DNSCacheSize = 2
+	conf.DNSCacheMinTTL = 30
+	conf.DNSCacheMaxTTL = 600
+	conf.DisableDNSPrefetch = true
+	CONFIG.Store(conf)
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return m
+	}
+	reply := func(name string, answers ...dns.RR) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(query(name))
+		r.Answer = answers
+		return r
+	}
+
+	c := newDNSCache()
+	c.Store(reply("a.example.com.", testDNSAnswer("a.example.com.", 5, "10.0.0.1"), testDNSAnswer("a.example.com.", 3600, "10.0.0.2")), nil, "")
+
+	t.Run("TTLs are clamped per record", func(t *testing.T) {
+		rm, expires, ok := c.Reply(query("A.Example.com."), "")
+		if !ok {
+			t.Fatal("expected a cached reply")
+		}
+		if rm.Answer[0].Header().Ttl != 30 || rm.Answer[1].Header().Ttl != 600 {
+			t.Errorf("unexpected TTLs: %d %d", rm.Answer[0].Header().Ttl, rm.Answer[1].Header().Ttl)
+		}
+		if time.Until(expires) > 30*time.Second {
+			t.Errorf("reply should expire with the lowest TTL, expires in %s", time.Until(expires))
+		}
+	})
+
+	t.Run("TTLs decrease", func(t *testing.T) {
+		el := c.entries[dnsCacheKey("", "a.example.com.", dns.TypeA)]
+		e := el.Value.(*dnsCacheEntry)
+		e.stored = e.stored.Add(-10 * time.Second)
+		rm, _, _ := c.Reply(query("a.example.com."), "")
+		if rm.Answer[0].Header().Ttl != 20 || rm.Answer[1].Header().Ttl != 590 {
+			t.Errorf("unexpected TTLs: %d %d", rm.Answer[0].Header().Ttl, rm.Answer[1].Header().Ttl)
+		}
+	})
+
+	t.Run("negative replies", func(t *testing.T) {
+		r := new(dns.Msg)
+		r.SetRcode(query("missing.example.com."), dns.RcodeNameError)
+		r.Ns = []dns.RR{testSOA("example.com.", 3600, 60)}
+		c.Store(r, nil, "")
+		rm, _, ok := c.Reply(query("missing.example.com."), "")
+		if !ok || rm.Rcode != dns.RcodeNameError || len(rm.Ns) != 1 {
+			t.Fatalf("expected a cached NXDOMAIN, got %v", rm)
+		}
+		if c.Stats().NegativeHits != 1 {
+			t.Errorf("expected 1 negative hit, got %d", c.Stats().NegativeHits)
+		}
+	})
+
+	t.Run("least recently used reply is evicted", func(t *testing.T) {
+		c.Store(reply("b.example.com.", testDNSAnswer("b.example.com.", 60, "10.0.0.3")), nil, "")
+		if _, _, ok := c.Reply(query("a.example.com."), ""); ok {
+			t.Error("a.example.com should have been evicted")
+		}
+		stats := c.Stats()
+		if stats.Entries != 2 || stats.Evictions != 1 || stats.Capacity != 2 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("expired replies", func(t *testing.T) {
+		el := c.entries[dnsCacheKey("", "b.example.com.", dns.TypeA)]
+		el.Value.(*dnsCacheEntry).expires = time.Now().Add(-time.Second)
+		c.Clean()
+		if _, _, ok := c.Reply(query("b.example.com."), ""); ok {
+			t.Error("expired reply should not be served")
+		}
+	})
+
+	t.Run("replies from a disconnected tunnel", func(t *testing.T) {
+		c := newDNSCache()
+		tun := &TUN{ID: "office"}
+		c.Store(reply("a.office.lan.", testDNSAnswer("a.office.lan.", 60, "10.0.0.4")), tun, "")
+		c.Store(reply("b.office.lan.", testDNSAnswer("b.office.lan.", 60, "10.0.0.5")), tun, "")
+
+		// The tunnel is not in the tunnel map, so nothing is looked up
+		c.prefetch("a.office.lan.", dns.TypeA, tun.ID, "")
+		if _, _, ok := c.Reply(query("a.office.lan."), ""); ok {
+			t.Error("prefetch should remove replies from a disconnected tunnel")
+		}
+
+		c.Store(reply("c.example.com.", testDNSAnswer("c.example.com.", 60, "10.0.0.6")), nil, "")
+		c.RemoveTunnel(tun.ID)
+		if _, _, ok := c.Reply(query("b.office.lan."), ""); ok {
+			t.Error("replies from the tunnel should have been removed")
+		}
+		if _, _, ok := c.Reply(query("c.example.com."), ""); !ok {
+			t.Error("replies from other upstreams should be kept")
+		}
+	})
+}
@@ -0,0 +1,372 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	gobolt "go.etcd.io/bbolt"
+)
+
+// The DNS query log keeps the last DNSQueryLogSize queries in memory.
+// With DNSQueryLogDisk the queries are also written to a bbolt file in
+// the base path, in batches from WriteDNSLog, and queries older than
+// DNSQueryLogRetention days are removed once a day by PruneDNSLog.
+
+const (
+	defaultDNSLogSize      = 5000
+	defaultDNSLogRetention = 7
+	defaultDNSLogLimit     = 1000
+	dnsLogBatch            = 100
+	dnsLogFileName         = "dnslog.db"
+	dnsLogBucket           = "queries"
+)
+
+const (
+	DNSResultResolved = "resolved"
+	DNSResultCached   = "cached"
+	DNSResultLocal    = "local"
+	DNSResultBlocked  = "blocked"
+	DNSResultFailed   = "failed"
+	DNSResultBogus    = "bogus"
+)
+
+type DNSLogEntry struct {
+	Time     time.Time
+	Domain   string
+	Type     string
+	Tunnel   string
+	Profile  string
+	Upstream string
+	// Latency in milliseconds
+	Latency int64
+	Result  string
+	Tag     string
+}
+
+// DNSLogQuery filters the query log, empty fields match everything
+// and Domain matches any part of the domain.
+type DNSLogQuery struct {
+	Start   time.Time
+	End     time.Time
+	Domain  string
+	Type    string
+	Tunnel  string
+	Profile string
+	Result  string
+	Tag     string
+	Limit   int
+}
+
+type dnsQueryLog struct {
+	lock    sync.Mutex
+	entries []*DNSLogEntry
+	next    int
+	count   int
+
+	dbLock sync.Mutex
+	db     atomic.Pointer[gobolt.DB]
+	queue  chan *DNSLogEntry
+}
+
+func newDNSQueryLog() *dnsQueryLog {
+	return &dnsQueryLog{
+		queue: make(chan *DNSLogEntry, 1000),
+	}
+}
+
+func dnsLogSize(conf *configV2) int {
+	if conf.DNSQueryLogSize <= 0 {
+		return defaultDNSLogSize
+	}
+	return conf.DNSQueryLogSize
+}
+
+func dnsLogRetention(conf *configV2) time.Duration {
+	days := conf.DNSQueryLogRetention
+	if days <= 0 {
+		days = defaultDNSLogRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// logDNSQuery adds the query to the query log and the profile stats
+func logDNSQuery(m *dns.Msg, start time.Time, profile *DNSProfile, tun *TUN, upstream string, result string, tag string) {
+	conf := CONFIG.Load()
+	if !conf.DNSstats {
+		return
+	}
+	incrementDNSProfileStats(profile, result)
+
+	e := &DNSLogEntry{
+		Time:     start,
+		Domain:   m.Question[0].Name,
+		Type:     dns.TypeToString[m.Question[0].Qtype],
+		Upstream: upstream,
+		Latency:  time.Since(start).Milliseconds(),
+		Result:   result,
+		Tag:      tag,
+	}
+	if profile != nil {
+		e.Profile = profile.Tag
+	}
+	if tun != nil {
+		if meta := tun.meta.Load(); meta != nil {
+			e.Tunnel = meta.Tag
+		}
+	}
+	DNSQueryLog.Add(conf, e)
+}
+
+func (l *dnsQueryLog) Add(conf *configV2, e *DNSLogEntry) {
+	l.lock.Lock()
+	if size := dnsLogSize(conf); len(l.entries) != size {
+		l.resizeLocked(size)
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	l.count = min(l.count+1, len(l.entries))
+	l.lock.Unlock()
+
+	if !conf.DNSQueryLogDisk {
+		return
+	}
+	select {
+	case l.queue <- e:
+	default:
+		DEBUG("DNS query log queue full, dropping: ", e.Domain)
+	}
+}
+
+// resizeLocked changes the size of the ring and keeps the newest entries
+func (l *dnsQueryLog) resizeLocked(size int) {
+	entries := make([]*DNSLogEntry, size)
+	count := min(l.count, size)
+	for i := range count {
+		entries[count-1-i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	l.entries = entries
+	l.count = count
+	l.next = count % size
+}
+
+func (q *DNSLogQuery) match(e *DNSLogEntry) bool {
+	switch {
+	case !q.Start.IsZero() && e.Time.Before(q.Start):
+		return false
+	case !q.End.IsZero() && e.Time.After(q.End):
+		return false
+	case q.Domain != "" && !strings.Contains(strings.ToLower(e.Domain), strings.ToLower(q.Domain)):
+		return false
+	case q.Type != "" && !strings.EqualFold(q.Type, e.Type):
+		return false
+	case q.Tunnel != "" && q.Tunnel != e.Tunnel:
+		return false
+	case q.Profile != "" && q.Profile != e.Profile:
+		return false
+	case q.Result != "" && q.Result != e.Result:
+		return false
+	case q.Tag != "" && q.Tag != e.Tag:
+		return false
+	}
+	return true
+}
+
+// Query returns the newest entries that match the query, from the
+// file when DNSQueryLogDisk is enabled.
+func (l *dnsQueryLog) Query(conf *configV2, q *DNSLogQuery) (entries []*DNSLogEntry, err error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultDNSLogLimit
+	}
+	entries = make([]*DNSLogEntry, 0)
+
+	if conf.DNSQueryLogDisk {
+		db, err := l.open(STATE.Load().BasePath + dnsLogFileName)
+		if err != nil {
+			return nil, err
+		}
+		return queryDNSLogDB(db, q, limit)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := 0; i < l.count && len(entries) < limit; i++ {
+		e := l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if q.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func dnsLogKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(max(t.UnixNano(), 0)))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func queryDNSLogDB(db *gobolt.DB, q *DNSLogQuery, limit int) (entries []*DNSLogEntry, err error) {
+	entries = make([]*DNSLogEntry, 0)
+	end := time.Unix(0, math.MaxInt64)
+	if !q.End.IsZero() {
+		end = q.End
+	}
+	startKey := dnsLogKey(q.Start, 0)
+
+	err = db.View(func(tx *gobolt.Tx) error {
+		c := tx.Bucket([]byte(dnsLogBucket)).Cursor()
+		k, v := c.Seek(dnsLogKey(end, math.MaxUint64))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.Compare(k, startKey) >= 0 && len(entries) < limit; k, v = c.Prev() {
+			e := new(DNSLogEntry)
+			if err := json.Unmarshal(v, e); err != nil {
+				continue
+			}
+			if q.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// open returns the query log file, it is created on first use
+func (l *dnsQueryLog) open(path string) (db *gobolt.DB, err error) {
+	if db = l.db.Load(); db != nil {
+		return db, nil
+	}
+	l.dbLock.Lock()
+	defer l.dbLock.Unlock()
+	if db = l.db.Load(); db != nil {
+		return db, nil
+	}
+
+	db, err = gobolt.Open(path, 0o600, &gobolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *gobolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(dnsLogBucket))
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	l.db.Store(db)
+	return db, nil
+}
+
+func (l *dnsQueryLog) Close() {
+	l.dbLock.Lock()
+	defer l.dbLock.Unlock()
+	if db := l.db.Swap(nil); db != nil {
+		_ = db.Close()
+	}
+}
+
+func (l *dnsQueryLog) write(db *gobolt.DB, batch []*DNSLogEntry) error {
+	return db.Update(func(tx *gobolt.Tx) error {
+		b := tx.Bucket([]byte(dnsLogBucket))
+		for _, e := range batch {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err = b.Put(dnsLogKey(e.Time, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// prune removes queries older than the time from the file
+func (l *dnsQueryLog) prune(db *gobolt.DB, before time.Time) (removed int, err error) {
+	last := dnsLogKey(before, 0)
+	err = db.Update(func(tx *gobolt.Tx) error {
+		b := tx.Bucket([]byte(dnsLogBucket))
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, last) < 0; k, _ = c.Next() {
+			keys = append(keys, bytes.Clone(k))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
+
+// WriteDNSLog writes queued queries to the query log file
+func WriteDNSLog() {
+	defer RecoverAndLog()
+	DEBUG("Starting the DNS query log writer")
+
+	batch := make([]*DNSLogEntry, 0, dnsLogBatch)
+	for {
+		batch = append(batch[:0], <-DNSQueryLog.queue)
+	fill:
+		for len(batch) < dnsLogBatch {
+			select {
+			case e := <-DNSQueryLog.queue:
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+
+		db, err := DNSQueryLog.open(STATE.Load().BasePath + dnsLogFileName)
+		if err == nil {
+			err = DNSQueryLog.write(db, batch)
+		}
+		if err != nil {
+			ERROR("Unable to write the DNS query log: ", err)
+		}
+	}
+}
+
+// PruneDNSLog removes expired queries from the query log file, once a day
+func PruneDNSLog() {
+	defer func() {
+		time.Sleep(24 * time.Hour)
+	}()
+	defer RecoverAndLog()
+
+	conf := CONFIG.Load()
+	if !conf.DNSQueryLogDisk {
+		return
+	}
+	db, err := DNSQueryLog.open(STATE.Load().BasePath + dnsLogFileName)
+	if err != nil {
+		ERROR("Unable to open the DNS query log: ", err)
+		return
+	}
+	removed, err := DNSQueryLog.prune(db, time.Now().Add(-dnsLogRetention(conf)))
+	if err != nil {
+		ERROR("Unable to prune the DNS query log: ", err)
+		return
+	}
+	DEBUG("Removed ", removed, " queries from the DNS query log")
+}
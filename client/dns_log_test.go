@@ -0,0 +1,136 @@
+package client
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDNSLogEntries(start time.Time, n int) (entries []*DNSLogEntry) {
+	for i := range n {
+		e := &DNSLogEntry{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Domain: "host" + strconv.Itoa(i) + ".example.com.",
+			Type:   "A",
+			Result: DNSResultResolved,
+		}
+		if i%2 == 1 {
+			e.Result = DNSResultBlocked
+			e.Tag = "ads"
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func logDomains(entries []*DNSLogEntry) (domains []string) {
+	for _, e := range entries {
+		domains = append(domains, e.Domain)
+	}
+	return domains
+}
+
+func TestDNSQueryLog(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	conf := &configV2{DNSQueryLogSize: 4}
+	l := newDNSQueryLog()
+	for _, e := range testDNSLogEntries(start, 6) {
+		l.Add(conf, e)
+	}
+
+	tests := []struct {
+		name     string
+		conf     *configV2
+		query    *DNSLogQuery
+		expected []string
+	}{
+		{
+			name:     "newest entries first",
+			query:    &DNSLogQuery{},
+			expected: []string{"host5.example.com.", "host4.example.com.", "host3.example.com.", "host2.example.com."},
+		},
+		{
+			name:     "limit",
+			query:    &DNSLogQuery{Limit: 1},
+			expected: []string{"host5.example.com."},
+		},
+		{
+			name:     "time range",
+			query:    &DNSLogQuery{Start: start.Add(3 * time.Minute), End: start.Add(4 * time.Minute)},
+			expected: []string{"host4.example.com.", "host3.example.com."},
+		},
+		{
+			name:     "result and tag",
+			query:    &DNSLogQuery{Result: DNSResultBlocked, Tag: "ads"},
+			expected: []string{"host5.example.com.", "host3.example.com."},
+		},
+		{
+			name:     "domain",
+			query:    &DNSLogQuery{Domain: "HOST2"},
+			expected: []string{"host2.example.com."},
+		},
+		{
+			name:     "resized ring keeps the newest entries",
+			conf:     &configV2{DNSQueryLogSize: 2},
+			query:    &DNSLogQuery{},
+			expected: []string{"host6.example.com.", "host5.example.com."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.conf != nil {
+				l.Add(tt.conf, &DNSLogEntry{Time: start.Add(6 * time.Minute), Domain: "host6.example.com."})
+			}
+			entries, err := l.Query(conf, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			domains := logDomains(entries)
+			if strings.Join(domains, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, domains)
+			}
+		})
+	}
+}
+
+func TestDNSQueryLogFile(t *testing.T) {
+	start := time.Now().Add(-10 * 24 * time.Hour).Truncate(time.Minute)
+	l := newDNSQueryLog()
+	defer l.Close()
+	db, err := l.open(filepath.Join(t.TempDir(), dnsLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := testDNSLogEntries(start, 4)
+	recent := &DNSLogEntry{Time: time.Now(), Domain: "recent.example.com.", Result: DNSResultCached}
+	if err = l.write(db, append(entries, recent)); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := queryDNSLogDB(db, &DNSLogQuery{End: start.Add(2 * time.Minute)}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(logDomains(found), ",") != "host2.example.com.,host1.example.com.,host0.example.com." {
+		t.Errorf("unexpected entries: %v", logDomains(found))
+	}
+
+	removed, err := l.prune(db, time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 {
+		t.Errorf("expected 4 removed entries, got %d", removed)
+	}
+	found, err = queryDNSLogDB(db, &DNSLogQuery{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Domain != recent.Domain || found[0].Result != DNSResultCached {
+		t.Errorf("unexpected entries after pruning: %v", logDomains(found))
+	}
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNS profiles apply a different policy to the devices that use the
+// client as their resolver. The first profile with a source matching
+// the address of the device is used, devices without a profile get the
+// global policy.
+
+type DNSProfile struct {
+	Tag string
+	// IP addresses or subnets in CIDR notation
+	Sources []string
+	// Tags of the block and white lists used for the profile, the lists
+	// that are enabled are used when they are empty
+	BlockLists      []string
+	WhiteLists      []string
+	DisableBlocking bool
+	// Upstreams for the profile, empty uses the default upstreams
+	DNSUpstreams []string
+}
+
+type DNSProfileStats struct {
+	Queries  int
+	Resolved int
+	Blocked  int
+	Cached   int
+	Failed   int
+	LastSeen time.Time
+	m        sync.Mutex
+}
+
+// defaultDNSProfile is the stats key for devices without a profile
+const defaultDNSProfile = "default"
+
+var (
+	dnsProfileBlockLists atomic.Pointer[map[string]*domainMatcher]
+	dnsProfileWhiteLists atomic.Pointer[map[string]*domainMatcher]
+)
+
+func parseDNSSource(source string) (*net.IPNet, error) {
+	if strings.Contains(source, "/") {
+		_, network, err := net.ParseCIDR(source)
+		return network, err
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source: %s", source)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func validateDNSProfiles(profiles []*DNSProfile) error {
+	tags := make(map[string]bool)
+	for _, p := range profiles {
+		if p == nil {
+			continue
+		}
+		if p.Tag == "" || p.Tag == defaultDNSProfile {
+			return fmt.Errorf("invalid DNS profile tag: %q", p.Tag)
+		}
+		if tags[p.Tag] {
+			return fmt.Errorf("duplicate DNS profile: %s", p.Tag)
+		}
+		tags[p.Tag] = true
+		if len(p.Sources) == 0 {
+			return errors.New("DNS profile " + p.Tag + " has no sources")
+		}
+		for _, v := range p.Sources {
+			if _, err := parseDNSSource(v); err != nil {
+				return err
+			}
+		}
+		for _, v := range p.DNSUpstreams {
+			if _, err := parseDNSUpstream(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *DNSProfile) matches(ip net.IP) bool {
+	for _, v := range p.Sources {
+		network, err := parseDNSSource(v)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// findDNSProfile returns the profile for the address of the device
+func findDNSProfile(addr net.Addr) *DNSProfile {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return nil
+	}
+
+	for _, p := range CONFIG.Load().DNSProfiles {
+		if p != nil && p.matches(ip) {
+			return p
+		}
+	}
+	return nil
+}
+
+func dnsProfileByTag(tag string) *DNSProfile {
+	for _, p := range CONFIG.Load().DNSProfiles {
+		if p != nil && p.Tag == tag {
+			return p
+		}
+	}
+	return nil
+}
+
+// buildProfileMatchers returns a matcher for every profile that selects
+// lists, rules is keyed by the lower case tag of the list.
+func buildProfileMatchers(profiles []*DNSProfile, rules map[string][]*domainRule, lists func(p *DNSProfile) []string) map[string]*domainMatcher {
+	matchers := make(map[string]*domainMatcher)
+	for _, p := range profiles {
+		if p == nil || len(lists(p)) == 0 {
+			continue
+		}
+		matcher := new(domainMatcher)
+		for _, tag := range lists(p) {
+			matcher.Add(rules[strings.ToLower(tag)]...)
+		}
+		matchers[p.Tag] = matcher
+	}
+	return matchers
+}
+
+func profileMatcher(matchers *atomic.Pointer[map[string]*domainMatcher], global *domainMatcher, p *DNSProfile) *domainMatcher {
+	if p == nil {
+		return global
+	}
+	m := matchers.Load()
+	if m == nil || (*m)[p.Tag] == nil {
+		return global
+	}
+	return (*m)[p.Tag]
+}
+
+// dnsUpstreamsForProfile returns the upstreams for queries that are not
+// sent to a tunnel.
+func dnsUpstreamsForProfile(conf *configV2, p *DNSProfile) (s *dnsUpstreamSet, err error) {
+	if p == nil || len(p.DNSUpstreams) == 0 {
+		return getDNSUpstreams(conf)
+	}
+
+	bootstrap := dnsBootstrapServers(conf)
+	key := dnsUpstreamKey(p.DNSUpstreams, nil, bootstrap)
+	s, _ = dnsProfileUpstreams.Compute(p.Tag, func(old *dnsUpstreamSet, loaded bool) (*dnsUpstreamSet, bool) {
+		if loaded && old.key == key {
+			return old, false
+		}
+		s, err = newDNSUpstreamSet(p.DNSUpstreams, nil, bootstrap)
+		if err != nil {
+			return old, !loaded
+		}
+		if loaded {
+			old.Close()
+		}
+		return s, false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dnsCacheScope keeps replies from the upstreams of a profile apart from
+// the replies every other device gets.
+func dnsCacheScope(p *DNSProfile) string {
+	if p == nil || len(p.DNSUpstreams) == 0 {
+		return ""
+	}
+	return p.Tag
+}
+
+func incrementDNSProfileStats(p *DNSProfile, result string) {
+	tag := defaultDNSProfile
+	if p != nil {
+		tag = p.Tag
+	}
+	stats, _ := DNSProfileStatsMap.LoadOrCompute(tag, func() *DNSProfileStats {
+		return new(DNSProfileStats)
+	})
+
+	stats.m.Lock()
+	defer stats.m.Unlock()
+	stats.Queries++
+	stats.LastSeen = time.Now()
+	switch result {
+	case DNSResultResolved, DNSResultLocal:
+		stats.Resolved++
+	case DNSResultBlocked:
+		stats.Blocked++
+	case DNSResultCached:
+		stats.Cached++
+	case DNSResultFailed, DNSResultBogus:
+		stats.Failed++
+	}
+}
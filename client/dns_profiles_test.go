@@ -0,0 +1,116 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateDNSProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles []*DNSProfile
+		valid    bool
+	}{
+		{
+			name:     "address and subnet",
+			profiles: []*DNSProfile{{Tag: "kids", Sources: []string{"192.168.1.20", "10.10.0.0/16", "fd00::/64"}}},
+			valid:    true,
+		},
+		{
+			name:     "invalid source",
+			profiles: []*DNSProfile{{Tag: "kids", Sources: []string{"192.168.1.300"}}},
+		},
+		{
+			name:     "no sources",
+			profiles: []*DNSProfile{{Tag: "kids"}},
+		},
+		{
+			name:     "no tag",
+			profiles: []*DNSProfile{{Sources: []string{"192.168.1.20"}}},
+		},
+		{
+			name:     "reserved tag",
+			profiles: []*DNSProfile{{Tag: defaultDNSProfile, Sources: []string{"192.168.1.20"}}},
+		},
+		{
+			name: "duplicate tag",
+			profiles: []*DNSProfile{
+				{Tag: "kids", Sources: []string{"192.168.1.20"}},
+				{Tag: "kids", Sources: []string{"192.168.1.21"}},
+			},
+		},
+		{
+			name:     "invalid upstream",
+			profiles: []*DNSProfile{{Tag: "kids", Sources: []string{"192.168.1.20"}, DNSUpstreams: []string{"ftp://1.1.1.1"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDNSProfiles(tt.profiles)
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid=%v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestDNSProfilePolicy(t *testing.T) {
+	originalConfig := CONFIG.Load()
+	originalBlockList := DNSBlockList.Load()
+	originalProfiles := dnsProfileBlockLists.Load()
+	defer func() {
+		CONFIG.Store(originalConfig)
+		DNSBlockList.Store(originalBlockList)
+		dnsProfileBlockLists.Store(originalProfiles)
+	}()
+
+	kids := &DNSProfile{Tag: "kids", Sources: []string{"192.168.1.0/24"}, BlockLists: []string{"Ads", "AdultContent"}}
+	servers := &DNSProfile{Tag: "servers", Sources: []string{"192.168.2.10", "fd00::10"}, DisableBlocking: true}
+	conf := DefaultConfig()
+	conf.DNSProfiles = []*DNSProfile{kids, servers}
+	CONFIG.Store(conf)
+
+	ads, _ := parseDomainList([]byte("ads.example.com"), "Ads")
+	adult, _ := parseDomainList([]byte("adult.example.com"), "AdultContent")
+	global := new(domainMatcher)
+	global.Add(ads...)
+	DNSBlockList.Store(global)
+	profiles := buildProfileMatchers(conf.DNSProfiles, map[string][]*domainRule{"ads": ads, "adultcontent": adult}, func(p *DNSProfile) []string {
+		return p.BlockLists
+	})
+	dnsProfileBlockLists.Store(&profiles)
+
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		domain  string
+		profile *DNSProfile
+		blocked bool
+		tag     string
+	}{
+		{name: "kids ads", addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.50")}, domain: "ads.example.com.", profile: kids, blocked: true, tag: "Ads"},
+		{name: "kids adult content", addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.51")}, domain: "adult.example.com.", profile: kids, blocked: true, tag: "AdultContent"},
+		{name: "servers", addr: &net.UDPAddr{IP: net.ParseIP("192.168.2.10")}, domain: "ads.example.com.", profile: servers},
+		{name: "servers over IPv6", addr: &net.UDPAddr{IP: net.ParseIP("fd00::10")}, domain: "ads.example.com.", profile: servers},
+		{name: "no profile ads", addr: &net.UDPAddr{IP: net.ParseIP("192.168.3.1")}, domain: "ads.example.com.", blocked: true, tag: "Ads"},
+		{name: "no profile adult content", addr: &net.UDPAddr{IP: net.ParseIP("192.168.3.1")}, domain: "adult.example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := findDNSProfile(tt.addr)
+			if profile != tt.profile {
+				t.Fatalf("expected profile %v, got %v", tt.profile, profile)
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(tt.domain, dns.TypeA)
+			blocked, tag := isBlocked(m, profile)
+			if blocked != tt.blocked || tag != tt.tag {
+				t.Errorf("expected %v %q, got %v %q", tt.blocked, tt.tag, blocked, tag)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// maxCNAMEDepth limits how many CNAME records are followed for a query
+const maxCNAMEDepth = 8
+
+// findDNSRecord returns the record for the name, records pushed by a
+// connected tunnel are used before records in the config.
+func findDNSRecord(name string, blocked bool) (record *types.DNSRecord, DNSTunnel *TUN) {
+	tunnelMapRange(func(tun *TUN) bool {
+		if tun.GetState() != TUN_Connected {
+			return true
+		}
+
+		meta := tun.meta.Load()
+		if meta == nil {
+			return true
+		}
+
+		if meta.DNSBlocking && blocked {
+			return true
+		}
+
+		sr := tun.ServerResponse()
+		if sr == nil {
+			return true
+		}
+
+		record = DNSAMapping(sr.DNSRecords, name)
+		if record != nil {
+			DNSTunnel = tun
+			return false
+		}
+
+		return true
+	})
+
+	if record == nil {
+		record = DNSAMapping(CONFIG.Load().DNSRecords, name)
+	}
+	return record, DNSTunnel
+}
+
+func dnsRecordAnswers(q dns.Question, DNS *types.DNSRecord) (answers []dns.RR) {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: rrtype,
+			Class:  dns.ClassINET,
+			Ttl:    DNS.RecordTTL(),
+		}
+	}
+
+	if DNS.CNAME != "" {
+		return []dns.RR{&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: dns.Fqdn(DNS.CNAME)}}
+	}
+
+	switch q.Qtype {
+	case dns.TypeA:
+		for _, v := range DNS.IP {
+			if ip := net.ParseIP(v).To4(); ip != nil {
+				answers = append(answers, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+			}
+		}
+	case dns.TypeAAAA:
+		for _, v := range DNS.IP {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() == nil {
+				answers = append(answers, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+			}
+		}
+	case dns.TypeTXT:
+		for _, v := range DNS.TXT {
+			answers = append(answers, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{v}})
+		}
+	case dns.TypeMX:
+		for _, v := range DNS.MX {
+			if v != nil {
+				answers = append(answers, &dns.MX{Hdr: hdr(dns.TypeMX), Preference: v.Preference, Mx: dns.Fqdn(v.Host)})
+			}
+		}
+	case dns.TypeSRV:
+		for _, v := range DNS.SRV {
+			if v != nil {
+				answers = append(answers, &dns.SRV{
+					Hdr:      hdr(dns.TypeSRV),
+					Priority: v.Priority,
+					Weight:   v.Weight,
+					Port:     v.Port,
+					Target:   dns.Fqdn(v.Target),
+				})
+			}
+		}
+	}
+	return answers
+}
+
+// resolveCNAME follows the CNAME in the record and adds the answers for
+// the target. Targets are looked up in the records first, then on the
+// DNS servers of the tunnel that pushed the record, DNS routes and the
+// default upstreams.
+func resolveCNAME(tun *TUN, profile *DNSProfile, rm *dns.Msg, record *types.DNSRecord) {
+	q := rm.Question[0]
+	if record.CNAME == "" || q.Qtype == dns.TypeCNAME {
+		return
+	}
+
+	target := dns.Fqdn(record.CNAME)
+	for range maxCNAMEDepth {
+		next, nextTunnel := findDNSRecord(target, false)
+		if nextTunnel != nil {
+			tun = nextTunnel
+		}
+		if next == nil || !next.HasAnswers() {
+			r, err := lookupDNS(tun, profile, target, q.Qtype)
+			if err != nil {
+				DEBUG("Unable to resolve CNAME target: ", target, " >> ", err)
+				return
+			}
+			rm.Answer = append(rm.Answer, r.Answer...)
+			rm.Rcode = r.Rcode
+			return
+		}
+
+		rm.Answer = append(rm.Answer, dnsRecordAnswers(dns.Question{Name: target, Qtype: q.Qtype, Qclass: dns.ClassINET}, next)...)
+		if next.CNAME == "" {
+			return
+		}
+		target = dns.Fqdn(next.CNAME)
+	}
+	DEBUG("Too many CNAME records: ", q.Name)
+}
+
+// lookupDNS resolves a name through the tunnel, or the tunnel with a
+// DNS route for the name, and falls back to the upstreams of the
+// profile. Replies from those upstreams are validated when DNSSEC is on.
+func lookupDNS(tun *TUN, profile *DNSProfile, name string, qtype uint16) (r *dns.Msg, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+
+	if tun == nil {
+		tun, _ = findDNSRoute(name)
+	}
+	var upstreams *dnsUpstreamSet
+	if tun != nil {
+		upstreams = tun.dnsUpstreams.Load()
+	}
+	if upstreams != nil {
+		r, _, err = upstreams.Exchange(m)
+		return r, err
+	}
+
+	conf := CONFIG.Load()
+	upstreams, err = dnsUpstreamsForProfile(conf, profile)
+	if err != nil {
+		return nil, err
+	}
+	if !conf.DNSSEC {
+		r, _, err = upstreams.Exchange(m)
+		return r, err
+	}
+	r, _, err = upstreams.Exchange(dnssecQuery(m))
+	if err != nil {
+		return nil, err
+	}
+	return r, validateDNSReply(conf, m, r)
+}
+
+// reverseAddress returns the address of an in-addr.arpa or ip6.arpa name
+func reverseAddress(name string) net.IP {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		for i, v := range labels {
+			b, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(b)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 32 {
+			return nil
+		}
+		ip := make(net.IP, 16)
+		for i, v := range labels {
+			n, err := strconv.ParseUint(v, 16, 4)
+			if err != nil || len(v) != 1 {
+				return nil
+			}
+			pos := 31 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(n) << 4
+			} else {
+				ip[pos/2] |= byte(n)
+			}
+		}
+		return ip
+	}
+	return nil
+}
+
+// reverseDNSRecords returns every record with the address
+func reverseDNSRecords(ip net.IP) (found []*types.DNSRecord) {
+	match := func(records []*types.DNSRecord) {
+		for _, r := range records {
+			if r == nil {
+				continue
+			}
+			for _, v := range r.IP {
+				if ip.Equal(net.ParseIP(v)) {
+					found = append(found, r)
+					break
+				}
+			}
+		}
+	}
+
+	tunnelMapRange(func(tun *TUN) bool {
+		if sr := tun.ServerResponse(); sr != nil && tun.GetState() == TUN_Connected {
+			match(sr.DNSRecords)
+		}
+		return true
+	})
+	match(CONFIG.Load().DNSRecords)
+	return found
+}
+
+// answerReverseLookup answers PTR queries for addresses in the DNS
+// records, other .arpa queries are dropped by isValidDomain.
+func answerReverseLookup(m *dns.Msg, w dns.ResponseWriter) bool {
+	q := m.Question[0]
+	if q.Qtype != dns.TypePTR {
+		return false
+	}
+	ip := reverseAddress(q.Name)
+	if ip == nil {
+		return false
+	}
+	records := reverseDNSRecords(ip)
+	if len(records) == 0 {
+		return false
+	}
+
+	rm := new(dns.Msg)
+	rm.SetReply(m)
+	rm.Authoritative = true
+	for _, r := range records {
+		rm.Answer = append(rm.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    r.RecordTTL(),
+			},
+			Ptr: dns.Fqdn(r.Domain),
+		})
+	}
+
+	err := writeDNSReply(w, m, rm)
+	w.Close()
+	if err != nil {
+		ERROR("Unable to  write dns reply:", err)
+	}
+	if CONFIG.Load().LogAllDomains {
+		INFO("DNS @ local:", q.Name, " >> reverse record found")
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func TestDNSRecordAnswers(t *testing.T) {
+	record := &types.DNSRecord{
+		Domain: "host.example.com",
+		IP:     []string{"10.0.0.1", "fd00::1"},
+		TXT:    []string{"v=spf1 -all"},
+		MX:     []*types.DNSMX{{Preference: 10, Host: "mail.example.com"}},
+		SRV:    []*types.DNSSRV{{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example.com"}},
+		TTL:    300,
+	}
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		record   *types.DNSRecord
+		expected []string
+	}{
+		{name: "A", qtype: dns.TypeA, record: record, expected: []string{"host.example.com.\t300\tIN\tA\t10.0.0.1"}},
+		{name: "AAAA", qtype: dns.TypeAAAA, record: record, expected: []string{"host.example.com.\t300\tIN\tAAAA\tfd00::1"}},
+		{name: "TXT", qtype: dns.TypeTXT, record: record, expected: []string{"host.example.com.\t300\tIN\tTXT\t\"v=spf1 -all\""}},
+		{name: "MX", qtype: dns.TypeMX, record: record, expected: []string{"host.example.com.\t300\tIN\tMX\t10 mail.example.com."}},
+		{name: "SRV", qtype: dns.TypeSRV, record: record, expected: []string{"host.example.com.\t300\tIN\tSRV\t1 5 5060 sip.example.com."}},
+		{name: "no answer for the type", qtype: dns.TypeNS, record: record},
+		{
+			name:     "CNAME with the default TTL",
+			qtype:    dns.TypeA,
+			record:   &types.DNSRecord{Domain: "host.example.com", CNAME: "other.example.com", IP: []string{"10.0.0.1"}},
+			expected: []string{"host.example.com.\t30\tIN\tCNAME\tother.example.com."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers := dnsRecordAnswers(dns.Question{Name: "host.example.com.", Qtype: tt.qtype, Qclass: dns.ClassINET}, tt.record)
+			if len(answers) != len(tt.expected) {
+				t.Fatalf("expected %d answers, got %v", len(tt.expected), answers)
+			}
+			for i := range answers {
+				if answers[i].String() != tt.expected[i] {
+					t.Errorf("expected %q, got %q", tt.expected[i], answers[i].String())
+				}
+			}
+		})
+	}
+}
+
+func TestReverseAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected net.IP
+	}{
+		{name: "1.0.0.10.in-addr.arpa.", expected: net.ParseIP("10.0.0.1")},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", expected: net.ParseIP("fd00::1")},
+		{name: "0.10.in-addr.arpa."},
+		{name: "300.0.0.10.in-addr.arpa."},
+		{name: "example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := reverseAddress(tt.name)
+			if !ip.Equal(tt.expected) {
+				t.Errorf("expected %s, got %s", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestLocalRecords(t *testing.T) {
+	originalConfig := CONFIG.Load()
+	defer CONFIG.Store(originalConfig)
+	conf := DefaultConfig()
+	conf.DNSRecords = []*types.DNSRecord{
+		{Domain: "www.example.lan", CNAME: "web.example.lan"},
+		{Domain: "web.example.lan", CNAME: "server.example.lan"},
+		{Domain: "server.example.lan", IP: []string{"10.0.0.5"}},
+	}
+	CONFIG.Store(conf)
+
+	t.Run("CNAME chain", func(t *testing.T) {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.lan.", dns.TypeA)
+		record, tun := findDNSRecord(req.Question[0].Name, false)
+		if record == nil {
+			t.Fatal("record not found")
+		}
+		rm := ProcessDNSMsg(req, record)
+		resolveCNAME(tun, nil, rm, record)
+		if len(rm.Answer) != 3 {
+			t.Fatalf("expected 3 answers, got %v", rm.Answer)
+		}
+		if a, ok := rm.Answer[2].(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.5")) || a.Hdr.Name != "server.example.lan." {
+			t.Errorf("unexpected answer: %v", rm.Answer[2])
+		}
+	})
+
+	t.Run("reverse lookup", func(t *testing.T) {
+		req := new(dns.Msg)
+		req.SetQuestion("5.0.0.10.in-addr.arpa.", dns.TypePTR)
+		w := &testDNSWriter{remote: &net.TCPAddr{}}
+		if !answerReverseLookup(req, w) {
+			t.Fatal("reverse lookup was not answered")
+		}
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.PTR).Ptr != "server.example.lan." {
+			t.Errorf("unexpected answer: %v", w.msg.Answer)
+		}
+
+		req.SetQuestion("6.0.0.10.in-addr.arpa.", dns.TypePTR)
+		if answerReverseLookup(req, w) {
+			t.Error("unknown addresses should not be answered")
+		}
+	})
+}
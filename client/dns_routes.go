@@ -0,0 +1,78 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Split DNS: queries matching a DNSRoute of a connected tunnel are sent
+// to the DNS servers of that tunnel, everything else goes to the
+// default upstreams. DNS records are checked before DNS routes.
+
+// dnsRouteMatches returns the length of the matched domain, or -1
+func dnsRouteMatches(route *types.DNSRoute, name string) int {
+	domain := strings.ToLower(strings.Trim(route.Domain, "."))
+	domain = strings.TrimPrefix(domain, "*.")
+	if domain == "" {
+		return -1
+	}
+	if name == domain || strings.HasSuffix(name, "."+domain) {
+		return len(domain)
+	}
+	return -1
+}
+
+// betterDNSRoute reports whether route a with match length aLen wins over b
+func betterDNSRoute(a *types.DNSRoute, aLen int, b *types.DNSRoute, bLen int) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if aLen != bLen {
+		return aLen > bLen
+	}
+	return a.Exclude && !b.Exclude
+}
+
+// findDNSRoute returns the tunnel that should resolve the name, nil when
+// no tunnel routes the name or the best route is an exclusion.
+func findDNSRoute(name string) (DNSTunnel *TUN, route *types.DNSRoute) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	bestLen := -1
+	var bestTag string
+
+	tunnelMapRange(func(tun *TUN) bool {
+		sr := tun.ServerResponse()
+		if tun.GetState() != TUN_Connected || sr == nil {
+			return true
+		}
+		meta := tun.meta.Load()
+		if meta == nil {
+			return true
+		}
+
+		for _, r := range sr.DNSRoutes {
+			if r == nil {
+				continue
+			}
+			l := dnsRouteMatches(r, name)
+			if l < 0 {
+				continue
+			}
+			better := route == nil || betterDNSRoute(r, l, route, bestLen)
+			// Equal routes on different tunnels pick the same tunnel every time
+			if !better && !betterDNSRoute(route, bestLen, r, l) && meta.Tag < bestTag {
+				better = true
+			}
+			if better {
+				DNSTunnel, route, bestLen, bestTag = tun, r, l, meta.Tag
+			}
+		}
+		return true
+	})
+
+	if route != nil && route.Exclude {
+		return nil, route
+	}
+	return DNSTunnel, route
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func TestFindDNSRoute(t *testing.T) {
+	newTunnel := func(tag string, state TunnelState, routes ...*types.DNSRoute) *TUN {
+		tun := &TUN{ID: tag}
+		tun.serverResponse.Store(&types.ServerConnectResponse{DNSRoutes: routes})
+		tun.meta.Store(&TunnelMETA{Tag: tag})
+		tun.SetState(state)
+		return tun
+	}
+
+	corp := newTunnel("corp", TUN_Connected,
+		&types.DNSRoute{Domain: "corp.example"},
+		&types.DNSRoute{Domain: "public.corp.example", Exclude: true},
+	)
+	lab := newTunnel("lab", TUN_Connected,
+		&types.DNSRoute{Domain: "*.lab.corp.example"},
+		&types.DNSRoute{Domain: "shared.example"},
+	)
+	priority := newTunnel("priority", TUN_Connected,
+		&types.DNSRoute{Domain: "example", Priority: 10},
+	)
+	other := newTunnel("other", TUN_Connected,
+		&types.DNSRoute{Domain: "shared.example"},
+	)
+	disconnected := newTunnel("disconnected", TUN_Disconnected,
+		&types.DNSRoute{Domain: "offline.example", Priority: 100},
+	)
+
+	for _, tun := range []*TUN{corp, lab, other, disconnected} {
+		TunnelMap.Store(tun.ID, tun)
+		defer TunnelMap.Delete(tun.ID)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected *TUN
+	}{
+		{name: "domain", query: "corp.example.", expected: corp},
+		{name: "subdomain", query: "Intranet.Corp.Example.", expected: corp},
+		{name: "longest suffix wins", query: "build.lab.corp.example.", expected: lab},
+		{name: "excluded", query: "www.public.corp.example.", expected: nil},
+		{name: "no route", query: "example.com.", expected: nil},
+		{name: "suffix must match a label", query: "notcorp.example.", expected: nil},
+		{name: "disconnected tunnel", query: "offline.example.", expected: nil},
+		{name: "same route on two tunnels", query: "a.shared.example.", expected: lab},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, _ := findDNSRoute(tt.query)
+			if tun != tt.expected {
+				t.Errorf("expected %v, got %v", tunnelID(tt.expected), tunnelID(tun))
+			}
+		})
+	}
+
+	TunnelMap.Store(priority.ID, priority)
+	defer TunnelMap.Delete(priority.ID)
+	if tun, _ := findDNSRoute("build.lab.corp.example."); tun != priority {
+		t.Errorf("expected the route with the highest priority, got %s", tunnelID(tun))
+	}
+}
+
+func tunnelID(tun *TUN) string {
+	if tun == nil {
+		return "<nil>"
+	}
+	return tun.ID
+}
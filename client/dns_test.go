@@ -1,8 +1,11 @@
 package client
 
 import (
+	"net"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/tunnels-is/tunnels/types"
 )
 
@@ -309,3 +312,128 @@ func TestDNSAMappingComplexDomains(t *testing.T) {
 		})
 	}
 }
+
+type testDNSWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testDNSWriter) RemoteAddr() net.Addr       { return w.remote }
+func (w *testDNSWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *testDNSWriter) Close() error              { return nil }
+
+func largeDNSReply(req *dns.Msg, records int) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(req)
+	for i := range records {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+		})
+	}
+	return r
+}
+
+func TestWriteDNSReply(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	tests := []struct {
+		name      string
+		remote    net.Addr
+		edns      uint16
+		maxSize   int
+		truncated bool
+	}{
+		{"udp without edns0", udp, 0, dns.MinMsgSize, true},
+		{"udp with small edns0", udp, 1232, 1232, true},
+		{"udp with large edns0", udp, 4096, 4096, false},
+		{"tcp", tcp, 0, dns.MaxMsgSize, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("large.example.com.", dns.TypeA)
+			if tt.edns > 0 {
+				req.SetEdns0(tt.edns, false)
+			}
+			w := &testDNSWriter{remote: tt.remote}
+			if err := writeDNSReply(w, req, largeDNSReply(req, 150)); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.msg.Truncated != tt.truncated {
+				t.Errorf("expected truncated=%t, got %t", tt.truncated, w.msg.Truncated)
+			}
+			if tt.truncated && len(w.msg.Answer) == 150 {
+				t.Error("answers were not removed")
+			}
+			if !tt.truncated && len(w.msg.Answer) != 150 {
+				t.Errorf("expected 150 answers, got %d", len(w.msg.Answer))
+			}
+			if w.msg.Len() > tt.maxSize {
+				t.Errorf("reply is %d bytes, the limit is %d", w.msg.Len(), tt.maxSize)
+			}
+		})
+	}
+}
+
+func TestExchangeDNSFallsBackToTCP(t *testing.T) {
+	var pc net.PacketConn
+	var l net.Listener
+	var err error
+	for range 10 {
+		pc, err = net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err = net.Listen("tcp4", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		_ = pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		r := largeDNSReply(req, 100)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			r.Truncate(dns.MinMsgSize)
+		}
+		_ = w.WriteMsg(r)
+	})
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	defer func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	}()
+
+	c := &dns.Client{
+		Timeout: 2 * time.Second,
+		Dialer:  &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("large.example.com.", dns.TypeA)
+
+	var r *dns.Msg
+	for range 20 {
+		r, err = exchangeDNS(c, req, pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 100 {
+		t.Errorf("expected the full reply over TCP, got %d answers (truncated=%t)", len(r.Answer), r.Truncated)
+	}
+}
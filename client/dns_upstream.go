@@ -0,0 +1,633 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/quic"
+)
+
+// DNS upstreams are configured as URLs:
+//
+//	udp://1.1.1.1                   plain DNS, retried over TCP when truncated
+//	tcp://1.1.1.1:53                plain DNS over TCP
+//	tls://dns.google                DNS over TLS (RFC 7858)
+//	https://dns.google/dns-query    DNS over HTTPS (RFC 8484)
+//	quic://dns.adguard-dns.com      DNS over QUIC (RFC 9250)
+//
+// An address without a scheme is plain UDP. Host names are resolved
+// with the bootstrap servers and never through the local DNS proxy.
+// TCP, TLS, HTTPS and QUIC connections are kept open and reused.
+//
+// Upstreams are tried in order of health, an upstream that fails is
+// moved to the end of the list for dnsUpstreamBackoff and the healthy
+// ones are ordered by their average response time.
+
+const (
+	dnsUpstreamTimeout   = 5 * time.Second
+	dnsUpstreamBackoff   = 30 * time.Second
+	dnsUpstreamIdleConns = 4
+	dnsBootstrapTTL      = 10 * time.Minute
+)
+
+var globalDNSUpstreams atomic.Pointer[dnsUpstreamSet]
+
+type dnsUpstream struct {
+	URL    string
+	Scheme string
+	Host   string
+	Port   string
+	Path   string
+
+	localIP   net.IP
+	bootstrap []string
+	closed    atomic.Bool
+
+	// rtt is a moving average in nanoseconds
+	rtt         atomic.Int64
+	failures    atomic.Int32
+	lastFailure atomic.Int64
+
+	addrLock    sync.Mutex
+	addr        string
+	addrExpires time.Time
+
+	// tcp and tls
+	conns chan *dns.Conn
+	// https
+	httpClient *http.Client
+	// quic
+	quicLock     sync.Mutex
+	quicEndpoint *quic.Endpoint
+	quicConn     *quic.Conn
+}
+
+type dnsUpstreamSet struct {
+	key       string
+	upstreams []*dnsUpstream
+}
+
+func parseDNSUpstream(raw string) (u *dnsUpstream, err error) {
+	raw = strings.TrimSpace(raw)
+	target := raw
+	if !strings.Contains(target, "://") {
+		target = "udp://" + target
+	}
+	pu, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS upstream %q: %s", raw, err)
+	}
+
+	u = &dnsUpstream{
+		URL:    raw,
+		Scheme: strings.ToLower(pu.Scheme),
+		Host:   pu.Hostname(),
+		Port:   pu.Port(),
+		Path:   pu.Path,
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid DNS upstream %q: missing host", raw)
+	}
+
+	defaultPort := ""
+	switch u.Scheme {
+	case "udp", "tcp":
+		defaultPort = "53"
+	case "tls", "quic":
+		defaultPort = "853"
+	case "https":
+		defaultPort = "443"
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/dns-query"
+		}
+	default:
+		return nil, fmt.Errorf("invalid DNS upstream %q: unsupported scheme %s", raw, u.Scheme)
+	}
+	if u.Port == "" {
+		u.Port = defaultPort
+	}
+	return u, nil
+}
+
+// legacyDNSUpstreams converts DNS1Default and DNS2Default to upstreams
+func legacyDNSUpstreams(conf *configV2) (upstreams []string) {
+	for _, v := range []string{conf.DNS1Default, conf.DNS2Default} {
+		if v == "" {
+			continue
+		}
+		if conf.DNSOverHTTPS {
+			upstreams = append(upstreams, "https://"+v+"/dns-query")
+		} else {
+			upstreams = append(upstreams, "udp://"+v)
+		}
+	}
+	return upstreams
+}
+
+// dnsBootstrapServers returns the IP addresses used to resolve upstream host names
+func dnsBootstrapServers(conf *configV2) (servers []string) {
+	list := conf.DNSBootstrap
+	if len(list) == 0 {
+		list = []string{conf.DNS1Default, conf.DNS2Default}
+	}
+	for _, v := range list {
+		if net.ParseIP(v) != nil {
+			servers = append(servers, v)
+		}
+	}
+	return servers
+}
+
+func newDNSUpstreamSet(urls []string, localIP net.IP, bootstrap []string) (s *dnsUpstreamSet, err error) {
+	s = &dnsUpstreamSet{
+		key: dnsUpstreamKey(urls, localIP, bootstrap),
+	}
+	for _, v := range urls {
+		u, err := parseDNSUpstream(v)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		u.localIP = localIP
+		u.bootstrap = bootstrap
+		u.init()
+		s.upstreams = append(s.upstreams, u)
+	}
+	if len(s.upstreams) == 0 {
+		return nil, errors.New("no DNS upstreams configured")
+	}
+	return s, nil
+}
+
+func dnsUpstreamKey(urls []string, localIP net.IP, bootstrap []string) string {
+	return strings.Join(urls, ",") + "|" + localIP.String() + "|" + strings.Join(bootstrap, ",")
+}
+
+// getDNSUpstreams returns the upstreams used outside of tunnels, the set
+// is rebuilt when the upstream settings change.
+func getDNSUpstreams(conf *configV2) (s *dnsUpstreamSet, err error) {
+	urls := conf.DNSUpstreams
+	if len(urls) == 0 {
+		urls = legacyDNSUpstreams(conf)
+	}
+	bootstrap := dnsBootstrapServers(conf)
+
+	old := globalDNSUpstreams.Load()
+	if old != nil && old.key == dnsUpstreamKey(urls, nil, bootstrap) {
+		return old, nil
+	}
+	s, err = newDNSUpstreamSet(urls, nil, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	if !globalDNSUpstreams.CompareAndSwap(old, s) {
+		s.Close()
+		return globalDNSUpstreams.Load(), nil
+	}
+	if old != nil {
+		old.Close()
+	}
+	return s, nil
+}
+
+// resetDNSUpstreams builds the upstreams of the tunnel from DNSUpstreams
+// on the tunnel or the DNS servers sent by the server. Queries are sent
+// from the tunnel interface address.
+func (t *TUN) resetDNSUpstreams() (err error) {
+	meta := t.meta.Load()
+	urls := meta.DNSUpstreams
+	if len(urls) == 0 {
+		for _, v := range t.ServerResponse().DNSServers {
+			if v != "" {
+				urls = append(urls, "udp://"+v)
+			}
+		}
+	}
+
+	s, err := newDNSUpstreamSet(urls, t.localInterfaceNetIP, dnsBootstrapServers(CONFIG.Load()))
+	if err != nil {
+		return err
+	}
+	t.dnsUpstreams.Swap(s).Close()
+	return nil
+}
+
+func (u *dnsUpstream) init() {
+	switch u.Scheme {
+	case "tcp", "tls":
+		u.conns = make(chan *dns.Conn, dnsUpstreamIdleConns)
+	case "https":
+		u.httpClient = &http.Client{
+			Timeout: dnsUpstreamTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+					addr, err := u.address()
+					if err != nil {
+						return nil, err
+					}
+					return u.dialer("tcp").DialContext(ctx, network, addr)
+				},
+				TLSClientConfig: &tls.Config{
+					ServerName: u.Host,
+					MinVersion: tls.VersionTLS12,
+				},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: dnsUpstreamIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: dnsUpstreamTimeout,
+			},
+		}
+	}
+}
+
+func (u *dnsUpstream) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Timeout: dnsUpstreamTimeout}
+	if u.localIP != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: u.localIP}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: u.localIP}
+		}
+	}
+	return d
+}
+
+// address resolves the upstream host name with the bootstrap servers
+func (u *dnsUpstream) address() (string, error) {
+	if net.ParseIP(u.Host) != nil {
+		return net.JoinHostPort(u.Host, u.Port), nil
+	}
+
+	u.addrLock.Lock()
+	defer u.addrLock.Unlock()
+	if u.addr != "" && time.Now().Before(u.addrExpires) {
+		return u.addr, nil
+	}
+	ip, err := bootstrapResolve(u.Host, u.bootstrap)
+	if err != nil {
+		return "", err
+	}
+	u.addr = net.JoinHostPort(ip, u.Port)
+	u.addrExpires = time.Now().Add(dnsBootstrapTTL)
+	return u.addr, nil
+}
+
+func bootstrapResolve(host string, servers []string) (ip string, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	c := &dns.Client{Timeout: dnsUpstreamTimeout}
+
+	err = fmt.Errorf("no bootstrap servers to resolve %s", host)
+	for _, v := range servers {
+		r, _, xerr := c.Exchange(m, net.JoinHostPort(v, "53"))
+		if xerr != nil {
+			err = xerr
+			continue
+		}
+		for _, rr := range r.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A.String(), nil
+			}
+		}
+		err = fmt.Errorf("no address found for %s", host)
+	}
+	return "", err
+}
+
+func (u *dnsUpstream) healthy() bool {
+	if u.failures.Load() == 0 {
+		return true
+	}
+	return time.Since(time.Unix(0, u.lastFailure.Load())) > dnsUpstreamBackoff
+}
+
+func (u *dnsUpstream) recordSuccess(rtt time.Duration) {
+	u.failures.Store(0)
+	old := u.rtt.Load()
+	if old == 0 {
+		u.rtt.Store(int64(rtt))
+	} else {
+		u.rtt.Store((old*7 + int64(rtt)) / 8)
+	}
+}
+
+func (u *dnsUpstream) recordFailure() {
+	u.failures.Add(1)
+	u.lastFailure.Store(time.Now().UnixNano())
+}
+
+func (u *dnsUpstream) exchange(m *dns.Msg) (r *dns.Msg, err error) {
+	switch u.Scheme {
+	case "udp":
+		addr, err := u.address()
+		if err != nil {
+			return nil, err
+		}
+		c := &dns.Client{Timeout: dnsUpstreamTimeout, Dialer: u.dialer("udp")}
+		return exchangeDNS(c, m, addr)
+	case "tcp", "tls":
+		return u.exchangeConn(m)
+	case "https":
+		return u.exchangeHTTPS(m)
+	case "quic":
+		return u.exchangeQUIC(m)
+	}
+	return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+}
+
+// exchangeConn uses a pooled connection, a pooled connection may have
+// been closed by the upstream so the query is retried on a new one.
+func (u *dnsUpstream) exchangeConn(m *dns.Msg) (r *dns.Msg, err error) {
+	c := &dns.Client{Timeout: dnsUpstreamTimeout}
+	for {
+		conn, reused, cerr := u.getConn()
+		if cerr != nil {
+			return nil, cerr
+		}
+		r, _, err = c.ExchangeWithConn(m, conn)
+		if err == nil {
+			u.putConn(conn)
+			return r, nil
+		}
+		_ = conn.Close()
+		if !reused {
+			return nil, err
+		}
+	}
+}
+
+func (u *dnsUpstream) getConn() (conn *dns.Conn, reused bool, err error) {
+	select {
+	case conn = <-u.conns:
+		return conn, true, nil
+	default:
+	}
+
+	addr, err := u.address()
+	if err != nil {
+		return nil, false, err
+	}
+	var nc net.Conn
+	if u.Scheme == "tls" {
+		nc, err = tls.DialWithDialer(u.dialer("tcp"), "tcp", addr, &tls.Config{
+			ServerName: u.Host,
+			MinVersion: tls.VersionTLS12,
+		})
+	} else {
+		nc, err = u.dialer("tcp").Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &dns.Conn{Conn: nc}, false, nil
+}
+
+func (u *dnsUpstream) putConn(conn *dns.Conn) {
+	if u.closed.Load() {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case u.conns <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (u *dnsUpstream) exchangeHTTPS(m *dns.Msg) (r *dns.Msg, err error) {
+	// RFC 8484 recommends ID 0 so replies can be cached
+	q := m.Copy()
+	q.Id = 0
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://"+net.JoinHostPort(u.Host, u.Port)+u.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("accept", "application/dns-message")
+	req.Header.Set("content-type", "application/dns-message")
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r = new(dns.Msg)
+	err = r.Unpack(reply)
+	if err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
+
+func (u *dnsUpstream) quicConnection(ctx context.Context) (conn *quic.Conn, err error) {
+	u.quicLock.Lock()
+	defer u.quicLock.Unlock()
+	if u.quicConn != nil {
+		return u.quicConn, nil
+	}
+
+	if u.quicEndpoint == nil {
+		local := "0.0.0.0:0"
+		if u.localIP != nil {
+			local = net.JoinHostPort(u.localIP.String(), "0")
+		}
+		u.quicEndpoint, err = quic.Listen("udp", local, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addr, err := u.address()
+	if err != nil {
+		return nil, err
+	}
+	u.quicConn, err = u.quicEndpoint.Dial(ctx, "udp", addr, &quic.Config{
+		TLSConfig: &tls.Config{
+			ServerName: u.Host,
+			NextProtos: []string{"doq"},
+			MinVersion: tls.VersionTLS13,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.quicConn, nil
+}
+
+func (u *dnsUpstream) resetQUIC(conn *quic.Conn) {
+	u.quicLock.Lock()
+	defer u.quicLock.Unlock()
+	if u.quicConn == conn {
+		conn.Abort(nil)
+		u.quicConn = nil
+	}
+}
+
+// exchangeQUIC sends every query on a new stream, the connection is
+// redialed once if it was closed by the upstream.
+func (u *dnsUpstream) exchangeQUIC(m *dns.Msg) (r *dns.Msg, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsUpstreamTimeout)
+	defer cancel()
+
+	for range 2 {
+		conn, cerr := u.quicConnection(ctx)
+		if cerr != nil {
+			return nil, cerr
+		}
+		r, err = doqExchange(ctx, conn, m)
+		if err == nil {
+			return r, nil
+		}
+		u.resetQUIC(conn)
+	}
+	return nil, err
+}
+
+func doqExchange(ctx context.Context, conn *quic.Conn, m *dns.Msg) (r *dns.Msg, err error) {
+	s, err := conn.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.CloseRead()
+	s.SetReadContext(ctx)
+	s.SetWriteContext(ctx)
+
+	// RFC 9250 requires ID 0 and a two byte length prefix
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(out, uint16(len(packed)))
+	copy(out[2:], packed)
+	_, err = s.Write(out)
+	if err != nil {
+		return nil, err
+	}
+	s.CloseWrite()
+
+	size := make([]byte, 2)
+	_, err = io.ReadFull(s, size)
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(size))
+	_, err = io.ReadFull(s, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	r = new(dns.Msg)
+	err = r.Unpack(reply)
+	if err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
+
+func (u *dnsUpstream) close() {
+	u.closed.Store(true)
+	if u.conns != nil {
+	DRAIN:
+		for {
+			select {
+			case conn := <-u.conns:
+				_ = conn.Close()
+			default:
+				break DRAIN
+			}
+		}
+	}
+	if u.httpClient != nil {
+		u.httpClient.CloseIdleConnections()
+	}
+
+	u.quicLock.Lock()
+	defer u.quicLock.Unlock()
+	if u.quicConn != nil {
+		u.quicConn.Abort(nil)
+		u.quicConn = nil
+	}
+	if u.quicEndpoint != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_ = u.quicEndpoint.Close(ctx)
+		u.quicEndpoint = nil
+	}
+}
+
+// ordered returns healthy upstreams by response time followed by the
+// upstreams that failed, the longest failed first.
+func (s *dnsUpstreamSet) ordered() (list []*dnsUpstream) {
+	list = make([]*dnsUpstream, len(s.upstreams))
+	copy(list, s.upstreams)
+	healthy := make(map[*dnsUpstream]bool, len(list))
+	for _, u := range list {
+		healthy[u] = u.healthy()
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if healthy[a] != healthy[b] {
+			return healthy[a]
+		}
+		if !healthy[a] {
+			return a.lastFailure.Load() < b.lastFailure.Load()
+		}
+		return a.rtt.Load() < b.rtt.Load()
+	})
+	return list
+}
+
+// Exchange tries the upstreams in order until one replies
+func (s *dnsUpstreamSet) Exchange(m *dns.Msg) (r *dns.Msg, u *dnsUpstream, err error) {
+	for _, u = range s.ordered() {
+		start := time.Now()
+		r, err = u.exchange(m)
+		if err == nil {
+			u.recordSuccess(time.Since(start))
+			return r, u, nil
+		}
+		u.recordFailure()
+		DEBUG("DNS upstream failed:", u.URL, err)
+	}
+	return nil, u, err
+}
+
+func (s *dnsUpstreamSet) Close() {
+	if s == nil {
+		return
+	}
+	for _, u := range s.upstreams {
+		u.close()
+	}
+}
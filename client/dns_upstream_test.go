@@ -0,0 +1,189 @@
+package client
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseDNSUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		scheme   string
+		host     string
+		port     string
+		path     string
+		hasError bool
+	}{
+		{name: "bare ip", url: "1.1.1.1", scheme: "udp", host: "1.1.1.1", port: "53"},
+		{name: "udp with port", url: "udp://9.9.9.9:5353", scheme: "udp", host: "9.9.9.9", port: "5353"},
+		{name: "tcp", url: "tcp://1.1.1.1", scheme: "tcp", host: "1.1.1.1", port: "53"},
+		{name: "tls", url: "tls://dns.google", scheme: "tls", host: "dns.google", port: "853"},
+		{name: "https default path", url: "https://dns.google", scheme: "https", host: "dns.google", port: "443", path: "/dns-query"},
+		{name: "https custom path", url: "https://dns.example.com:8443/resolve", scheme: "https", host: "dns.example.com", port: "8443", path: "/resolve"},
+		{name: "quic", url: "quic://dns.adguard-dns.com", scheme: "quic", host: "dns.adguard-dns.com", port: "853"},
+		{name: "ipv6", url: "tls://[2606:4700:4700::1111]", scheme: "tls", host: "2606:4700:4700::1111", port: "853"},
+		{name: "unsupported scheme", url: "ftp://1.1.1.1", hasError: true},
+		{name: "missing host", url: "https:///dns-query", hasError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := parseDNSUpstream(tt.url)
+			if tt.hasError {
+				if err == nil {
+					t.Fatalf("expected an error for %s", tt.url)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Scheme != tt.scheme || u.Host != tt.host || u.Port != tt.port || u.Path != tt.path {
+				t.Errorf("unexpected upstream: %s %s %s %s", u.Scheme, u.Host, u.Port, u.Path)
+			}
+		})
+	}
+}
+
+func TestDNSUpstreamOrder(t *testing.T) {
+	s, err := newDNSUpstreamSet([]string{"udp://10.0.0.1", "udp://10.0.0.2", "udp://10.0.0.3"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second, third := s.upstreams[0], s.upstreams[1], s.upstreams[2]
+	first.recordSuccess(40 * time.Millisecond)
+	second.recordSuccess(10 * time.Millisecond)
+	third.recordSuccess(5 * time.Millisecond)
+	third.recordFailure()
+
+	ordered := s.ordered()
+	if ordered[0] != second || ordered[1] != first || ordered[2] != third {
+		t.Errorf("unexpected order: %s %s %s", ordered[0].URL, ordered[1].URL, ordered[2].URL)
+	}
+
+	third.lastFailure.Store(time.Now().Add(-dnsUpstreamBackoff - time.Second).UnixNano())
+	if s.ordered()[0] != third {
+		t.Error("a failed upstream should be retried after the backoff")
+	}
+
+	third.recordSuccess(5 * time.Millisecond)
+	if third.failures.Load() != 0 {
+		t.Error("a reply should reset the failures")
+	}
+}
+
+func TestDNSUpstreamHTTPS(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/dns-query" || r.Header.Get("content-type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil || req.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reply, _ := largeDNSReply(req, 2).Pack()
+		w.Header().Set("content-type", "application/dns-message")
+		_, _ = w.Write(reply)
+	}))
+	defer srv.Close()
+
+	s, err := newDNSUpstreamSet([]string{srv.URL}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	u := s.upstreams[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	u.httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for range 2 {
+		r, _, err := s.Exchange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != req.Id || len(r.Answer) != 2 {
+			t.Errorf("unexpected reply: %v", r)
+		}
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected 2 requests, got %d", requests.Load())
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestDNSUpstreamTCPPool(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	server := &dns.Server{
+		Listener: cl,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			_ = w.WriteMsg(largeDNSReply(req, 1))
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	s, err := newDNSUpstreamSet([]string{"tcp://" + l.Addr().String()}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for range 3 {
+		r, _, err := s.Exchange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != req.Id || len(r.Answer) != 1 {
+			t.Errorf("unexpected reply: %v", r)
+		}
+	}
+	if cl.accepted.Load() != 1 {
+		t.Errorf("expected the connection to be reused, got %d connections", cl.accepted.Load())
+	}
+
+	// A pooled connection closed by the upstream is replaced
+	conn := <-s.upstreams[0].conns
+	_ = conn.Close()
+	s.upstreams[0].conns <- conn
+	if _, _, err = s.Exchange(req); err != nil {
+		t.Fatal(err)
+	}
+	if cl.accepted.Load() != 2 {
+		t.Errorf("expected a new connection, got %d connections", cl.accepted.Load())
+	}
+}
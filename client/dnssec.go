@@ -0,0 +1,795 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation of replies from the default upstreams. Queries are
+// sent with the DO and CD bits so the upstream returns the signatures,
+// even for data it considers bogus, and the DNSKEY and DS records are
+// validated from the trust anchors down to the signer of every RRset.
+// Bogus replies are answered with SERVFAIL and validated replies get
+// the AD bit. Unsigned data is only accepted below a delegation that is
+// proven to be insecure.
+
+// The root zone KSKs, used when DNSSECTrustAnchors is empty
+var defaultDNSSECTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// dnssecMaxKeyTTL limits how long validated zone keys are cached
+const dnssecMaxKeyTTL = 3600
+
+// dnssecMaxNSEC3Iterations follows RFC 9276, proofs with more
+// iterations are treated as insecure.
+const dnssecMaxNSEC3Iterations = 150
+
+var (
+	errDNSSECUnsigned = errors.New("no signatures")
+	errDNSSECInsecure = errors.New("insecure delegation")
+	errDNSSECNotZone  = errors.New("not a zone")
+
+	globalDNSSEC atomic.Pointer[dnssecValidator]
+)
+
+type dnssecZone struct {
+	keys    []*dns.DNSKEY
+	err     error
+	expires time.Time
+}
+
+type dnssecValidator struct {
+	key      string
+	anchors  map[string][]*dns.DS
+	exchange func(m *dns.Msg) (*dns.Msg, error)
+
+	lock  sync.Mutex
+	zones map[string]*dnssecZone
+}
+
+// signedRRset is an RRset and the RRSIG records that cover it
+type signedRRset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+	// wildcard is the closest encloser when the RRset was expanded
+	// from a wildcard, set by verify.
+	wildcard string
+}
+
+// denialProof holds the verified NSEC and NSEC3 records of a reply
+type denialProof struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+func parseTrustAnchors(list []string) (anchors map[string][]*dns.DS, err error) {
+	if len(list) == 0 {
+		list = defaultDNSSECTrustAnchors
+	}
+	anchors = make(map[string][]*dns.DS)
+	for _, v := range list {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %w", v, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor is not a DS record: %s", v)
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		anchors[zone] = append(anchors[zone], ds)
+	}
+	return anchors, nil
+}
+
+func newDNSSECValidator(list []string, exchange func(m *dns.Msg) (*dns.Msg, error)) (v *dnssecValidator, err error) {
+	anchors, err := parseTrustAnchors(list)
+	if err != nil {
+		return nil, err
+	}
+	return &dnssecValidator{
+		key:      strings.Join(list, "\n"),
+		anchors:  anchors,
+		exchange: exchange,
+		zones:    make(map[string]*dnssecZone),
+	}, nil
+}
+
+// getDNSSECValidator returns the validator for the trust anchors in the
+// config, DNSKEY and DS records are looked up on the default upstreams.
+func getDNSSECValidator(conf *configV2) (v *dnssecValidator, err error) {
+	old := globalDNSSEC.Load()
+	if old != nil && old.key == strings.Join(conf.DNSSECTrustAnchors, "\n") {
+		return old, nil
+	}
+	v, err = newDNSSECValidator(conf.DNSSECTrustAnchors, func(m *dns.Msg) (*dns.Msg, error) {
+		upstreams, err := getDNSUpstreams(CONFIG.Load())
+		if err != nil {
+			return nil, err
+		}
+		r, _, err := upstreams.Exchange(m)
+		return r, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	globalDNSSEC.Store(v)
+	return v, nil
+}
+
+// dnssecQuery copies the query and sets the DO and CD bits
+func dnssecQuery(m *dns.Msg) *dns.Msg {
+	q := m.Copy()
+	q.CheckingDisabled = true
+	if opt := q.IsEdns0(); opt != nil {
+		opt.SetDo()
+		opt.SetUDPSize(max(opt.UDPSize(), dns.DefaultMsgSize))
+	} else {
+		q.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return q
+}
+
+// dnssecRecord reports whether rr only exists for validation and should
+// not be sent to clients that did not set the DO bit.
+func dnssecRecord(rr dns.RR, qtype uint16) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return rr.Header().Rrtype != qtype
+	}
+	return false
+}
+
+func dnssecOK(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// validateDNSReply validates the reply to m and removes the DNSSEC
+// records if the client did not ask for them.
+func validateDNSReply(conf *configV2, m *dns.Msg, r *dns.Msg) (err error) {
+	v, err := getDNSSECValidator(conf)
+	if err != nil {
+		return err
+	}
+	secure, err := v.Validate(r)
+	if err != nil {
+		return err
+	}
+	r.AuthenticatedData = secure
+	r.CheckingDisabled = m.CheckingDisabled
+
+	if dnssecOK(m) {
+		return nil
+	}
+	qtype := m.Question[0].Qtype
+	r.Answer = slices.DeleteFunc(r.Answer, func(rr dns.RR) bool { return dnssecRecord(rr, qtype) })
+	r.Ns = slices.DeleteFunc(r.Ns, func(rr dns.RR) bool { return dnssecRecord(rr, qtype) })
+	if opt := r.IsEdns0(); opt != nil {
+		if m.IsEdns0() == nil {
+			r.Extra = slices.DeleteFunc(r.Extra, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeOPT })
+		} else {
+			opt.Hdr.Ttl &^= 1 << 15
+		}
+	}
+	return nil
+}
+
+func signedRRsets(section []dns.RR) (sets []*signedRRset) {
+	index := make(map[string]*signedRRset)
+	get := func(name string, rrtype uint16) *signedRRset {
+		name = strings.ToLower(dns.Fqdn(name))
+		key := name + "/" + strconv.FormatUint(uint64(rrtype), 10)
+		s, ok := index[key]
+		if !ok {
+			s = &signedRRset{name: name, rrtype: rrtype}
+			index[key] = s
+			sets = append(sets, s)
+		}
+		return s
+	}
+
+	for _, rr := range section {
+		switch v := rr.(type) {
+		case *dns.OPT:
+		case *dns.RRSIG:
+			s := get(v.Hdr.Name, v.TypeCovered)
+			s.sigs = append(s.sigs, v)
+		default:
+			s := get(rr.Header().Name, rr.Header().Rrtype)
+			s.rrs = append(s.rrs, rr)
+		}
+	}
+	return slices.DeleteFunc(sets, func(s *signedRRset) bool { return len(s.rrs) == 0 })
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	return slices.Contains(bitmap, rrtype)
+}
+
+func parentZone(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// nameSuffix returns the last labels of name
+func nameSuffix(name string, labels int) string {
+	index := dns.Split(name)
+	if labels <= 0 || len(index) == 0 {
+		return "."
+	}
+	if labels >= len(index) {
+		return name
+	}
+	return name[index[len(index)-labels]:]
+}
+
+func wildcardName(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// delegationBitmap reports whether the types belong to the parent side
+// of a delegation, which says nothing about the names below it.
+func delegationBitmap(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// canonicalCompare orders names as described in RFC 4034 section 6.1
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// nsecCovers reports whether name is between the owner and the next
+// name of an NSEC record, the last record in a zone points to the apex.
+func nsecCovers(owner, next, name string) bool {
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	if !dns.IsSubDomain(next, name) {
+		return false
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// nsecEncloser returns the closest encloser of a name covered by the
+// NSEC record, the deepest ancestor it shares with the owner or next name.
+func nsecEncloser(n *dns.NSEC, name string) string {
+	labels := max(dns.CompareDomainName(name, n.Hdr.Name), dns.CompareDomainName(name, n.NextDomain))
+	return nameSuffix(name, labels)
+}
+
+// nodataBitmap checks that the types of a name prove it has no records
+// of qtype.
+func nodataBitmap(bitmap []uint16, name string, qtype uint16) error {
+	switch {
+	case hasType(bitmap, qtype):
+		return fmt.Errorf("%s has %s records", name, dns.TypeToString[qtype])
+	case hasType(bitmap, dns.TypeCNAME):
+		return fmt.Errorf("%s has a CNAME record", name)
+	case qtype != dns.TypeDS && delegationBitmap(bitmap):
+		return fmt.Errorf("%s is a delegation, the proof is from the parent zone", name)
+	case qtype == dns.TypeDS && hasType(bitmap, dns.TypeSOA) && name != ".":
+		return fmt.Errorf("%s is a zone apex, the proof is from the child zone", name)
+	}
+	return nil
+}
+
+func (p *denialProof) nsecMatch(name string) *dns.NSEC {
+	for _, n := range p.nsec {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsecNoName returns the NSEC record that proves name does not exist
+func (p *denialProof) nsecNoName(name string) *dns.NSEC {
+	for _, n := range p.nsec {
+		owner := strings.ToLower(n.Hdr.Name)
+		if !nsecCovers(owner, n.NextDomain, name) {
+			continue
+		}
+		// Names below a delegation or DNAME are not in the zone
+		if dns.IsSubDomain(owner, name) && (delegationBitmap(n.TypeBitMap) || hasType(n.TypeBitMap, dns.TypeDNAME)) {
+			continue
+		}
+		return n
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3Match(name string) *dns.NSEC3 {
+	for _, n := range p.nsec3 {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3Cover(name string) *dns.NSEC3 {
+	for _, n := range p.nsec3 {
+		if n.Cover(name) && !n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsec3Encloser is the closest encloser proof from RFC 5155 section 8.3,
+// it returns the closest encloser of a name that does not exist and the
+// NSEC3 record covering the next closer name.
+func (p *denialProof) nsec3Encloser(name string) (encloser string, next *dns.NSEC3, err error) {
+	closer := name
+	for encloser = parentZone(name); ; encloser = parentZone(encloser) {
+		if n := p.nsec3Match(encloser); n != nil {
+			if delegationBitmap(n.TypeBitMap) || hasType(n.TypeBitMap, dns.TypeDNAME) {
+				return "", nil, fmt.Errorf("closest encloser of %s is not in the zone", name)
+			}
+			next = p.nsec3Cover(closer)
+			if next == nil {
+				return "", nil, fmt.Errorf("no proof that %s does not exist", closer)
+			}
+			return encloser, next, nil
+		}
+		if encloser == "." {
+			return "", nil, fmt.Errorf("no closest encloser for %s", name)
+		}
+		closer = encloser
+	}
+}
+
+// nameError checks the proof that name and the wildcard that could
+// have matched it do not exist.
+func (p *denialProof) nameError(name string) error {
+	if n := p.nsecNoName(name); n != nil {
+		wildcard := wildcardName(nsecEncloser(n, name))
+		if p.nsecNoName(wildcard) == nil {
+			return fmt.Errorf("no proof that %s does not exist", wildcard)
+		}
+		return nil
+	}
+	if len(p.nsec3) > 0 {
+		encloser, next, err := p.nsec3Encloser(name)
+		if err != nil {
+			return err
+		}
+		if p.nsec3Cover(wildcardName(encloser)) == nil {
+			return fmt.Errorf("no proof that %s does not exist", wildcardName(encloser))
+		}
+		if next.Flags&1 == 1 {
+			// Opt-out, the name could be an unsigned delegation
+			return errDNSSECInsecure
+		}
+		return nil
+	}
+	return fmt.Errorf("no proof that %s does not exist", name)
+}
+
+// noData checks the proof that name exists without records of qtype,
+// directly, as an empty non-terminal or through a wildcard.
+func (p *denialProof) noData(name string, qtype uint16) error {
+	if n := p.nsecMatch(name); n != nil {
+		return nodataBitmap(n.TypeBitMap, name, qtype)
+	}
+	if n := p.nsec3Match(name); n != nil {
+		return nodataBitmap(n.TypeBitMap, name, qtype)
+	}
+
+	for _, n := range p.nsec {
+		next := strings.ToLower(n.NextDomain)
+		if next != name && dns.IsSubDomain(name, next) && nsecCovers(n.Hdr.Name, next, name) {
+			return nil
+		}
+	}
+	if n := p.nsecNoName(name); n != nil {
+		wildcard := wildcardName(nsecEncloser(n, name))
+		w := p.nsecMatch(wildcard)
+		if w == nil {
+			return fmt.Errorf("no proof that %s %s does not exist", name, dns.TypeToString[qtype])
+		}
+		return nodataBitmap(w.TypeBitMap, wildcard, qtype)
+	}
+
+	if len(p.nsec3) > 0 {
+		encloser, next, err := p.nsec3Encloser(name)
+		if err != nil {
+			return err
+		}
+		if w := p.nsec3Match(wildcardName(encloser)); w != nil {
+			return nodataBitmap(w.TypeBitMap, wildcardName(encloser), qtype)
+		}
+		if qtype == dns.TypeDS && next.Flags&1 == 1 {
+			// Opt-out, the delegation is not signed
+			return errDNSSECInsecure
+		}
+	}
+	return fmt.Errorf("no proof that %s %s does not exist", name, dns.TypeToString[qtype])
+}
+
+// wildcardAnswer checks the proof that name does not exist for an
+// answer expanded from the wildcard at encloser, RFC 4035 section 5.3.4.
+func (p *denialProof) wildcardAnswer(name, encloser string) error {
+	if n := p.nsecNoName(name); n != nil && nsecEncloser(n, name) == encloser {
+		return nil
+	}
+	closer := nameSuffix(name, dns.CountLabel(encloser)+1)
+	if p.nsec3Cover(closer) != nil {
+		return nil
+	}
+	return fmt.Errorf("no proof that %s does not exist for the wildcard answer", name)
+}
+
+func (v *dnssecValidator) query(name string, qtype uint16) (r *dns.Msg, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	r, err = v.exchange(dnssecQuery(m))
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// verify checks the signatures of the RRset, signers at or below
+// exclude are ignored so a zone can not vouch for its own delegation.
+func (v *dnssecValidator) verify(set *signedRRset, exclude string) error {
+	if len(set.sigs) == 0 {
+		return errDNSSECUnsigned
+	}
+
+	labels := dns.CountLabel(set.name)
+	if strings.HasPrefix(set.name, "*.") {
+		labels--
+	}
+
+	err := fmt.Errorf("no valid signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+	for _, sig := range set.sigs {
+		signer := strings.ToLower(dns.Fqdn(sig.SignerName))
+		if !dns.IsSubDomain(signer, set.name) || int(sig.Labels) > labels {
+			continue
+		}
+		if exclude != "" && dns.IsSubDomain(exclude, signer) {
+			continue
+		}
+		if !sig.ValidityPeriod(time.Time{}) {
+			err = fmt.Errorf("signature for %s %s has expired", set.name, dns.TypeToString[set.rrtype])
+			continue
+		}
+
+		keys, kerr := v.zoneKeys(signer)
+		if errors.Is(kerr, errDNSSECInsecure) {
+			return kerr
+		}
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set.rrs) == nil {
+				if int(sig.Labels) < labels {
+					set.wildcard = nameSuffix(set.name, int(sig.Labels))
+				}
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+func (v *dnssecValidator) storeZone(zone string, z *dnssecZone, ttl uint32) {
+	z.expires = time.Now().Add(time.Duration(min(ttl, dnssecMaxKeyTTL)) * time.Second)
+	v.lock.Lock()
+	v.zones[zone] = z
+	v.lock.Unlock()
+}
+
+// zoneKeys returns the validated DNSKEY records of the zone
+func (v *dnssecValidator) zoneKeys(zone string) (keys []*dns.DNSKEY, err error) {
+	v.lock.Lock()
+	z, ok := v.zones[zone]
+	v.lock.Unlock()
+	if ok && time.Now().Before(z.expires) {
+		return z.keys, z.err
+	}
+
+	ttl := uint32(dnssecMaxKeyTTL)
+	trusted, ok := v.anchors[zone]
+	if !ok {
+		if zone == "." {
+			// No trust anchor covers the zone
+			return nil, errDNSSECInsecure
+		}
+		trusted, ttl, err = v.delegation(zone)
+		if errors.Is(err, errDNSSECInsecure) || errors.Is(err, errDNSSECNotZone) {
+			v.storeZone(zone, &dnssecZone{err: err}, ttl)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var set *signedRRset
+	for _, s := range signedRRsets(r.Answer) {
+		if s.rrtype == dns.TypeDNSKEY && s.name == zone {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, fmt.Errorf("no DNSKEY records for %s", zone)
+	}
+	for _, rr := range set.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	if !trustedKeys(keys, trusted, set) {
+		return nil, fmt.Errorf("DNSKEY records for %s do not match the DS records", zone)
+	}
+
+	v.storeZone(zone, &dnssecZone{keys: keys}, ttl)
+	return keys, nil
+}
+
+// trustedKeys reports whether the DNSKEY RRset is signed by a key that
+// matches one of the DS records.
+func trustedKeys(keys []*dns.DNSKEY, trusted []*dns.DS, set *signedRRset) bool {
+	for _, key := range keys {
+		for _, ds := range trusted {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			digest := key.ToDS(ds.DigestType)
+			if digest == nil || !strings.EqualFold(digest.Digest, ds.Digest) {
+				continue
+			}
+			for _, sig := range set.sigs {
+				if sig.KeyTag == key.KeyTag() && sig.ValidityPeriod(time.Time{}) && sig.Verify(key, set.rrs) == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// delegation returns the validated DS records of the zone. Zones above
+// it are validated first so an insecure parent makes the zone insecure.
+func (v *dnssecValidator) delegation(zone string) (records []*dns.DS, ttl uint32, err error) {
+	ttl = dnssecMaxKeyTTL
+	for parent := parentZone(zone); ; parent = parentZone(parent) {
+		_, err = v.zoneKeys(parent)
+		if !errors.Is(err, errDNSSECNotZone) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, ttl, err
+	}
+
+	r, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, ttl, err
+	}
+	for _, s := range signedRRsets(r.Answer) {
+		if s.rrtype != dns.TypeDS || s.name != zone {
+			continue
+		}
+		if err = v.verify(s, zone); err != nil {
+			return nil, ttl, err
+		}
+		for _, rr := range s.rrs {
+			records = append(records, rr.(*dns.DS))
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return records, ttl, nil
+	}
+
+	delegated, err := v.dsDenial(r, zone)
+	if err != nil {
+		return nil, ttl, err
+	}
+	if delegated {
+		return nil, ttl, errDNSSECInsecure
+	}
+	return nil, ttl, errDNSSECNotZone
+}
+
+// denialProof verifies the NSEC and NSEC3 records in the authority
+// section and returns them.
+func (v *dnssecValidator) denialProof(r *dns.Msg, exclude string) (p *denialProof, err error) {
+	p = new(denialProof)
+	for _, s := range signedRRsets(r.Ns) {
+		if s.rrtype != dns.TypeNSEC && s.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if err = v.verify(s, exclude); err != nil {
+			return nil, err
+		}
+		for _, rr := range s.rrs {
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				p.nsec = append(p.nsec, n)
+			case *dns.NSEC3:
+				if n.Hash != dns.SHA1 || n.Iterations > dnssecMaxNSEC3Iterations {
+					return nil, errDNSSECInsecure
+				}
+				p.nsec3 = append(p.nsec3, n)
+			}
+		}
+	}
+	if len(p.nsec) == 0 && len(p.nsec3) == 0 {
+		return nil, errDNSSECUnsigned
+	}
+	return p, nil
+}
+
+// dsDenial checks the proof that the zone has no DS records and reports
+// whether the name is an unsigned delegation.
+func (v *dnssecValidator) dsDenial(r *dns.Msg, zone string) (delegated bool, err error) {
+	p, err := v.denialProof(r, zone)
+	if err != nil {
+		return false, err
+	}
+
+	if r.Rcode == dns.RcodeNameError {
+		err = p.nameError(zone)
+	} else if n := p.nsecMatch(zone); n != nil {
+		return delegationBitmap(n.TypeBitMap), nodataBitmap(n.TypeBitMap, zone, dns.TypeDS)
+	} else if n := p.nsec3Match(zone); n != nil {
+		return delegationBitmap(n.TypeBitMap), nodataBitmap(n.TypeBitMap, zone, dns.TypeDS)
+	} else {
+		err = p.noData(zone, dns.TypeDS)
+	}
+	if errors.Is(err, errDNSSECInsecure) {
+		// Covered by an opt-out NSEC3, the delegation is not signed
+		return true, nil
+	}
+	return false, err
+}
+
+// anchorFor returns the closest trust anchor above the name
+func (v *dnssecValidator) anchorFor(name string) (zone string, ok bool) {
+	for zone = name; ; zone = parentZone(zone) {
+		if _, ok = v.anchors[zone]; ok {
+			return zone, true
+		}
+		if zone == "." {
+			return "", false
+		}
+	}
+}
+
+// insecure returns nil if the name is below an insecure delegation or
+// not covered by a trust anchor, unsigned data from a signed zone is bogus.
+func (v *dnssecValidator) insecure(name string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	anchor, ok := v.anchorFor(name)
+	if !ok {
+		return nil
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor); i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		_, err := v.zoneKeys(zone)
+		switch {
+		case errors.Is(err, errDNSSECInsecure):
+			return nil
+		case errors.Is(err, errDNSSECNotZone):
+		case err != nil:
+			return err
+		}
+	}
+	return fmt.Errorf("%s is in a signed zone but has no signatures", name)
+}
+
+// denial validates the NSEC or NSEC3 records of a reply without answers
+func (v *dnssecValidator) denial(r *dns.Msg) error {
+	p, err := v.denialProof(r, "")
+	if err != nil {
+		return err
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	if r.Rcode == dns.RcodeNameError {
+		return p.nameError(name)
+	}
+	return p.noData(name, q.Qtype)
+}
+
+// wildcardProof checks that the name of an RRset expanded from a
+// wildcard does not exist.
+func (v *dnssecValidator) wildcardProof(r *dns.Msg, set *signedRRset) error {
+	p, err := v.denialProof(r, "")
+	if errors.Is(err, errDNSSECUnsigned) {
+		return fmt.Errorf("no proof that %s does not exist for the wildcard answer", set.name)
+	}
+	if err != nil {
+		return err
+	}
+	return p.wildcardAnswer(set.name, set.wildcard)
+}
+
+// Validate checks the signatures in the reply, secure is false when the
+// data is below an insecure delegation and an error is returned for
+// bogus replies.
+func (v *dnssecValidator) Validate(r *dns.Msg) (secure bool, err error) {
+	if len(r.Question) == 0 {
+		return false, errors.New("reply has no question")
+	}
+	secure = true
+
+	check := func(err error, name string) error {
+		if errors.Is(err, errDNSSECUnsigned) {
+			err = v.insecure(name)
+			if err == nil {
+				secure = false
+			}
+			return err
+		}
+		if errors.Is(err, errDNSSECInsecure) {
+			secure = false
+			return nil
+		}
+		return err
+	}
+
+	for _, set := range signedRRsets(r.Answer) {
+		err = v.verify(set, "")
+		if err == nil && set.wildcard != "" {
+			err = v.wildcardProof(r, set)
+		}
+		if err = check(err, set.name); err != nil {
+			return false, err
+		}
+	}
+	for _, set := range signedRRsets(r.Ns) {
+		if len(set.sigs) == 0 {
+			// Unsigned referrals are checked by the denial below
+			continue
+		}
+		if err = check(v.verify(set, ""), set.name); err != nil {
+			return false, err
+		}
+	}
+
+	if len(r.Answer) == 0 {
+		if err = check(v.denial(r), r.Question[0].Name); err != nil {
+			return false, err
+		}
+	}
+	return secure, nil
+}
@@ -0,0 +1,385 @@
+package client
+
+import (
+	"crypto"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testSignedZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSignedZone(t *testing.T, name string) *testSignedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSignedZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testSignedZone) signAt(t *testing.T, inception, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func (z *testSignedZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	return z.signAt(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), rrs...)
+}
+
+func testNSEC(owner, next string, types ...uint16) *dns.NSEC {
+	slices.Sort(types)
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// testNSEC3Chain returns the NSEC3 records for the names of a zone
+func testNSEC3Chain(zone string, optOut bool, names map[string][]uint16) []dns.RR {
+	hashes := make([]string, 0, len(names))
+	types := make(map[string][]uint16)
+	for name, bitmap := range names {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, hash)
+		slices.Sort(bitmap)
+		types[hash] = bitmap
+	}
+	slices.Sort(hashes)
+
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	records := make([]dns.RR, 0, len(hashes))
+	for i, hash := range hashes {
+		records = append(records, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			HashLength: 20,
+			TypeBitMap: types[hash],
+		})
+	}
+	return records
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	root := newTestSignedZone(t, ".")
+	example := newTestSignedZone(t, "example.")
+	exampleDS := example.key.ToDS(dns.SHA256)
+	exampleDS.Hdr.Ttl = 3600
+
+	apexNSEC := testNSEC("example.", "www.example.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC, dns.TypeRRSIG)
+	zone := map[string]*dns.Msg{
+		".|DNSKEY":        {Answer: root.sign(t, root.key)},
+		"example.|DNSKEY": {Answer: example.sign(t, example.key)},
+		"example.|DS":     {Answer: root.sign(t, exampleDS)},
+		"insecure.|DS":    {Ns: root.sign(t, testNSEC("insecure.", "zz.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))},
+		"missing.example.|DS": {
+			MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError},
+			Ns:     example.sign(t, apexNSEC),
+		},
+	}
+	exchange := func(m *dns.Msg) (*dns.Msg, error) {
+		q := m.Question[0]
+		r := new(dns.Msg)
+		found, ok := zone[q.Name+"|"+dns.TypeToString[q.Qtype]]
+		if !ok {
+			r.SetRcode(m, dns.RcodeServerFailure)
+			return r, nil
+		}
+		r.SetRcode(m, found.Rcode)
+		r.Answer = found.Answer
+		r.Ns = found.Ns
+		return r, nil
+	}
+
+	a := func(name, ip string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip).To4()}
+	}
+	replyType := func(name string, qtype uint16, rcode int, answer []dns.RR, ns []dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r := new(dns.Msg)
+		r.SetRcode(m, rcode)
+		r.Answer = answer
+		r.Ns = ns
+		return r
+	}
+	reply := func(name string, rcode int, answer []dns.RR, ns []dns.RR) *dns.Msg {
+		return replyType(name, dns.TypeA, rcode, answer, ns)
+	}
+	// signNSEC3 signs every record of the chain as its own RRset
+	signNSEC3 := func(chain []dns.RR) (signed []dns.RR) {
+		for _, rr := range chain {
+			signed = append(signed, example.sign(t, rr)...)
+		}
+		return signed
+	}
+	// expanded signs the wildcard RRset and moves it to the name
+	expanded := func(name, ip string) []dns.RR {
+		rrs := example.sign(t, a("*.example.", ip))
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+		return rrs
+	}
+
+	tampered := example.sign(t, a("www.example.", "10.0.0.1"))
+	tampered[0].(*dns.A).A = net.ParseIP("10.6.6.6").To4()
+
+	otherRoot := newTestSignedZone(t, ".")
+
+	wildcardNSEC := testNSEC("*.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+	delegationNSEC := testNSEC("sub.example.", "www.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)
+	mailNSEC := testNSEC("mail.example.", "www.example.", dns.TypeMX, dns.TypeRRSIG, dns.TypeNSEC)
+	apexTypes := []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG}
+	nsec3 := testNSEC3Chain("example.", false, map[string][]uint16{
+		"example.":     apexTypes,
+		"www.example.": {dns.TypeA, dns.TypeRRSIG},
+	})
+	nsec3Wildcard := testNSEC3Chain("example.", false, map[string][]uint16{
+		"example.":     apexTypes,
+		"www.example.": {dns.TypeA, dns.TypeRRSIG},
+		"*.example.":   {dns.TypeA, dns.TypeRRSIG},
+	})
+	nsec3OptOut := testNSEC3Chain("example.", true, map[string][]uint16{
+		"example.":     apexTypes,
+		"www.example.": {dns.TypeA, dns.TypeRRSIG},
+	})
+	exampleAnchor := exampleDS.String()
+
+	tests := []struct {
+		name    string
+		anchors []string
+		reply   *dns.Msg
+		secure  bool
+		bogus   bool
+	}{
+		{
+			name:   "signed answer",
+			reply:  reply("www.example.", dns.RcodeSuccess, example.sign(t, a("www.example.", "10.0.0.1")), nil),
+			secure: true,
+		},
+		{
+			name:  "modified answer",
+			reply: reply("www.example.", dns.RcodeSuccess, tampered, nil),
+			bogus: true,
+		},
+		{
+			name:  "unsigned answer from a signed zone",
+			reply: reply("www.example.", dns.RcodeSuccess, []dns.RR{a("www.example.", "10.0.0.1")}, nil),
+			bogus: true,
+		},
+		{
+			name:  "expired signature",
+			reply: reply("www.example.", dns.RcodeSuccess, example.signAt(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour), a("www.example.", "10.0.0.1")), nil),
+			bogus: true,
+		},
+		{
+			name:  "signed by the wrong zone",
+			reply: reply("www.example.", dns.RcodeSuccess, newTestSignedZone(t, "example.").sign(t, a("www.example.", "10.0.0.1")), nil),
+			bogus: true,
+		},
+		{
+			name:  "unsigned answer below an insecure delegation",
+			reply: reply("host.insecure.", dns.RcodeSuccess, []dns.RR{a("host.insecure.", "10.0.0.1")}, nil),
+		},
+		{
+			name:   "signed NXDOMAIN",
+			reply:  reply("missing.example.", dns.RcodeNameError, nil, example.sign(t, apexNSEC)),
+			secure: true,
+		},
+		{
+			name:  "NXDOMAIN without proof",
+			reply: reply("missing.example.", dns.RcodeNameError, nil, nil),
+			bogus: true,
+		},
+		{
+			name:  "NSEC does not cover the name",
+			reply: reply("zzz.example.", dns.RcodeNameError, nil, example.sign(t, apexNSEC)),
+			bogus: true,
+		},
+		{
+			name:  "NXDOMAIN without wildcard proof",
+			reply: reply("missing.example.", dns.RcodeNameError, nil, example.sign(t, testNSEC("lost.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))),
+			bogus: true,
+		},
+		{
+			name:  "NXDOMAIN from above a delegation",
+			reply: reply("host.sub.example.", dns.RcodeNameError, nil, example.sign(t, delegationNSEC)),
+			bogus: true,
+		},
+		{
+			name:   "signed NODATA",
+			reply:  reply("mail.example.", dns.RcodeSuccess, nil, example.sign(t, mailNSEC)),
+			secure: true,
+		},
+		{
+			name:  "NODATA for a type that exists",
+			reply: replyType("mail.example.", dns.TypeMX, dns.RcodeSuccess, nil, example.sign(t, mailNSEC)),
+			bogus: true,
+		},
+		{
+			name:  "NODATA from the parent side of a delegation",
+			reply: reply("sub.example.", dns.RcodeSuccess, nil, example.sign(t, delegationNSEC)),
+			bogus: true,
+		},
+		{
+			name:   "DS NODATA from the parent side of a delegation",
+			reply:  replyType("sub.example.", dns.TypeDS, dns.RcodeSuccess, nil, example.sign(t, delegationNSEC)),
+			secure: true,
+		},
+		{
+			name:   "empty non-terminal NODATA",
+			reply:  reply("b.example.", dns.RcodeSuccess, nil, example.sign(t, testNSEC("a.example.", "c.b.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))),
+			secure: true,
+		},
+		{
+			name:   "wildcard NODATA",
+			reply:  replyType("host.example.", dns.TypeMX, dns.RcodeSuccess, nil, example.sign(t, wildcardNSEC)),
+			secure: true,
+		},
+		{
+			name:   "wildcard answer",
+			reply:  reply("host.example.", dns.RcodeSuccess, expanded("host.example.", "10.0.0.1"), example.sign(t, wildcardNSEC)),
+			secure: true,
+		},
+		{
+			name:  "wildcard answer without proof",
+			reply: reply("host.example.", dns.RcodeSuccess, expanded("host.example.", "10.0.0.1"), nil),
+			bogus: true,
+		},
+		{
+			name:  "wildcard answer for a name that exists",
+			reply: reply("www.example.", dns.RcodeSuccess, expanded("www.example.", "10.6.6.6"), example.sign(t, wildcardNSEC)),
+			bogus: true,
+		},
+		{
+			name:  "wildcard answer below a closer encloser",
+			reply: reply("host.mail.example.", dns.RcodeSuccess, expanded("host.mail.example.", "10.6.6.6"), example.sign(t, mailNSEC)),
+			bogus: true,
+		},
+		{
+			name:   "NSEC3 NXDOMAIN",
+			reply:  reply("missing.example.", dns.RcodeNameError, nil, signNSEC3(nsec3)),
+			secure: true,
+		},
+		{
+			name:  "NSEC3 NXDOMAIN with a wildcard",
+			reply: reply("missing.example.", dns.RcodeNameError, nil, signNSEC3(nsec3Wildcard)),
+			bogus: true,
+		},
+		{
+			name:  "NSEC3 opt-out NXDOMAIN",
+			reply: reply("missing.example.", dns.RcodeNameError, nil, signNSEC3(nsec3OptOut)),
+		},
+		{
+			name:   "NSEC3 NODATA",
+			reply:  replyType("www.example.", dns.TypeMX, dns.RcodeSuccess, nil, signNSEC3(nsec3)),
+			secure: true,
+		},
+		{
+			name:   "NSEC3 wildcard answer",
+			reply:  reply("host.example.", dns.RcodeSuccess, expanded("host.example.", "10.0.0.1"), signNSEC3(nsec3Wildcard)),
+			secure: true,
+		},
+		{
+			name:  "NSEC3 wildcard answer for a name that exists",
+			reply: reply("www.example.", dns.RcodeSuccess, expanded("www.example.", "10.6.6.6"), signNSEC3(nsec3Wildcard)),
+			bogus: true,
+		},
+		{
+			name:    "name outside the trust anchors",
+			anchors: []string{exampleAnchor},
+			reply:   reply("host.other.", dns.RcodeSuccess, []dns.RR{a("host.other.", "10.0.0.1")}, nil),
+		},
+		{
+			name:    "unsigned answer below a trust anchor",
+			anchors: []string{exampleAnchor},
+			reply:   reply("www.example.", dns.RcodeSuccess, []dns.RR{a("www.example.", "10.0.0.1")}, nil),
+			bogus:   true,
+		},
+		{
+			name:    "signed answer below a trust anchor",
+			anchors: []string{exampleAnchor},
+			reply:   reply("www.example.", dns.RcodeSuccess, example.sign(t, a("www.example.", "10.0.0.1")), nil),
+			secure:  true,
+		},
+		{
+			name:    "wrong trust anchor",
+			anchors: []string{otherRoot.key.ToDS(dns.SHA256).String()},
+			reply:   reply("www.example.", dns.RcodeSuccess, example.sign(t, a("www.example.", "10.0.0.1")), nil),
+			bogus:   true,
+		},
+	}
+
+	rootAnchor := root.key.ToDS(dns.SHA256).String()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anchors := tt.anchors
+			if anchors == nil {
+				anchors = []string{rootAnchor}
+			}
+			v, err := newDNSSECValidator(anchors, exchange)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secure, err := v.Validate(tt.reply)
+			if (err != nil) != tt.bogus {
+				t.Fatalf("expected bogus=%v, got %v", tt.bogus, err)
+			}
+			if secure != tt.secure {
+				t.Errorf("expected secure=%v, got %v", tt.secure, secure)
+			}
+		})
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	tests := []struct {
+		owner, next, name string
+		covered           bool
+	}{
+		{owner: "a.example.", next: "d.example.", name: "b.example.", covered: true},
+		{owner: "a.example.", next: "d.example.", name: "d.example."},
+		{owner: "a.example.", next: "d.example.", name: "x.a.example.", covered: true},
+		{owner: "w.example.", next: "example.", name: "z.example.", covered: true},
+		{owner: "w.example.", next: "example.", name: "b.example."},
+		{owner: "w.example.", next: "example.", name: "a.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if nsecCovers(tt.owner, tt.next, tt.name) != tt.covered {
+				t.Errorf("expected %v", tt.covered)
+			}
+		})
+	}
+}
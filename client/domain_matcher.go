@@ -0,0 +1,280 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Block and allow lists are parsed into a domainMatcher. Supported
+// formats, one rule per line:
+//
+//	example.com               example.com and every subdomain
+//	*.example.com             every subdomain, but not example.com
+//	ads*.example.com          wildcard, * matches any characters
+//	0.0.0.0 a.com b.com       hosts file, same as a plain domain
+//	||example.com^            AdBlock, same as a plain domain
+//	@@||example.com^          exception, never matches example.com
+//	/^ad[0-9]+\./             regular expression
+//
+// Lines starting with # or ! are comments. Exceptions win over every
+// other rule in the matcher, no matter which list they came from.
+
+type domainRule struct {
+	Tag       string
+	Domain    string
+	Regex     *regexp.Regexp
+	Exception bool
+	// SubdomainsOnly is set for *.example.com
+	SubdomainsOnly bool
+}
+
+type domainNode struct {
+	children  map[string]*domainNode
+	self      *domainRule
+	subdomain *domainRule
+	allowSelf bool
+	allowSub  bool
+}
+
+type domainMatcher struct {
+	lock    sync.Mutex
+	root    domainNode
+	regex   []*domainRule
+	allowRe []*domainRule
+	Rules   int
+}
+
+// hostsIgnore are names found in most hosts files that must not be blocked
+var hostsIgnore = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// parseDomainList returns the rules in the list, comments and empty
+// lines are not counted as rejected.
+func parseDomainList(list []byte, tag string) (rules []*domainRule, rejected int) {
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		lineRules, err := parseDomainLine(scanner.Text(), tag)
+		if err != nil {
+			rejected++
+			continue
+		}
+		rules = append(rules, lineRules...)
+	}
+	return rules, rejected
+}
+
+func parseDomainLine(line string, tag string) (rules []*domainRule, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil, nil
+	}
+	if c := strings.Index(line, " #"); c != -1 {
+		line = line[:c]
+	}
+	if c := strings.Index(line, "\t#"); c != -1 {
+		line = line[:c]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		rule, err := parseDomainRule(fields[0], tag)
+		if err != nil {
+			return nil, err
+		}
+		return []*domainRule{rule}, nil
+	}
+
+	if net.ParseIP(fields[0]) == nil {
+		return nil, errors.New("invalid rule")
+	}
+	for _, v := range fields[1:] {
+		v = strings.ToLower(v)
+		if hostsIgnore[v] {
+			continue
+		}
+		if !validRuleDomain(v) {
+			return nil, errors.New("invalid domain")
+		}
+		rules = append(rules, &domainRule{Tag: tag, Domain: v})
+	}
+	return rules, nil
+}
+
+func parseDomainRule(rule string, tag string) (r *domainRule, err error) {
+	r = &domainRule{Tag: tag}
+	if strings.HasPrefix(rule, "@@") {
+		r.Exception = true
+		rule = rule[2:]
+	}
+
+	if len(rule) > 2 && rule[0] == '/' && rule[len(rule)-1] == '/' {
+		r.Regex, err = regexp.Compile("(?i)" + rule[1:len(rule)-1])
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	plain := true
+	if strings.HasPrefix(rule, "||") {
+		plain = false
+		rule = strings.TrimSuffix(strings.TrimSuffix(rule[2:], "|"), "^")
+	}
+	rule = strings.ToLower(strings.TrimSuffix(rule, "."))
+
+	if strings.HasPrefix(rule, "*.") {
+		r.SubdomainsOnly = true
+		rule = rule[2:]
+	}
+	if strings.Contains(rule, "*") {
+		if !validRuleDomain(strings.ReplaceAll(rule, "*", "x")) {
+			return nil, errors.New("invalid wildcard")
+		}
+		pattern := regexp.QuoteMeta(rule)
+		pattern = strings.ReplaceAll(pattern, `\*`, `.*`)
+		if r.SubdomainsOnly {
+			pattern = `.+\.` + pattern
+		}
+		r.Regex = regexp.MustCompile("^" + pattern + "$")
+		r.SubdomainsOnly = false
+		return r, nil
+	}
+
+	if plain && !strings.Contains(rule, ".") {
+		return nil, errors.New("invalid domain")
+	}
+	if !validRuleDomain(rule) {
+		return nil, errors.New("invalid domain")
+	}
+	r.Domain = rule
+	return r, nil
+}
+
+func validRuleDomain(d string) bool {
+	if d == "" || len(d) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z':
+			case c >= '0' && c <= '9':
+			case c == '-' || c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Add is safe to call from multiple goroutines while the matcher is
+// being built, Match must only be called once the matcher is complete.
+func (dm *domainMatcher) Add(rules ...*domainRule) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	for _, r := range rules {
+		dm.Rules++
+		if r.Regex != nil {
+			if r.Exception {
+				dm.allowRe = append(dm.allowRe, r)
+			} else {
+				dm.regex = append(dm.regex, r)
+			}
+			continue
+		}
+
+		node := &dm.root
+		labels := strings.Split(r.Domain, ".")
+		for i := len(labels) - 1; i >= 0; i-- {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			next := node.children[labels[i]]
+			if next == nil {
+				next = new(domainNode)
+				node.children[labels[i]] = next
+			}
+			node = next
+		}
+
+		if r.Exception {
+			node.allowSub = true
+			node.allowSelf = node.allowSelf || !r.SubdomainsOnly
+			continue
+		}
+		if node.subdomain == nil {
+			node.subdomain = r
+		}
+		if node.self == nil && !r.SubdomainsOnly {
+			node.self = r
+		}
+	}
+}
+
+// Match returns the rule matching the domain, a trailing dot is ignored
+func (dm *domainMatcher) Match(name string) (rule *domainRule, ok bool) {
+	if dm == nil {
+		return nil, false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	node := &dm.root
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			break
+		}
+		if i == 0 {
+			if node.allowSelf {
+				return nil, false
+			}
+			if rule == nil {
+				rule = node.self
+			}
+		} else {
+			if node.allowSub {
+				return nil, false
+			}
+			if rule == nil {
+				rule = node.subdomain
+			}
+		}
+	}
+
+	for _, r := range dm.allowRe {
+		if r.Regex.MatchString(name) {
+			return nil, false
+		}
+	}
+	if rule != nil {
+		return rule, true
+	}
+	for _, r := range dm.regex {
+		if r.Regex.MatchString(name) {
+			return r, true
+		}
+	}
+	return nil, false
+}
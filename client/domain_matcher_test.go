@@ -0,0 +1,96 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestParseDomainList(t *testing.T) {
+	list := []byte(`# hosts file
+[Adblock Plus 2.0]
+! AdBlock comment
+0.0.0.0 localhost
+127.0.0.1 ads.example.com tracker.example.com # inline comment
+example.org
+||adblock.example.net^
+@@||allowed.example.net^
+*.wild.example.com
+/^ad[0-9]+\./
+
+||example.com/path^
+example.com##.banner
+||example.com^$third-party
+not-a-domain
+/[invalid/
+`)
+
+	rules, rejected := parseDomainList(list, "Ads")
+	if len(rules) != 7 {
+		t.Errorf("expected 7 rules, got %d", len(rules))
+	}
+	if rejected != 5 {
+		t.Errorf("expected 5 rejected lines, got %d", rejected)
+	}
+	for _, r := range rules {
+		if r.Tag != "Ads" {
+			t.Errorf("expected tag Ads, got %s", r.Tag)
+		}
+	}
+}
+
+func TestDomainMatcher(t *testing.T) {
+	rules, rejected := parseDomainList([]byte(`doubleclick.net
+0.0.0.0 tracker.example.com
+||adblock.example.net^
+@@||safe.adblock.example.net^
+*.wild.example.com
+ads*.example.org
+/^ad[0-9]+\.example\.io$/
+@@/^ad1\.example\.io$/
+`), "Ads")
+	if rejected != 0 {
+		t.Fatalf("expected no rejected lines, got %d", rejected)
+	}
+	dm := new(domainMatcher)
+	dm.Add(rules...)
+
+	tests := []struct {
+		name    string
+		domain  string
+		matched bool
+	}{
+		{name: "exact", domain: "doubleclick.net.", matched: true},
+		{name: "subdomain", domain: "ad.doubleclick.net.", matched: true},
+		{name: "deep subdomain", domain: "a.b.c.doubleclick.net", matched: true},
+		{name: "case insensitive", domain: "AD.DoubleClick.NET.", matched: true},
+		{name: "parent is not matched", domain: "net.", matched: false},
+		{name: "different domain with same suffix", domain: "notdoubleclick.net.", matched: false},
+		{name: "hosts entry", domain: "tracker.example.com.", matched: true},
+		{name: "hosts parent", domain: "example.com.", matched: false},
+		{name: "adblock subdomain", domain: "x.adblock.example.net.", matched: true},
+		{name: "exception", domain: "safe.adblock.example.net.", matched: false},
+		{name: "exception subdomain", domain: "cdn.safe.adblock.example.net.", matched: false},
+		{name: "wildcard subdomain", domain: "a.wild.example.com.", matched: true},
+		{name: "wildcard does not match the domain", domain: "wild.example.com.", matched: false},
+		{name: "glob", domain: "ads123.example.org.", matched: true},
+		{name: "glob mismatch", domain: "tracking.example.org.", matched: false},
+		{name: "regex", domain: "ad7.example.io.", matched: true},
+		{name: "regex exception", domain: "ad1.example.io.", matched: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := dm.Match(tt.domain)
+			if ok != tt.matched {
+				t.Fatalf("expected %v for %s, got %v", tt.matched, tt.domain, ok)
+			}
+			if ok && rule.Tag != "Ads" {
+				t.Errorf("expected tag Ads, got %s", rule.Tag)
+			}
+		})
+	}
+
+	var empty *domainMatcher
+	if _, ok := empty.Match("doubleclick.net."); ok {
+		t.Error("a nil matcher should not match")
+	}
+}
@@ -198,6 +198,12 @@ func HTTPhandler(w http.ResponseWriter, r *http.Request) {
 	case "getDNSStats":
 		HTTP_GetDNSStats(w, r)
 		return
+	case "getDNSCacheStats":
+		HTTP_GetDNSCacheStats(w, r)
+		return
+	case "pauseDNSBlocking":
+		HTTP_PauseDNSBlocking(w, r)
+		return
 	default:
 	}
 
@@ -286,13 +292,77 @@ type StateNetworkResponse struct {
 	DefaultInterfaceName string
 }
 
+type DNSStatsResponse struct {
+	Domains  map[string]any
+	Profiles map[string]*DNSProfileStats
+	Queries  []*DNSLogEntry
+}
+
+// HTTP_GetDNSStats returns the stats for every domain and DNS profile,
+// and the entries from the query log when the request contains a
+// DNSLogQuery.
 func HTTP_GetDNSStats(w http.ResponseWriter, r *http.Request) {
-	stats := make(map[string]any)
+	var query *DNSLogQuery
+	if err := Bind(&query, r); err != nil && err != io.EOF {
+		JSON(w, r, 400, err)
+		return
+	}
+
+	resp := &DNSStatsResponse{
+		Domains:  make(map[string]any),
+		Profiles: make(map[string]*DNSProfileStats),
+	}
 	DNSStatsMap.Range(func(key string, value any) bool {
-		stats[key] = value
+		resp.Domains[key] = value
+		return true
+	})
+	DNSProfileStatsMap.Range(func(key string, value *DNSProfileStats) bool {
+		resp.Profiles[key] = value
+		return true
+	})
+
+	if query != nil {
+		var err error
+		resp.Queries, err = DNSQueryLog.Query(CONFIG.Load(), query)
+		if err != nil {
+			JSON(w, r, 500, err)
+			return
+		}
+	}
+	JSON(w, r, 200, resp)
+}
+
+func HTTP_GetDNSCacheStats(w http.ResponseWriter, r *http.Request) {
+	JSON(w, r, 200, DNSCache.Stats())
+}
+
+type PauseDNSBlockingForm struct {
+	// Tag of the block list, empty pauses every list
+	Tag string
+	// Minutes to pause for, zero resumes blocking
+	Minutes int
+}
+
+// HTTP_PauseDNSBlocking pauses or resumes block lists and returns the
+// time every paused list resumes blocking.
+func HTTP_PauseDNSBlocking(w http.ResponseWriter, r *http.Request) {
+	form := new(PauseDNSBlockingForm)
+	if err := Bind(form, r); err != nil {
+		JSON(w, r, 400, err)
+		return
+	}
+
+	PauseBlockLists(form.Tag, time.Duration(form.Minutes)*time.Minute)
+
+	now := time.Now()
+	pauses := make(map[string]time.Time)
+	DNSBlockPauses.Range(func(key string, until time.Time) bool {
+		if until.After(now) {
+			pauses[key] = until
+		}
 		return true
 	})
-	JSON(w, r, 200, stats)
+	JSON(w, r, 200, pauses)
 }
 
 func HTTP_GetState(w http.ResponseWriter, r *http.Request) {
@@ -146,15 +146,27 @@ func LaunchTunnels() {
 		newConcurrentSignal("UDPDNSHandler", CancelContext, func() {
 			StartUDPDNSHandler()
 		})
+		newConcurrentSignal("TCPDNSHandler", CancelContext, func() {
+			StartTCPDNSHandler()
+		})
 		newConcurrentSignal("BlockListUpdater", CancelContext, func() {
 			reloadBlockLists(true)
 		})
 		newConcurrentSignal("WhiteListUpdater", CancelContext, func() {
 			reloadWhiteLists(true)
 		})
+		newConcurrentSignal("BlockListScheduler", CancelContext, func() {
+			ScheduleBlockLists()
+		})
 		newConcurrentSignal("CleanDNSCache", CancelContext, func() {
 			CleanDNSCache()
 		})
+		newConcurrentSignal("DNSLogWriter", CancelContext, func() {
+			WriteDNSLog()
+		})
+		newConcurrentSignal("PruneDNSLog", CancelContext, func() {
+			PruneDNSLog()
+		})
 	}
 
 	if conf.OpenUI {
@@ -0,0 +1,80 @@
+package client
+
+import "net"
+
+var limitedBroadcast = [4]byte{255, 255, 255, 255}
+
+func (t *TUN) InitMulticast() (err error) {
+	for _, v := range t.ServerResponse().LANMulticastGroups {
+		if _, v.NetIPNet, err = net.ParseCIDR(v.Group); err == nil {
+			continue
+		}
+		ip := net.ParseIP(v.Group).To4()
+		if ip == nil {
+			return err
+		}
+		v.NetIPNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	return nil
+}
+
+// IsLANBroadcast reports whether the ip is the limited broadcast
+// address or the broadcast address of the VPL network.
+func (t *TUN) IsLANBroadcast(ip [4]byte) bool {
+	if ip == limitedBroadcast {
+		return true
+	}
+	if t.VPLNetwork == nil || t.VPLNetwork.NetIPNet == nil {
+		return false
+	}
+	n := t.VPLNetwork.NetIPNet
+	if !n.Contains(ip[:]) {
+		return false
+	}
+	for i := range 4 {
+		if ip[i]|n.Mask[i] != 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsLANMulticast reports whether egress traffic to ip should be sent
+// to the server as LAN broadcast or multicast.
+func (t *TUN) IsLANMulticast(ip [4]byte) bool {
+	if t.ServerResponse() == nil || t.VPLNetwork == nil {
+		return false
+	}
+	if ip == limitedBroadcast {
+		return t.ServerResponse().LANBroadcast
+	}
+	for _, v := range t.ServerResponse().LANMulticastGroups {
+		if v.NetIPNet != nil && v.NetIPNet.Contains(ip[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessEgressIGMP forwards IGMP membership reports to the server
+// so it knows which multicast groups this client has joined.
+func (V *TUN) ProcessEgressIGMP(packet []byte) bool {
+	if V.ServerResponse() == nil || V.VPLNetwork == nil {
+		return false
+	}
+	if len(V.ServerResponse().LANMulticastGroups) == 0 {
+		return false
+	}
+
+	ihl := int(packet[0]&0x0F) * 4
+	if len(packet) < ihl+8 {
+		return false
+	}
+
+	packet[12] = V.serverVPLIP[0]
+	packet[13] = V.serverVPLIP[1]
+	packet[14] = V.serverVPLIP[2]
+	packet[15] = V.serverVPLIP[3]
+	RecalculateIPv4HeaderChecksum(packet[:ihl])
+	return true
+}
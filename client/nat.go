@@ -1,8 +1,12 @@
 package client
 
 import (
+	"errors"
 	"net"
+	"slices"
 	"strings"
+
+	"github.com/tunnels-is/tunnels/types"
 )
 
 func inc(ip net.IP) {
@@ -19,11 +23,11 @@ func (t *TUN) TransLateVPLIP(ip [4]byte) ([4]byte, bool) {
 		return xxx, true
 	}
 
-	if t.ServerResponse.LAN == nil {
+	if t.ServerResponse().LAN == nil {
 		return ip, true
 	}
 
-	v := t.ServerResponse.LAN
+	v := t.ServerResponse().LAN
 	var newIP [4]byte
 
 	for i := range 3 {
@@ -42,12 +46,12 @@ func (V *TUN) TransLateIP(ip [4]byte) ([4]byte, bool) {
 		return xxx, true
 	}
 
-	if len(V.ServerResponse.Networks) == 0 {
+	if len(V.ServerResponse().Networks) == 0 {
 		return ip, true
 	}
 
 	var newIP [4]byte
-	for _, v := range V.ServerResponse.Networks {
+	for _, v := range V.ServerResponse().Networks {
 		if v.Nat == "" {
 			continue
 		}
@@ -92,27 +96,27 @@ func (V *TUN) IsIngressVPLIP(ip [4]byte) (ok bool) {
 func (t *TUN) InitVPLMap() (err error) {
 	meta := t.meta.Load()
 	DEBUG("Initializing VPL/NAT maps for tunnel:", meta.IFName)
-	if t.ServerResponse.LAN == nil {
+	if t.ServerResponse().LAN == nil {
 		return nil
 	}
 
-	if t.ServerResponse.LAN.Nat != "" {
-		_, t.ServerResponse.LAN.NatIPNet, err = net.ParseCIDR(t.ServerResponse.LAN.Nat)
+	if t.ServerResponse().LAN.Nat != "" {
+		_, t.ServerResponse().LAN.NatIPNet, err = net.ParseCIDR(t.ServerResponse().LAN.Nat)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, t.ServerResponse.LAN.NetIPNet, err = net.ParseCIDR(t.ServerResponse.LAN.Network)
+	_, t.ServerResponse().LAN.NetIPNet, err = net.ParseCIDR(t.ServerResponse().LAN.Network)
 	if err != nil {
 		return err
 	}
 
 	toMap := ""
-	if t.ServerResponse.LAN.Nat != "" {
-		toMap = t.ServerResponse.LAN.Nat
+	if t.ServerResponse().LAN.Nat != "" {
+		toMap = t.ServerResponse().LAN.Nat
 	} else {
-		toMap = t.ServerResponse.LAN.Network
+		toMap = t.ServerResponse().LAN.Network
 	}
 
 	ip, network, err := net.ParseCIDR(toMap)
@@ -136,7 +140,7 @@ func (t *TUN) InitVPLMap() (err error) {
 func (t *TUN) InitNatMaps() (err error) {
 	meta := t.meta.Load()
 	DEBUG("Initializing NAT maps for tunnel:", meta.IFName)
-	for _, v := range t.ServerResponse.Networks {
+	for _, v := range t.ServerResponse().Networks {
 		if v.Nat == "" {
 			continue
 		}
@@ -155,6 +159,171 @@ func (t *TUN) InitNatMaps() (err error) {
 	return nil
 }
 
+func translateIPToNetwork(ip [4]byte, to *net.IPNet) (out [4]byte) {
+	for i := range 4 {
+		out[i] = to.IP[i]&to.Mask[i] | ip[i]&^to.Mask[i]
+	}
+	return
+}
+
+// InitSiteMaps parses the site networks advertised by this client
+// and the site networks advertised by other clients on the server.
+func (t *TUN) InitSiteMaps() (err error) {
+	meta := t.meta.Load()
+	DEBUG("Initializing site maps for tunnel:", meta.IFName)
+
+	t.localSites = make([]*types.Network, 0)
+	for _, v := range meta.SiteNetworks {
+		n := &types.Network{
+			Tag:     v.Tag,
+			Network: v.Network,
+			Nat:     v.Nat,
+		}
+		_, n.NetIPNet, err = net.ParseCIDR(n.Network)
+		if err != nil {
+			return err
+		}
+		if n.Nat != "" {
+			_, n.NatIPNet, err = net.ParseCIDR(n.Nat)
+			if err != nil {
+				return err
+			}
+		}
+		t.localSites = append(t.localSites, n)
+	}
+
+	remote, err := parseSiteNetworks(t.ServerResponse().SiteNetworks)
+	if err != nil {
+		return err
+	}
+	t.remoteSites.Store(&remote)
+	return nil
+}
+
+func parseSiteNetworks(networks []*types.Network) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, 0, len(networks))
+	for _, v := range networks {
+		_, n, err := net.ParseCIDR(v.Network)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// IsSiteIP reports whether ip is inside a network advertised by another client
+func (t *TUN) IsSiteIP(ip [4]byte) bool {
+	sites := t.remoteSites.Load()
+	if sites == nil {
+		return false
+	}
+	for _, v := range *sites {
+		if v.Contains(ip[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// TranslateSiteEgress translates the source address of a packet coming
+// from a host behind this client into its advertised address.
+func (t *TUN) TranslateSiteEgress(ip [4]byte) ([4]byte, bool) {
+	for _, v := range t.localSites {
+		if !v.NetIPNet.Contains(ip[:]) {
+			continue
+		}
+		if v.NatIPNet == nil {
+			return ip, true
+		}
+		return translateIPToNetwork(ip, v.NatIPNet), true
+	}
+	return ip, false
+}
+
+// TranslateSiteIngress translates an advertised address into the
+// address of the host behind this client.
+func (t *TUN) TranslateSiteIngress(ip [4]byte) ([4]byte, bool) {
+	for _, v := range t.localSites {
+		if v.NatIPNet == nil {
+			if v.NetIPNet.Contains(ip[:]) {
+				return ip, true
+			}
+			continue
+		}
+		if v.NatIPNet.Contains(ip[:]) {
+			return translateIPToNetwork(ip, v.NetIPNet), true
+		}
+	}
+	return ip, false
+}
+
+// UpdateSiteNetworks replaces the remote site networks and
+// adjusts the routes on the tunnel interface. The server response
+// is replaced with the new networks and routes so the routes are
+// removed on disconnect.
+func (t *TUN) UpdateSiteNetworks(networks []*types.Network) (err error) {
+	newSites, err := parseSiteNetworks(networks)
+	if err != nil {
+		return err
+	}
+
+	meta := t.meta.Load()
+	tunif := t.tunnel.Load()
+	old := t.ServerResponse()
+	if tunif == nil || meta == nil || old == nil {
+		return errors.New("no tunnel interface")
+	}
+
+	oldSites := t.remoteSites.Load()
+	if oldSites != nil {
+		for _, o := range *oldSites {
+			found := false
+			for _, n := range newSites {
+				if o.String() == n.String() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				_ = IP_DelRoute(o.String(), tunif.IPv4Address, "0")
+			}
+		}
+	}
+
+	for _, n := range newSites {
+		err = IP_AddRoute(n.String(), meta.IFName, tunif.IPv4Address, "0")
+		if err != nil {
+			ERROR("unable to add site route:", n.String(), err)
+		}
+	}
+
+	sr := *old
+	sr.SiteNetworks = networks
+	sr.Routes = replaceSiteRoutes(old.Routes, old.SiteNetworks, networks)
+	t.serverResponse.Store(&sr)
+	t.remoteSites.Store(&newSites)
+	DEBUG("site networks updated for tunnel:", meta.Tag, networks)
+	return nil
+}
+
+// replaceSiteRoutes returns routes with the routes of the old site
+// networks replaced by routes to the new ones.
+func replaceSiteRoutes(routes []*types.Route, oldSites []*types.Network, newSites []*types.Network) []*types.Route {
+	routes = slices.DeleteFunc(slices.Clone(routes), func(r *types.Route) bool {
+		return r.Metric == "0" && slices.ContainsFunc(oldSites, func(n *types.Network) bool {
+			return n.Network == r.Address
+		})
+	})
+	for _, n := range newSites {
+		routes = append(routes, &types.Route{
+			Address: n.Network,
+			Metric:  "0",
+		})
+	}
+	return routes
+}
+
 // func (V *Tunnel) BuildNATMap() (err error) {
 // 	if V.crReponse.Networks == nil {
 // 		DEBUG("no NAT map found")
@@ -2,7 +2,10 @@ package client
 
 import (
 	"net"
+	"slices"
 	"testing"
+
+	"github.com/tunnels-is/tunnels/types"
 )
 
 func TestInc(t *testing.T) {
@@ -114,3 +117,107 @@ func TestIncSequence(t *testing.T) {
 
 	t.Logf("Sequential increment test passed ✓")
 }
+
+func TestSiteTranslation(t *testing.T) {
+	tun := new(TUN)
+	tun.meta.Store(&TunnelMETA{
+		IFName: "test",
+		SiteNetworks: []*types.Network{
+			{Network: "192.168.1.0/24", Nat: "192.168.50.0/24"},
+			{Network: "192.168.2.0/24"},
+		},
+	})
+	tun.serverResponse.Store(&types.ServerConnectResponse{
+		SiteNetworks: []*types.Network{
+			{Network: "172.20.0.0/16"},
+		},
+	})
+
+	err := tun.InitSiteMaps()
+	if err != nil {
+		t.Fatalf("InitSiteMaps() error: %s", err)
+	}
+
+	if !tun.IsSiteIP([4]byte{172, 20, 1, 1}) {
+		t.Error("expected 172.20.1.1 to be a remote site address")
+	}
+	if tun.IsSiteIP([4]byte{192, 168, 1, 1}) {
+		t.Error("local site networks should not be remote site addresses")
+	}
+
+	tests := []struct {
+		name     string
+		egress   bool
+		input    [4]byte
+		expected [4]byte
+		ok       bool
+	}{
+		{name: "egress natted", egress: true, input: [4]byte{192, 168, 1, 7}, expected: [4]byte{192, 168, 50, 7}, ok: true},
+		{name: "egress plain", egress: true, input: [4]byte{192, 168, 2, 7}, expected: [4]byte{192, 168, 2, 7}, ok: true},
+		{name: "egress not a site", egress: true, input: [4]byte{192, 168, 3, 7}, expected: [4]byte{192, 168, 3, 7}, ok: false},
+		{name: "ingress natted", egress: false, input: [4]byte{192, 168, 50, 9}, expected: [4]byte{192, 168, 1, 9}, ok: true},
+		{name: "ingress plain", egress: false, input: [4]byte{192, 168, 2, 9}, expected: [4]byte{192, 168, 2, 9}, ok: true},
+		{name: "ingress real address of natted network", egress: false, input: [4]byte{192, 168, 1, 9}, expected: [4]byte{192, 168, 1, 9}, ok: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out [4]byte
+			var ok bool
+			if tc.egress {
+				out, ok = tun.TranslateSiteEgress(tc.input)
+			} else {
+				out, ok = tun.TranslateSiteIngress(tc.input)
+			}
+			if out != tc.expected || ok != tc.ok {
+				t.Errorf("got (%v, %v), expected (%v, %v)", out, ok, tc.expected, tc.ok)
+			}
+		})
+	}
+}
+
+func TestReplaceSiteRoutes(t *testing.T) {
+	site := func(network string) *types.Network { return &types.Network{Network: network} }
+	route := func(address string, metric string) *types.Route { return &types.Route{Address: address, Metric: metric} }
+
+	tests := []struct {
+		name     string
+		routes   []*types.Route
+		oldSites []*types.Network
+		newSites []*types.Network
+		expected []string
+	}{
+		{
+			name:     "site added",
+			routes:   []*types.Route{route("10.0.0.0/8", "0")},
+			newSites: []*types.Network{site("172.20.0.0/16")},
+			expected: []string{"10.0.0.0/8", "172.20.0.0/16"},
+		},
+		{
+			name:     "site removed",
+			routes:   []*types.Route{route("10.0.0.0/8", "0"), route("172.20.0.0/16", "0")},
+			oldSites: []*types.Network{site("172.20.0.0/16")},
+			expected: []string{"10.0.0.0/8"},
+		},
+		{
+			name:     "site replaced",
+			routes:   []*types.Route{route("172.20.0.0/16", "0"), route("172.21.0.0/16", "5")},
+			oldSites: []*types.Network{site("172.20.0.0/16")},
+			newSites: []*types.Network{site("172.22.0.0/16")},
+			expected: []string{"172.21.0.0/16", "172.22.0.0/16"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			routes := replaceSiteRoutes(tc.routes, tc.oldSites, tc.newSites)
+			var got []string
+			for _, r := range routes {
+				got = append(got, r.Address)
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
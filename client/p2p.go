@@ -0,0 +1,434 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v3"
+	"github.com/tunnels-is/tunnels/crypt"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+const (
+	p2pKeepaliveInterval = 5 * time.Second
+	p2pRegisterInterval  = 30 * time.Second
+	p2pOfferInterval     = 30 * time.Second
+	// peers that have not sent anything within this window
+	// are considered unreachable and traffic falls back to the server
+	p2pReadyTimeout = 15 * time.Second
+	p2pIdleTimeout  = 2 * time.Minute
+)
+
+var p2pKeepalivePacket = []byte{0}
+
+// peerSession is a direct, encrypted path to another LAN client.
+// The side that sent the offer seals with key 1 and the side that
+// answered seals with key 2, just like the client and the server.
+type peerSession struct {
+	IP        [4]byte
+	initiator bool
+	enc       *crypt.SocketWrapper
+	ready     atomic.Bool
+
+	candidates atomic.Pointer[[]*net.UDPAddr]
+	addr       atomic.Pointer[net.UDPAddr]
+	lastRecv   atomic.Int64
+	lastOffer  time.Time
+	created    time.Time
+}
+
+func (p *peerSession) seal(data []byte, index []byte) []byte {
+	if p.initiator {
+		return p.enc.SEAL.Seal1(data, index)
+	}
+	return p.enc.SEAL.Seal2(data, index)
+}
+
+func (p *peerSession) open(packet []byte, staging []byte) ([]byte, error) {
+	if p.initiator {
+		return p.enc.SEAL.Open2(packet[10:], packet[2:10], staging, packet[0:2])
+	}
+	return p.enc.SEAL.Open1(packet[10:], packet[2:10], staging, packet[0:2])
+}
+
+func (p *peerSession) isDirect() bool {
+	if !p.ready.Load() || p.addr.Load() == nil {
+		return false
+	}
+	return time.Since(time.Unix(0, p.lastRecv.Load())) < p2pReadyTimeout
+}
+
+// InitP2P opens the peer to peer socket and registers
+// it's public endpoint with the server.
+func (t *TUN) InitP2P() (err error) {
+	meta := t.meta.Load()
+	if !meta.PeerToPeer || t.dhcp == nil || t.VPLNetwork == nil {
+		return nil
+	}
+
+	t.p2pConn, err = net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	t.p2pPeers = xsync.NewMapOf[[4]byte, *peerSession]()
+
+	err = t.registerP2P()
+	if err != nil {
+		_ = t.p2pConn.Close()
+		t.p2pConn = nil
+		return err
+	}
+
+	go t.readFromPeers()
+	go t.p2pKeepalive()
+
+	DEBUG("p2p socket initialized on:", t.p2pConn.LocalAddr().String())
+	return nil
+}
+
+func (t *TUN) closeP2P() {
+	if t.p2pConn != nil {
+		_ = t.p2pConn.Close()
+	}
+}
+
+func (t *TUN) p2pIndex() []byte {
+	return []byte{t.serverVPLIP[2], t.serverVPLIP[3]}
+}
+
+func (t *TUN) peerIPFromIndex(index []byte) [4]byte {
+	return [4]byte{t.serverVPLIP[0], t.serverVPLIP[1], index[0], index[1]}
+}
+
+func (t *TUN) registerP2P() (err error) {
+	msg := new(types.P2PRegisterMessage)
+	port := t.p2pConn.LocalAddr().(*net.UDPAddr).Port
+	ifip := STATE.Load().DefaultInterface.Load()
+	if ifip != nil && ifip.To4() != nil {
+		msg.LocalEndpoints = append(msg.LocalEndpoints,
+			(&net.UDPAddr{IP: ifip.To4(), Port: port}).String(),
+		)
+	}
+
+	packet, err := types.MarshalControlMessage(types.ControlP2PRegister, msg)
+	if err != nil {
+		return err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", t.ServerResponse().InterfaceIP+":"+t.ServerResponse().DataPort)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.p2pConn.WriteToUDP(t.encWrapper.SEAL.Seal1(packet, t.Index), raddr)
+	return err
+}
+
+func (t *TUN) sendControlMessage(mt types.ControlMessageType, payload any) (err error) {
+	if t.connection == nil || t.encWrapper == nil {
+		return errors.New("tunnel is not connected")
+	}
+	packet, err := types.MarshalControlMessage(mt, payload)
+	if err != nil {
+		return err
+	}
+	_, err = t.connection.Write(t.encWrapper.SEAL.Seal1(packet, t.Index))
+	return err
+}
+
+// sendToPeer sends an egress LAN packet directly to the peer if a
+// direct path is available. If no session exists a new handshake
+// is started and the packet is relayed through the server.
+func (t *TUN) sendToPeer(packet []byte) bool {
+	if t.p2pConn == nil {
+		return false
+	}
+
+	// Packets from hosts behind a site network are relayed, the server
+	// checks that the site belongs to the sender.
+	var src, dst [4]byte
+	copy(src[:], packet[12:16])
+	copy(dst[:], packet[16:20])
+	if src != t.serverVPLIP || dst == t.serverVPLIP || !t.VPLNetwork.NetIPNet.Contains(dst[:]) || t.IsLANBroadcast(dst) {
+		return false
+	}
+
+	peer, ok := t.p2pPeers.Load(dst)
+	if !ok || (!peer.ready.Load() && time.Since(peer.lastOffer) > p2pOfferInterval) {
+		go t.offerP2P(dst)
+		return false
+	}
+
+	if !peer.isDirect() {
+		return false
+	}
+
+	_, err := t.p2pConn.WriteToUDP(peer.seal(packet, t.p2pIndex()), peer.addr.Load())
+	if err != nil {
+		DEBUG("p2p write error, falling back to relay:", err)
+		peer.ready.Store(false)
+		return false
+	}
+
+	t.egressBytes.Add(int64(len(packet)))
+	return true
+}
+
+func (t *TUN) offerP2P(ip [4]byte) {
+	defer RecoverAndLog()
+	meta := t.meta.Load()
+
+	peer := &peerSession{
+		IP:        ip,
+		initiator: true,
+		enc:       crypt.NewEncryptionHandler(meta.EncryptionType),
+		lastOffer: time.Now(),
+		created:   time.Now(),
+	}
+	err := peer.enc.InitializeClient()
+	if err != nil {
+		ERROR("unable to initialize p2p encryption:", err)
+		return
+	}
+
+	t.p2pPeers.Store(ip, peer)
+	err = t.sendControlMessage(types.ControlP2POffer, &types.P2PHandshakeMessage{
+		Peer:           ip,
+		EncType:        meta.EncryptionType,
+		X25519Pub:      peer.enc.SEAL.X25519Pub.Bytes(),
+		Mlkem1024Encap: peer.enc.SEAL.Mlkem1024Encap.Bytes(),
+	})
+	if err != nil {
+		ERROR("unable to send p2p offer:", err)
+	}
+}
+
+func (t *TUN) handleP2POffer(msg *types.P2PHandshakeMessage) {
+	meta := t.meta.Load()
+	if t.p2pConn == nil || !meta.PeerToPeer {
+		return
+	}
+
+	existing, ok := t.p2pPeers.Load(msg.Peer)
+	if ok && existing.initiator && !existing.ready.Load() {
+		// Both sides sent an offer at the same time,
+		// the lower address keeps the initiator role.
+		if bytes.Compare(t.serverVPLIP[:], msg.Peer[:]) < 0 {
+			return
+		}
+	}
+
+	peer := &peerSession{
+		IP:        msg.Peer,
+		initiator: false,
+		enc:       crypt.NewEncryptionHandler(msg.EncType),
+		created:   time.Now(),
+	}
+	peer.setCandidates(msg.Endpoints)
+
+	err := peer.enc.InitializeServer(msg.X25519Pub, msg.Mlkem1024Encap)
+	if err != nil {
+		ERROR("unable to initialize p2p encryption:", err)
+		return
+	}
+	err = peer.enc.FinalizeServer()
+	if err != nil {
+		ERROR("unable to finalize p2p encryption:", err)
+		return
+	}
+
+	answer := &types.P2PHandshakeMessage{
+		Peer:            msg.Peer,
+		EncType:         msg.EncType,
+		X25519Pub:       peer.enc.SEAL.X25519Pub.Bytes(),
+		Mlkem1024Cipher: peer.enc.SEAL.Mlkem1024Cipher,
+	}
+	peer.enc.SEAL.CleanPostSecretGeneration()
+	peer.ready.Store(true)
+	t.p2pPeers.Store(msg.Peer, peer)
+
+	err = t.sendControlMessage(types.ControlP2PAnswer, answer)
+	if err != nil {
+		ERROR("unable to send p2p answer:", err)
+		return
+	}
+	t.punchP2P(peer)
+}
+
+func (t *TUN) handleP2PAnswer(msg *types.P2PHandshakeMessage) {
+	if t.p2pConn == nil {
+		return
+	}
+	peer, ok := t.p2pPeers.Load(msg.Peer)
+	if !ok || !peer.initiator || peer.ready.Load() {
+		return
+	}
+
+	err := peer.enc.FinalizeClient(msg.X25519Pub, msg.Mlkem1024Cipher)
+	if err != nil {
+		ERROR("unable to finalize p2p encryption:", err)
+		t.p2pPeers.Delete(msg.Peer)
+		return
+	}
+	peer.enc.SEAL.CleanPostSecretGeneration()
+	peer.setCandidates(msg.Endpoints)
+	peer.ready.Store(true)
+	t.punchP2P(peer)
+}
+
+func parseP2PEndpoints(endpoints []string) (addrs []*net.UDPAddr) {
+	for _, v := range endpoints {
+		addr, err := net.ResolveUDPAddr("udp4", v)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (p *peerSession) setCandidates(endpoints []string) {
+	addrs := parseP2PEndpoints(endpoints)
+	p.candidates.Store(&addrs)
+}
+
+// punchP2P sends a keepalive to every known endpoint of the peer,
+// the first endpoint to answer becomes the direct path.
+func (t *TUN) punchP2P(peer *peerSession) {
+	if addr := peer.addr.Load(); addr != nil {
+		_, _ = t.p2pConn.WriteToUDP(peer.seal(p2pKeepalivePacket, t.p2pIndex()), addr)
+		return
+	}
+	candidates := peer.candidates.Load()
+	if candidates == nil {
+		return
+	}
+	for _, addr := range *candidates {
+		_, _ = t.p2pConn.WriteToUDP(peer.seal(p2pKeepalivePacket, t.p2pIndex()), addr)
+	}
+}
+
+func (t *TUN) p2pKeepalive() {
+	defer RecoverAndLog()
+	lastRegister := time.Now()
+
+	for {
+		time.Sleep(p2pKeepaliveInterval)
+		if t.GetState() < TUN_Connected {
+			return
+		}
+
+		if time.Since(lastRegister) > p2pRegisterInterval {
+			err := t.registerP2P()
+			if err != nil {
+				DEBUG("unable to register p2p endpoint:", err)
+			}
+			lastRegister = time.Now()
+		}
+
+		t.p2pPeers.Range(func(ip [4]byte, peer *peerSession) bool {
+			lastRecv := time.Unix(0, peer.lastRecv.Load())
+			if time.Since(peer.created) > p2pIdleTimeout && time.Since(lastRecv) > p2pIdleTimeout {
+				DEBUG("p2p session expired:", ip)
+				t.p2pPeers.Delete(ip)
+				return true
+			}
+			if peer.ready.Load() {
+				t.punchP2P(peer)
+			}
+			return true
+		})
+	}
+}
+
+func (t *TUN) readFromPeers() {
+	defer RecoverAndLog()
+
+	var (
+		n       int
+		addr    *net.UDPAddr
+		err     error
+		packet  []byte
+		peer    *peerSession
+		ok      bool
+		buff    = make([]byte, 66000)
+		staging = make([]byte, 66000)
+	)
+
+	for {
+		n, addr, err = t.p2pConn.ReadFromUDP(buff)
+		if err != nil {
+			DEBUG("p2p listener exiting:", err)
+			return
+		}
+		if n < 10 {
+			continue
+		}
+
+		peer, ok = t.p2pPeers.Load(t.peerIPFromIndex(buff[0:2]))
+		if !ok || !peer.ready.Load() {
+			continue
+		}
+
+		packet, err = peer.open(buff[:n], staging[:0])
+		if err != nil {
+			DEEP("p2p authentication error:", err)
+			continue
+		}
+
+		peer.addr.Store(addr)
+		peer.lastRecv.Store(time.Now().UnixNano())
+		if len(packet) < 20 {
+			continue
+		}
+
+		if !t.processPeerIngressPacket(peer, packet) {
+			continue
+		}
+
+		err = t.writeToInterface(packet)
+		if err != nil {
+			ERROR("p2p tun/tap write error:", err)
+			continue
+		}
+		t.ingressBytes.Add(int64(n))
+	}
+}
+
+// processPeerIngressPacket prepares a packet received directly from
+// another LAN client. It runs on the p2p reader, so it can not use
+// the ingress scratch fields used by the server reader. Only packets
+// from the peer's own address are accepted, site traffic is relayed.
+func (t *TUN) processPeerIngressPacket(peer *peerSession, packet []byte) bool {
+	if packet[0]>>4 != 4 {
+		return false
+	}
+	if packet[9] != 6 && packet[9] != 17 {
+		return false
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if len(packet) < ihl+8 {
+		return false
+	}
+
+	var src [4]byte
+	copy(src[:], packet[12:16])
+	if src != peer.IP {
+		return false
+	}
+
+	var dst [4]byte
+	copy(dst[:], packet[16:20])
+	dst, ok := t.TranslateSiteIngress(dst)
+	if !ok {
+		dst = t.localInterfaceIP4bytes
+	}
+	copy(packet[16:20], dst[:])
+
+	RecalculateIPv4HeaderChecksum(packet[:ihl])
+	RecalculateTransportChecksum(packet[:ihl], packet[ihl:])
+	return true
+}
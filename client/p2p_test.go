@@ -0,0 +1,40 @@
+package client
+
+import "testing"
+
+func TestProcessPeerIngressPacket(t *testing.T) {
+	tun := &TUN{localInterfaceIP4bytes: [4]byte{10, 0, 0, 1}}
+	peer := &peerSession{IP: [4]byte{10, 4, 3, 2}}
+
+	udpPacket := func(src [4]byte) []byte {
+		packet := make([]byte, 28)
+		packet[0] = 0x45
+		packet[9] = 17
+		copy(packet[12:16], src[:])
+		copy(packet[16:20], []byte{10, 4, 3, 9})
+		return packet
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		ok     bool
+	}{
+		{name: "from the peer", packet: udpPacket(peer.IP), ok: true},
+		{name: "spoofed LAN address", packet: udpPacket([4]byte{10, 4, 3, 7})},
+		{name: "site address", packet: udpPacket([4]byte{192, 168, 1, 7})},
+		{name: "not ipv4", packet: append([]byte{0x60}, udpPacket(peer.IP)[1:]...)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ok := tun.processPeerIngressPacket(peer, tc.packet)
+			if ok != tc.ok {
+				t.Fatalf("expected %v, got %v", tc.ok, ok)
+			}
+			if ok && [4]byte(tc.packet[16:20]) != tun.localInterfaceIP4bytes {
+				t.Errorf("destination was not translated, got %v", tc.packet[16:20])
+			}
+		})
+	}
+}
@@ -40,6 +40,9 @@ func (V *TUN) ProcessEgressPacket(p *[]byte) (sendRemote bool) {
 	}
 
 	V.EP_Protocol = packet[9]
+	if V.EP_Protocol == 2 {
+		return V.ProcessEgressIGMP(packet)
+	}
 	if V.EP_Protocol != 17 && V.EP_Protocol != 6 {
 		return false
 	}
@@ -54,6 +57,11 @@ func (V *TUN) ProcessEgressPacket(p *[]byte) (sendRemote bool) {
 		return false
 	}
 
+	V.EP_SrcIP[0] = packet[12]
+	V.EP_SrcIP[1] = packet[13]
+	V.EP_SrcIP[2] = packet[14]
+	V.EP_SrcIP[3] = packet[15]
+
 	V.EP_DstIP[0] = packet[16]
 	V.EP_DstIP[1] = packet[17]
 	V.EP_DstIP[2] = packet[18]
@@ -71,7 +79,7 @@ func (V *TUN) ProcessEgressPacket(p *[]byte) (sendRemote bool) {
 	// 	}
 	// }
 
-	if !V.IsEgressVPLIP(V.EP_DstIP) {
+	if !V.IsEgressVPLIP(V.EP_DstIP) && !V.IsSiteIP(V.EP_DstIP) && !V.IsLANMulticast(V.EP_DstIP) {
 
 		V.EgressMapping = V.CreateNEWPortMapping(p)
 		if V.EgressMapping == nil {
@@ -101,12 +109,23 @@ func (V *TUN) ProcessEgressPacket(p *[]byte) (sendRemote bool) {
 		V.EP_IPv4Header[15] = V.serverInterfaceIP4bytes[3]
 
 	} else {
-		V.EP_NAT_IP, V.EP_NAT_OK = V.TransLateVPLIP(V.EP_DstIP)
+		if V.IsEgressVPLIP(V.EP_DstIP) {
+			V.EP_NAT_IP, V.EP_NAT_OK = V.TransLateVPLIP(V.EP_DstIP)
+		} else {
+			V.EP_NAT_OK = false
+		}
 
-		V.EP_IPv4Header[12] = V.serverVPLIP[0]
-		V.EP_IPv4Header[13] = V.serverVPLIP[1]
-		V.EP_IPv4Header[14] = V.serverVPLIP[2]
-		V.EP_IPv4Header[15] = V.serverVPLIP[3]
+		// Hosts behind a site-to-site client keep their own
+		// (advertised) address, everything else uses the VPL address.
+		V.EP_SrcIP, V.EP_NAT_OK_SRC = V.TranslateSiteEgress(V.EP_SrcIP)
+		if !V.EP_NAT_OK_SRC {
+			V.EP_SrcIP = V.serverVPLIP
+		}
+
+		V.EP_IPv4Header[12] = V.EP_SrcIP[0]
+		V.EP_IPv4Header[13] = V.EP_SrcIP[1]
+		V.EP_IPv4Header[14] = V.EP_SrcIP[2]
+		V.EP_IPv4Header[15] = V.EP_SrcIP[3]
 	}
 
 	if V.EP_NAT_OK {
@@ -139,7 +158,7 @@ func (V *TUN) ProcessIngressPacket(packet []byte) bool {
 	V.IP_DstPort[0] = V.IP_TPHeader[2]
 	V.IP_DstPort[1] = V.IP_TPHeader[3]
 
-	if !V.IsIngressVPLIP(V.IP_SrcIP) {
+	if !V.IsIngressVPLIP(V.IP_SrcIP) && !V.IsSiteIP(V.IP_SrcIP) {
 		V.IP_NAT_IP, V.IP_NAT_OK = V.NATIngress[V.IP_SrcIP]
 		if V.IP_NAT_OK {
 			V.IP_IPv4Header[12] = V.IP_NAT_IP[0]
@@ -178,15 +197,34 @@ func (V *TUN) ProcessIngressPacket(packet []byte) bool {
 		V.IP_IPv4Header[19] = V.IngressMapping.OriginalSourceIP[3]
 
 	} else {
-		// if DST == ME ON VPL .. then DST == 127.0.0.1
-		// V.IP_IPv4Header[16] = 127
-		// V.IP_IPv4Header[17] = 0
-		// V.IP_IPv4Header[18] = 0
-		// V.IP_IPv4Header[19] = 1
-		V.IP_IPv4Header[16] = V.localInterfaceIP4bytes[0]
-		V.IP_IPv4Header[17] = V.localInterfaceIP4bytes[1]
-		V.IP_IPv4Header[18] = V.localInterfaceIP4bytes[2]
-		V.IP_IPv4Header[19] = V.localInterfaceIP4bytes[3]
+		V.IP_DstIP[0] = packet[16]
+		V.IP_DstIP[1] = packet[17]
+		V.IP_DstIP[2] = packet[18]
+		V.IP_DstIP[3] = packet[19]
+
+		// Packets for hosts behind a site-to-site client are
+		// forwarded to the real address of the host.
+		// LAN broadcasts are delivered as a limited broadcast
+		// and multicast packets keep their group address.
+		V.IP_NAT_OK = true
+		if V.IsLANBroadcast(V.IP_DstIP) {
+			V.IP_DstIP = limitedBroadcast
+		} else if V.IP_DstIP[0] < 224 || V.IP_DstIP[0] > 239 {
+			V.IP_DstIP, V.IP_NAT_OK = V.TranslateSiteIngress(V.IP_DstIP)
+		}
+		if !V.IP_NAT_OK {
+			// if DST == ME ON VPL .. then DST == 127.0.0.1
+			// V.IP_IPv4Header[16] = 127
+			// V.IP_IPv4Header[17] = 0
+			// V.IP_IPv4Header[18] = 0
+			// V.IP_IPv4Header[19] = 1
+			V.IP_DstIP = V.localInterfaceIP4bytes
+		}
+
+		V.IP_IPv4Header[16] = V.IP_DstIP[0]
+		V.IP_IPv4Header[17] = V.IP_DstIP[1]
+		V.IP_IPv4Header[18] = V.IP_DstIP[2]
+		V.IP_IPv4Header[19] = V.IP_DstIP[3]
 	}
 
 	RecalculateIPv4HeaderChecksum(V.IP_IPv4Header)
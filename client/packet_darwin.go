@@ -3,7 +3,10 @@
 package client
 
 import (
+	"errors"
 	"runtime/debug"
+
+	"github.com/tunnels-is/tunnels/types"
 )
 
 func (tun *TUN) ReadFromTunnelInterface() {
@@ -53,6 +56,10 @@ func (tun *TUN) ReadFromTunnelInterface() {
 			continue
 		}
 
+		if tun.sendToPeer(packet) {
+			continue
+		}
+
 		out = tun.encWrapper.SEAL.Seal1(packet, tun.Index)
 
 		writtenBytes, err = tun.connection.Write(out)
@@ -92,6 +99,11 @@ func (tun *TUN) ReadFromServeTunnel() {
 		meta     = tun.meta.Load()
 	)
 
+	// Control messages are applied in order on their own goroutine
+	control := make(chan []byte, controlQueueSize)
+	go tun.handleControlMessages(control)
+	defer close(control)
+
 	DEBUG("Server Tunnel listener initialized")
 	for {
 		if tun.GetState() < TUN_Connected {
@@ -101,6 +113,9 @@ func (tun *TUN) ReadFromServeTunnel() {
 		n, readErr = tun.connection.Read(buff)
 		if readErr != nil {
 			ERROR("error reading from server socket: ", readErr, n)
+			if tun.GetState() >= TUN_Connected {
+				tun.serverFailed()
+			}
 			return
 		}
 
@@ -118,6 +133,11 @@ func (tun *TUN) ReadFromServeTunnel() {
 
 		tun.ingressBytes.Add(int64(n))
 
+		if types.IsControlMessage(packet) {
+			control <- CopySlice(packet)
+			continue
+		}
+
 		if len(packet) < 20 {
 			tun.RegisterPing(meta.Tag, CopySlice(packet))
 			continue
@@ -136,3 +156,16 @@ func (tun *TUN) ReadFromServeTunnel() {
 		}
 	}
 }
+
+// writeToInterface is used by readers other than ReadFromServeTunnel
+func (tun *TUN) writeToInterface(packet []byte) (err error) {
+	osTunnel := tun.tunnel.Load()
+	if osTunnel == nil {
+		return errors.New("no tun/tap interface")
+	}
+	out := make([]byte, 0, len(packet)+4)
+	out = append(out, 0, 0, 0, 2)
+	out = append(out, packet...)
+	_, err = osTunnel.RWC.Write(out)
+	return err
+}
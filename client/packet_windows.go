@@ -3,9 +3,11 @@
 package client
 
 import (
+	"errors"
 	"runtime/debug"
 	"time"
 
+	"github.com/tunnels-is/tunnels/types"
 	"golang.org/x/sys/windows"
 )
 
@@ -86,6 +88,10 @@ func (tun *TUN) ReadFromTunnelInterface() {
 			continue
 		}
 
+		if tun.sendToPeer(packet) {
+			continue
+		}
+
 		writtenBytes, err = tun.connection.Write(tun.encWrapper.SEAL.Seal1(packet, tun.Index))
 		if err != nil {
 			ERROR("router write error: ", err)
@@ -130,6 +136,11 @@ func (tun *TUN) ReadFromServeTunnel() {
 		meta    = tun.meta.Load()
 	)
 
+	// Control messages are applied in order on their own goroutine
+	control := make(chan []byte, controlQueueSize)
+	go tun.handleControlMessages(control)
+	defer close(control)
+
 	for {
 		if tun.GetState() < TUN_Connected {
 			return
@@ -138,6 +149,9 @@ func (tun *TUN) ReadFromServeTunnel() {
 		n, readErr = tun.connection.Read(buff)
 		if readErr != nil {
 			ERROR("error reading from server socket: ", readErr, n)
+			if tun.GetState() >= TUN_Connected {
+				tun.serverFailed()
+			}
 			return
 		}
 
@@ -154,6 +168,11 @@ func (tun *TUN) ReadFromServeTunnel() {
 		}
 		tun.ingressBytes.Add(int64(n))
 
+		if types.IsControlMessage(packet) {
+			control <- CopySlice(packet)
+			continue
+		}
+
 		if len(packet) < 20 {
 			go tun.RegisterPing(meta.Tag, CopySlice(packet))
 			continue
@@ -177,3 +196,17 @@ func (tun *TUN) ReadFromServeTunnel() {
 		}
 	}
 }
+
+// writeToInterface is used by readers other than ReadFromServeTunnel
+func (tun *TUN) writeToInterface(packet []byte) (err error) {
+	inf := tun.tunnel.Load()
+	if inf == nil {
+		return errors.New("no tun/tap interface")
+	}
+	outb, err := inf.AllocateSendPacket(len(packet))
+	if err != nil {
+		return err
+	}
+	copy(outb, packet)
+	return inf.SendPacket(outb)
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func newPortTestTUN(start, end uint16) *TUN {
+	t := new(TUN)
+	t.startPort = start
+	t.endPort = end
+	t.InitPortMap()
+	// Prevent port requests from being sent during tests
+	t.lastPortRequest.Store(time.Now().Add(time.Hour).UnixNano())
+	return t
+}
+
+func egressTestPacket(t *TUN, srcPort byte) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	packet[9] = 6
+	copy(packet[12:16], []byte{172, 16, 0, 2})
+	copy(packet[16:20], []byte{1, 1, 1, 1})
+	packet[21] = srcPort
+	packet[23] = 80
+	t.EP_Protocol = 6
+	t.EP_TPHeader = packet[20:]
+	return packet
+}
+
+func TestCreateNEWPortMapping_Blocks(t *testing.T) {
+	tun := newPortTestTUN(2000, 2001)
+
+	for i := range 2 {
+		p := egressTestPacket(tun, byte(i+1))
+		if m := tun.CreateNEWPortMapping(&p); m == nil {
+			t.Fatalf("expected mapping %d to be created", i)
+		}
+	}
+
+	p := egressTestPacket(tun, 3)
+	if m := tun.CreateNEWPortMapping(&p); m != nil {
+		t.Fatal("expected no mapping when all ports are used")
+	}
+
+	tun.UpdatePortBlocks([]types.PortBlock{
+		{StartPort: 2000, EndPort: 2001},
+		{StartPort: 3000, EndPort: 3001},
+	})
+	m := tun.CreateNEWPortMapping(&p)
+	if m == nil || m.MappedPort != [2]byte{0x0b, 0xb8} {
+		t.Fatalf("expected mapping on port 3000, got %v", m)
+	}
+
+	p = egressTestPacket(tun, 1)
+	if m := tun.CreateNEWPortMapping(&p); m == nil || m.MappedPort != [2]byte{0x07, 0xd0} {
+		t.Error("existing mappings should be kept when blocks are added")
+	}
+
+	tun.UpdatePortBlocks([]types.PortBlock{{StartPort: 2000, EndPort: 2001}})
+	if tun.portMap(6, 3000) != nil {
+		t.Error("expected port 3000 to be removed")
+	}
+	p = egressTestPacket(tun, 3)
+	if m := tun.CreateNEWPortMapping(&p); m != nil {
+		t.Error("mappings on removed blocks should not be reused")
+	}
+}
+
+func TestReleaseIdlePortBlocks(t *testing.T) {
+	tun := newPortTestTUN(2000, 2001)
+	tun.UpdatePortBlocks([]types.PortBlock{
+		{StartPort: 2000, EndPort: 2001},
+		{StartPort: 3000, EndPort: 3001},
+	})
+
+	blocks := tun.getPortBlocks()
+	blocks[0].emptySince = time.Now().Add(-time.Hour)
+	blocks[1].emptySince = time.Now()
+	tun.releaseIdlePortBlocks()
+	if len(tun.getPortBlocks()) != 2 {
+		t.Fatal("recently emptied blocks should be kept")
+	}
+
+	blocks[1].emptySince = time.Now().Add(-portBlockIdleTimeout - time.Second)
+	tun.releaseIdlePortBlocks()
+	if len(tun.getPortBlocks()) != 1 {
+		t.Error("expected the idle block to be released")
+	}
+
+	// A mapping that was about to use the block before it was released
+	p := egressTestPacket(tun, 1)
+	if m := tun.mapPortInBlock(blocks[1], [12]byte{}, [6]byte{1, 1, 1, 1, 0, 80}); m != nil {
+		t.Errorf("mapping was added to a released block on port %v", m.MappedPort)
+	}
+	if m := tun.CreateNEWPortMapping(&p); m == nil || m.MappedPort != [2]byte{0x07, 0xd0} {
+		t.Errorf("expected mapping on port 2000, got %v", m)
+	}
+}
+
+func TestPortBlockOccupancy(t *testing.T) {
+	tun := newPortTestTUN(2000, 2009)
+	blocks := tun.getPortBlocks()
+
+	// Different destinations share the first port
+	for i := range 5 {
+		p := egressTestPacket(tun, 1)
+		p[19] = byte(i + 1)
+		if m := tun.CreateNEWPortMapping(&p); m == nil || m.MappedPort != [2]byte{0x07, 0xd0} {
+			t.Fatalf("expected mapping %d on port 2000, got %v", i, m)
+		}
+	}
+	if used := blocks[0].used(6).Load(); used != 1 {
+		t.Fatalf("expected 1 used port, got %d", used)
+	}
+
+	for i := range 8 {
+		p := egressTestPacket(tun, byte(i+2))
+		if m := tun.CreateNEWPortMapping(&p); m == nil {
+			t.Fatalf("expected mapping %d to be created", i)
+		}
+		if full := portBlocksFull(blocks, 6); full != (i == 7) {
+			t.Errorf("%d used ports: expected full=%v, got %v", i+2, i == 7, full)
+		}
+	}
+
+	blocks[0].lock.Lock()
+	blocks[0].removeMapping(6, 0, [6]byte{1, 1, 1, 1, 0, 80})
+	blocks[0].removeMapping(6, 8, [6]byte{1, 1, 1, 1, 0, 80})
+	blocks[0].lock.Unlock()
+	if used := blocks[0].used(6).Load(); used != 8 {
+		t.Errorf("expected 8 used ports after removing the only mapping of a port, got %d", used)
+	}
+	if blocks[0].isEmpty() {
+		t.Error("block with mappings should not be empty")
+	}
+}
+
+func TestInitPortMap_SinglePort(t *testing.T) {
+	tun := newPortTestTUN(2000, 2000)
+	p := egressTestPacket(tun, 1)
+	if m := tun.CreateNEWPortMapping(&p); m == nil || m.MappedPort != [2]byte{0x07, 0xd0} {
+		t.Fatalf("expected mapping on port 2000, got %v", m)
+	}
+
+	if blocks := newPortTestTUN(0, 0).getPortBlocks(); len(blocks) != 0 {
+		t.Errorf("expected no port blocks without a port range, got %d", len(blocks))
+	}
+}
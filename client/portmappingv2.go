@@ -4,11 +4,110 @@ import (
 	"encoding/binary"
 	"net"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/puzpuzpuz/xsync/v3"
+	"github.com/tunnels-is/tunnels/types"
 )
 
+const (
+	// More ports are requested from the server when this fraction
+	// of the available ports has at least one mapping.
+	portBlockGrowThreshold = 0.8
+	portRequestInterval    = 5 * time.Second
+	portBlockIdleTimeout   = 2 * time.Minute
+)
+
+// PortBlock is a range of NAT ports assigned by the server,
+// StartPort and EndPort are both inclusive. Mappings are added and
+// removed with lock held so the used port counts stay exact and a
+// block is never released while a mapping is being added to it.
+type PortBlock struct {
+	StartPort uint16
+	EndPort   uint16
+
+	TCP []*xsync.MapOf[any, *Mapping]
+	UDP []*xsync.MapOf[any, *Mapping]
+
+	lock       sync.Mutex
+	usedTCP    atomic.Int64
+	usedUDP    atomic.Int64
+	released   bool
+	emptySince time.Time
+}
+
+func NewPortBlock(start uint16, end uint16) (b *PortBlock) {
+	b = &PortBlock{
+		StartPort: start,
+		EndPort:   end,
+		TCP:       make([]*xsync.MapOf[any, *Mapping], int(end-start)+1),
+		UDP:       make([]*xsync.MapOf[any, *Mapping], int(end-start)+1),
+	}
+	for i := range b.TCP {
+		b.TCP[i] = xsync.NewMapOf[any, *Mapping]()
+	}
+	for i := range b.UDP {
+		b.UDP[i] = xsync.NewMapOf[any, *Mapping]()
+	}
+	return b
+}
+
+func (b *PortBlock) ports(proto byte) []*xsync.MapOf[any, *Mapping] {
+	if proto == 6 {
+		return b.TCP
+	}
+	return b.UDP
+}
+
+// used returns the number of ports with at least one mapping
+func (b *PortBlock) used(proto byte) *atomic.Int64 {
+	if proto == 6 {
+		return &b.usedTCP
+	}
+	return &b.usedUDP
+}
+
+// addMapping stores the mapping on the port, the caller holds b.lock
+func (b *PortBlock) addMapping(proto byte, i int, key any, m *Mapping) {
+	ports := b.ports(proto)
+	if ports[i].Size() == 0 {
+		b.used(proto).Add(1)
+	}
+	ports[i].Store(key, m)
+}
+
+// removeMapping deletes the mapping from the port, the caller holds b.lock
+func (b *PortBlock) removeMapping(proto byte, i int, key any) {
+	ports := b.ports(proto)
+	if _, ok := ports[i].LoadAndDelete(key); ok && ports[i].Size() == 0 {
+		b.used(proto).Add(-1)
+	}
+}
+
+func (b *PortBlock) isEmpty() bool {
+	return b.usedTCP.Load() == 0 && b.usedUDP.Load() == 0
+}
+
+func (V *TUN) getPortBlocks() []*PortBlock {
+	blocks := V.portBlocks.Load()
+	if blocks == nil {
+		return nil
+	}
+	return *blocks
+}
+
+// portMap returns the mapping table for a local port
+func (V *TUN) portMap(proto byte, port uint16) *xsync.MapOf[any, *Mapping] {
+	for _, b := range V.getPortBlocks() {
+		if port >= b.StartPort && port <= b.EndPort {
+			return b.ports(proto)[port-b.StartPort]
+		}
+	}
+	return nil
+}
+
 func (V *TUN) CreateNEWPortMapping(p *[]byte) (m *Mapping) {
 	packet := *p
 	EID := [12]byte{
@@ -25,75 +124,114 @@ func (V *TUN) CreateNEWPortMapping(p *[]byte) (m *Mapping) {
 		V.EP_TPHeader[2],
 		V.EP_TPHeader[3], // dst PORT
 	}
+	IID := [6]byte{EID[4], EID[5], EID[6], EID[7], EID[10], EID[11]}
 
 	var smap *xsync.MapOf[any, *Mapping]
-	var aports []*xsync.MapOf[any, *Mapping]
 	if V.EP_Protocol == 6 {
 		smap = V.ActiveTCPMapping
-		aports = V.AvailableTCPPorts
 	} else {
 		smap = V.ActiveUDPMapping
-		aports = V.AvailableUDPPorts
 	}
 
 	mm, ok := smap.Load(EID)
 	if ok && mm != nil {
-		m = mm
-		// TODO...
-		m.UnixTime.Store(time.Now().UnixMicro())
-		if V.EP_TPHeader[13]&0x2 > 0 {
-			m.rstFound.Store(false)
-			m.finCount.Store(0)
+		// The mapping is only valid while the port is still
+		// assigned to us and the ingress entry has not expired.
+		pm := V.portMap(V.EP_Protocol, binary.BigEndian.Uint16(mm.MappedPort[:]))
+		if pm != nil {
+			if im, ok := pm.Load(IID); ok && im == mm {
+				m = mm
+				// TODO...
+				m.UnixTime.Store(time.Now().UnixMicro())
+				if V.EP_TPHeader[13]&0x2 > 0 {
+					m.rstFound.Store(false)
+					m.finCount.Store(0)
+				}
+				return m
+			}
 		}
-		return m
+		smap.Delete(EID)
 	}
-	for i := range aports {
-		_, ok = aports[i].Load([6]byte{EID[4], EID[5], EID[6], EID[7], EID[10], EID[11]})
-		if !ok {
-			m = &Mapping{
-				Proto:   V.EP_Protocol,
-				SrcPort: [2]byte{V.EP_TPHeader[0], V.EP_TPHeader[1]},
-				DstPort: [2]byte{V.EP_TPHeader[2], V.EP_TPHeader[3]},
-				OriginalSourceIP: [4]byte{
-					EID[0],
-					EID[1],
-					EID[2],
-					EID[3],
-				},
-				DestinationIP: [4]byte{
-					EID[4],
-					EID[5],
-					EID[6],
-					EID[7],
-				},
-			}
-			m.UnixTime.Store(time.Now().UnixMicro())
-			binary.BigEndian.PutUint16(
-				m.MappedPort[:],
-				uint16(i)+V.startPort,
-			)
 
-			smap.Store(EID, m)
-			aports[i].Store(
-				[6]byte{EID[4], EID[5], EID[6], EID[7], EID[10], EID[11]},
-				m,
-			)
-			return m
+	blocks := V.getPortBlocks()
+	for _, b := range blocks {
+		m = V.mapPortInBlock(b, EID, IID)
+		if m == nil {
+			continue
+		}
+		smap.Store(EID, m)
+		if portBlocksFull(blocks, V.EP_Protocol) {
+			V.requestPortBlock()
 		}
+		return m
 	}
 
+	V.requestPortBlock()
 	return
 }
 
+// portBlocksFull reports whether more than portBlockGrowThreshold of
+// the ports in the blocks are in use.
+func portBlocksFull(blocks []*PortBlock, proto byte) bool {
+	var used, total int64
+	for _, b := range blocks {
+		used += b.used(proto).Load()
+		total += int64(len(b.ports(proto)))
+	}
+	return float64(used) > float64(total)*portBlockGrowThreshold
+}
+
+// mapPortInBlock adds a mapping on the first port in the block that is
+// not used for the destination, or returns nil if there is none.
+func (V *TUN) mapPortInBlock(b *PortBlock, EID [12]byte, IID [6]byte) (m *Mapping) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.released {
+		return nil
+	}
+
+	aports := b.ports(V.EP_Protocol)
+	for i := range aports {
+		if _, ok := aports[i].Load(IID); ok {
+			continue
+		}
+
+		m = &Mapping{
+			Proto:   V.EP_Protocol,
+			SrcPort: [2]byte{V.EP_TPHeader[0], V.EP_TPHeader[1]},
+			DstPort: [2]byte{V.EP_TPHeader[2], V.EP_TPHeader[3]},
+			OriginalSourceIP: [4]byte{
+				EID[0],
+				EID[1],
+				EID[2],
+				EID[3],
+			},
+			DestinationIP: [4]byte{
+				EID[4],
+				EID[5],
+				EID[6],
+				EID[7],
+			},
+		}
+		m.UnixTime.Store(time.Now().UnixMicro())
+		binary.BigEndian.PutUint16(
+			m.MappedPort[:],
+			uint16(i)+b.StartPort,
+		)
+
+		b.addMapping(V.EP_Protocol, i, IID, m)
+		return m
+	}
+	return nil
+}
+
 // func (V *TUN) getIngressPortMapping(VPNPortMap []atomic.Pointer[VPNPort], dstIP []byte, port [2]byte) *Mapping {
 func (V *TUN) getIngressPortMapping() (m *Mapping) {
-	var imap []*xsync.MapOf[any, *Mapping]
-	if V.IP_Protocol == 6 {
-		imap = V.AvailableTCPPorts
-	} else {
-		imap = V.AvailableUDPPorts
+	imap := V.portMap(V.IP_Protocol, binary.BigEndian.Uint16(V.IP_DstPort[:]))
+	if imap == nil {
+		return nil
 	}
-	mm, ok := imap[binary.BigEndian.Uint16(V.IP_DstPort[:])-V.startPort].Load(
+	mm, ok := imap.Load(
 		[6]byte{V.IP_SrcIP[0], V.IP_SrcIP[1], V.IP_SrcIP[2], V.IP_SrcIP[3], V.IP_SrcPort[0], V.IP_SrcPort[1]},
 	)
 	if ok && mm != nil {
@@ -104,22 +242,124 @@ func (V *TUN) getIngressPortMapping() (m *Mapping) {
 	return nil
 }
 
+// requestPortBlock asks the server for more ports, at most once per portRequestInterval
+func (V *TUN) requestPortBlock() {
+	if len(V.getPortBlocks()) == 0 {
+		return
+	}
+	last := V.lastPortRequest.Load()
+	if time.Since(time.Unix(0, last)) < portRequestInterval {
+		return
+	}
+	if !V.lastPortRequest.CompareAndSwap(last, time.Now().UnixNano()) {
+		return
+	}
+
+	go func() {
+		defer RecoverAndLog()
+		err := V.sendControlMessage(types.ControlPortRequest, nil)
+		if err != nil {
+			ERROR("unable to request port block:", err)
+		}
+	}()
+}
+
+// UpdatePortBlocks replaces the port blocks with the list sent by the
+// server. Existing blocks keep their mappings.
+func (V *TUN) UpdatePortBlocks(list []types.PortBlock) {
+	current := V.getPortBlocks()
+	blocks := make([]*PortBlock, 0, len(list))
+
+	for _, v := range list {
+		if v.EndPort < v.StartPort {
+			continue
+		}
+		i := slices.IndexFunc(current, func(b *PortBlock) bool {
+			return b.StartPort == v.StartPort && b.EndPort == v.EndPort
+		})
+		if i >= 0 {
+			blocks = append(blocks, current[i])
+		} else {
+			DEBUG("new port block:", v.StartPort, v.EndPort)
+			blocks = append(blocks, NewPortBlock(v.StartPort, v.EndPort))
+		}
+	}
+
+	V.portBlocks.Store(&blocks)
+	for _, b := range current {
+		if !slices.Contains(blocks, b) {
+			b.lock.Lock()
+			b.released = true
+			b.lock.Unlock()
+		}
+	}
+}
+
+// releaseIdlePortBlocks returns extra blocks that have had no mappings
+// for portBlockIdleTimeout. The first block is never released.
+func (t *TUN) releaseIdlePortBlocks() {
+	blocks := t.getPortBlocks()
+	if len(blocks) < 2 {
+		return
+	}
+
+	keep := []*PortBlock{blocks[0]}
+	release := []types.PortBlock{}
+	for _, b := range blocks[1:] {
+		// The lock is held from the check until the block is marked
+		// as released so no mapping can be added in between.
+		b.lock.Lock()
+		if !b.isEmpty() {
+			b.emptySince = time.Time{}
+			b.lock.Unlock()
+			keep = append(keep, b)
+			continue
+		}
+		if b.emptySince.IsZero() {
+			b.emptySince = time.Now()
+		}
+		if time.Since(b.emptySince) < portBlockIdleTimeout {
+			b.lock.Unlock()
+			keep = append(keep, b)
+			continue
+		}
+		b.released = true
+		b.lock.Unlock()
+		release = append(release, types.PortBlock{StartPort: b.StartPort, EndPort: b.EndPort})
+	}
+
+	if len(release) == 0 {
+		return
+	}
+
+	t.portBlocks.Store(&keep)
+	err := t.sendControlMessage(types.ControlPortRelease, &types.PortBlocksMessage{Blocks: release})
+	if err != nil {
+		ERROR("unable to release port blocks:", err)
+	}
+}
+
 func (t *TUN) cleanPortMap() {
-	for i := range t.AvailableTCPPorts {
-		t.AvailableTCPPorts[i].Range(func(key any, value *Mapping) bool {
-			m := value
-			if m != nil {
-				ut := time.UnixMicro(m.UnixTime.Load())
-				if m.rstFound.Load() || m.finCount.Load() > 1 {
-					if time.Since(ut) > time.Second*10 {
-						t.AvailableTCPPorts[i].Delete(key)
+	blocks := t.getPortBlocks()
+	for _, b := range blocks {
+		b.lock.Lock()
+		for i := range b.TCP {
+			b.TCP[i].Range(func(key any, value *Mapping) bool {
+				m := value
+				if m != nil {
+					ut := time.UnixMicro(m.UnixTime.Load())
+					if m.rstFound.Load() || m.finCount.Load() > 1 {
+						if time.Since(ut) > time.Second*10 {
+							b.removeMapping(6, i, key)
+						}
+					} else if time.Since(ut) > time.Second*360 {
+						b.removeMapping(6, i, key)
 					}
-				} else if time.Since(ut) > time.Second*360 {
-					t.AvailableTCPPorts[i].Delete(key)
 				}
-			}
-			return true
-		})
+				return true
+			})
+		}
+		b.lock.Unlock()
 	}
 
 	config := CONFIG.Load()
@@ -133,8 +373,8 @@ func (t *TUN) cleanPortMap() {
 		dnsServer = append(dnsServer, [4]byte{dnsIP2[0], dnsIP2[1], dnsIP2[2], dnsIP2[3]})
 	}
 
-	if t.ServerResponse != nil {
-		for _, v := range t.ServerResponse.DNSServers {
+	if t.ServerResponse() != nil {
+		for _, v := range t.ServerResponse().DNSServers {
 			dns := net.ParseIP(v).To4()
 			if len(dns) == 4 {
 				dnsServer = append(dnsServer, [4]byte{dns[0], dns[1], dns[2], dns[3]})
@@ -149,24 +389,30 @@ func (t *TUN) cleanPortMap() {
 			dnsServer = append(dnsServer, [4]byte{dns[0], dns[1], dns[2], dns[3]})
 		}
 	}
-	for i := range t.AvailableUDPPorts {
-		t.AvailableUDPPorts[i].Range(func(key any, value *Mapping) bool {
-			m := value
-			if m != nil {
-				ut := time.UnixMicro(m.UnixTime.Load())
-				if slices.Contains(dnsServer, m.DestinationIP) {
-					if time.Since(ut) > time.Second*15 {
-						t.AvailableUDPPorts[i].Delete(key)
-					}
-				} else {
-					if time.Since(ut) > time.Second*150 {
-						t.AvailableUDPPorts[i].Delete(key)
+	for _, b := range blocks {
+		b.lock.Lock()
+		for i := range b.UDP {
+			b.UDP[i].Range(func(key any, value *Mapping) bool {
+				m := value
+				if m != nil {
+					ut := time.UnixMicro(m.UnixTime.Load())
+					if slices.Contains(dnsServer, m.DestinationIP) {
+						if time.Since(ut) > time.Second*15 {
+							b.removeMapping(17, i, key)
+						}
+					} else {
+						if time.Since(ut) > time.Second*150 {
+							b.removeMapping(17, i, key)
+						}
 					}
 				}
-			}
-			return true
-		})
+				return true
+			})
+		}
+		b.lock.Unlock()
 	}
+
+	t.releaseIdlePortBlocks()
 }
 
 func CleanPortsForAllConnections() {
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Automatic connections measure every server in CLIConfig.ServerIDs by
+// timing a TLS handshake with the server API. The handshake time is
+// weighted by the load the controller reports, servers the controller
+// reports as unavailable are skipped. A server that stops responding
+// is moved to the end of the list for serverFailureCooldown, so the
+// next reconnect fails over to the next-best server.
+
+type ServerPolicy string
+
+const (
+	// PolicyLatency picks the server with the lowest weighted latency
+	PolicyLatency ServerPolicy = "latency"
+	// PolicyCountry only uses servers in CLIConfig.ServerCountry
+	PolicyCountry ServerPolicy = "country"
+	// PolicySticky keeps the current server while it is available
+	PolicySticky ServerPolicy = "sticky"
+)
+
+const (
+	serverProbeTimeout    = 3 * time.Second
+	serverFailureCooldown = 5 * time.Minute
+)
+
+var failedServers sync.Map
+
+// migrateTargets holds the server a draining server asked a tunnel
+// to move to, by tunnel tag, until the next CLI connect.
+var migrateTargets sync.Map
+
+type serverCandidate struct {
+	Server *types.Server
+	RTT    time.Duration
+	Err    error
+	Failed bool
+}
+
+// load is the highest CPU, RAM or bandwidth usage reported for the server
+func (c *serverCandidate) load() (load int) {
+	S := c.Server.Status
+	if S == nil {
+		return 0
+	}
+	load = max(S.CPU, S.RAM)
+	if S.BandwidthMbps > 0 {
+		mbps := (S.RXBytesPerSecond + S.TXBytesPerSecond) * 8 / 1_000_000
+		load = max(load, int(mbps*100/uint64(S.BandwidthMbps)))
+	}
+	return load
+}
+
+func (c *serverCandidate) score() time.Duration {
+	return c.RTT * time.Duration(100+c.load()) / 100
+}
+
+func markServerFailed(serverID string) {
+	if serverID != "" {
+		failedServers.Store(serverID, time.Now())
+	}
+}
+
+func serverFailedRecently(serverID string) bool {
+	v, ok := failedServers.Load(serverID)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) > serverFailureCooldown {
+		failedServers.Delete(serverID)
+		return false
+	}
+	return true
+}
+
+// serverFailed is called when the connection to the server breaks, the
+// tunnel is reconnected by PingConnections.
+func (t *TUN) serverFailed() {
+	if t.CR != nil {
+		markServerFailed(t.CR.ServerID)
+	}
+	t.needsReconnect.Store(true)
+}
+
+func probeServer(CS *ControlServer, S *types.Server) (rtt time.Duration, err error) {
+	tc, err := serverTLSConfig(CS, S.PubKey)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	conn, err := tls.DialWithDialer(
+		&net.Dialer{Timeout: serverProbeTimeout},
+		"tcp",
+		net.JoinHostPort(S.IP, S.Port),
+		tc,
+	)
+	if err != nil {
+		return 0, err
+	}
+	rtt = time.Since(start)
+	_ = conn.Close()
+	return rtt, nil
+}
+
+// measureServers fetches and probes every server at the same time
+func measureServers(CS *ControlServer, deviceKey string, serverIDs []string) (candidates []*serverCandidate) {
+	candidates = make([]*serverCandidate, len(serverIDs))
+	wg := sync.WaitGroup{}
+	for i, id := range serverIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer RecoverAndLog()
+			c := &serverCandidate{Failed: serverFailedRecently(id)}
+			candidates[i] = c
+			c.Server, c.Err = getServerByID(CS, deviceKey, "", "", id)
+			if c.Err != nil {
+				return
+			}
+			c.RTT, c.Err = probeServer(CS, c.Server)
+		}()
+	}
+	wg.Wait()
+	return candidates
+}
+
+// rankServers returns the servers to try in order, servers that could
+// not be reached or are draining or overloaded are left out. Servers the
+// controller reports as offline are kept since the probe reached them.
+func rankServers(candidates []*serverCandidate, policy ServerPolicy, country string, current string) (ranked []*serverCandidate) {
+	for _, c := range candidates {
+		if c == nil || c.Err != nil || c.Server == nil {
+			continue
+		}
+		if s := c.Server.Status; s != nil && s.Online && s.Unavailable() != "" {
+			continue
+		}
+		if policy == PolicyCountry && !strings.EqualFold(c.Server.Country, country) {
+			continue
+		}
+		ranked = append(ranked, c)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Failed != b.Failed {
+			return !a.Failed
+		}
+		if policy == PolicySticky && current != "" {
+			aCurrent := a.Server.ID.Hex() == current
+			bCurrent := b.Server.ID.Hex() == current
+			if aCurrent != bCurrent {
+				return aCurrent
+			}
+		}
+		return a.score() < b.score()
+	})
+	return ranked
+}
+
+// currentServerID returns the server the tunnel with the tag is using
+func currentServerID(tag string) (serverID string) {
+	tunnelMapRange(func(tun *TUN) bool {
+		meta := tun.meta.Load()
+		if meta != nil && meta.Tag == tag && tun.CR != nil {
+			serverID = tun.CR.ServerID
+			return false
+		}
+		return true
+	})
+	return serverID
+}
+
+// connectToBestServer tries the ranked servers until one connects
+func connectToBestServer(CS *ControlServer, conf *CLIConfig, tag string) (err error) {
+	if IsConnecting.Load() {
+		return errors.New("already connecting to another connection")
+	}
+	current := currentServerID(tag)
+	if current == "" {
+		current = conf.ServerID
+	}
+
+	candidates := measureServers(CS, conf.DeviceID, conf.ServerIDs)
+	ranked := rankServers(candidates, conf.ServerPolicy, conf.ServerCountry, current)
+	if len(ranked) == 0 {
+		return errors.New("no server is available")
+	}
+
+	for _, c := range ranked {
+		S := c.Server
+		DEBUG("Connecting to server:", S.ID.Hex(), S.Country, "rtt:", c.RTT, "load:", c.load())
+		code, cerr := PublicConnect(&ConnectionRequest{
+			Server:        CS,
+			Tag:           tag,
+			ServerID:      S.ID.Hex(),
+			DeviceKey:     conf.DeviceID,
+			ServerIP:      S.IP,
+			ServerPort:    S.Port,
+			ServerPubKey:  S.PubKey,
+			ServerPubKeys: S.PubKeys,
+		})
+		if cerr == nil {
+			INFO("Connected to server:", S.ID.Hex(), S.Country)
+			return nil
+		}
+		ERROR("Unable to connect to server:", S.ID.Hex(), "code:", code, "err:", cerr)
+		markServerFailed(S.ID.Hex())
+		err = cerr
+	}
+	return err
+}
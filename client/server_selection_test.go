@@ -0,0 +1,176 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRankServers(t *testing.T) {
+	candidate := func(country string, rtt time.Duration, status *types.ServerStatus) *serverCandidate {
+		return &serverCandidate{
+			Server: &types.Server{ID: primitive.NewObjectID(), Country: country, Status: status},
+			RTT:    rtt,
+		}
+	}
+	online := func(cpu int) *types.ServerStatus {
+		return &types.ServerStatus{Online: true, CPU: cpu}
+	}
+
+	fast := candidate("de", 10*time.Millisecond, online(10))
+	slow := candidate("us", 40*time.Millisecond, online(10))
+	busy := candidate("de", 8*time.Millisecond, online(85))
+	offline := candidate("de", 1*time.Millisecond, &types.ServerStatus{})
+	draining := candidate("de", 1*time.Millisecond, &types.ServerStatus{Online: true, Draining: true})
+	unreachable := &serverCandidate{Server: &types.Server{ID: primitive.NewObjectID()}, Err: net.ErrClosed}
+	failed := candidate("de", 1*time.Millisecond, online(0))
+	failed.Failed = true
+	unknown := candidate("us", 12*time.Millisecond, nil)
+
+	tests := []struct {
+		name       string
+		candidates []*serverCandidate
+		policy     ServerPolicy
+		country    string
+		current    string
+		expected   []*serverCandidate
+	}{
+		{
+			name:       "lowest latency weighted by load",
+			candidates: []*serverCandidate{slow, busy, fast},
+			policy:     PolicyLatency,
+			expected:   []*serverCandidate{fast, busy, slow},
+		},
+		{
+			name:       "unavailable servers are skipped",
+			candidates: []*serverCandidate{draining, unreachable, slow},
+			expected:   []*serverCandidate{slow},
+		},
+		{
+			name:       "servers reported offline that answered the probe",
+			candidates: []*serverCandidate{slow, offline},
+			expected:   []*serverCandidate{offline, slow},
+		},
+		{
+			name:       "failed servers are tried last",
+			candidates: []*serverCandidate{failed, slow, fast},
+			expected:   []*serverCandidate{fast, slow, failed},
+		},
+		{
+			name:       "servers without status",
+			candidates: []*serverCandidate{slow, unknown},
+			expected:   []*serverCandidate{unknown, slow},
+		},
+		{
+			name:       "pinned country",
+			candidates: []*serverCandidate{slow, busy, fast},
+			policy:     PolicyCountry,
+			country:    "US",
+			expected:   []*serverCandidate{slow},
+		},
+		{
+			name:       "sticky",
+			candidates: []*serverCandidate{fast, busy, slow},
+			policy:     PolicySticky,
+			current:    slow.Server.ID.Hex(),
+			expected:   []*serverCandidate{slow, fast, busy},
+		},
+		{
+			name:       "sticky server failed",
+			candidates: []*serverCandidate{fast, failed},
+			policy:     PolicySticky,
+			current:    failed.Server.ID.Hex(),
+			expected:   []*serverCandidate{fast, failed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranked := rankServers(tt.candidates, tt.policy, tt.country, tt.current)
+			if len(ranked) != len(tt.expected) {
+				t.Fatalf("expected %d servers, got %d", len(tt.expected), len(ranked))
+			}
+			for i := range ranked {
+				if ranked[i] != tt.expected[i] {
+					t.Errorf("position %d: expected %s, got %s", i, tt.expected[i].Server.ID.Hex(), ranked[i].Server.ID.Hex())
+				}
+			}
+		})
+	}
+}
+
+func TestServerFailure(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	if serverFailedRecently(id) {
+		t.Fatal("server should not be marked as failed")
+	}
+
+	tun := &TUN{CR: &ConnectionRequest{ServerID: id}}
+	tun.serverFailed()
+	if !serverFailedRecently(id) || !tun.needsReconnect.Load() {
+		t.Error("a broken connection should mark the server as failed")
+	}
+
+	failedServers.Store(id, time.Now().Add(-serverFailureCooldown-time.Second))
+	if serverFailedRecently(id) {
+		t.Error("the failure should expire after the cooldown")
+	}
+}
+
+func TestProbeServer(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	server := &types.Server{IP: host, Port: port, PubKey: cert}
+
+	rtt, err := probeServer(&ControlServer{ValidateCertificate: true}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Errorf("expected a round trip time, got %s", rtt)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP(host)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if _, err = probeServer(&ControlServer{ValidateCertificate: true}, &types.Server{IP: host, Port: port, PubKey: wrongCert}); err == nil {
+		t.Error("expected an error for a certificate that does not match")
+	}
+	if _, err = probeServer(&ControlServer{}, &types.Server{IP: host, Port: port, PubKey: wrongCert}); err != nil {
+		t.Errorf("the certificate should not be checked without ValidateCertificate: %s", err)
+	}
+
+	srv.Close()
+	if _, err = probeServer(&ControlServer{}, server); err == nil {
+		t.Error("expected an error for a closed server")
+	}
+}
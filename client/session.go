@@ -1,7 +1,6 @@
 package client
 
 import (
-	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -16,7 +15,6 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/miekg/dns"
 	"github.com/tunnels-is/tunnels/crypt"
 	"github.com/tunnels-is/tunnels/types"
 	"github.com/tunnels-is/tunnels/version"
@@ -120,10 +118,17 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 			ERROR("Error finding server", err)
 			return 400, err
 		}
+		if ClientCR.SkipUnavailable && server.Status != nil {
+			if reason := server.Status.Unavailable(); reason != "" {
+				INFO("Server is unavailable:", ClientCR.ServerID, reason)
+				return 503, errors.New("server is " + reason)
+			}
+		}
 
 		ClientCR.ServerPort = server.Port
 		ClientCR.ServerIP = server.IP
 		ClientCR.ServerPubKey = server.PubKey
+		ClientCR.ServerPubKeys = server.PubKeys
 	}
 
 	if ClientCR.ServerIP == "" {
@@ -201,6 +206,7 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 	FinalCR.DeviceToken = ClientCR.DeviceToken
 	FinalCR.EncType = meta.EncryptionType
 	FinalCR.RequestingPorts = meta.RequestVPNPorts
+	FinalCR.SiteNetworks = meta.SiteNetworks
 	DEBUG("ConnectRequestFromClient", ClientCR)
 
 	url := ClientCR.Server.GetURL("/v3/session")
@@ -243,12 +249,7 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 	SignedResponse.X25519PeerPub = tunnel.encWrapper.SEAL.X25519Pub.Bytes()
 	SignedResponse.Mlkem1024Encap = tunnel.encWrapper.SEAL.Mlkem1024Encap.Bytes()
 
-	tc := &tls.Config{
-		MinVersion:         tls.VersionTLS13,
-		CurvePreferences:   []tls.CurveID{tls.X25519MLKEM768},
-		InsecureSkipVerify: !ClientCR.Server.ValidateCertificate,
-	}
-	tc.RootCAs, errm = tunnel.LoadCertPEMBytes([]byte(ClientCR.ServerPubKey))
+	tc, errm := serverTLSConfig(ClientCR.Server, ClientCR.ServerPubKey)
 	if errm != nil {
 		ERROR("Unable to load cert pem from controller: ", errm)
 		return 502, errors.New("Unable to load cert pem from controller")
@@ -281,13 +282,9 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 		return 500, errors.New("Unable to decode response from server")
 	}
 
-	pubKey, _, err := crypt.LoadPublicKeyBytes([]byte(ClientCR.ServerPubKey))
-	if err != nil {
-		return 500, errors.New("Unable to load server public key")
-	}
-
-	err = crypt.VerifySignature(ServerReponse.X25519Pub, ServerReponse.ServerHandshakeSignature, pubKey)
+	err = verifyServerHandshake(ClientCR, ServerReponse)
 	if err != nil {
+		ERROR("Unable to verify server signature: ", err)
 		return 500, errors.New("Unable to verify server signature")
 	}
 
@@ -305,7 +302,7 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 	tunnel.encWrapper.SEAL.CleanPostSecretGeneration()
 
 	DEBUG("ConnectionRequestResponse:", ServerReponse)
-	tunnel.ServerResponse = ServerReponse
+	tunnel.serverResponse.Store(ServerReponse)
 
 	err = InitializeTunnelFromCRR(tunnel)
 	if err != nil {
@@ -357,6 +354,7 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 	tunnel.registerPing(time.Now())
 	tunnel.ID = uuid.NewString()
 	TunnelMap.Store(tunnel.ID, tunnel)
+	applyBlockLists(false)
 
 	_, err = tunnel.connection.Write(
 		tunnel.encWrapper.SEAL.Seal1(PingPongStatsBuffer, tunnel.Index),
@@ -368,7 +366,12 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 	go tunnel.ReadFromServeTunnel()
 	go tunnel.ReadFromTunnelInterface()
 
-	if tunnel.ServerResponse.DHCP != nil {
+	err = tunnel.InitP2P()
+	if err != nil {
+		ERROR("unable to initialize p2p, LAN traffic will be relayed: ", err)
+	}
+
+	if tunnel.ServerResponse().DHCP != nil {
 		FR := &FirewallRequest{
 			DHCPToken:       tunnel.dhcp.Token,
 			IP:              net.IP(tunnel.dhcp.IP[:]).String(),
@@ -399,6 +402,42 @@ func PublicConnect(ClientCR *ConnectionRequest) (code int, errm error) {
 	return 200, nil
 }
 
+// verifyServerHandshake checks the handshake signature against the
+// published server keys that are valid right now, falling back to
+// PubKey for servers that do not publish any keys.
+func verifyServerHandshake(CR *ConnectionRequest, resp *types.ServerConnectResponse) (err error) {
+	keys := make([]*types.PublicKey, 0, len(CR.ServerPubKeys)+1)
+	now := time.Now()
+	for _, v := range CR.ServerPubKeys {
+		if v.ValidAt(now) {
+			keys = append(keys, v)
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, &types.PublicKey{PEM: CR.ServerPubKey})
+	}
+
+	err = errors.New("no server key matches " + resp.ServerHandshakeKeyID)
+	for _, v := range keys {
+		pubKey, _, lerr := crypt.LoadPublicKeyBytes([]byte(v.PEM))
+		if lerr != nil {
+			err = lerr
+			continue
+		}
+		if resp.ServerHandshakeKeyID != "" {
+			id, lerr := crypt.KeyID(pubKey)
+			if lerr != nil || id != resp.ServerHandshakeKeyID {
+				continue
+			}
+		}
+		err = crypt.VerifySignature(resp.X25519Pub, resp.ServerHandshakeSignature, pubKey)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
 // getServerByID retrieves server information from the controller
 func getServerByID(server *ControlServer, deviceKey string, deviceToken string, UserID string, ServerID string) (s *types.Server, err error) {
 	SID, _ := primitive.ObjectIDFromHex(ServerID)
@@ -490,7 +529,7 @@ func InitializeTunnelFromCRR(TUN *TUN) (err error) {
 
 	// This index is used to identify packet streams between server and user.
 	TUN.Index = make([]byte, 2)
-	binary.BigEndian.PutUint16(TUN.Index, uint16(TUN.ServerResponse.Index))
+	binary.BigEndian.PutUint16(TUN.Index, uint16(TUN.ServerResponse().Index))
 
 	TUN.localInterfaceNetIP = net.ParseIP(meta.IPv4Address).To4()
 	if TUN.localInterfaceNetIP == nil {
@@ -501,20 +540,9 @@ func InitializeTunnelFromCRR(TUN *TUN) (err error) {
 	TUN.localInterfaceIP4bytes[2] = TUN.localInterfaceNetIP[2]
 	TUN.localInterfaceIP4bytes[3] = TUN.localInterfaceNetIP[3]
 
-	if DNSClient.Dialer != nil {
-		TUN.localDNSClient = new(dns.Client)
-		TUN.localDNSClient.Dialer = new(net.Dialer)
-		TUN.localDNSClient.Dialer.LocalAddr = &net.UDPAddr{
-			IP: TUN.localInterfaceNetIP.To4(),
-		}
-		TUN.localDNSClient.Dialer.Resolver = DNSClient.Dialer.Resolver
-		TUN.localDNSClient.Dialer.Timeout = time.Duration(5 * time.Second)
-		TUN.localDNSClient.Timeout = time.Second * 5
-	}
-
-	TUN.serverInterfaceNetIP = net.ParseIP(TUN.ServerResponse.InterfaceIP).To4()
+	TUN.serverInterfaceNetIP = net.ParseIP(TUN.ServerResponse().InterfaceIP).To4()
 	if TUN.serverInterfaceNetIP == nil {
-		return fmt.Errorf("Interface ip (%s) was malformed", TUN.ServerResponse.InterfaceIP)
+		return fmt.Errorf("Interface ip (%s) was malformed", TUN.ServerResponse().InterfaceIP)
 	}
 
 	TUN.serverInterfaceIP4bytes[0] = TUN.serverInterfaceNetIP[0]
@@ -522,45 +550,60 @@ func InitializeTunnelFromCRR(TUN *TUN) (err error) {
 	TUN.serverInterfaceIP4bytes[2] = TUN.serverInterfaceNetIP[2]
 	TUN.serverInterfaceIP4bytes[3] = TUN.serverInterfaceNetIP[3]
 
-	if TUN.ServerResponse.DHCP != nil {
-		TUN.serverVPLIP[0] = TUN.ServerResponse.DHCP.IP[0]
-		TUN.serverVPLIP[1] = TUN.ServerResponse.DHCP.IP[1]
-		TUN.serverVPLIP[2] = TUN.ServerResponse.DHCP.IP[2]
-		TUN.serverVPLIP[3] = TUN.ServerResponse.DHCP.IP[3]
-		TUN.dhcp = TUN.ServerResponse.DHCP
+	if TUN.ServerResponse().DHCP != nil {
+		TUN.serverVPLIP[0] = TUN.ServerResponse().DHCP.IP[0]
+		TUN.serverVPLIP[1] = TUN.ServerResponse().DHCP.IP[1]
+		TUN.serverVPLIP[2] = TUN.ServerResponse().DHCP.IP[2]
+		TUN.serverVPLIP[3] = TUN.ServerResponse().DHCP.IP[3]
+		TUN.dhcp = TUN.ServerResponse().DHCP
 	}
 
-	if TUN.ServerResponse.LAN != nil {
-		TUN.VPLNetwork = TUN.ServerResponse.LAN
+	if TUN.ServerResponse().LAN != nil {
+		TUN.VPLNetwork = TUN.ServerResponse().LAN
 	}
 
 	if meta.LocalhostNat {
 		NN := new(types.Network)
 		NN.Network = "127.0.0.1/32"
 		NN.Nat = TUN.serverInterfaceNetIP.String() + "/32"
-		TUN.ServerResponse.Networks = append(TUN.ServerResponse.Networks, NN)
+		TUN.ServerResponse().Networks = append(TUN.ServerResponse().Networks, NN)
 	}
 
 	if len(meta.Networks) > 0 {
-		TUN.ServerResponse.Networks = meta.Networks
+		TUN.ServerResponse().Networks = meta.Networks
 	}
 	if len(meta.Routes) > 0 {
-		TUN.ServerResponse.Routes = meta.Routes
+		TUN.ServerResponse().Routes = meta.Routes
 	}
 	if len(meta.DNSRecords) > 0 {
-		TUN.ServerResponse.DNSRecords = meta.DNSRecords
+		TUN.ServerResponse().DNSRecords = meta.DNSRecords
 	}
 	if len(meta.DNSServers) > 0 {
-		TUN.ServerResponse.DNSServers = meta.DNSServers
+		TUN.ServerResponse().DNSServers = meta.DNSServers
+	}
+	if len(meta.DNSRoutes) > 0 {
+		TUN.ServerResponse().DNSRoutes = meta.DNSRoutes
+	}
+
+	for _, v := range TUN.ServerResponse().SiteNetworks {
+		TUN.ServerResponse().Routes = append(TUN.ServerResponse().Routes, &types.Route{
+			Address: v.Network,
+			Metric:  "0",
+		})
 	}
 
 	conf := CONFIG.Load()
-	if len(TUN.ServerResponse.DNSServers) < 1 {
-		TUN.ServerResponse.DNSServers = []string{conf.DNS1Default, conf.DNS2Default}
+	if len(TUN.ServerResponse().DNSServers) < 1 {
+		TUN.ServerResponse().DNSServers = []string{conf.DNS1Default, conf.DNS2Default}
+	}
+
+	err = TUN.resetDNSUpstreams()
+	if err != nil {
+		return err
 	}
 
-	TUN.startPort = TUN.ServerResponse.StartPort
-	TUN.endPort = TUN.ServerResponse.EndPort
+	TUN.startPort = TUN.ServerResponse().StartPort
+	TUN.endPort = TUN.ServerResponse().EndPort
 	TUN.InitPortMap()
 
 	err = TUN.InitVPLMap()
@@ -571,20 +614,28 @@ func InitializeTunnelFromCRR(TUN *TUN) (err error) {
 	if err != nil {
 		return err
 	}
+	err = TUN.InitSiteMaps()
+	if err != nil {
+		return err
+	}
+	err = TUN.InitMulticast()
+	if err != nil {
+		return err
+	}
 
 	DEBUG(fmt.Sprintf(
 		"Connection info: Addr(%s) StartPort(%d) EndPort(%d) srcIP(%s) ",
 		meta.IPv4Address,
-		TUN.ServerResponse.StartPort,
-		TUN.ServerResponse.EndPort,
-		TUN.ServerResponse.InterfaceIP,
+		TUN.ServerResponse().StartPort,
+		TUN.ServerResponse().EndPort,
+		TUN.ServerResponse().InterfaceIP,
 	))
 
-	if TUN.ServerResponse.LAN != nil && TUN.ServerResponse.DHCP != nil {
+	if TUN.ServerResponse().LAN != nil && TUN.ServerResponse().DHCP != nil {
 		DEBUG(fmt.Sprintf(
 			"DHCP/VPL info: Addr(%s) Network:(%s)",
-			TUN.ServerResponse.DHCP.IP,
-			TUN.ServerResponse.LAN.Network,
+			TUN.ServerResponse().DHCP.IP,
+			TUN.ServerResponse().LAN.Network,
 		))
 	}
 
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/certs"
+	"github.com/tunnels-is/tunnels/crypt"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func TestVerifyServerHandshake(t *testing.T) {
+	makeKey := func() (*certs.Certs, string) {
+		CR, err := certs.MakeCertV2(certs.ECDSA, "", "", []string{}, []string{}, "", time.Time{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := crypt.KeyID(CR.Pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CR, id
+	}
+	oldKey, oldID := makeKey()
+	newKey, newID := makeKey()
+
+	handshake := []byte("x25519 public key")
+	sign := func(CR *certs.Certs, id string) *types.ServerConnectResponse {
+		sig, err := crypt.SignData(handshake, CR.Priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &types.ServerConnectResponse{
+			X25519Pub:                handshake,
+			ServerHandshakeSignature: sig,
+			ServerHandshakeKeyID:     id,
+		}
+	}
+
+	published := []*types.PublicKey{
+		{ID: oldID, PEM: string(oldKey.CertPem), NotAfter: time.Now().Add(time.Hour)},
+		{ID: newID, PEM: string(newKey.CertPem)},
+	}
+	expired := []*types.PublicKey{
+		{ID: oldID, PEM: string(oldKey.CertPem), NotAfter: time.Now().Add(-time.Hour)},
+		{ID: newID, PEM: string(newKey.CertPem)},
+	}
+
+	tests := []struct {
+		name      string
+		CR        *ConnectionRequest
+		resp      *types.ServerConnectResponse
+		expectErr bool
+	}{
+		{
+			name: "pinned key only",
+			CR:   &ConnectionRequest{ServerPubKey: string(oldKey.CertPem)},
+			resp: sign(oldKey, ""),
+		},
+		{
+			name:      "pinned key does not match",
+			CR:        &ConnectionRequest{ServerPubKey: string(oldKey.CertPem)},
+			resp:      sign(newKey, newID),
+			expectErr: true,
+		},
+		{
+			name: "old key during overlap",
+			CR:   &ConnectionRequest{ServerPubKey: string(oldKey.CertPem), ServerPubKeys: published},
+			resp: sign(oldKey, oldID),
+		},
+		{
+			name: "new key",
+			CR:   &ConnectionRequest{ServerPubKey: string(oldKey.CertPem), ServerPubKeys: published},
+			resp: sign(newKey, newID),
+		},
+		{
+			name: "new key without key ID",
+			CR:   &ConnectionRequest{ServerPubKey: string(oldKey.CertPem), ServerPubKeys: published},
+			resp: sign(newKey, ""),
+		},
+		{
+			name:      "key ID of another key",
+			CR:        &ConnectionRequest{ServerPubKey: string(oldKey.CertPem), ServerPubKeys: published},
+			resp:      sign(newKey, oldID),
+			expectErr: true,
+		},
+		{
+			name:      "expired key",
+			CR:        &ConnectionRequest{ServerPubKey: string(oldKey.CertPem), ServerPubKeys: expired},
+			resp:      sign(oldKey, oldID),
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyServerHandshake(tt.CR, tt.resp)
+			if tt.expectErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
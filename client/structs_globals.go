@@ -71,10 +71,15 @@ var (
 
 	// DNS
 	DNSGlobalBlock atomic.Bool
-	DNSBlockList   atomic.Pointer[*xsync.MapOf[string, bool]]
-	DNSWhiteList   atomic.Pointer[*xsync.MapOf[string, bool]]
-	DNSCache       *xsync.MapOf[string, any]
+	DNSBlockList   atomic.Pointer[domainMatcher]
+	DNSWhiteList   atomic.Pointer[domainMatcher]
+	DNSCache       *dnsCache
+	DNSQueryLog    *dnsQueryLog
 	DNSStatsMap    *xsync.MapOf[string, any]
+
+	DNSProfileStatsMap  *xsync.MapOf[string, *DNSProfileStats]
+	dnsProfileUpstreams *xsync.MapOf[string, *dnsUpstreamSet]
+	DNSBlockPauses      *xsync.MapOf[string, time.Time]
 )
 
 type DNSStats struct {
@@ -89,8 +94,9 @@ type DNSStats struct {
 }
 
 type ConnectionRequest struct {
-	Server       *ControlServer
-	ServerPubKey string
+	Server        *ControlServer
+	ServerPubKey  string
+	ServerPubKeys []*types.PublicKey
 
 	DeviceKey string `json:"DeviceKey"`
 
@@ -100,6 +106,10 @@ type ConnectionRequest struct {
 	Tag      string `json:"Tag"`
 	ServerID string `json:"ServerID"`
 
+	// Automatic connections do not connect to servers the controller
+	// reports as offline, draining or overloaded.
+	SkipUnavailable bool
+
 	// Set using API call in PublicConnect
 	ServerIP   string `json:"ServerIP"`
 	ServerPort string `json:"ServerPort"`
@@ -148,14 +158,9 @@ var (
 	TraceFile   *os.File
 	// UDPDNSServer *dns.Server
 	UDPDNSServer atomic.Pointer[dns.Server]
+	TCPDNSServer atomic.Pointer[dns.Server]
 )
 
-type DNSReply struct {
-	// M       *dns.Msg
-	A       []dns.RR
-	Expires time.Time
-}
-
 var letterRunes = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567")
 
 // var LastRouterPing = time.Now()
@@ -327,13 +332,24 @@ type TunnelMETA struct {
 	AllowedHosts    []string
 	DisableFirewall bool
 
+	// Send LAN traffic directly to other clients when possible,
+	// traffic is relayed through the server if no direct path exists.
+	PeerToPeer bool
+
 	// This overwrites or adds to settings
 	// that are applied to the Node
 	EnableDefaultRoute bool
 	DNSServers         []string
+	DNSUpstreams       []string
+	DNSRoutes          []*types.DNSRoute
 	DNSRecords         []*types.DNSRecord
 	Networks           []*types.Network
 	Routes             []*types.Route
+
+	// Site-to-site: networks behind this device that are advertised
+	// to the server. Set Nat to advertise an overlapping network
+	// using a different range.
+	SiteNetworks []*types.Network
 }
 
 type AllowedHost struct {
@@ -500,7 +516,13 @@ type BlockList struct {
 	URL          string
 	Enabled      bool
 	Count        int
+	Rejected     int
 	LastDownload time.Time
+
+	// The list only blocks inside one of the schedules, or always when
+	// there are none, and only while the tunnel with this tag is connected
+	Schedules []*BlockListSchedule
+	Tunnel    string
 }
 
 type CLIInfo struct {
@@ -548,6 +570,13 @@ type CLIConfig struct {
 	SendStats        bool
 	PinVersion       bool
 	SkipUpdatePrompt bool
+
+	// ServerIDs are candidates for automatic server selection, usually
+	// the servers of one group. ServerID is the only server used when
+	// ServerIDs is empty, see server_selection.go.
+	ServerIDs     []string
+	ServerPolicy  ServerPolicy
+	ServerCountry string
 }
 
 type configV2 struct {
@@ -590,12 +619,31 @@ type configV2 struct {
 	DNS1Default   string
 	DNS2Default   string
 	DNSOverHTTPS  bool
+	DNSUpstreams  []string
+	DNSBootstrap  []string
 	DNSstats      bool
 	DNSServerIP   string
 	DNSServerPort string
 	DNSBlockLists []*BlockList
 	DNSWhiteLists []*BlockList
 	DNSRecords    []*types.DNSRecord
+	DNSProfiles   []*DNSProfile
+
+	// DNS cache, zero uses the defaults in dns_cache.go
+	DNSCacheSize       int
+	DNSCacheMinTTL     int
+	DNSCacheMaxTTL     int
+	DisableDNSPrefetch bool
+
+	// DNSSEC validation, the trust anchors are DS records in zone
+	// file format and the root zone KSKs are used when it is empty
+	DNSSEC             bool
+	DNSSECTrustAnchors []string
+
+	// DNS query log, DNSQueryLogRetention is in days
+	DNSQueryLogSize      int
+	DNSQueryLogDisk      bool
+	DNSQueryLogRetention int
 }
 
 type stateV2 struct {
@@ -665,12 +713,13 @@ type TUN struct {
 
 	// Connection Requests + Response
 	CR             *ConnectionRequest
-	ServerResponse *types.ServerConnectResponse
+	serverResponse atomic.Pointer[types.ServerConnectResponse] `json:"-"`
 
 	pingTime                atomic.Pointer[time.Time]
 	needsReconnect          atomic.Bool
+	sessionRemoved          atomic.Bool
 	localInterfaceNetIP     net.IP
-	localDNSClient          *dns.Client
+	dnsUpstreams            atomic.Pointer[dnsUpstreamSet]
 	localInterfaceIP4bytes  [4]byte
 	serverInterfaceNetIP    net.IP
 	serverInterfaceIP4bytes [4]byte
@@ -688,12 +737,23 @@ type TUN struct {
 	VPLEgress   map[[4]byte]struct{} `json:"-"`
 	VPLIngress  map[[4]byte]struct{} `json:"-"`
 
+	// Site-to-site
+	// remoteSites are the networks advertised by other clients
+	// localSites are the networks advertised by this client
+	remoteSites atomic.Pointer[[]*net.IPNet]
+	localSites  []*types.Network
+
+	// Peer to peer
+	p2pConn  *net.UDPConn
+	p2pPeers *xsync.MapOf[[4]byte, *peerSession]
+
 	// TCP and UDP Natting
 	// ingress
-	// index == local port number
+	// port blocks assigned by the server, inside each
+	// block index == local port number - block start port
 	// lport/dip/dp
-	AvailableTCPPorts []*xsync.MapOf[any, *Mapping]
-	AvailableUDPPorts []*xsync.MapOf[any, *Mapping]
+	portBlocks      atomic.Pointer[[]*PortBlock]
+	lastPortRequest atomic.Int64
 
 	// egress
 	// sip/dip/sp/dp
@@ -718,6 +778,7 @@ type TUN struct {
 
 	// EGRESS PACKET STUFF
 	EP_Protocol         byte
+	EP_SrcIP            [4]byte
 	EP_DstIP            [4]byte
 	EP_IPv4HeaderLength byte
 	EP_IPv4Header       []byte
@@ -726,10 +787,12 @@ type TUN struct {
 	EP_DstPort          [2]byte
 	EP_NAT_IP           [4]byte
 	EP_NAT_OK           bool
+	EP_NAT_OK_SRC       bool
 
 	// INGRESS PACKET STUFF
 	IP_Protocol         byte
 	IP_SrcIP            [4]byte
+	IP_DstIP            [4]byte
 	IP_IPv4HeaderLength byte
 	IP_IPv4Header       []byte
 	IP_TPHeader         []byte
@@ -767,8 +830,18 @@ func init() {
 	TunnelMetaMap = xsync.NewMapOf[string, *TunnelMETA]()
 	TunnelMap = xsync.NewMapOf[string, *TUN]()
 	logRecordHash = xsync.NewMapOf[string, bool]()
-	DNSCache = xsync.NewMapOf[string, any]()
+	DNSCache = newDNSCache()
+	DNSQueryLog = newDNSQueryLog()
 	DNSStatsMap = xsync.NewMapOf[string, any]()
+	DNSProfileStatsMap = xsync.NewMapOf[string, *DNSProfileStats]()
+	dnsProfileUpstreams = xsync.NewMapOf[string, *dnsUpstreamSet]()
+	DNSBlockPauses = xsync.NewMapOf[string, time.Time]()
+}
+
+// ServerResponse returns the current server settings of the tunnel, a
+// config update replaces the whole response instead of changing it.
+func (t *TUN) ServerResponse() *types.ServerConnectResponse {
+	return t.serverResponse.Load()
 }
 
 func (t *TUN) GetState() TunnelState {
@@ -817,7 +890,7 @@ func (t *TUN) MarshalJSON() ([]byte, error) {
 	}{
 		t.ID,
 		t.CR,
-		t.ServerResponse,
+		t.ServerResponse(),
 		pingTime,
 		int(t.startPort),
 		int(t.endPort),
@@ -832,16 +905,11 @@ func (t *TUN) MarshalJSON() ([]byte, error) {
 }
 
 func (t *TUN) InitPortMap() {
-	t.AvailableTCPPorts = make([]*xsync.MapOf[any, *Mapping], t.endPort-t.startPort)
-	t.AvailableUDPPorts = make([]*xsync.MapOf[any, *Mapping], t.endPort-t.startPort)
-
-	// Initialize each map in the slice
-	for i := range t.AvailableTCPPorts {
-		t.AvailableTCPPorts[i] = xsync.NewMapOf[any, *Mapping]()
-	}
-	for i := range t.AvailableUDPPorts {
-		t.AvailableUDPPorts[i] = xsync.NewMapOf[any, *Mapping]()
+	blocks := []*PortBlock{}
+	if t.startPort > 0 && t.endPort >= t.startPort {
+		blocks = append(blocks, NewPortBlock(t.startPort, t.endPort))
 	}
+	t.portBlocks.Store(&blocks)
 
 	t.ActiveTCPMapping = xsync.NewMapOf[any, *Mapping]()
 	t.ActiveUDPMapping = xsync.NewMapOf[any, *Mapping]()
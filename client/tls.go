@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"os"
@@ -24,12 +25,19 @@ func LoadPrivateCert(path string) (pool *x509.CertPool, err error) {
 	return certPool, nil
 }
 
-// LoadCertPEMBytes loads certificate PEM bytes into a cert pool
-func (m *TUN) LoadCertPEMBytes(cert []byte) (pool *x509.CertPool, err error) {
-	certPool := x509.NewCertPool()
-	ok := certPool.AppendCertsFromPEM(cert)
-	if !ok {
-		return certPool, fmt.Errorf("unable to append cert")
+// serverTLSConfig returns the TLS config for connections to a VPN
+// server, the certificate is checked against the PEM from the controller
+// when the control server has ValidateCertificate set. The signing keys
+// of the server are checked by verifyServerHandshake.
+func serverTLSConfig(CS *ControlServer, certPEM string) (tc *tls.Config, err error) {
+	tc = &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		CurvePreferences:   []tls.CurveID{tls.X25519MLKEM768},
+		InsecureSkipVerify: !CS.ValidateCertificate,
+		RootCAs:            x509.NewCertPool(),
 	}
-	return certPool, nil
+	if !tc.RootCAs.AppendCertsFromPEM([]byte(certPEM)) {
+		return tc, fmt.Errorf("unable to append cert")
+	}
+	return tc, nil
 }
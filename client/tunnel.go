@@ -27,6 +27,10 @@ func Disconnect(tunID string, switching bool) (err error) {
 	tunnelMapRange(func(tun *TUN) bool {
 		if tun.ID == tunID {
 			tun.SetState(TUN_Disconnecting)
+			// Lets the server remove the session without waiting for the ping timeout
+			if !tun.sessionRemoved.Load() {
+				_ = tun.sendControlMessage(types.ControlDisconnect, nil)
+			}
 			tunnel := tun.tunnel.Load()
 			if !switching {
 				_ = tunnel.Disconnect(tun)
@@ -35,6 +39,8 @@ func Disconnect(tunID string, switching bool) (err error) {
 					_ = tun.connection.Close()
 				}
 			}
+			tun.closeP2P()
+			tun.dnsUpstreams.Swap(nil).Close()
 			if tun.encWrapper != nil {
 				if tun.encWrapper.HStream != nil {
 					_ = tun.encWrapper.HStream.Close()
@@ -45,6 +51,7 @@ func Disconnect(tunID string, switching bool) (err error) {
 			}
 
 			TunnelMap.Delete(tun.ID)
+			DNSCache.RemoveTunnel(tun.ID)
 			m := tun.meta.Load()
 			tun.SetState(TUN_Disconnected)
 			if m != nil {
@@ -56,6 +63,7 @@ func Disconnect(tunID string, switching bool) (err error) {
 		}
 		return true
 	})
+	applyBlockLists(false)
 
 	return
 }
@@ -140,6 +148,7 @@ func CleanupOnClose() {
 	if TraceFile != nil {
 		_ = TraceFile.Close()
 	}
+	DNSQueryLog.Close()
 	if LogFile != nil {
 		_ = LogFile.Close()
 	}
@@ -1,8 +1,6 @@
 package client
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,8 +8,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/puzpuzpuz/xsync/v3"
 )
 
 func reloadWhiteLists(sleep bool) {
@@ -41,24 +37,29 @@ func reloadWhiteLists(sleep bool) {
 	if badList {
 		config.DNSWhiteLists = GetDefaultWhiteLists()
 	}
-	newMap := xsync.NewMapOf[string, bool]()
+	matcher := new(domainMatcher)
+	lists := &listRules{rules: make(map[string][]*domainRule)}
 
 	wg := new(sync.WaitGroup)
 	for i := range config.DNSWhiteLists {
 		wg.Add(1)
-		go processWhiteList(i, wg, newMap)
+		go processWhiteList(i, wg, matcher, lists)
 	}
 	wg.Wait()
 
 	DEBUG("finished updating whitelists")
-	DNSWhiteList.Store(&newMap)
+	DNSWhiteList.Store(matcher)
+	profiles := buildProfileMatchers(config.DNSProfiles, lists.rules, func(p *DNSProfile) []string {
+		return p.WhiteLists
+	})
+	dnsProfileWhiteLists.Store(&profiles)
 	err := writeConfigToDisk()
 	if err != nil {
 		ERROR("unable to write config to disk post whitelist update", err)
 	}
 }
 
-func processWhiteList(index int, wg *sync.WaitGroup, nm *xsync.MapOf[string, bool]) {
+func processWhiteList(index int, wg *sync.WaitGroup, matcher *domainMatcher, lists *listRules) {
 	defer func() {
 		wg.Done()
 	}()
@@ -107,25 +108,17 @@ func processWhiteList(index int, wg *sync.WaitGroup, nm *xsync.MapOf[string, boo
 		return
 	}
 
-	wl.Count = 0
-	var badLines int
-	buff := bytes.NewBuffer(listBytes)
-	scanner := bufio.NewScanner(buff)
-	for scanner.Scan() {
-		d := scanner.Text()
-		if CheckIfPlainDomain(d) {
-			if wl.Enabled {
-				nm.Store(d, true)
-			}
-			wl.Count++
-		} else {
-			badLines++
-		}
+	rules, rejected := parseDomainList(listBytes, wl.Tag)
+	if wl.Enabled {
+		matcher.Add(rules...)
 	}
+	lists.set(lowerTag, rules)
+	wl.Count = len(rules)
+	wl.Rejected = rejected
 
 	wl.LastDownload = time.Now()
-	if badLines > 0 {
-		DEBUG(badLines, " invalid lines in list: ", wl.URL)
+	if rejected > 0 {
+		DEBUG(rejected, " invalid lines in list: ", wl.URL)
 	}
 	config.DNSWhiteLists[index] = wl
 }
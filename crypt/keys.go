@@ -7,6 +7,7 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -30,6 +31,10 @@ func LoadPrivateKey(filePath string) (any, []byte, error) {
 		return nil, nil, fmt.Errorf("failed to read private key file: %w", err)
 	}
 
+	return LoadPrivateKeyBytes(keyBytes)
+}
+
+func LoadPrivateKeyBytes(keyBytes []byte) (any, []byte, error) {
 	block, _ := pem.Decode(keyBytes)
 	if block == nil {
 		return nil, nil, errors.New("failed to decode PEM block containing private key")
@@ -119,7 +124,19 @@ func VerifySignature(data []byte, signature []byte, key any) error {
 		if !ok {
 			return fmt.Errorf("ec signature verification failed")
 		}
-
+	} else {
+		return fmt.Errorf("unsupported public key type: %T", key)
 	}
 	return nil
 }
+
+// KeyID returns a short fingerprint of a public key, it is used
+// to tell which key made a signature.
+func KeyID(key any) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
@@ -0,0 +1,65 @@
+package firewall
+
+import (
+	"slices"
+	"sync"
+)
+
+// Fake is an in-memory Backend for tests
+type Fake struct {
+	mu sync.Mutex
+
+	rules   []Rule
+	applied int
+	cleaned bool
+
+	// Returned by Apply and Cleanup when set
+	Err error
+}
+
+func NewFake() *Fake {
+	return new(Fake)
+}
+
+func (f *Fake) Apply(rules []Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.rules = slices.Clone(rules)
+	f.applied++
+	f.cleaned = false
+	return nil
+}
+
+func (f *Fake) Cleanup() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.rules = nil
+	f.cleaned = true
+	return nil
+}
+
+// Rules returns the rules currently installed
+func (f *Fake) Rules() []Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.rules)
+}
+
+// Applied returns how many times the rule set has been replaced
+func (f *Fake) Applied() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.applied
+}
+
+func (f *Fake) CleanedUp() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cleaned
+}
@@ -0,0 +1,169 @@
+// Package firewall manages host firewall rules used by the server.
+// All rules live in a dedicated table which is replaced atomically
+// every time the rule set changes and removed again on Close.
+package firewall
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+)
+
+// DefaultTable is the nftables table owned by tunnels
+const DefaultTable = "tunnels"
+
+type Hook byte
+
+const (
+	Input Hook = iota + 1
+	Output
+)
+
+type Verdict byte
+
+const (
+	Drop Verdict = iota + 1
+	Accept
+)
+
+// Rule matches IPv4 packets. Zero values are not matched on,
+// TCPFlags is compared after masking with TCPFlagsMask.
+type Rule struct {
+	Name    string
+	Hook    Hook
+	Verdict Verdict
+
+	SrcIP    net.IP
+	DstIP    net.IP
+	Protocol byte
+
+	TCPFlagsMask byte
+	TCPFlags     byte
+}
+
+func (r Rule) Equal(o Rule) bool {
+	return r.Name == o.Name &&
+		r.Hook == o.Hook &&
+		r.Verdict == o.Verdict &&
+		r.SrcIP.Equal(o.SrcIP) &&
+		r.DstIP.Equal(o.DstIP) &&
+		r.Protocol == o.Protocol &&
+		r.TCPFlagsMask == o.TCPFlagsMask &&
+		r.TCPFlags == o.TCPFlags
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule has no name")
+	}
+	if r.Hook != Input && r.Hook != Output {
+		return errors.New("invalid hook for rule: " + r.Name)
+	}
+	if r.Verdict != Drop && r.Verdict != Accept {
+		return errors.New("invalid verdict for rule: " + r.Name)
+	}
+	if r.SrcIP != nil && r.SrcIP.To4() == nil {
+		return errors.New("source ip is not IPv4 for rule: " + r.Name)
+	}
+	if r.DstIP != nil && r.DstIP.To4() == nil {
+		return errors.New("destination ip is not IPv4 for rule: " + r.Name)
+	}
+	if r.TCPFlagsMask != 0 && r.Protocol != 6 {
+		return errors.New("tcp flags require the tcp protocol for rule: " + r.Name)
+	}
+	return nil
+}
+
+// RSTDropRule drops outgoing TCP resets from ip. The server uses raw
+// sockets, so the kernel would otherwise reset every connection it
+// does not know about.
+func RSTDropRule(ip net.IP) Rule {
+	return Rule{
+		Name:         "rst-drop",
+		Hook:         Output,
+		Verdict:      Drop,
+		SrcIP:        ip,
+		Protocol:     6,
+		TCPFlagsMask: 0x14, // ACK,RST
+		TCPFlags:     0x04, // RST
+	}
+}
+
+// Backend installs a complete rule set
+type Backend interface {
+	Apply(rules []Rule) error
+	Cleanup() error
+}
+
+type Manager struct {
+	mu      sync.Mutex
+	backend Backend
+	rules   []Rule
+}
+
+// New creates a manager backed by nftables
+func New() *Manager {
+	return NewManager(NewNFTables(DefaultTable))
+}
+
+func NewManager(backend Backend) *Manager {
+	return &Manager{backend: backend}
+}
+
+// Add installs rule, replacing any rule with the same name.
+// Adding a rule that is already installed does nothing.
+func (m *Manager) Add(rule Rule) (added bool, err error) {
+	if err = rule.validate(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules := slices.Clone(m.rules)
+	i := slices.IndexFunc(rules, func(r Rule) bool { return r.Name == rule.Name })
+	if i >= 0 {
+		if rules[i].Equal(rule) {
+			return false, nil
+		}
+		rules[i] = rule
+	} else {
+		rules = append(rules, rule)
+	}
+
+	if err = m.backend.Apply(rules); err != nil {
+		return false, err
+	}
+	m.rules = rules
+	return true, nil
+}
+
+func (m *Manager) Remove(name string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules := slices.DeleteFunc(slices.Clone(m.rules), func(r Rule) bool { return r.Name == name })
+	if len(rules) == len(m.rules) {
+		return nil
+	}
+	if err = m.backend.Apply(rules); err != nil {
+		return err
+	}
+	m.rules = rules
+	return nil
+}
+
+func (m *Manager) Rules() []Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.rules)
+}
+
+// Close removes every rule installed by the manager
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = nil
+	return m.backend.Cleanup()
+}
@@ -0,0 +1,97 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestManager_Add(t *testing.T) {
+	fake := NewFake()
+	m := NewManager(fake)
+
+	rule := RSTDropRule(net.ParseIP("192.0.2.1"))
+	added, err := m.Add(rule)
+	if err != nil || !added {
+		t.Fatalf("expected rule to be added, added=%v err=%v", added, err)
+	}
+
+	added, err = m.Add(RSTDropRule(net.ParseIP("192.0.2.1")))
+	if err != nil || added {
+		t.Fatalf("expected identical rule to be ignored, added=%v err=%v", added, err)
+	}
+	if fake.Applied() != 1 {
+		t.Errorf("expected 1 apply, got %d", fake.Applied())
+	}
+
+	added, err = m.Add(RSTDropRule(net.ParseIP("192.0.2.2")))
+	if err != nil || !added {
+		t.Fatalf("expected rule to be replaced, added=%v err=%v", added, err)
+	}
+	rules := fake.Rules()
+	if len(rules) != 1 || !rules[0].SrcIP.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("unexpected rules installed: %+v", rules)
+	}
+}
+
+func TestManager_AddInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "no name", rule: Rule{Hook: Output, Verdict: Drop}},
+		{name: "no hook", rule: Rule{Name: "a", Verdict: Drop}},
+		{name: "no verdict", rule: Rule{Name: "a", Hook: Output}},
+		{name: "ipv6 source", rule: Rule{Name: "a", Hook: Output, Verdict: Drop, SrcIP: net.ParseIP("::1")}},
+		{name: "flags without tcp", rule: Rule{Name: "a", Hook: Output, Verdict: Drop, Protocol: 17, TCPFlagsMask: 1}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake()
+			_, err := NewManager(fake).Add(tc.rule)
+			if err == nil {
+				t.Error("expected an error")
+			}
+			if fake.Applied() != 0 {
+				t.Error("invalid rule should not be applied")
+			}
+		})
+	}
+}
+
+func TestManager_BackendError(t *testing.T) {
+	fake := NewFake()
+	fake.Err = errors.New("permission denied")
+	m := NewManager(fake)
+
+	_, err := m.Add(RSTDropRule(net.ParseIP("192.0.2.1")))
+	if err == nil {
+		t.Fatal("expected backend error")
+	}
+	if len(m.Rules()) != 0 {
+		t.Error("rules should not be recorded when the backend fails")
+	}
+}
+
+func TestManager_RemoveAndClose(t *testing.T) {
+	fake := NewFake()
+	m := NewManager(fake)
+
+	_, _ = m.Add(RSTDropRule(net.ParseIP("192.0.2.1")))
+	_, _ = m.Add(Rule{Name: "drop-in", Hook: Input, Verdict: Drop, Protocol: 17})
+
+	if err := m.Remove("rst-drop"); err != nil {
+		t.Fatal(err)
+	}
+	if rules := fake.Rules(); len(rules) != 1 || rules[0].Name != "drop-in" {
+		t.Errorf("unexpected rules after remove: %+v", rules)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.CleanedUp() || len(fake.Rules()) != 0 || len(m.Rules()) != 0 {
+		t.Error("expected all rules to be removed on close")
+	}
+}
@@ -0,0 +1,299 @@
+//go:build linux
+
+package firewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nfDrop   = 0
+	nfAccept = 1
+
+	chainPriorityFilter = 0
+)
+
+// NFTables installs rules in a dedicated IPv4 nftables table over netlink
+type NFTables struct {
+	Table string
+}
+
+func NewNFTables(table string) *NFTables {
+	return &NFTables{Table: table}
+}
+
+// Apply replaces the table with one containing rules. The table is
+// created, deleted and created again in the same batch, which makes
+// the operation atomic and idempotent whether the table exists or not.
+func (n *NFTables) Apply(rules []Rule) error {
+	b := newBatch()
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, n.tableAttrs())
+	b.add(unix.NFT_MSG_DELTABLE, 0, n.tableAttrs())
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, n.tableAttrs())
+	b.add(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE, n.chainAttrs(Input))
+	b.add(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE, n.chainAttrs(Output))
+	for _, r := range rules {
+		b.add(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND, n.ruleAttrs(r))
+	}
+	return b.send()
+}
+
+// Cleanup removes the table, it does not fail if the table does not exist
+func (n *NFTables) Cleanup() error {
+	b := newBatch()
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, n.tableAttrs())
+	b.add(unix.NFT_MSG_DELTABLE, 0, n.tableAttrs())
+	return b.send()
+}
+
+func (n *NFTables) tableAttrs() []byte {
+	return nlString(unix.NFTA_TABLE_NAME, n.Table)
+}
+
+func chainName(h Hook) string {
+	if h == Input {
+		return "input"
+	}
+	return "output"
+}
+
+func (n *NFTables) chainAttrs(h Hook) []byte {
+	hooknum := uint32(unix.NF_INET_LOCAL_OUT)
+	if h == Input {
+		hooknum = unix.NF_INET_LOCAL_IN
+	}
+	return concat(
+		nlString(unix.NFTA_CHAIN_TABLE, n.Table),
+		nlString(unix.NFTA_CHAIN_NAME, chainName(h)),
+		nlNested(unix.NFTA_CHAIN_HOOK,
+			nlUint32(unix.NFTA_HOOK_HOOKNUM, hooknum),
+			nlUint32(unix.NFTA_HOOK_PRIORITY, chainPriorityFilter),
+		),
+		nlUint32(unix.NFTA_CHAIN_POLICY, nfAccept),
+		nlString(unix.NFTA_CHAIN_TYPE, "filter"),
+	)
+}
+
+func (n *NFTables) ruleAttrs(r Rule) []byte {
+	return concat(
+		nlString(unix.NFTA_RULE_TABLE, n.Table),
+		nlString(unix.NFTA_RULE_CHAIN, chainName(r.Hook)),
+		nlNested(unix.NFTA_RULE_EXPRESSIONS, ruleExpressions(r)...),
+	)
+}
+
+func ruleExpressions(r Rule) (exprs [][]byte) {
+	if r.SrcIP != nil {
+		exprs = append(exprs,
+			exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 12, 4),
+			exprCmp(r.SrcIP.To4()),
+		)
+	}
+	if r.DstIP != nil {
+		exprs = append(exprs,
+			exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 16, 4),
+			exprCmp(r.DstIP.To4()),
+		)
+	}
+	if r.Protocol != 0 {
+		exprs = append(exprs,
+			exprMeta(unix.NFT_META_L4PROTO),
+			exprCmp([]byte{r.Protocol}),
+		)
+	}
+	if r.TCPFlagsMask != 0 {
+		exprs = append(exprs,
+			exprPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 13, 1),
+			exprBitwise([]byte{r.TCPFlagsMask}, []byte{0}),
+			exprCmp([]byte{r.TCPFlags}),
+		)
+	}
+
+	verdict := uint32(nfAccept)
+	if r.Verdict == Drop {
+		verdict = nfDrop
+	}
+	exprs = append(exprs, exprVerdict(verdict))
+	return exprs
+}
+
+func expr(name string, data ...[]byte) []byte {
+	return nlNested(unix.NFTA_LIST_ELEM,
+		nlString(unix.NFTA_EXPR_NAME, name),
+		nlNested(unix.NFTA_EXPR_DATA, data...),
+	)
+}
+
+func exprPayload(base, offset, length uint32) []byte {
+	return expr("payload",
+		nlUint32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1),
+		nlUint32(unix.NFTA_PAYLOAD_BASE, base),
+		nlUint32(unix.NFTA_PAYLOAD_OFFSET, offset),
+		nlUint32(unix.NFTA_PAYLOAD_LEN, length),
+	)
+}
+
+func exprMeta(key uint32) []byte {
+	return expr("meta",
+		nlUint32(unix.NFTA_META_DREG, unix.NFT_REG_1),
+		nlUint32(unix.NFTA_META_KEY, key),
+	)
+}
+
+func exprCmp(data []byte) []byte {
+	return expr("cmp",
+		nlUint32(unix.NFTA_CMP_SREG, unix.NFT_REG_1),
+		nlUint32(unix.NFTA_CMP_OP, unix.NFT_CMP_EQ),
+		nlNested(unix.NFTA_CMP_DATA, nlAttr(unix.NFTA_DATA_VALUE, data)),
+	)
+}
+
+func exprBitwise(mask, xor []byte) []byte {
+	return expr("bitwise",
+		nlUint32(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1),
+		nlUint32(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1),
+		nlUint32(unix.NFTA_BITWISE_LEN, uint32(len(mask))),
+		nlNested(unix.NFTA_BITWISE_MASK, nlAttr(unix.NFTA_DATA_VALUE, mask)),
+		nlNested(unix.NFTA_BITWISE_XOR, nlAttr(unix.NFTA_DATA_VALUE, xor)),
+	)
+}
+
+func exprVerdict(code uint32) []byte {
+	return expr("immediate",
+		nlUint32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT),
+		nlNested(unix.NFTA_IMMEDIATE_DATA,
+			nlNested(unix.NFTA_DATA_VERDICT,
+				nlUint32(unix.NFTA_VERDICT_CODE, code),
+			),
+		),
+	)
+}
+
+// Netlink encoding
+
+func nlAlign(l int) int {
+	return (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	l := unix.SizeofNlAttr + len(data)
+	b := make([]byte, nlAlign(l))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[unix.SizeofNlAttr:], data)
+	return b
+}
+
+func nlNested(typ uint16, attrs ...[]byte) []byte {
+	return nlAttr(typ|unix.NLA_F_NESTED, concat(attrs...))
+}
+
+func nlString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+// nftables expects integer attributes in network byte order
+func nlUint32(typ uint16, v uint32) []byte {
+	return nlAttr(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func concat(parts ...[]byte) (out []byte) {
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+type batch struct {
+	seq  uint32
+	msgs [][]byte
+	acks int
+}
+
+func newBatch() *batch {
+	b := new(batch)
+	b.msgs = append(b.msgs, b.message(unix.NFNL_MSG_BATCH_BEGIN, 0, unix.NFNL_SUBSYS_NFTABLES, nil))
+	return b
+}
+
+func (b *batch) add(msgType uint16, flags uint16, attrs []byte) {
+	b.msgs = append(b.msgs, b.message(
+		unix.NFNL_SUBSYS_NFTABLES<<8|msgType,
+		flags|unix.NLM_F_ACK,
+		0,
+		attrs,
+	))
+	b.acks++
+}
+
+func (b *batch) message(msgType uint16, flags uint16, resID uint16, attrs []byte) []byte {
+	b.seq++
+	l := unix.SizeofNlMsghdr + 4 + len(attrs)
+	m := make([]byte, unix.SizeofNlMsghdr+4, l)
+	binary.NativeEndian.PutUint32(m[0:4], uint32(l))
+	binary.NativeEndian.PutUint16(m[4:6], msgType)
+	binary.NativeEndian.PutUint16(m[6:8], flags|unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(m[8:12], b.seq)
+	m[16] = unix.AF_UNSPEC
+	if msgType&0xff00 != 0 {
+		m[16] = unix.NFPROTO_IPV4
+	}
+	m[17] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(m[18:20], resID)
+	return append(m, attrs...)
+}
+
+func (b *batch) send() (err error) {
+	b.msgs = append(b.msgs, b.message(unix.NFNL_MSG_BATCH_END, 0, unix.NFNL_SUBSYS_NFTABLES, nil))
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("unable to open netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return fmt.Errorf("unable to bind netlink socket: %w", err)
+	}
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 5})
+	if err != nil {
+		return err
+	}
+
+	err = unix.Sendto(fd, concat(b.msgs...), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return fmt.Errorf("unable to send netlink batch: %w", err)
+	}
+
+	buf := make([]byte, 65536)
+	for acks := 0; acks < b.acks; {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("unable to read netlink response: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			acks++
+			if len(m.Data) < 4 {
+				return errors.New("short netlink error message")
+			}
+			errno := int32(binary.NativeEndian.Uint32(m.Data[0:4]))
+			if errno != 0 {
+				return fmt.Errorf("nftables: %w", syscall.Errno(-errno))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+//go:build linux
+
+package firewall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNlAttr_Alignment(t *testing.T) {
+	a := nlString(1, "abc")
+	if len(a) != 8 {
+		t.Fatalf("expected attribute to be padded to 8 bytes, got %d", len(a))
+	}
+	if a[0] != 8 {
+		t.Errorf("expected attribute length 8, got %d", a[0])
+	}
+
+	a = nlString(1, "abcd")
+	if len(a) != 12 || a[0] != 9 {
+		t.Errorf("expected padded length 12 and attribute length 9, got %d and %d", len(a), a[0])
+	}
+}
+
+func TestRuleExpressions(t *testing.T) {
+	exprs := ruleExpressions(RSTDropRule(net.ParseIP("192.0.2.1")))
+	// payload+cmp for the source, meta+cmp for the protocol,
+	// payload+bitwise+cmp for the flags and the verdict
+	if len(exprs) != 8 {
+		t.Fatalf("expected 8 expressions, got %d", len(exprs))
+	}
+
+	names := []string{"payload", "cmp", "meta", "cmp", "payload", "bitwise", "cmp", "immediate"}
+	for i, name := range names {
+		if !bytes.Contains(exprs[i], append([]byte(name), 0)) {
+			t.Errorf("expression %d is not %s", i, name)
+		}
+	}
+	if !bytes.Contains(exprs[1], []byte{192, 0, 2, 1}) {
+		t.Error("source address missing from cmp expression")
+	}
+}
+
+// nlAttrs splits a list of netlink attributes
+func nlAttrs(b []byte) (attrs []nlAttribute) {
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < 4 || l > len(b) {
+			return attrs
+		}
+		attrs = append(attrs, nlAttribute{
+			typ:  binary.NativeEndian.Uint16(b[2:4]) &^ unix.NLA_F_NESTED,
+			data: b[4:l],
+		})
+		b = b[min(nlAlign(l), len(b)):]
+	}
+	return attrs
+}
+
+type nlAttribute struct {
+	typ  uint16
+	data []byte
+}
+
+func nlAttrData(attrs []nlAttribute, typ uint16) []byte {
+	for _, a := range attrs {
+		if a.typ == typ {
+			return a.data
+		}
+	}
+	return nil
+}
+
+type listedRule struct {
+	chain string
+	exprs []string
+	cmp   [][]byte
+}
+
+// listRules dumps the rules of the table from the kernel
+func listRules(table string) (rules []listedRule, err error) {
+	b := new(batch)
+	req := b.message(
+		unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_GETRULE,
+		unix.NLM_F_DUMP,
+		0,
+		nlString(unix.NFTA_RULE_TABLE, table),
+	)
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	err = unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return rules, nil
+			case unix.NLMSG_ERROR:
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				continue
+			}
+
+			attrs := nlAttrs(m.Data[4:])
+			if string(bytes.TrimRight(nlAttrData(attrs, unix.NFTA_RULE_TABLE), "\x00")) != table {
+				continue
+			}
+			r := listedRule{chain: string(bytes.TrimRight(nlAttrData(attrs, unix.NFTA_RULE_CHAIN), "\x00"))}
+			for _, e := range nlAttrs(nlAttrData(attrs, unix.NFTA_RULE_EXPRESSIONS)) {
+				ea := nlAttrs(e.data)
+				name := string(bytes.TrimRight(nlAttrData(ea, unix.NFTA_EXPR_NAME), "\x00"))
+				r.exprs = append(r.exprs, name)
+				if name == "cmp" {
+					data := nlAttrs(nlAttrData(ea, unix.NFTA_EXPR_DATA))
+					r.cmp = append(r.cmp, nlAttrData(nlAttrs(nlAttrData(data, unix.NFTA_CMP_DATA)), unix.NFTA_DATA_VALUE))
+				}
+			}
+			rules = append(rules, r)
+		}
+	}
+}
+
+// inNetNS runs fn in a new network namespace, the thread is not
+// unlocked so it exits with the goroutine instead of being reused.
+func inNetNS(t *testing.T, fn func()) {
+	t.Helper()
+	skip := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			skip <- err
+			return
+		}
+		// nf_tables may not be available in the sandbox or kernel
+		if err := NewNFTables("tunnels_probe").Cleanup(); err != nil {
+			skip <- err
+			return
+		}
+		close(skip)
+		fn()
+	}()
+	if err := <-skip; err != nil {
+		<-done
+		t.Skip("requires CAP_SYS_ADMIN, CAP_NET_ADMIN and nf_tables:", err)
+	}
+	<-done
+}
+
+func TestNFTables_Namespace(t *testing.T) {
+	inNetNS(t, func() {
+		n := NewNFTables("tunnels_test")
+		rst := RSTDropRule(net.ParseIP("192.0.2.1"))
+		accept := Rule{Name: "accept", Hook: Input, Verdict: Accept, DstIP: net.ParseIP("192.0.2.2")}
+
+		if err := n.Apply([]Rule{rst, accept}); err != nil {
+			t.Errorf("Apply() error: %s", err)
+			return
+		}
+		rules, err := listRules(n.Table)
+		if err != nil {
+			t.Errorf("unable to list rules: %s", err)
+			return
+		}
+		if len(rules) != 2 {
+			t.Errorf("expected 2 rules, got %d", len(rules))
+			return
+		}
+		// Rules are listed by chain
+		slices.SortFunc(rules, func(a, b listedRule) int { return strings.Compare(b.chain, a.chain) })
+
+		tests := []struct {
+			name  string
+			rule  listedRule
+			chain string
+			exprs []string
+			cmp   [][]byte
+		}{
+			{
+				name:  "rst drop",
+				rule:  rules[0],
+				chain: "output",
+				exprs: []string{"payload", "cmp", "meta", "cmp", "payload", "bitwise", "cmp", "immediate"},
+				cmp:   [][]byte{{192, 0, 2, 1}, {6}, {0x04}},
+			},
+			{
+				name:  "accept",
+				rule:  rules[1],
+				chain: "input",
+				exprs: []string{"payload", "cmp", "immediate"},
+				cmp:   [][]byte{{192, 0, 2, 2}},
+			},
+		}
+		for _, tc := range tests {
+			if tc.rule.chain != tc.chain {
+				t.Errorf("%s: expected chain %s, got %s", tc.name, tc.chain, tc.rule.chain)
+			}
+			if !slices.Equal(tc.rule.exprs, tc.exprs) {
+				t.Errorf("%s: expected expressions %v, got %v", tc.name, tc.exprs, tc.rule.exprs)
+			}
+			if !slices.EqualFunc(tc.rule.cmp, tc.cmp, bytes.Equal) {
+				t.Errorf("%s: expected compared values %v, got %v", tc.name, tc.cmp, tc.rule.cmp)
+			}
+		}
+
+		// Applying again replaces the rules
+		if err = n.Apply([]Rule{accept}); err != nil {
+			t.Errorf("second Apply() error: %s", err)
+			return
+		}
+		if rules, err = listRules(n.Table); err != nil || len(rules) != 1 || rules[0].chain != "input" {
+			t.Errorf("expected only the accept rule, got %v (%v)", rules, err)
+		}
+
+		if err = n.Cleanup(); err != nil {
+			t.Errorf("Cleanup() error: %s", err)
+		}
+		if rules, err = listRules(n.Table); err != nil || len(rules) != 0 {
+			t.Errorf("expected the table to be removed, got %v (%v)", rules, err)
+		}
+		if err = n.Cleanup(); err != nil {
+			t.Errorf("Cleanup() without a table error: %s", err)
+		}
+	})
+}
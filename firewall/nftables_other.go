@@ -0,0 +1,23 @@
+//go:build !linux
+
+package firewall
+
+import "errors"
+
+var errUnsupported = errors.New("nftables is only supported on linux")
+
+type NFTables struct {
+	Table string
+}
+
+func NewNFTables(table string) *NFTables {
+	return &NFTables{Table: table}
+}
+
+func (n *NFTables) Apply(rules []Rule) error {
+	return errUnsupported
+}
+
+func (n *NFTables) Cleanup() error {
+	return errUnsupported
+}
@@ -84,6 +84,7 @@ const DNS = () => {
         Domain: true,
         IP: true,
         TXT: true,
+        CNAME: true,
         Wildcard: true,
       },
       headerFormat: {
@@ -114,11 +115,11 @@ const DNS = () => {
         },
         New: () => {
           setIsRecordEdit(false)
-          setRecord({ Domain: "yourdomain.com", IP: ["127.0.0.1"], TXT: ["yourdomain.com text record"], Wildcard: true })
+          setRecord({ Domain: "yourdomain.com", IP: ["127.0.0.1"], TXT: ["yourdomain.com text record"], CNAME: "", TTL: 30, Wildcard: true })
           setRecordModal(true)
         }
       },
-      headers: ["Domain", "IP", "Text", "Wildcard"],
+      headers: ["Domain", "IP", "Text", "CNAME", "Wildcard"],
       headerClass: {},
     }
 
@@ -244,6 +245,7 @@ const DNS = () => {
     columns: {
       Tag: true,
       Count: true,
+      Rejected: true,
     },
     customColumns: {
       Enabled: EnableColumn,
@@ -277,7 +279,7 @@ const DNS = () => {
       },
       Save: state.v2_ConfigSave
     },
-    headers: ["Tag", "Domains", "Blocked"],
+    headers: ["Tag", "Rules", "Rejected", "Blocked"],
     headerClass: {},
     opts: {
       RowPerPage: 50,
@@ -289,6 +291,7 @@ const DNS = () => {
     columns: {
       Tag: true,
       Count: true,
+      Rejected: true,
     },
     customColumns: {
       Enabled: EnableColumnWhitelist,
@@ -322,7 +325,7 @@ const DNS = () => {
       },
       Save: state.v2_ConfigSave
     },
-    headers: ["Tag", "Domains", "Allowed"],
+    headers: ["Tag", "Rules", "Rejected", "Allowed"],
     headerClass: {},
     opts: {
       RowPerPage: 50,
@@ -435,6 +438,17 @@ const DNS = () => {
                 />
               </div>
 
+              <div className="flex items-center justify-between py-1">
+                <Label className="text-white mr-3">DNSSEC</Label>
+                <Switch
+                  checked={state?.Config?.DNSSEC}
+                  onCheckedChange={() => {
+                    state.toggleConfigKeyAndSave("Config", "DNSSEC");
+                    state.fullRerender();
+                  }}
+                />
+              </div>
+
               <div className="flex items-center justify-between py-1">
                 <Label className="text-white mr-3">Log Blocked</Label>
                 <Switch
@@ -483,6 +497,7 @@ const DNS = () => {
             opts={{
               fields: {
                 Count: "hidden",
+                Rejected: "hidden",
                 LastDownload: "hidden"
               }
             }}
@@ -519,6 +534,7 @@ const DNS = () => {
             opts={{
               fields: {
                 Count: "hidden",
+                Rejected: "hidden",
                 LastDownload: "hidden"
               }
             }}
@@ -794,8 +794,8 @@ export var STATE = {
     try {
       let resp = await STATE.API.method("getDNSStats", null);
       if (resp?.status === 200) {
-        STATE.DNSStats = resp.data
-        STORE.Cache.SetObject("dns-stats", resp.data);
+        STATE.DNSStats = resp.data?.Domains
+        STORE.Cache.SetObject("dns-stats", resp.data?.Domains);
       }
     } catch (error) {
       console.dir(error)
@@ -528,6 +528,7 @@ func BBolt_UpdateServer(S *types.Server) (*types.Server, error) {
 		SS.Port = S.Port
 		SS.DataPort = S.DataPort
 		SS.PubKey = S.PubKey
+		SS.PubKeys = S.PubKeys
 		data, err := bboltMarshal(SS)
 		if err != nil {
 			return err
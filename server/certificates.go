@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// API certificates are loaded from CertPem/KeyPem and the CertPems/KeyPems
+// SNI list. They are served through GetCertificate and reloaded when the
+// files change, without a restart. The keys used to sign the VPN handshake
+// are not reloaded.
+
+const (
+	certExpiryWarning = 14 * 24 * time.Hour
+	certCheckInterval = time.Hour
+)
+
+var (
+	apiCertificates atomic.Pointer[[]*tls.Certificate]
+	acmeManager     atomic.Pointer[autocert.Manager]
+	// domain > *x509.Certificate
+	acmeCertificates sync.Map
+)
+
+type certificateStatus struct {
+	Name     string
+	Source   string
+	NotAfter time.Time
+}
+
+func loadAPICertificates() (certs []*tls.Certificate, err error) {
+	keyPems := loadStringSliceKey("KeyPems")
+	certPems := loadStringSliceKey("CertPems")
+	if len(keyPems) != len(certPems) {
+		return nil, fmt.Errorf("found %d KeyPems and %d CertPems", len(keyPems), len(certPems))
+	}
+	for i := range keyPems {
+		c, err := loadKeyPair(keyPems[i], certPems[i])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, &c)
+	}
+
+	c, err := loadKeyPair(loadSecret("KeyPem"), loadSecret("CertPem"))
+	if err != nil {
+		return nil, err
+	}
+	certs = append(certs, &c)
+	return certs, nil
+}
+
+func sameCertificates(a []*tls.Certificate, b []*tls.Certificate) bool {
+	return slices.EqualFunc(a, b, func(x, y *tls.Certificate) bool {
+		return bytes.Equal(x.Certificate[0], y.Certificate[0])
+	})
+}
+
+// reloadAPICertificates replaces the API certificates, the current
+// certificates are kept if any of the new ones can not be loaded.
+func reloadAPICertificates() (err error) {
+	certs, err := loadAPICertificates()
+	if err != nil {
+		return err
+	}
+
+	current := apiCertificates.Load()
+	if current == nil || !sameCertificates(*current, certs) {
+		apiCertificates.Store(&certs)
+		KeyPair.Store(certs[len(certs)-1])
+		if current != nil {
+			INFO("API certificates reloaded:", len(certs))
+		}
+	}
+
+	checkCertificateExpiry()
+	return nil
+}
+
+// certificateFiles returns the certificate and key values that are
+// file paths, PEM data loaded from a secret store is not watched.
+func certificateFiles() (files []string) {
+	values := []string{loadSecret("KeyPem"), loadSecret("CertPem")}
+	values = append(values, loadStringSliceKey("KeyPems")...)
+	values = append(values, loadStringSliceKey("CertPems")...)
+	for _, v := range values {
+		if v == "" || strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN") {
+			continue
+		}
+		files = append(files, v)
+	}
+	return files
+}
+
+func isACMEHost(name string) bool {
+	Config := Config.Load()
+	return name != "" && slices.Contains(Config.ACMEDomains, strings.ToLower(name))
+}
+
+func getAPICertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m := acmeManager.Load(); m != nil && isACMEHost(hello.ServerName) {
+		cert, err := m.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err == nil {
+			acmeCertificates.Store(strings.ToLower(hello.ServerName), leaf)
+		}
+		return cert, nil
+	}
+
+	certs := apiCertificates.Load()
+	if certs == nil || len(*certs) == 0 {
+		return nil, errors.New("no API certificates loaded")
+	}
+	for _, c := range *certs {
+		if hello.SupportsCertificate(c) == nil {
+			return c, nil
+		}
+	}
+	return (*certs)[0], nil
+}
+
+func newAPITLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS13,
+		MaxVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768},
+		GetCertificate:   getAPICertificate,
+		// TLS-ALPN-01 validation connections are answered by the ACME
+		// manager, CAs do not always support our curve preferences.
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			m := acmeManager.Load()
+			if m != nil && slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+				return m.TLSConfig(), nil
+			}
+			return nil, nil
+		},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+}
+
+func newACMEManager(C *types.ServerConfig) *autocert.Manager {
+	cacheDir := C.ACMECacheDir
+	if cacheDir == "" {
+		cacheDir = "acme"
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(C.ACMEDomains...),
+		Email:      C.ACMEEmail,
+		Client: &acme.Client{
+			DirectoryURL: C.ACMEDirectory,
+		},
+	}
+}
+
+// prefetchACMECertificates requests certificates before the first
+// client connects. The ACME manager renews them before they expire.
+func prefetchACMECertificates() {
+	m := acmeManager.Load()
+	if m == nil {
+		return
+	}
+	Config := Config.Load()
+	for _, domain := range Config.ACMEDomains {
+		_, err := getAPICertificate(&tls.ClientHelloInfo{
+			ServerName:   domain,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			ERR("unable to get ACME certificate:", domain, err)
+		}
+	}
+}
+
+func certificateStatuses() (statuses []certificateStatus) {
+	if certs := apiCertificates.Load(); certs != nil {
+		for _, c := range *certs {
+			if c.Leaf == nil {
+				continue
+			}
+			name := c.Leaf.Subject.CommonName
+			if len(c.Leaf.DNSNames) > 0 {
+				name = c.Leaf.DNSNames[0]
+			}
+			statuses = append(statuses, certificateStatus{
+				Name:     name,
+				Source:   "file",
+				NotAfter: c.Leaf.NotAfter,
+			})
+		}
+	}
+
+	acmeCertificates.Range(func(key, value any) bool {
+		statuses = append(statuses, certificateStatus{
+			Name:     key.(string),
+			Source:   "acme",
+			NotAfter: value.(*x509.Certificate).NotAfter,
+		})
+		return true
+	})
+
+	return statuses
+}
+
+func checkCertificateExpiry() {
+	for _, v := range certificateStatuses() {
+		left := time.Until(v.NotAfter)
+		if left <= 0 {
+			ERR("certificate has expired:", v.Name, v.Source, v.NotAfter)
+		} else if left < certExpiryWarning {
+			WARN("certificate expires soon:", v.Name, v.Source, v.NotAfter)
+		}
+	}
+}
+
+// watchCertificates reloads the API certificates when the files change
+// and checks them every certCheckInterval, which also picks up
+// certificates rotated in a secret store.
+func watchCertificates() {
+	ctx := *CTX.Load()
+	events := make(chan struct{}, 1)
+	files := certificateFiles()
+	if len(files) > 0 {
+		err := watchFiles(ctx, files, events)
+		if err != nil {
+			WARN("unable to watch certificate files:", err)
+		}
+	}
+
+	prefetchACMECertificates()
+
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-events:
+			debounce = time.After(configReloadDelay)
+		case <-debounce:
+			debounce = nil
+			err := reloadAPICertificates()
+			if err != nil {
+				ERR("unable to reload API certificates:", err)
+			}
+		case <-ticker.C:
+			err := reloadAPICertificates()
+			if err != nil {
+				ERR("unable to reload API certificates:", err)
+			}
+			prefetchACMECertificates()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// launchACMEHTTPServer answers HTTP-01 challenges and
+// redirects everything else to the API.
+func launchACMEHTTPServer() {
+	m := acmeManager.Load()
+	if m == nil {
+		return
+	}
+	Config := Config.Load()
+
+	addr := Config.APIIP + ":" + Config.ACMEHTTPPort
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      m.HTTPHandler(nil),
+		IdleTimeout:  time.Second * 60,
+		WriteTimeout: time.Second * 60,
+		ReadTimeout:  time.Second * 60,
+	}
+
+	logger.Info("ACME HTTP server launching", slog.Any("address", addr))
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("ACME HTTP server error", slog.Any("err", err))
+	}
+}
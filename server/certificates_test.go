@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/certs"
+	"github.com/tunnels-is/tunnels/types"
+	"golang.org/x/crypto/acme"
+)
+
+func setupCertificateTest(t *testing.T, C *types.ServerConfig) {
+	t.Helper()
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	C.SecretStore = types.ConfigStore
+	Config.Store(C)
+	t.Cleanup(func() {
+		apiCertificates.Store(nil)
+		acmeManager.Store(nil)
+		acmeCertificates.Clear()
+	})
+}
+
+func makeTestCert(t *testing.T, dir string, name string, expires time.Time) (certPath string, keyPath string) {
+	t.Helper()
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	_, err := certs.MakeCert(certs.ECDSA, certPath, keyPath, nil, []string{name}, "", expires, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func Test_reloadAPICertificates(t *testing.T) {
+	dir := t.TempDir()
+	mainCert, mainKey := makeTestCert(t, dir, "main.example", time.Now().Add(365*24*time.Hour))
+	sniCert, sniKey := makeTestCert(t, dir, "sni.example", time.Now().Add(365*24*time.Hour))
+	setupCertificateTest(t, &types.ServerConfig{
+		CertPem:  mainCert,
+		KeyPem:   mainKey,
+		CertPems: []string{sniCert},
+		KeyPems:  []string{sniKey},
+	})
+
+	if err := reloadAPICertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	selected := func(name string) string {
+		c, err := getAPICertificate(&tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Leaf.DNSNames[0]
+	}
+	if n := selected("main.example"); n != "main.example" {
+		t.Errorf("expected main.example, got %s", n)
+	}
+	if n := selected("sni.example"); n != "sni.example" {
+		t.Errorf("expected sni.example, got %s", n)
+	}
+	if n := selected(""); n != "sni.example" {
+		t.Errorf("expected the first certificate without SNI, got %s", n)
+	}
+
+	old := KeyPair.Load()
+	makeTestCert(t, dir, "main.example", time.Now().Add(2*365*24*time.Hour))
+	if err := reloadAPICertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if KeyPair.Load() == old {
+		t.Error("rotated certificate was not loaded")
+	}
+
+	// A broken key is rejected and the current certificates are kept
+	current := apiCertificates.Load()
+	if err := os.WriteFile(mainKey, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadAPICertificates(); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+	if apiCertificates.Load() != current {
+		t.Error("certificates were replaced after a failed reload")
+	}
+}
+
+func Test_certificateExpiryMetric(t *testing.T) {
+	dir := t.TempDir()
+	expires := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	mainCert, mainKey := makeTestCert(t, dir, "soon.example", expires)
+	setupCertificateTest(t, &types.ServerConfig{CertPem: mainCert, KeyPem: mainKey})
+
+	if err := reloadAPICertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	writeMetrics(&sb)
+	expected := fmt.Sprintf(`tunnels_certificate_expiry_timestamp_seconds{name="soon.example",source="file"} %d`, expires.Unix())
+	if !strings.Contains(sb.String(), expected) {
+		t.Errorf("missing %q in metrics", expected)
+	}
+}
+
+// testACMEServer is a minimal RFC 8555 CA. It validates tls-alpn-01
+// challenges by connecting to target, the same way a real CA does.
+type testACMEServer struct {
+	*httptest.Server
+	t      *testing.T
+	target string
+
+	mu      sync.Mutex
+	jwk     json.RawMessage
+	domain  string
+	authz   string
+	order   string
+	certPEM []byte
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+}
+
+func newTestACMEServer(t *testing.T, target string) *testACMEServer {
+	s := &testACMEServer{t: t, target: target, authz: "pending", order: "pending"}
+	var err error
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &s.caKey.PublicKey, s.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.caCert, _ = x509.ParseCertificate(der)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *testACMEServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+
+	if r.URL.Path == "/dir" {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	switch r.URL.Path {
+	case "/account":
+		protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		var header struct {
+			JWK json.RawMessage `json:"jwk"`
+		}
+		_ = json.Unmarshal(protected, &header)
+		s.jwk = header.JWK
+		w.Header().Set("Location", s.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	case "/order":
+		var req struct {
+			Identifiers []acme.AuthzID `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		s.domain = req.Identifiers[0].Value
+		w.Header().Set("Location", s.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		s.writeOrder(w)
+	case "/order/1":
+		s.writeOrder(w)
+	case "/authz/1":
+		s.writeAuthz(w)
+	case "/chal/1":
+		if err := s.validate(); err != nil {
+			s.t.Errorf("tls-alpn-01 validation failed: %s", err)
+			s.authz = "invalid"
+		} else {
+			s.authz = "valid"
+			s.order = "ready"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"type": "tls-alpn-01", "url": s.URL + "/chal/1", "token": "token", "status": s.authz,
+		})
+	case "/finalize/1":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err := s.issue(der); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.order = "valid"
+		s.writeOrder(w)
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *testACMEServer) writeOrder(w http.ResponseWriter) {
+	o := map[string]any{
+		"status":         s.order,
+		"identifiers":    []acme.AuthzID{{Type: "dns", Value: s.domain}},
+		"authorizations": []string{s.URL + "/authz/1"},
+		"finalize":       s.URL + "/finalize/1",
+	}
+	if s.order == "valid" {
+		o["certificate"] = s.URL + "/cert/1"
+	}
+	_ = json.NewEncoder(w).Encode(o)
+}
+
+func (s *testACMEServer) writeAuthz(w http.ResponseWriter) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":     s.authz,
+		"identifier": acme.AuthzID{Type: "dns", Value: s.domain},
+		"challenges": []map[string]string{
+			{"type": "tls-alpn-01", "url": s.URL + "/chal/1", "token": "token", "status": s.authz},
+		},
+	})
+}
+
+func (s *testACMEServer) validate() error {
+	var jwk struct {
+		X string `json:"x"`
+		Y string `json:"y"`
+	}
+	if err := json.Unmarshal(s.jwk, &jwk); err != nil {
+		return err
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	thumbprint, err := acme.JWKThumbprint(&ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	})
+	if err != nil {
+		return err
+	}
+	expected := sha256.Sum256([]byte("token." + thumbprint))
+
+	conn, err := tls.Dial("tcp", s.target, &tls.Config{
+		ServerName:         s.domain,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	idPeAcmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		var digest []byte
+		if _, err := asn1.Unmarshal(ext.Value, &digest); err != nil {
+			return err
+		}
+		if string(digest) != string(expected[:]) {
+			return fmt.Errorf("invalid key authorization")
+		}
+		return nil
+	}
+	return fmt.Errorf("no acmeIdentifier extension")
+}
+
+func (s *testACMEServer) issue(csrDER []byte) error {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	s.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	s.certPEM = append(s.certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	return nil
+}
+
+func Test_ACMECertificate(t *testing.T) {
+	dir := t.TempDir()
+	mainCert, mainKey := makeTestCert(t, dir, "main.example", time.Now().Add(365*24*time.Hour))
+
+	// The API listener answers the tls-alpn-01 challenge
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", newAPITLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	ca := newTestACMEServer(t, ln.Addr().String())
+	defer ca.Close()
+
+	C := &types.ServerConfig{
+		CertPem:       mainCert,
+		KeyPem:        mainKey,
+		ACMEDirectory: ca.URL + "/dir",
+		ACMEDomains:   []string{"api.tunnels.test"},
+		ACMECacheDir:  filepath.Join(dir, "acme"),
+	}
+	setupCertificateTest(t, C)
+	if err := reloadAPICertificates(); err != nil {
+		t.Fatal(err)
+	}
+	m := newACMEManager(C)
+	m.Client.HTTPClient = ca.Client()
+	acmeManager.Store(m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := (&tls.Dialer{Config: &tls.Config{
+		ServerName:         "api.tunnels.test",
+		InsecureSkipVerify: true,
+	}}).DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	leaf := conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+	if leaf.Issuer.CommonName != "test ca" || leaf.DNSNames[0] != "api.tunnels.test" {
+		t.Errorf("expected a certificate from the ACME server, got %s for %v", leaf.Issuer, leaf.DNSNames)
+	}
+
+	found := false
+	for _, v := range certificateStatuses() {
+		if v.Source == "acme" && v.Name == "api.tunnels.test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("ACME certificate is missing from the certificate status")
+	}
+
+	// Other names are still served from the certificate files
+	other, err := getAPICertificate(&tls.ClientHelloInfo{
+		ServerName:        "main.example",
+		SupportedVersions: []uint16{tls.VersionTLS13},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Leaf.DNSNames[0] != "main.example" {
+		t.Errorf("expected the file certificate, got %v", other.Leaf.DNSNames)
+	}
+}
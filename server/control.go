@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func sendControlMessage(CM *UserCoreMapping, t types.ControlMessageType, payload any) (err error) {
+	if CM == nil || CM.EH == nil {
+		return errors.New("no session")
+	}
+	if CM.Addr == nil {
+		return errors.New("no client address")
+	}
+
+	msg, err := types.MarshalControlMessage(t, payload)
+	if err != nil {
+		return err
+	}
+
+	return syscall.Sendto(dataSocketFD,
+		CM.EH.SEAL.Seal2(msg, CM.Uindex),
+		0, CM.Addr)
+}
+
+func handleControlMessage(CM *UserCoreMapping, addr syscall.Sockaddr, packet []byte) {
+	defer BasicRecover()
+
+	switch types.ControlMessageType(packet[1]) {
+	case types.ControlP2PRegister:
+		msg := new(types.P2PRegisterMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			WARN("invalid p2p register message:", err)
+			return
+		}
+		handleP2PRegister(CM, addr, msg)
+	case types.ControlP2POffer, types.ControlP2PAnswer:
+		msg := new(types.P2PHandshakeMessage)
+		t, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			WARN("invalid p2p handshake message:", err)
+			return
+		}
+		relayP2PHandshake(CM, t, msg)
+	case types.ControlPortRequest:
+		handlePortRequest(CM)
+	case types.ControlPortRelease:
+		msg := new(types.PortBlocksMessage)
+		_, err := types.UnmarshalControlMessage(packet, msg)
+		if err != nil {
+			WARN("invalid port release message:", err)
+			return
+		}
+		handlePortRelease(CM, msg)
+	case types.ControlDisconnect:
+		handleDisconnect(CM)
+	default:
+		WARN("unknown control message:", packet[1])
+	}
+}
+
+// handleDisconnect removes the session right away instead of
+// waiting for the ping timeout.
+func handleDisconnect(CM *UserCoreMapping) {
+	for i := range clientCoreMappings {
+		if clientCoreMappings[i] != CM {
+			continue
+		}
+		LOG("client disconnected:", i)
+		CM.Delete.Do(func() {
+			NukeClient(i)
+		})
+		return
+	}
+}
@@ -783,6 +783,7 @@ func DB_UpdateServer(S *types.Server) (RS *types.Server, err error) {
 						{Key: "Port", Value: S.Port},
 						{Key: "DataPort", Value: S.DataPort},
 						{Key: "PubKey", Value: S.PubKey},
+						{Key: "PubKeys", Value: S.PubKeys},
 					},
 				},
 			},
@@ -87,6 +87,13 @@ func assignDHCP(CR *types.ControllerConnectRequest, CRR *types.ServerConnectResp
 		return errors.New("No DHCP ip address available")
 	}
 
+	ip := CRR.DHCP.IP
+	publishEvent(EventDHCPAssign, &DHCPEvent{
+		Index:    index,
+		UserID:   clientCoreMappings[index].ID,
+		IP:       net.IP(ip[:]).String(),
+		Hostname: CRR.DHCP.Hostname,
+	})
 	return err
 }
 
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	sig "os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Drain mode stops new sessions on /v3/connect and sends a migrate
+// control message to every connected client, the message is sent
+// again until the client has left or the drain times out. SIGTERM
+// drains and shuts the server down, SIGUSR1 only drains. A second
+// SIGTERM or SIGINT shuts down right away.
+
+const (
+	defaultDrainTimeout   = 120 * time.Second
+	migrateResendInterval = 10 * time.Second
+	drainCheckInterval    = time.Second
+)
+
+type DrainStatus struct {
+	Draining bool
+	Trigger  string
+	ServerID string
+	Shutdown bool
+	Started  time.Time
+	Deadline time.Time
+	Sessions int
+}
+
+type DrainRequest struct {
+	ServerID       string
+	TimeoutSeconds int
+	Shutdown       bool
+}
+
+// drainer holds the state of one drain, the server uses serverDrain.
+type drainer struct {
+	draining atomic.Bool
+	status   atomic.Pointer[DrainStatus]
+
+	checkInterval  time.Duration
+	resendInterval time.Duration
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// shutdown is closed when a drain wants the server to exit
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+var serverDrain = newDrainer()
+
+func newDrainer() *drainer {
+	return &drainer{
+		checkInterval:  drainCheckInterval,
+		resendInterval: migrateResendInterval,
+		shutdown:       make(chan struct{}),
+	}
+}
+
+func (d *drainer) requestShutdown() {
+	d.shutdownOnce.Do(func() { close(d.shutdown) })
+}
+
+func activeSessions() (count int) {
+	count, _ = countConnections("")
+	return count
+}
+
+func drainTimeout(C *types.ServerConfig) time.Duration {
+	if C.DrainTimeoutSeconds > 0 {
+		return time.Duration(C.DrainTimeoutSeconds) * time.Second
+	}
+	return defaultDrainTimeout
+}
+
+func sendMigrate(serverID string) (sent int) {
+	msg := &types.MigrateMessage{
+		ServerID: serverID,
+		Reason:   "server is draining",
+	}
+	for i := range clientCoreMappings {
+		CM := clientCoreMappings[i]
+		if CM == nil {
+			continue
+		}
+		err := sendControlMessage(CM, types.ControlMigrate, msg)
+		if err != nil {
+			LOG("unable to send migrate message:", i, err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// start stops new sessions and asks clients to move, the server
+// shuts down when all sessions are gone or the timeout is reached if
+// shutdown is set.
+func (d *drainer) start(trigger string, serverID string, timeout time.Duration, shutdown bool) (s *DrainStatus, err error) {
+	if !d.draining.CompareAndSwap(false, true) {
+		return nil, errors.New("server is already draining")
+	}
+
+	if serverID == "" {
+		serverID = Config.Load().MigrateServerID
+	}
+	s = &DrainStatus{
+		Draining: true,
+		Trigger:  trigger,
+		ServerID: serverID,
+		Shutdown: shutdown,
+		Started:  time.Now(),
+		Deadline: time.Now().Add(timeout),
+		Sessions: activeSessions(),
+	}
+	d.status.Store(s)
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.Deadline)
+	done := make(chan struct{})
+	d.lock.Lock()
+	d.cancel = cancel
+	d.done = done
+	d.lock.Unlock()
+
+	WARN("draining server (", trigger, "), sessions:", s.Sessions, "timeout:", timeout)
+	status := *s
+	publishEvent(EventServerDrain, &status)
+	sendMigrate(s.ServerID)
+	go d.run(ctx, s, done)
+	return s, nil
+}
+
+func (d *drainer) run(ctx context.Context, s *DrainStatus, done chan struct{}) {
+	defer close(done)
+	defer BasicRecover()
+
+	check := time.NewTicker(d.checkInterval)
+	defer check.Stop()
+	resend := time.NewTicker(d.resendInterval)
+	defer resend.Stop()
+
+	for {
+		select {
+		case <-check.C:
+			if activeSessions() == 0 {
+				INFO("drain finished, all sessions have left")
+				if s.Shutdown {
+					d.requestShutdown()
+				}
+				return
+			}
+		case <-resend.C:
+			sendMigrate(s.ServerID)
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return
+			}
+			WARN("drain timed out, sessions remaining:", activeSessions())
+			if s.Shutdown {
+				d.requestShutdown()
+			}
+			return
+		}
+	}
+}
+
+// stop ends the drain routine and waits for it to return
+func (d *drainer) stop() {
+	d.lock.Lock()
+	cancel, done := d.cancel, d.done
+	d.cancel, d.done = nil, nil
+	d.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// cancelDrain accepts new sessions again, a drain that is shutting
+// the server down can not be cancelled.
+func (d *drainer) cancelDrain() (err error) {
+	s := d.status.Load()
+	if !d.draining.Load() || s == nil {
+		return errors.New("server is not draining")
+	}
+	if s.Shutdown {
+		return errors.New("server is shutting down")
+	}
+	d.stop()
+	d.status.Store(nil)
+	d.draining.Store(false)
+	INFO("drain cancelled")
+	return nil
+}
+
+func (d *drainer) currentStatus() (s DrainStatus) {
+	if current := d.status.Load(); current != nil {
+		s = *current
+	}
+	s.Draining = d.draining.Load()
+	s.Sessions = activeSessions()
+	return s
+}
+
+// waitForShutdown blocks until the server should exit
+func waitForShutdown(d *drainer) {
+	signals := make(chan os.Signal, 1)
+	sig.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+	defer sig.Stop(signals)
+
+	for {
+		select {
+		case s := <-signals:
+			C := Config.Load()
+			if s == syscall.SIGUSR1 {
+				_, err := d.start("signal", "", drainTimeout(C), false)
+				if err != nil {
+					WARN("unable to drain:", err)
+				}
+				continue
+			}
+			if !(VPNEnabled || LANEnabled) || d.draining.Load() {
+				return
+			}
+			_, err := d.start("signal", "", drainTimeout(C), true)
+			if err != nil {
+				return
+			}
+		case <-d.shutdown:
+			return
+		}
+	}
+}
+
+// shutdownServer removes the remaining sessions, the raw sockets
+// and the firewall rule added by initializeVPN.
+func shutdownServer() {
+	if cancel := Cancel.Load(); cancel != nil {
+		(*cancel)()
+	}
+
+	for i := range clientCoreMappings {
+		CM := clientCoreMappings[i]
+		if CM == nil {
+			continue
+		}
+		CM.Delete.Do(func() {
+			NukeClient(i)
+		})
+	}
+
+	for _, fd := range []int{rawTCPSockFD, rawUDPSockFD, dataSocketFD} {
+		if fd > 0 {
+			_ = syscall.Close(fd)
+		}
+	}
+
+	if hostFirewall != nil {
+		err := hostFirewall.Close()
+		if err != nil {
+			ERR("unable to remove firewall rules", err)
+		}
+	}
+}
+
+func API_Drain(w http.ResponseWriter, r *http.Request) {
+	defer BasicRecover()
+	if !HTTP_validateKey(r) {
+		senderr(w, 401, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sendObject(w, serverDrain.currentStatus())
+	case http.MethodPost:
+		F := new(DrainRequest)
+		if r.ContentLength != 0 {
+			err := decodeBody(r, F)
+			if err != nil {
+				senderr(w, 400, err.Error())
+				return
+			}
+		}
+		timeout := drainTimeout(Config.Load())
+		if F.TimeoutSeconds > 0 {
+			timeout = time.Duration(F.TimeoutSeconds) * time.Second
+		}
+		_, err := serverDrain.start("api", F.ServerID, timeout, F.Shutdown)
+		if err != nil {
+			senderr(w, 409, err.Error())
+			return
+		}
+		sendObject(w, serverDrain.currentStatus())
+	case http.MethodDelete:
+		err := serverDrain.cancelDrain()
+		if err != nil {
+			senderr(w, 409, err.Error())
+			return
+		}
+		sendObject(w, serverDrain.currentStatus())
+	default:
+		senderr(w, 405, "method not allowed")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_API_Drain(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	Config.Store(&types.ServerConfig{
+		AdminAPIKey:         "key",
+		DrainTimeoutSeconds: 60,
+	})
+	CM := &UserCoreMapping{
+		ToUser:   make(chan []byte, 1),
+		FromUser: make(chan Packet, 1),
+	}
+	clientCoreMappings[10] = CM
+	// Only the first migrate message is sent while the test runs
+	original := serverDrain
+	serverDrain = newDrainer()
+	serverDrain.checkInterval = time.Hour
+	serverDrain.resendInterval = time.Hour
+	t.Cleanup(func() {
+		serverDrain.stop()
+		serverDrain = original
+		clientCoreMappings[10] = nil
+	})
+
+	call := func(method string, body string) (*httptest.ResponseRecorder, DrainStatus) {
+		req := httptest.NewRequest(method, "/v3/drain", strings.NewReader(body))
+		req.Header.Set("X-API-KEY", "key")
+		rec := httptest.NewRecorder()
+		API_Drain(rec, req)
+		var s DrainStatus
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, s
+	}
+
+	rec, s := call(http.MethodPost, `{"ServerID":"other"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !s.Draining || s.ServerID != "other" || s.Sessions != 1 || s.Shutdown {
+		t.Errorf("unexpected drain status: %+v", s)
+	}
+	if rec, _ = call(http.MethodPost, ""); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a second drain, got %d", rec.Code)
+	}
+
+	connect := httptest.NewRecorder()
+	API_AcceptUserConnections(connect, httptest.NewRequest(http.MethodPost, "/v3/connect", strings.NewReader("{}")))
+	if connect.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while draining, got %d", connect.Code)
+	}
+
+	handleDisconnect(CM)
+	if clientCoreMappings[10] != nil {
+		t.Fatal("session was not removed on disconnect")
+	}
+	if _, s = call(http.MethodGet, ""); !s.Draining || s.Sessions != 0 {
+		t.Errorf("unexpected drain status after disconnect: %+v", s)
+	}
+
+	if rec, s = call(http.MethodDelete, ""); rec.Code != http.StatusOK || s.Draining {
+		t.Errorf("drain was not cancelled: %d %+v", rec.Code, s)
+	}
+	if rec, _ = call(http.MethodDelete, ""); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 when not draining, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v3/drain", nil)
+	rec = httptest.NewRecorder()
+	API_Drain(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without an API key, got %d", rec.Code)
+	}
+}
+
+func Test_drainShutdown(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	Config.Store(&types.ServerConfig{})
+	d := newDrainer()
+	d.checkInterval = 10 * time.Millisecond
+	t.Cleanup(d.stop)
+
+	if _, err := d.start("test", "", time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.cancelDrain(); err == nil {
+		t.Error("expected a shutdown drain to not be cancellable")
+	}
+
+	select {
+	case <-d.shutdown:
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown was not requested after all sessions left")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Events are published to a queue per sink and delivered in order by
+// one goroutine per sink. A failed delivery is retried with backoff,
+// events are dropped when a queue is full so a slow sink never blocks
+// the server.
+//
+// Webhooks are POSTed as JSON with these headers:
+//
+//	X-Tunnels-Event:     event type
+//	X-Tunnels-Delivery:  event ID, the same on every retry
+//	X-Tunnels-Timestamp: unix time of the attempt
+//	X-Tunnels-Signature: sha256=hex(HMAC-SHA256(EventSecret, timestamp + "." + body))
+//
+// Session events identify users by the same SHA3-256 hash the server
+// uses for NetAdmins, the VPN server never stores the plain user ID.
+
+type EventType string
+
+const (
+	EventSessionConnect     EventType = "session.connect"
+	EventSessionDisconnect  EventType = "session.disconnect"
+	EventSessionPingTimeout EventType = "session.ping_timeout"
+	EventSessionKick        EventType = "session.kick"
+	EventDHCPAssign         EventType = "dhcp.assign"
+	EventUserCreate         EventType = "user.create"
+	EventLicenseActivate    EventType = "license.activate"
+	EventServerDrain        EventType = "server.drain"
+	EventConfigReload       EventType = "config.reload"
+)
+
+const (
+	defaultEventQueueSize  = 1000
+	defaultEventMaxRetries = 5
+	eventRetryDelay        = time.Second
+	eventMaxRetryDelay     = time.Minute
+)
+
+type Event struct {
+	ID     string
+	Type   EventType
+	Time   time.Time
+	Server string
+	Data   any
+}
+
+type SessionEvent struct {
+	Index      int
+	UserID     string
+	DeviceID   string
+	Version    int       `json:",omitempty"`
+	Address    string    `json:",omitempty"`
+	LANAddress string    `json:",omitempty"`
+	Connected  time.Time `json:",omitzero"`
+	Seconds    int64     `json:",omitempty"`
+	Reason     string    `json:",omitempty"`
+}
+
+type DHCPEvent struct {
+	Index    int
+	UserID   string
+	IP       string
+	Hostname string
+}
+
+type UserEvent struct {
+	UserID string
+	Email  string
+	Trial  bool
+}
+
+type LicenseEvent struct {
+	UserID        string
+	Months        int
+	SubExpiration time.Time
+}
+
+type EventSink interface {
+	Send(e *Event) error
+}
+
+// permanentError is not retried
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+var (
+	eventWorkers atomic.Pointer[[]*eventWorker]
+	eventHost, _ = os.Hostname()
+
+	metricEventsSent    atomic.Uint64
+	metricEventsFailed  atomic.Uint64
+	metricEventsDropped atomic.Uint64
+)
+
+type eventWorker struct {
+	sink    EventSink
+	events  []string
+	retries int
+	queue   chan *Event
+	stop    chan struct{}
+}
+
+func newEventSink(C *types.EventSink) (EventSink, error) {
+	switch C.Type {
+	case types.WebhookSink:
+		if !strings.HasPrefix(C.URL, "https://") {
+			return nil, fmt.Errorf("webhook URL must use https: %s", C.URL)
+		}
+		return newWebhookSink(C.URL), nil
+	case types.FileSink:
+		if C.Path == "" {
+			return nil, errors.New("file event sink requires a Path")
+		}
+		return &fileSink{Path: C.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown event sink type: %s", C.Type)
+}
+
+// reloadEventSinks replaces the running sinks, events that are
+// already queued are still delivered by the old sinks.
+func reloadEventSinks() (err error) {
+	C := Config.Load()
+	workers := make([]*eventWorker, 0, len(C.EventSinks))
+	for _, v := range C.EventSinks {
+		sink, err := newEventSink(v)
+		if err != nil {
+			return err
+		}
+		w := &eventWorker{
+			sink:    sink,
+			events:  v.Events,
+			retries: v.MaxRetries,
+			queue:   make(chan *Event, v.QueueSize),
+			stop:    make(chan struct{}),
+		}
+		workers = append(workers, w)
+	}
+
+	for _, w := range workers {
+		go w.run()
+	}
+	old := eventWorkers.Swap(&workers)
+	if old != nil {
+		for _, w := range *old {
+			close(w.stop)
+		}
+	}
+	return nil
+}
+
+func eventMatches(filter []string, t EventType) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, v := range filter {
+		if v == string(t) || v == "*" {
+			return true
+		}
+		prefix, ok := strings.CutSuffix(v, "*")
+		if ok && strings.HasPrefix(string(t), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishEvent queues an event for every sink that accepts it
+func publishEvent(t EventType, data any) {
+	workers := eventWorkers.Load()
+	if workers == nil || len(*workers) == 0 {
+		return
+	}
+
+	e := &Event{
+		ID:     uuid.NewString(),
+		Type:   t,
+		Time:   time.Now(),
+		Server: eventHost,
+		Data:   data,
+	}
+	for _, w := range *workers {
+		if !eventMatches(w.events, t) {
+			continue
+		}
+		select {
+		case w.queue <- e:
+		default:
+			metricEventsDropped.Add(1)
+		}
+	}
+}
+
+func (w *eventWorker) run() {
+	defer BasicRecover()
+	for {
+		select {
+		case e := <-w.queue:
+			w.deliver(e)
+		case <-w.stop:
+			for {
+				select {
+				case e := <-w.queue:
+					w.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *eventWorker) deliver(e *Event) {
+	delay := eventRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := w.sink.Send(e)
+		if err == nil {
+			metricEventsSent.Add(1)
+			return
+		}
+
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= w.retries {
+			metricEventsFailed.Add(1)
+			WARN("unable to deliver event:", e.Type, e.ID, err)
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > eventMaxRetryDelay {
+			delay = eventMaxRetryDelay
+		}
+	}
+}
+
+func signEvent(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *webhookSink) Send(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tunnels-Event", string(e.Type))
+	req.Header.Set("X-Tunnels-Delivery", e.ID)
+	req.Header.Set("X-Tunnels-Timestamp", timestamp)
+	if secret := loadSecret("EventSecret"); secret != "" {
+		req.Header.Set("X-Tunnels-Signature", "sha256="+signEvent(secret, timestamp, body))
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return permanentError{fmt.Errorf("webhook returned %s", resp.Status)}
+}
+
+// fileSink appends one JSON object per line. The file is opened for
+// every event so it can be rotated without notifying the server.
+type fileSink struct {
+	Path string
+}
+
+func (s *fileSink) Send(e *Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return permanentError{err}
+	}
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func sessionEvent(index int, CM *UserCoreMapping) *SessionEvent {
+	e := &SessionEvent{
+		Index:     index,
+		UserID:    CM.ID,
+		DeviceID:  CM.DeviceToken,
+		Version:   CM.Version,
+		Connected: CM.Created,
+	}
+	if CM.Addr != nil {
+		e.Address = sockaddrToString(CM.Addr)
+	}
+	if CM.DHCP != nil {
+		e.LANAddress = fmt.Sprintf("%d.%d.%d.%d", CM.DHCP.IP[0], CM.DHCP.IP[1], CM.DHCP.IP[2], CM.DHCP.IP[3])
+	}
+	return e
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_eventMatches(t *testing.T) {
+	tests := []struct {
+		filter   []string
+		event    EventType
+		expected bool
+	}{
+		{nil, EventUserCreate, true},
+		{[]string{"*"}, EventUserCreate, true},
+		{[]string{"user.create"}, EventUserCreate, true},
+		{[]string{"session.*"}, EventSessionPingTimeout, true},
+		{[]string{"session.*"}, EventDHCPAssign, false},
+		{[]string{"session.connect"}, EventSessionDisconnect, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.event), func(t *testing.T) {
+			if eventMatches(tt.filter, tt.event) != tt.expected {
+				t.Errorf("expected %t for %q and %s", tt.expected, tt.filter, tt.event)
+			}
+		})
+	}
+}
+
+func Test_webhookSink(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	Config.Store(&types.ServerConfig{SecretStore: types.ConfigStore, EventSecret: "secret"})
+
+	var attempts atomic.Int32
+	deliveries := make(chan string, 10)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		expected := "sha256=" + signEvent("secret", r.Header.Get("X-Tunnels-Timestamp"), body)
+		if r.Header.Get("X-Tunnels-Signature") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Tunnels-Event") == string(EventUserCreate) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The first attempt fails and is retried
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- r.Header.Get("X-Tunnels-Delivery")
+	}))
+	defer srv.Close()
+
+	sink := newWebhookSink(srv.URL)
+	sink.Client = srv.Client()
+	w := &eventWorker{sink: sink, retries: 2}
+
+	e := &Event{ID: "event-1", Type: EventSessionConnect, Time: time.Now()}
+	w.deliver(e)
+	select {
+	case id := <-deliveries:
+		if id != e.ID {
+			t.Errorf("expected delivery %s, got %s", e.ID, id)
+		}
+	default:
+		t.Fatal("event was not delivered")
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts.Load())
+	}
+
+	// Client errors are not retried
+	failed := metricEventsFailed.Load()
+	w.deliver(&Event{ID: "event-2", Type: EventUserCreate})
+	if attempts.Load() != 2 {
+		t.Errorf("a rejected event was retried")
+	}
+	if metricEventsFailed.Load() != failed+1 {
+		t.Error("failed event was not counted")
+	}
+
+	if _, err := newEventSink(&types.EventSink{Type: types.WebhookSink, URL: "http://example.com"}); err == nil {
+		t.Error("expected an error for a webhook without https")
+	}
+}
+
+func Test_fileSink(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	C := &types.ServerConfig{
+		Features: []types.Feature{types.VPN},
+		EventSinks: []*types.EventSink{
+			{Type: types.FileSink, Path: path, Events: []string{"session.*"}},
+		},
+	}
+	if err := validateConfig(C); err != nil {
+		t.Fatal(err)
+	}
+	Config.Store(C)
+	if err := reloadEventSinks(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Config.Store(&types.ServerConfig{})
+		_ = reloadEventSinks()
+	})
+
+	publishEvent(EventSessionConnect, &SessionEvent{Index: 1, UserID: "user"})
+	publishEvent(EventUserCreate, &UserEvent{UserID: "user"})
+	publishEvent(EventSessionDisconnect, &SessionEvent{Index: 1, UserID: "user", Seconds: 10})
+
+	var lines []*Event
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		lines = lines[:0]
+		if f, err := os.Open(path); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				e := new(Event)
+				if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, e)
+			}
+			_ = f.Close()
+		}
+		if len(lines) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(lines))
+	}
+	if lines[0].Type != EventSessionConnect || lines[1].Type != EventSessionDisconnect {
+		t.Errorf("unexpected events: %s, %s", lines[0].Type, lines[1].Type)
+	}
+	if lines[0].ID == "" || lines[0].ID == lines[1].ID {
+		t.Error("events should have unique IDs")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/tunnels-is/tunnels/crypt"
+	"github.com/tunnels-is/tunnels/types"
+	"github.com/tunnels-is/tunnels/version"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// VPN servers with a ControllerURL POST a signed report to
+// /v3/server/heartbeat on the controller. The controller verifies the
+// report with the keys published for the server and keeps the last
+// report in memory, a server is offline when no report has arrived for
+// heartbeatMissedIntervals intervals. The first report after a restart
+// registers the server.
+
+const (
+	defaultHeartbeatSeconds  = 30
+	heartbeatMissedIntervals = 3
+	heartbeatMaxClockSkew    = 2 * time.Minute
+)
+
+var (
+	serverStarted   = time.Now()
+	heartbeatClient = &http.Client{Timeout: 10 * time.Second}
+
+	// previous counters, only used by the heartbeat goroutine
+	heartbeatLastTime time.Time
+	heartbeatLastRX   uint64
+	heartbeatLastTX   uint64
+
+	fleetMutex  sync.Mutex
+	fleetStatus = make(map[primitive.ObjectID]*types.ServerReport)
+)
+
+func systemStats() (cpuPercent int, ramPercent int, diskPercent int, err error) {
+	cpuStats, err := cpu.Percent(0, false)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(cpuStats) > 0 {
+		cpuPercent = int(cpuStats[0])
+	}
+
+	memStats, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	diskUsage, err := disk.Usage("/")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return cpuPercent, int(memStats.UsedPercent), int(diskUsage.UsedPercent), nil
+}
+
+func newServerReport(C *types.ServerConfig) (R *types.ServerReport, err error) {
+	R = &types.ServerReport{
+		Time:            time.Now(),
+		Started:         serverStarted,
+		IntervalSeconds: C.HeartbeatSeconds,
+		Version:         version.Version,
+		Sessions:        activeSessions(),
+		BandwidthMbps:   C.ServerBandwidthMbps,
+		Draining:        serverDrain.draining.Load(),
+	}
+	R.ServerID, err = primitive.ObjectIDFromHex(C.ServerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ServerID: %s", err)
+	}
+
+	R.CPU, R.RAM, R.Disk, err = systemStats()
+	if err != nil {
+		return nil, err
+	}
+
+	rx := metricBytesFromUsers.Load()
+	tx := metricBytesToUsers.Load()
+	if !heartbeatLastTime.IsZero() {
+		seconds := uint64(R.Time.Sub(heartbeatLastTime).Seconds())
+		if seconds > 0 {
+			R.RXBytesPerSecond = (rx - heartbeatLastRX) / seconds
+			R.TXBytesPerSecond = (tx - heartbeatLastTX) / seconds
+		}
+	}
+	heartbeatLastTime = R.Time
+	heartbeatLastRX = rx
+	heartbeatLastTX = tx
+	return R, nil
+}
+
+func sendHeartbeat() {
+	defer BasicRecover()
+	C := Config.Load()
+	if C.ControllerURL == "" {
+		return
+	}
+
+	R, err := newServerReport(C)
+	if err != nil {
+		ERR("unable to create heartbeat:", err)
+		return
+	}
+	SSR := new(types.SignedServerReport)
+	SSR.Payload, err = json.Marshal(R)
+	if err != nil {
+		ERR("unable to encode heartbeat:", err)
+		return
+	}
+	SSR.Signature, SSR.KeyID, err = signData(SSR.Payload)
+	if err != nil {
+		ERR("unable to sign heartbeat:", err)
+		return
+	}
+	body, err := json.Marshal(SSR)
+	if err != nil {
+		ERR("unable to encode heartbeat:", err)
+		return
+	}
+
+	url := strings.TrimSuffix(C.ControllerURL, "/") + "/v3/server/heartbeat"
+	resp, err := heartbeatClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		WARN("unable to send heartbeat:", err)
+		return
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		WARN("heartbeat rejected by controller:", resp.Status, string(msg))
+	}
+}
+
+// verifyServerReport checks the signature against the keys published
+// for the server, PubKey is used when no key in PubKeys is valid.
+func verifyServerReport(S *types.Server, SSR *types.SignedServerReport) (err error) {
+	keys := make([]*types.PublicKey, 0, len(S.PubKeys)+1)
+	now := time.Now()
+	for _, v := range S.PubKeys {
+		if v.ValidAt(now) {
+			keys = append(keys, v)
+		}
+	}
+	if len(keys) == 0 && S.PubKey != "" {
+		keys = append(keys, &types.PublicKey{PEM: S.PubKey})
+	}
+
+	err = fmt.Errorf("unknown signing key: %s", SSR.KeyID)
+	for _, v := range keys {
+		pub, _, lerr := crypt.LoadPublicKeyBytes([]byte(v.PEM))
+		if lerr != nil {
+			err = lerr
+			continue
+		}
+		if SSR.KeyID != "" {
+			id, lerr := crypt.KeyID(pub)
+			if lerr != nil || id != SSR.KeyID {
+				continue
+			}
+		}
+		err = crypt.VerifySignature(SSR.Payload, SSR.Signature, pub)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// recordServerReport stores a report unless it is older than the last
+// one, which stops a captured report from being replayed.
+func recordServerReport(R *types.ServerReport) (registered bool, err error) {
+	skew := time.Since(R.Time)
+	if skew > heartbeatMaxClockSkew || skew < -heartbeatMaxClockSkew {
+		return false, errors.New("report time is too far from controller time")
+	}
+
+	fleetMutex.Lock()
+	defer fleetMutex.Unlock()
+	last := fleetStatus[R.ServerID]
+	if last != nil && !R.Time.After(last.Time) {
+		return false, errors.New("report is older than the last report")
+	}
+	fleetStatus[R.ServerID] = R
+	return last == nil || !last.Started.Equal(R.Started), nil
+}
+
+// serverStatus returns nil for servers that have not sent a heartbeat,
+// servers without a ControllerURL never do and are not marked offline.
+func serverStatus(ID primitive.ObjectID) *types.ServerStatus {
+	fleetMutex.Lock()
+	R := fleetStatus[ID]
+	fleetMutex.Unlock()
+	if R == nil {
+		return nil
+	}
+
+	interval := time.Duration(R.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultHeartbeatSeconds * time.Second
+	}
+	return &types.ServerStatus{
+		Online:           time.Since(R.Time) < interval*heartbeatMissedIntervals,
+		LastSeen:         R.Time,
+		Started:          R.Started,
+		Version:          R.Version,
+		Sessions:         R.Sessions,
+		CPU:              R.CPU,
+		RAM:              R.RAM,
+		Disk:             R.Disk,
+		RXBytesPerSecond: R.RXBytesPerSecond,
+		TXBytesPerSecond: R.TXBytesPerSecond,
+		BandwidthMbps:    R.BandwidthMbps,
+		Draining:         R.Draining,
+	}
+}
+
+func API_ServerHeartbeat(w http.ResponseWriter, r *http.Request) {
+	defer BasicRecover()
+	SSR := new(types.SignedServerReport)
+	err := decodeBody(r, SSR)
+	if err != nil {
+		senderr(w, 400, "Invalid request body")
+		return
+	}
+	R := new(types.ServerReport)
+	err = json.Unmarshal(SSR.Payload, R)
+	if err != nil {
+		senderr(w, 400, "Invalid report")
+		return
+	}
+
+	server, err := DB_FindServerByID(R.ServerID)
+	if err != nil || server == nil {
+		senderr(w, 404, "unknown server")
+		return
+	}
+	err = verifyServerReport(server, SSR)
+	if err != nil {
+		senderr(w, 401, "invalid signature")
+		return
+	}
+
+	registered, err := recordServerReport(R)
+	if err != nil {
+		senderr(w, 400, err.Error())
+		return
+	}
+	if registered {
+		INFO("server registered:", server.Tag, R.ServerID.Hex(), "version:", R.Version)
+	}
+	w.WriteHeader(200)
+}
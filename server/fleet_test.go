@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_serverHeartbeat(t *testing.T) {
+	_, C := setupSigningKeys(t)
+	Config.Store(C)
+	if err := reloadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ConnectToBBoltDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	BBOLTEnabled = true
+	t.Cleanup(func() {
+		BBOLTEnabled = false
+		_ = BBoltDB.Close()
+	})
+
+	server := &types.Server{ID: primitive.NewObjectID(), Tag: "test", PubKeys: publishedKeys()}
+	if err := DB_CreateServer(server); err != nil {
+		t.Fatal(err)
+	}
+
+	var last *http.Response
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		API_ServerHeartbeat(rec, r)
+		last = rec.Result()
+		w.WriteHeader(rec.Code)
+	}))
+	defer srv.Close()
+	previousClient := heartbeatClient
+	heartbeatClient = srv.Client()
+	t.Cleanup(func() { heartbeatClient = previousClient })
+
+	C.ControllerURL = srv.URL
+	C.ServerID = server.ID.Hex()
+	C.HeartbeatSeconds = 30
+	C.ServerBandwidthMbps = 1000
+
+	if status := serverStatus(server.ID); status != nil {
+		t.Fatalf("server should have no status before the first heartbeat: %+v", status)
+	}
+
+	sendHeartbeat()
+	if last == nil || last.StatusCode != http.StatusOK {
+		t.Fatalf("heartbeat was not accepted: %+v", last)
+	}
+	status := serverStatus(server.ID)
+	if !status.Online || status.BandwidthMbps != 1000 || !status.Started.Equal(serverStarted) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// Reports can not be replayed
+	fleetMutex.Lock()
+	R := *fleetStatus[server.ID]
+	fleetMutex.Unlock()
+	SSR := &types.SignedServerReport{}
+	SSR.Payload, _ = json.Marshal(&R)
+	SSR.Signature, SSR.KeyID, _ = signData(SSR.Payload)
+	body, _ := json.Marshal(SSR)
+	rec := httptest.NewRecorder()
+	API_ServerHeartbeat(rec, httptest.NewRequest(http.MethodPost, "/v3/server/heartbeat", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a replayed report, got %d", rec.Code)
+	}
+
+	// Reports must be signed by a key of the server
+	R.Time = time.Now().Add(time.Second)
+	SSR.Payload, _ = json.Marshal(&R)
+	SSR.Signature = []byte("invalid")
+	body, _ = json.Marshal(SSR)
+	rec = httptest.NewRecorder()
+	API_ServerHeartbeat(rec, httptest.NewRequest(http.MethodPost, "/v3/server/heartbeat", bytes.NewReader(body)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an invalid signature, got %d", rec.Code)
+	}
+}
+
+func Test_serverStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		report   *types.ServerReport
+		expected string
+	}{
+		{
+			name: "no heartbeat",
+		},
+		{
+			name:     "missed heartbeats",
+			report:   &types.ServerReport{Time: time.Now().Add(-2 * time.Minute), IntervalSeconds: 30},
+			expected: "offline",
+		},
+		{
+			name:   "online",
+			report: &types.ServerReport{Time: time.Now(), IntervalSeconds: 30, CPU: 50, BandwidthMbps: 100},
+		},
+		{
+			name:     "draining",
+			report:   &types.ServerReport{Time: time.Now(), Draining: true},
+			expected: "draining",
+		},
+		{
+			name:     "cpu",
+			report:   &types.ServerReport{Time: time.Now(), CPU: 95},
+			expected: "overloaded",
+		},
+		{
+			name:     "bandwidth",
+			report:   &types.ServerReport{Time: time.Now(), BandwidthMbps: 100, RXBytesPerSecond: 6_000_000, TXBytesPerSecond: 6_000_000},
+			expected: "overloaded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ID := primitive.NewObjectID()
+			if tt.report != nil {
+				fleetMutex.Lock()
+				fleetStatus[ID] = tt.report
+				fleetMutex.Unlock()
+			}
+			status := serverStatus(ID)
+			if (status == nil) != (tt.report == nil) {
+				t.Fatalf("expected a status only after a heartbeat, got %+v", status)
+			}
+			if status == nil {
+				return
+			}
+			if reason := status.Unavailable(); reason != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, reason)
+			}
+		})
+	}
+}
@@ -23,6 +23,11 @@ import (
 )
 
 func API_AcceptUserConnections(w http.ResponseWriter, r *http.Request) {
+	if serverDrain.draining.Load() {
+		senderr(w, 503, "server is draining")
+		return
+	}
+
 	SCR := new(types.SignedConnectRequest)
 	err := decodeBody(r, SCR)
 	if err != nil {
@@ -30,7 +35,7 @@ func API_AcceptUserConnections(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = crypt.VerifySignature(SCR.Payload, SCR.Signature, SignKey)
+	err = verifyConnectRequest(SCR)
 	if err != nil {
 		senderr(w, 401, "Invalid signature", slog.Any("err", err))
 		return
@@ -51,7 +56,7 @@ func API_AcceptUserConnections(w http.ResponseWriter, r *http.Request) {
 		senderr(w, 401, "invalid user identifier")
 		return
 	}
-	totalC, totalUserC := countConnections(CR.UserID.Hex())
+	_, totalUserC := countConnections(CR.UserID.Hex())
 	Config := Config.Load()
 
 	if totalUserC > Config.UserMaxConnections {
@@ -60,7 +65,7 @@ func API_AcceptUserConnections(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if CR.RequestingPorts {
-		if totalC >= slots {
+		if freePortBlocks() == 0 {
 			senderr(w, 400, "server is full")
 			return
 		}
@@ -91,7 +96,7 @@ func API_AcceptUserConnections(w http.ResponseWriter, r *http.Request) {
 
 	CRR.X25519Pub = EH.SEAL.X25519Pub.Bytes()
 	CRR.Mlkem1024Cipher = EH.SEAL.Mlkem1024Cipher
-	CRR.ServerHandshakeSignature, err = crypt.SignData(CRR.X25519Pub, PrivKey)
+	CRR.ServerHandshakeSignature, CRR.ServerHandshakeKeyID, err = signData(CRR.X25519Pub)
 	if err != nil {
 		ERR("Unable to sign server handshake", err)
 		senderr(w, 400, "unable to sign server handshake")
@@ -123,6 +128,8 @@ func API_AcceptUserConnections(w http.ResponseWriter, r *http.Request) {
 	clientCoreMappings[index].FromSignal = signal.NewSignal(fmt.Sprintf("FROM:%d", index), *CTX.Load(), *Cancel.Load(), time.Second, goroutineLogger, func() {
 		fromUserChannel(index)
 	})
+
+	publishEvent(EventSessionConnect, sessionEvent(index, clientCoreMappings[index]))
 }
 
 func API_UserCreate(w http.ResponseWriter, r *http.Request) {
@@ -193,6 +200,11 @@ func API_UserCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishEvent(EventUserCreate, &UserEvent{
+		UserID: newUser.ID.Hex(),
+		Email:  newUser.Email,
+		Trial:  newUser.Trial,
+	})
 	sendObject(w, newUser)
 }
 
@@ -989,6 +1001,10 @@ func API_ServersForUser(w http.ResponseWriter, r *http.Request) {
 		servers = append(servers, puservers...)
 	}
 
+	for _, v := range servers {
+		v.Status = serverStatus(v.ID)
+	}
+
 	sendObject(w, servers)
 }
 
@@ -1048,6 +1064,7 @@ func API_ServerCreate(w http.ResponseWriter, r *http.Request) {
 
 	F.Server.ID = primitive.NewObjectID()
 	F.Server.Groups = make([]primitive.ObjectID, 0)
+	F.Server.Status = nil
 	err = DB_CreateServer(F.Server)
 	if err != nil {
 		senderr(w, 500, "Uknown error, please try again in a moment", slog.Any("err", err))
@@ -1118,6 +1135,7 @@ func API_ServerGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if allowed {
+		server.Status = serverStatus(server.ID)
 		sendObject(w, server)
 		return
 	}
@@ -1200,7 +1218,7 @@ func API_SessionCreate(w http.ResponseWriter, r *http.Request) {
 			senderr(w, 500, "Unable to decode payload")
 			return
 		}
-		SCR.Signature, err = crypt.SignData(SCR.Payload, PrivKey)
+		SCR.Signature, SCR.KeyID, err = signData(SCR.Payload)
 		if err != nil {
 			senderr(w, 500, "Unable to sign payload", slog.Any("err", err))
 			return
@@ -1386,5 +1404,10 @@ func API_ActivateLicenseKey(w http.ResponseWriter, r *http.Request) {
 		INFO("KEY: Activated:", key.LicenseKey.Key)
 	}
 
+	publishEvent(EventLicenseActivate, &LicenseEvent{
+		UserID:        user.ID.Hex(),
+		Months:        user.Key.Months,
+		SubExpiration: user.SubExpiration,
+	})
 	w.WriteHeader(200)
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,14 +11,12 @@ import (
 	"math"
 	"net"
 	"os"
-	sig "os/signal"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/NdoleStudio/lemonsqueezy-go"
@@ -28,7 +25,7 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/tunnels-is/tunnels/certs"
 	"github.com/tunnels-is/tunnels/crypt"
-	"github.com/tunnels-is/tunnels/iptables"
+	"github.com/tunnels-is/tunnels/firewall"
 	"github.com/tunnels-is/tunnels/setcap"
 	"github.com/tunnels-is/tunnels/signal"
 	"github.com/tunnels-is/tunnels/types"
@@ -44,12 +41,8 @@ var (
 	Config       atomic.Pointer[types.ServerConfig]
 	APITLSConfig atomic.Pointer[tls.Config]
 	KeyPair      atomic.Pointer[tls.Certificate]
-	PrivKey      any
-	SignKey      any
-	PubKey       any
 
 	coreMutex          = sync.Mutex{}
-	slots              int
 	VPLNetwork         *net.IPNet
 	clientCoreMappings [math.MaxUint16 + 1]*UserCoreMapping
 	portToCoreMapping  [math.MaxUint16 + 1]*PortRange
@@ -70,6 +63,7 @@ var (
 	rawUDPSockFD int
 	rawTCPSockFD int
 	InterfaceIP  net.IP
+	hostFirewall *firewall.Manager
 	TCPRWC       io.ReadWriteCloser
 	UDPRWC       io.ReadWriteCloser
 	logger       *slog.Logger
@@ -90,6 +84,8 @@ func main() {
 	silent := flag.Bool("silent", false, "This command disables logging")
 	logLevel := flag.String("logLevel", "debug", "set the log level. Available levels: debug, info, warn, error")
 	adminFlag := flag.String("admin", "", "Add an admin identifier (DeviceToken/DeviceKey/UserID) to NetAdmins")
+	generateKey := flag.Bool("generateKey", false, "Generate a new signing key, add it to SigningKeys and exit")
+	promoteKey := flag.String("promoteKey", "", "Make the signing key with this ID the primary signing key and exit")
 	flag.Parse()
 
 	serverConfigPath = *configPath
@@ -144,11 +140,40 @@ func main() {
 		}
 	}
 
+	err = initSecretProvider()
+	if err != nil {
+		logger.Error("unable to initialize secret store", slog.Any("err", err))
+		os.Exit(1)
+	}
+
 	AUTHEnabled = slices.Contains(config.Features, types.AUTH)
 	LANEnabled = slices.Contains(config.Features, types.LAN)
 	VPNEnabled = slices.Contains(config.Features, types.VPN)
 	BBOLTEnabled = slices.Contains(config.Features, types.BBOLT)
 
+	if *generateKey {
+		key, err := generateSigningKey()
+		if err != nil {
+			logger.Error("unable to generate signing key", slog.Any("err", err))
+			os.Exit(1)
+		}
+		logger.Info("signing key generated, publish it and promote it after the overlap period",
+			slog.String("id", key.ID),
+			slog.Int("overlapHours", config.KeyOverlapHours),
+		)
+		os.Exit(0)
+	}
+
+	if *promoteKey != "" {
+		err = promoteSigningKey(*promoteKey)
+		if err != nil {
+			logger.Error("unable to promote signing key", slog.Any("err", err))
+			os.Exit(1)
+		}
+		logger.Info("signing key promoted", slog.String("id", *promoteKey))
+		os.Exit(0)
+	}
+
 	// In development
 	// DNSEnabled = slices.Contains(config.Features, types.DNS)
 
@@ -157,6 +182,12 @@ func main() {
 		panic(err)
 	}
 
+	err = reloadEventSinks()
+	if err != nil {
+		logger.Error("unable to start event sinks", slog.Any("err", err))
+		os.Exit(1)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	CTX.Store(&ctx)
 	Cancel.Store(&cancel)
@@ -213,19 +244,31 @@ func main() {
 		go signal.NewSignal("TCP", ctx, cancel, 1*time.Second, goroutineLogger, ExternalTCPListener)
 		go signal.NewSignal("UDP", ctx, cancel, 1*time.Second, goroutineLogger, ExternalUDPListener)
 		go signal.NewSignal("PING", ctx, cancel, 10*time.Second, goroutineLogger, pingActiveUsers)
+		// Always running, ControllerURL can be set or removed by a
+		// config reload and sendHeartbeat does nothing without it.
+		interval := time.Duration(config.HeartbeatSeconds) * time.Second
+		go signal.NewSignal("HEARTBEAT", ctx, cancel, interval, goroutineLogger, sendHeartbeat)
 	}
 
 	go signal.NewSignal("API", ctx, cancel, 1*time.Second, goroutineLogger, launchAPIServer)
+	if config.ACMEDirectory != "" && config.ACMEHTTPPort != "" {
+		go signal.NewSignal("ACME", ctx, cancel, 1*time.Second, goroutineLogger, launchACMEHTTPServer)
+	}
+	go signal.NewSignal("CERTS", ctx, cancel, 1*time.Second, goroutineLogger, watchCertificates)
+	if config.MetricsPort != "" {
+		if _, err := metricsAddress(config, loadSecret("MetricsToken")); err != nil {
+			logger.Error("Metrics server disabled", slog.Any("err", err))
+		} else {
+			go signal.NewSignal("METRICS", ctx, cancel, 1*time.Second, goroutineLogger, launchMetricsServer)
+		}
+	}
 
-	go signal.NewSignal("CONFIG", ctx, cancel, 30*time.Second, goroutineLogger, func() {
-		_ = LoadServerConfig(serverConfigPath)
-	})
+	go signal.NewSignal("CONFIG", ctx, cancel, 1*time.Second, goroutineLogger, watchServerConfig)
 
 	logger.Info("Tunnels ready")
-	quit := make(chan os.Signal, 1)
-	sig.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	waitForShutdown(serverDrain)
 	logger.Info("Tunnels server exiting")
+	shutdownServer()
 }
 
 func goroutineLogger(msg string) {
@@ -244,25 +287,110 @@ func validateConfig(Config *types.ServerConfig) (err error) {
 	if Config.DHCPTimeoutHours < 1 {
 		Config.DHCPTimeoutHours = 1
 	}
+	if Config.MaxSiteNetworks < 1 {
+		Config.MaxSiteNetworks = 10
+	}
+	if Config.PortBlockSize < 1 {
+		Config.PortBlockSize = 512
+	}
+	if Config.MaxUserPortBlocks < 1 {
+		Config.MaxUserPortBlocks = 16
+	}
+	if Config.LANMulticastRate < 1 {
+		Config.LANMulticastRate = 100
+	}
+	err = parseMulticastGroups(Config.LANMulticastGroups)
+	if err != nil {
+		return err
+	}
 
 	if len(Config.Features) == 0 {
 		return fmt.Errorf("no features enbaled")
 	}
 
-	if Config.SecretStore == "" {
+	if Config.ACMEDirectory != "" {
+		if len(Config.ACMEDomains) == 0 {
+			return fmt.Errorf("ACMEDomains are required when ACMEDirectory is set")
+		}
+		for i := range Config.ACMEDomains {
+			Config.ACMEDomains[i] = strings.ToLower(Config.ACMEDomains[i])
+		}
+	}
+
+	for _, v := range Config.EventSinks {
+		if v.QueueSize < 1 {
+			v.QueueSize = defaultEventQueueSize
+		}
+		if v.MaxRetries < 1 {
+			v.MaxRetries = defaultEventMaxRetries
+		}
+		_, err = newEventSink(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	if Config.HeartbeatSeconds < 1 {
+		Config.HeartbeatSeconds = defaultHeartbeatSeconds
+	}
+	if Config.ControllerURL != "" {
+		if !strings.HasPrefix(Config.ControllerURL, "https://") {
+			return fmt.Errorf("ControllerURL must use https: %s", Config.ControllerURL)
+		}
+		_, err = primitive.ObjectIDFromHex(Config.ServerID)
+		if err != nil {
+			return fmt.Errorf("ServerID is required when ControllerURL is set: %s", err)
+		}
+	}
+
+	if Config.DrainTimeoutSeconds < 1 {
+		Config.DrainTimeoutSeconds = int(defaultDrainTimeout.Seconds())
+	}
+	if Config.KeyOverlapHours < 1 {
+		Config.KeyOverlapHours = defaultKeyOverlapHours
+	}
+	primaryKeys := 0
+	for _, v := range Config.SigningKeys {
+		if v.Primary {
+			primaryKeys++
+		}
+	}
+	if primaryKeys > 1 {
+		return fmt.Errorf("only one of SigningKeys can be primary")
+	}
+
+	switch Config.SecretStore {
+	case "":
 		Config.SecretStore = types.EnvStore
+	case types.EnvStore, types.ConfigStore, types.FileStore, types.SystemdStore:
+	case types.HTTPStore:
+		if Config.SecretURL == "" {
+			return fmt.Errorf("SecretURL is required for the http secret store")
+		}
+	default:
+		return fmt.Errorf("unknown secret store: %s", Config.SecretStore)
 	}
 
 	return nil
 }
 
 func LoadServerConfig(path string) (err error) {
+	C, err := readServerConfig(path)
+	if err != nil {
+		return err
+	}
+	Config.Store(C)
+	return nil
+}
+
+// readServerConfig reads and validates the config without storing it
+func readServerConfig(path string) (C *types.ServerConfig, err error) {
 	var nb []byte
 	nb, err = os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	C := new(types.ServerConfig)
+	C = new(types.ServerConfig)
 
 	// Determine format based on file extension
 	ext := strings.ToLower(filepath.Ext(path))
@@ -272,18 +400,17 @@ func LoadServerConfig(path string) (err error) {
 	case ".json", "":
 		err = json.Unmarshal(nb, &C)
 	default:
-		return fmt.Errorf("unsupported config file format: %s (supported: .json, .yaml, .yml)", ext)
+		return nil, fmt.Errorf("unsupported config file format: %s (supported: .json, .yaml, .yml)", ext)
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = validateConfig(C)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	Config.Store(C)
-	return err
+	return C, nil
 }
 
 func SaveServerConfig(path string) (err error) {
@@ -340,11 +467,19 @@ func addAdminToConfig(identifier string) error {
 }
 
 func loadKeyPair(key, cert string) (c tls.Certificate, err error) {
-	_, priv, err := crypt.LoadPrivateKey(key)
+	keyPEM, err := loadPEM(key)
+	if err != nil {
+		return c, err
+	}
+	_, priv, err := crypt.LoadPrivateKeyBytes(keyPEM)
+	if err != nil {
+		return c, err
+	}
+	certPEM, err := loadPEM(cert)
 	if err != nil {
 		return c, err
 	}
-	_, pub, err := crypt.LoadPublicKey(cert)
+	_, pub, err := crypt.LoadPublicKeyBytes(certPEM)
 	if err != nil {
 		return c, err
 	}
@@ -357,57 +492,20 @@ func loadKeyPair(key, cert string) (c tls.Certificate, err error) {
 }
 
 func loadCertificatesAndTLSSettings() (err error) {
-	priv, privB, err := crypt.LoadPrivateKey(loadSecret("KeyPem"))
-	if err != nil {
-		return err
-	}
-	pub, pubB, err := crypt.LoadPublicKey(loadSecret("CertPem"))
+	err = reloadSigningKeys()
 	if err != nil {
 		return err
 	}
-	PrivKey = priv
-	PubKey = pub
-	if AUTHEnabled && VPNEnabled {
-		SignKey = pub
-	} else {
-		sign, _, err := crypt.LoadPublicKey(loadSecret("SignPem"))
-		if err != nil {
-			return err
-		}
-		SignKey = sign
-	}
-	tlscert, err := tls.X509KeyPair(pubB, privB)
+	err = reloadAPICertificates()
 	if err != nil {
 		return err
 	}
-	KeyPair.Store(&tlscert)
+	APITLSConfig.Store(newAPITLSConfig())
 
-	apiCerts := []tls.Certificate{}
-	keyPems := loadStringSliceKey("KeyPems")
-	CertPems := loadStringSliceKey("CertPems")
-	for i := range keyPems {
-		fmt.Println(keyPems[i], CertPems[i])
-		tlsc, err := loadKeyPair(keyPems[i], CertPems[i])
-		if err != nil {
-			return err
-		}
-		apiCerts = append(apiCerts, tlsc)
-	}
-
-	apiCerts = append(apiCerts, *KeyPair.Load())
-
-	APITLSConfig.Store(&tls.Config{
-		MinVersion:       tls.VersionTLS13,
-		MaxVersion:       tls.VersionTLS13,
-		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768},
-		Certificates:     apiCerts,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-		},
-	})
+	config := Config.Load()
+	if config.ACMEDirectory != "" {
+		acmeManager.Store(newACMEManager(config))
+	}
 
 	return nil
 }
@@ -420,16 +518,6 @@ func initializeVPN() {
 	}
 	Config := Config.Load()
 
-	var existed bool
-	err, existed = iptables.SetIPTablesRSTDropFilter(Config.VPNIP)
-	if err != nil {
-		ERR("Error applying iptables rule: ", err)
-		os.Exit(1)
-	}
-	if !existed {
-		INFO("> added iptables rule")
-	}
-
 	InterfaceIP = net.ParseIP(Config.VPNIP)
 	if InterfaceIP == nil {
 		ERR("Interface IP not parsable")
@@ -437,6 +525,16 @@ func initializeVPN() {
 	}
 	InterfaceIP = InterfaceIP.To4()
 
+	hostFirewall = firewall.New()
+	added, err := hostFirewall.Add(firewall.RSTDropRule(InterfaceIP))
+	if err != nil {
+		ERR("Error applying firewall rule: ", err)
+		os.Exit(1)
+	}
+	if added {
+		INFO("> added firewall rule")
+	}
+
 	_, _, err = createRawTCPSocket()
 	if err != nil {
 		panic(err)
@@ -479,50 +577,6 @@ func GenerateVPLCoreMappings() {
 	}
 }
 
-func GeneratePortAllocation() (err error) {
-	Config := Config.Load()
-	slots = Config.ServerBandwidthMbps / Config.UserBandwidthMbps
-	portPerUser := (Config.EndPort - Config.StartPort) / slots
-
-	defer func() {
-		BasicRecover()
-		if err != nil {
-			panic(err)
-		}
-	}()
-
-	currentPort := uint16(Config.StartPort)
-
-	for range slots {
-		PR := new(PortRange)
-		PR.StartPort = currentPort
-		PR.EndPort = PR.StartPort + uint16(portPerUser)
-
-		for i := PR.StartPort; i <= PR.EndPort; i++ {
-			if i < PR.StartPort {
-				return errors.New("start port is too small")
-			} else if i > PR.EndPort {
-				return errors.New("end port is too big")
-			}
-
-			if portToCoreMapping[i] != nil {
-				if portToCoreMapping[i].StartPort < PR.StartPort {
-					return errors.New("start port is too small")
-				}
-				if portToCoreMapping[i].StartPort < PR.EndPort {
-					return errors.New("end port is too big")
-				}
-			}
-
-			portToCoreMapping[i] = PR
-		}
-
-		currentPort = PR.EndPort + 1
-	}
-
-	return nil
-}
-
 func makeConfigAndCerts() (err error) {
 	ep, err := os.Executable()
 	if err != nil {
@@ -565,6 +619,8 @@ func makeConfigAndCerts() (err error) {
 			DisableLanFirewall:  false,
 			StartPort:           2000,
 			EndPort:             65530,
+			PortBlockSize:       512,
+			MaxUserPortBlocks:   16,
 			UserMaxConnections:  10,
 			InternetAccess:      true,
 			LocalNetworkAccess:  false,
@@ -572,6 +628,7 @@ func makeConfigAndCerts() (err error) {
 			UserBandwidthMbps:   10,
 			DNSRecords:          []*types.DNSRecord{},
 			DNSServers:          []string{},
+			DNSRoutes:           []*types.DNSRoute{},
 			SecretStore:         "config",
 			DBurl:               "",
 			AdminAPIKey:         uuid.NewString(),
@@ -657,7 +714,7 @@ func initializeNewServer() error {
 	logger.Info("ADMIN PASSWORD (change this!!)", "pass", pw)
 
 	c := Config.Load()
-	keyBytes, err := os.ReadFile(c.CertPem)
+	keyBytes, err := loadSecretPEM("CertPem")
 	if err != nil {
 		return err
 	}
@@ -669,6 +726,7 @@ func initializeNewServer() error {
 		Port:     c.APIPort,
 		DataPort: c.VPNPort,
 		PubKey:   string(keyBytes),
+		PubKeys:  publishedKeys(),
 		Groups:   []primitive.ObjectID{},
 	})
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Metrics are exported in the Prometheus text format. Gauges are
+// calculated when the endpoint is scraped, counters and the
+// HTTP latency histogram are updated as events happen.
+
+var (
+	metricAuthFailures atomic.Uint64
+
+	metricBytesFromUsers atomic.Uint64
+	metricBytesToUsers   atomic.Uint64
+
+	metricDropsLAN       atomic.Uint64
+	metricDropsTCP       atomic.Uint64
+	metricDropsUDP       atomic.Uint64
+	metricDropsMulticast atomic.Uint64
+
+	httpDurations = newHistogram([]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+)
+
+type histogramSeries struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	series map[string]*histogramSeries
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		series: make(map[string]*histogramSeries),
+	}
+}
+
+func (h *histogram) Observe(labels string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labels]
+	if !ok {
+		s = &histogramSeries{buckets: make([]uint64, len(h.bounds))}
+		h.series[labels] = s
+	}
+	for i, b := range h.bounds {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, labels := range keys {
+		s := h.series[labels]
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, b, s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, s.count)
+	}
+}
+
+// observeHTTPRequest uses the mux pattern instead of the path
+// to keep the number of series bounded.
+func observeHTTPRequest(r *http.Request, d time.Duration) {
+	path := r.Pattern
+	if path == "" {
+		path = "unmatched"
+	}
+	httpDurations.Observe(
+		fmt.Sprintf("method=%q,path=%q", r.Method, path),
+		d.Seconds(),
+	)
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, v any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, v)
+}
+
+func writeMetrics(w io.Writer) {
+	var sessions, lanSessions int
+	type depth struct {
+		index    int
+		toUser   int
+		fromUser int
+	}
+	depths := []depth{}
+
+	for i := range clientCoreMappings {
+		CM := clientCoreMappings[i]
+		if CM == nil || CM.ToUser == nil {
+			continue
+		}
+		sessions++
+		if CM.DHCP != nil {
+			lanSessions++
+		}
+		depths = append(depths, depth{index: i, toUser: len(CM.ToUser), fromUser: len(CM.FromUser)})
+	}
+
+	writeMetric(w, "tunnels_sessions_active", "gauge", "Number of active sessions.", sessions)
+	writeMetric(w, "tunnels_sessions_lan_active", "gauge", "Number of active sessions with a LAN address.", lanSessions)
+	writeMetric(w, "tunnels_session_slots_total", "gauge", "Maximum number of sessions.", len(clientCoreMappings))
+	drainingValue := 0
+	if serverDrain.draining.Load() {
+		drainingValue = 1
+	}
+	writeMetric(w, "tunnels_draining", "gauge", "1 if the server is draining.", drainingValue)
+
+	var blocks, blocksUsed, ports, portsUsed int
+	portMutex.Lock()
+	for _, v := range portBlocks {
+		size := int(v.EndPort-v.StartPort) + 1
+		blocks++
+		ports += size
+		if v.Client != nil {
+			blocksUsed++
+			portsUsed += size
+		}
+	}
+	portMutex.Unlock()
+
+	writeMetric(w, "tunnels_port_blocks_total", "gauge", "Number of NAT port blocks.", blocks)
+	writeMetric(w, "tunnels_port_blocks_used", "gauge", "Number of NAT port blocks assigned to sessions.", blocksUsed)
+	writeMetric(w, "tunnels_ports_total", "gauge", "Number of NAT ports.", ports)
+	writeMetric(w, "tunnels_ports_used", "gauge", "Number of NAT ports assigned to sessions.", portsUsed)
+
+	if LANEnabled {
+		var dhcpTotal, dhcpAssigned int
+		for i := range DHCPMapping {
+			if DHCPMapping[i] == nil {
+				continue
+			}
+			dhcpTotal++
+			if DHCPMapping[i].Token != "" {
+				dhcpAssigned++
+			}
+		}
+		writeMetric(w, "tunnels_dhcp_assigned", "gauge", "Number of assigned LAN addresses.", dhcpAssigned)
+		writeMetric(w, "tunnels_dhcp_free", "gauge", "Number of free LAN addresses.", dhcpTotal-dhcpAssigned)
+	}
+
+	fmt.Fprint(w, "# HELP tunnels_session_queue_depth Packets waiting in a session channel.\n")
+	fmt.Fprint(w, "# TYPE tunnels_session_queue_depth gauge\n")
+	for _, v := range depths {
+		fmt.Fprintf(w, "tunnels_session_queue_depth{index=\"%d\",channel=\"to_user\"} %d\n", v.index, v.toUser)
+		fmt.Fprintf(w, "tunnels_session_queue_depth{index=\"%d\",channel=\"from_user\"} %d\n", v.index, v.fromUser)
+	}
+
+	writeMetric(w, "tunnels_data_received_bytes_total", "counter", "Bytes received from clients on the data socket.", metricBytesFromUsers.Load())
+	writeMetric(w, "tunnels_data_sent_bytes_total", "counter", "Bytes sent to clients on the data socket.", metricBytesToUsers.Load())
+	writeMetric(w, "tunnels_auth_failures_total", "counter", "Packets from clients that failed AEAD authentication.", metricAuthFailures.Load())
+	writeMetric(w, "tunnels_events_sent_total", "counter", "Events delivered to event sinks.", metricEventsSent.Load())
+	writeMetric(w, "tunnels_events_failed_total", "counter", "Events that could not be delivered after all retries.", metricEventsFailed.Load())
+	writeMetric(w, "tunnels_events_dropped_total", "counter", "Events dropped because an event sink queue was full.", metricEventsDropped.Load())
+
+	fmt.Fprint(w, "# HELP tunnels_channel_full_drops_total Packets dropped because a session channel was full.\n")
+	fmt.Fprint(w, "# TYPE tunnels_channel_full_drops_total counter\n")
+	fmt.Fprintf(w, "tunnels_channel_full_drops_total{source=\"lan\"} %d\n", metricDropsLAN.Load())
+	fmt.Fprintf(w, "tunnels_channel_full_drops_total{source=\"tcp\"} %d\n", metricDropsTCP.Load())
+	fmt.Fprintf(w, "tunnels_channel_full_drops_total{source=\"udp\"} %d\n", metricDropsUDP.Load())
+	fmt.Fprintf(w, "tunnels_channel_full_drops_total{source=\"multicast\"} %d\n", metricDropsMulticast.Load())
+
+	fmt.Fprint(w, "# HELP tunnels_certificate_expiry_timestamp_seconds Expiry time of the API certificates.\n")
+	fmt.Fprint(w, "# TYPE tunnels_certificate_expiry_timestamp_seconds gauge\n")
+	for _, v := range certificateStatuses() {
+		fmt.Fprintf(w, "tunnels_certificate_expiry_timestamp_seconds{name=%q,source=%q} %d\n", v.Name, v.Source, v.NotAfter.Unix())
+	}
+
+	httpDurations.write(w, "tunnels_http_request_duration_seconds", "API request latency.")
+}
+
+func API_Metrics(w http.ResponseWriter, r *http.Request) {
+	token := loadSecret("MetricsToken")
+	if token != "" {
+		auth, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// metricsAddress returns the address of the metrics server. It listens
+// on the loopback address when MetricsIP is empty and refuses any other
+// address without a MetricsToken.
+func metricsAddress(C *types.ServerConfig, token string) (addr string, err error) {
+	ip := C.MetricsIP
+	if ip == "" {
+		ip = "127.0.0.1"
+	}
+	if token == "" {
+		parsed := net.ParseIP(ip)
+		if ip != "localhost" && (parsed == nil || !parsed.IsLoopback()) {
+			return "", errors.New("MetricsToken is required when MetricsIP is not a loopback address")
+		}
+	}
+	return net.JoinHostPort(ip, C.MetricsPort), nil
+}
+
+// launchMetricsServer serves /metrics on a separate address,
+// meant to be bound to an interface only reachable by monitoring.
+func launchMetricsServer() {
+	addr, err := metricsAddress(Config.Load(), loadSecret("MetricsToken"))
+	if err != nil {
+		logger.Error("Metrics server disabled", slog.Any("err", err))
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", API_Metrics)
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		IdleTimeout:  time.Second * 60,
+		WriteTimeout: time.Second * 60,
+		ReadTimeout:  time.Second * 60,
+	}
+
+	logger.Info("Metrics server launching", slog.Any("address", addr))
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("Metrics server error", slog.Any("err", err))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_histogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.Observe(`path="/a"`, 0.05)
+	h.Observe(`path="/a"`, 0.5)
+	h.Observe(`path="/a"`, 5)
+
+	var b strings.Builder
+	h.write(&b, "test_seconds", "test")
+	out := b.String()
+
+	for _, want := range []string{
+		`test_seconds_bucket{path="/a",le="0.1"} 1`,
+		`test_seconds_bucket{path="/a",le="1"} 2`,
+		`test_seconds_bucket{path="/a",le="+Inf"} 3`,
+		`test_seconds_count{path="/a"} 3`,
+		`test_seconds_sum{path="/a"} 5.55`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func Test_API_Metrics(t *testing.T) {
+	Config.Store(&types.ServerConfig{
+		SecretStore:  types.ConfigStore,
+		MetricsToken: "secret",
+	})
+	httpDurations.Observe(`method="GET",path="/health"`, float64(time.Millisecond)/float64(time.Second))
+
+	tests := []struct {
+		name   string
+		header string
+		code   int
+	}{
+		{name: "no token", header: "", code: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer nope", code: http.StatusUnauthorized},
+		{name: "valid token", header: "Bearer secret", code: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			API_Metrics(rec, req)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d, got %d", tc.code, rec.Code)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			body := rec.Body.String()
+			for _, want := range []string{
+				"tunnels_sessions_active",
+				"tunnels_ports_total",
+				"tunnels_auth_failures_total",
+				`tunnels_channel_full_drops_total{source="lan"}`,
+				`tunnels_http_request_duration_seconds_count{method="GET",path="/health"}`,
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("missing %s in metrics output", want)
+				}
+			}
+		})
+	}
+}
+
+func Test_metricsAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		token   string
+		addr    string
+		wantErr bool
+	}{
+		{name: "loopback by default", addr: "127.0.0.1:9100"},
+		{name: "loopback without token", ip: "::1", addr: "[::1]:9100"},
+		{name: "any address without token", ip: "0.0.0.0", wantErr: true},
+		{name: "public address without token", ip: "10.0.0.1", wantErr: true},
+		{name: "public address with token", ip: "10.0.0.1", token: "secret", addr: "10.0.0.1:9100"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := metricsAddress(&types.ServerConfig{MetricsIP: tc.ip, MetricsPort: "9100"}, tc.token)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("metricsAddress() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if addr != tc.addr {
+				t.Errorf("expected %q, got %q", tc.addr, addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+const (
+	// Default IGMP group membership interval (RFC 2236)
+	igmpMembershipTimeout = 260 * time.Second
+	maxJoinedGroups       = 64
+
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+)
+
+func parseMulticastGroups(groups []*types.MulticastGroup) (err error) {
+	for _, v := range groups {
+		if v == nil {
+			return errors.New("empty multicast group")
+		}
+		if _, v.NetIPNet, err = net.ParseCIDR(v.Group); err != nil {
+			ip := net.ParseIP(v.Group).To4()
+			if ip == nil {
+				return errors.New("invalid multicast group: " + v.Group)
+			}
+			v.NetIPNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		}
+		if v.NetIPNet.IP.To4() == nil || !v.NetIPNet.IP.IsMulticast() {
+			return errors.New("not an IPv4 multicast group: " + v.Group)
+		}
+	}
+	return nil
+}
+
+func findMulticastGroup(groups []*types.MulticastGroup, ip [4]byte) *types.MulticastGroup {
+	for _, v := range groups {
+		if v.NetIPNet != nil && v.NetIPNet.Contains(ip[:]) {
+			return v
+		}
+	}
+	return nil
+}
+
+func isLANBroadcast(ip [4]byte) bool {
+	if ip == [4]byte{255, 255, 255, 255} {
+		return true
+	}
+	if VPLNetwork == nil || !VPLNetwork.Contains(ip[:]) {
+		return false
+	}
+	for i := range 4 {
+		if ip[i]|VPLNetwork.Mask[i] != 255 {
+			return false
+		}
+	}
+	return true
+}
+
+func isLANMulticast(ip [4]byte) bool {
+	return (ip[0] >= 224 && ip[0] <= 239) || isLANBroadcast(ip)
+}
+
+func (u *UserCoreMapping) JoinGroup(group [4]byte) {
+	u.Groupsm.Lock()
+	defer u.Groupsm.Unlock()
+	if u.Groups == nil {
+		u.Groups = make(map[[4]byte]time.Time)
+	}
+	if _, ok := u.Groups[group]; !ok && len(u.Groups) >= maxJoinedGroups {
+		return
+	}
+	u.Groups[group] = time.Now()
+}
+
+func (u *UserCoreMapping) LeaveGroup(group [4]byte) {
+	u.Groupsm.Lock()
+	defer u.Groupsm.Unlock()
+	delete(u.Groups, group)
+}
+
+func (u *UserCoreMapping) IsGroupMember(group [4]byte) bool {
+	u.Groupsm.Lock()
+	defer u.Groupsm.Unlock()
+	joined, ok := u.Groups[group]
+	if !ok {
+		return false
+	}
+	if time.Since(joined) > igmpMembershipTimeout {
+		delete(u.Groups, group)
+		return false
+	}
+	return true
+}
+
+// allowMulticast is only called from fromUserChannel
+func (u *UserCoreMapping) allowMulticast(rate int) bool {
+	if time.Since(u.MulticastWindow) > time.Second {
+		u.MulticastWindow = time.Now()
+		u.MulticastCount = 0
+	}
+	u.MulticastCount++
+	return u.MulticastCount <= rate
+}
+
+// handleIGMP tracks group membership from IGMP reports sent by the client.
+// Only groups that are configured for forwarding are recorded.
+func handleIGMP(CM *UserCoreMapping, packet []byte, groups []*types.MulticastGroup) {
+	ihl := int(packet[0]&0x0F) * 4
+	if len(packet) < ihl+8 {
+		return
+	}
+	igmp := packet[ihl:]
+
+	var group [4]byte
+	switch igmp[0] {
+	case igmpV1Report, igmpV2Report:
+		copy(group[:], igmp[4:8])
+		if findMulticastGroup(groups, group) != nil {
+			CM.JoinGroup(group)
+		}
+	case igmpV2Leave:
+		copy(group[:], igmp[4:8])
+		CM.LeaveGroup(group)
+	case igmpV3Report:
+		records := int(igmp[6])<<8 | int(igmp[7])
+		offset := 8
+		for range records {
+			if len(igmp) < offset+8 {
+				return
+			}
+			recordType := igmp[offset]
+			auxLen := int(igmp[offset+1]) * 4
+			sources := int(igmp[offset+2])<<8 | int(igmp[offset+3])
+			copy(group[:], igmp[offset+4:offset+8])
+			offset += 8 + sources*4 + auxLen
+
+			if findMulticastGroup(groups, group) == nil {
+				continue
+			}
+			switch recordType {
+			// MODE_IS_EXCLUDE and CHANGE_TO_EXCLUDE
+			case 2, 4:
+				CM.JoinGroup(group)
+			// MODE_IS_INCLUDE, CHANGE_TO_INCLUDE and ALLOW_NEW_SOURCES
+			case 1, 3, 5:
+				if sources > 0 {
+					CM.JoinGroup(group)
+				} else if recordType != 5 {
+					CM.LeaveGroup(group)
+				}
+			}
+		}
+	}
+}
+
+// forwardLANMulticast sends a broadcast or multicast packet to every
+// LAN client that should receive it. It returns false if the packet is
+// not handled by the LAN and should continue down the normal path.
+func forwardLANMulticast(CM *UserCoreMapping, packet []byte, dst [4]byte, Config *types.ServerConfig) bool {
+	var group *types.MulticastGroup
+	if isLANBroadcast(dst) {
+		if !Config.LANBroadcast {
+			return false
+		}
+	} else {
+		group = findMulticastGroup(Config.LANMulticastGroups, dst)
+		if group == nil {
+			return false
+		}
+	}
+
+	if CM.DHCP == nil || packet[9] != 17 {
+		return true
+	}
+	if !CM.allowMulticast(Config.LANMulticastRate) {
+		return true
+	}
+
+	for i := range clientCoreMappings {
+		target := clientCoreMappings[i]
+		if target == nil || target == CM || target.DHCP == nil || target.Addr == nil {
+			continue
+		}
+		if group != nil && group.JoinRequired && !target.IsGroupMember(dst) {
+			continue
+		}
+
+		select {
+		case target.ToUser <- CopySlice(packet):
+		default:
+			metricDropsMulticast.Add(1)
+		}
+	}
+	return true
+}
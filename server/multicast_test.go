@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func igmpPacket(igmp []byte) []byte {
+	packet := make([]byte, 20, 20+len(igmp))
+	packet[0] = 0x45
+	packet[9] = 2
+	return append(packet, igmp...)
+}
+
+func Test_handleIGMP(t *testing.T) {
+	groups := []*types.MulticastGroup{
+		{Group: "224.0.0.251"},
+		{Group: "239.255.0.0/16", JoinRequired: true},
+	}
+	if err := parseMulticastGroups(groups); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mdns := [4]byte{224, 0, 0, 251}
+	ssdp := [4]byte{239, 255, 255, 250}
+	other := [4]byte{239, 1, 1, 1}
+
+	tests := []struct {
+		name   string
+		igmp   []byte
+		group  [4]byte
+		joined bool
+	}{
+		{name: "v2 report", igmp: []byte{igmpV2Report, 0, 0, 0, 224, 0, 0, 251}, group: mdns, joined: true},
+		{name: "v2 leave", igmp: []byte{igmpV2Leave, 0, 0, 0, 224, 0, 0, 251}, group: mdns, joined: false},
+		{name: "v2 report unknown group", igmp: []byte{igmpV2Report, 0, 0, 0, 239, 1, 1, 1}, group: other, joined: false},
+		{
+			name:   "v3 change to exclude",
+			igmp:   []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 1, 4, 0, 0, 0, 239, 255, 255, 250},
+			group:  ssdp,
+			joined: true,
+		},
+		{
+			name:   "v3 change to include",
+			igmp:   []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 1, 3, 0, 0, 0, 239, 255, 255, 250},
+			group:  ssdp,
+			joined: false,
+		},
+	}
+
+	CM := new(UserCoreMapping)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handleIGMP(CM, igmpPacket(tc.igmp), groups)
+			if got := CM.IsGroupMember(tc.group); got != tc.joined {
+				t.Errorf("IsGroupMember() = %v, want %v", got, tc.joined)
+			}
+		})
+	}
+}
+
+func Test_IsGroupMember_Expired(t *testing.T) {
+	CM := new(UserCoreMapping)
+	group := [4]byte{224, 0, 0, 251}
+	CM.JoinGroup(group)
+	CM.Groups[group] = time.Now().Add(-igmpMembershipTimeout - time.Second)
+	if CM.IsGroupMember(group) {
+		t.Error("expected expired membership to be removed")
+	}
+}
+
+func Test_isLANBroadcast(t *testing.T) {
+	_, VPLNetwork, _ = net.ParseCIDR("10.0.0.0/16")
+	t.Cleanup(func() { VPLNetwork = nil })
+
+	tests := []struct {
+		ip   [4]byte
+		want bool
+	}{
+		{ip: [4]byte{255, 255, 255, 255}, want: true},
+		{ip: [4]byte{10, 0, 255, 255}, want: true},
+		{ip: [4]byte{10, 0, 0, 255}, want: false},
+		{ip: [4]byte{192, 168, 1, 255}, want: false},
+	}
+	for _, tc := range tests {
+		if got := isLANBroadcast(tc.ip); got != tc.want {
+			t.Errorf("isLANBroadcast(%v) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func Test_allowMulticast(t *testing.T) {
+	CM := new(UserCoreMapping)
+	for range 5 {
+		if !CM.allowMulticast(5) {
+			t.Fatal("expected packet to be allowed")
+		}
+	}
+	if CM.allowMulticast(5) {
+		t.Error("expected packet to be rate limited")
+	}
+}
+
+func Test_parseMulticastGroups_Invalid(t *testing.T) {
+	for _, g := range []string{"10.0.0.1", "not-an-ip", "192.168.0.0/16"} {
+		if err := parseMulticastGroups([]*types.MulticastGroup{{Group: g}}); err == nil {
+			t.Errorf("expected an error for %s", g)
+		}
+	}
+}
@@ -28,9 +28,18 @@ func launchAPIServer() {
 		mux.HandleFunc("/v3/devices", API_ListDevices)
 	}
 
+	if Config.MetricsPort == "" && loadSecret("MetricsToken") != "" {
+		mux.HandleFunc("/metrics", API_Metrics)
+	}
+
 	mux.HandleFunc("/v3/session", API_SessionCreate)
+	mux.HandleFunc("/v3/config/reload", API_ConfigReload)
+	mux.HandleFunc("/v3/keys", API_SigningKeys)
 	if VPNEnabled || LANEnabled {
 		mux.HandleFunc("/v3/connect", API_AcceptUserConnections)
+		mux.HandleFunc("/v3/drain", API_Drain)
+		mux.HandleFunc("/v3/sessions", API_Sessions)
+		mux.HandleFunc("/v3/sessions/{index}", API_Session)
 	}
 
 	if AUTHEnabled {
@@ -62,6 +71,7 @@ func launchAPIServer() {
 		mux.HandleFunc("/v3/server/create", API_ServerCreate)
 		mux.HandleFunc("/v3/server/update", API_ServerUpdate)
 		mux.HandleFunc("/v3/servers", API_ServersForUser)
+		mux.HandleFunc("/v3/server/heartbeat", API_ServerHeartbeat)
 
 		// Tunnels public network specific
 		if loadSecret("PayKey") != "" {
@@ -122,8 +132,9 @@ func loggingTimingMiddleware(next http.Handler) http.Handler {
 		}
 
 		next.ServeHTTP(w, r)
+		duration := time.Since(startTime)
+		observeHTTPRequest(r, duration)
 		if !disableLogs {
-			duration := time.Since(startTime)
 			log.Printf("<- %s %s completed in %d ms",
 				r.Method,
 				r.URL.RequestURI(),
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func sockaddrToString(addr syscall.Sockaddr) string {
+	a4, ok := addr.(*syscall.SockaddrInet4)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.%d:%d", a4.Addr[0], a4.Addr[1], a4.Addr[2], a4.Addr[3], a4.Port)
+}
+
+func handleP2PRegister(CM *UserCoreMapping, addr syscall.Sockaddr, msg *types.P2PRegisterMessage) {
+	CM.P2PAddr = addr
+	CM.P2PLocal = msg.LocalEndpoints
+	INFO("p2p endpoint registered:", sockaddrToString(addr))
+}
+
+// p2pAllowed reports whether the LAN firewall of target would accept
+// new connections from origin. Direct connections bypass the server
+// firewall, so they are only brokered when no filtering is needed.
+func p2pAllowed(origin *UserCoreMapping, target *UserCoreMapping) bool {
+	if lanFirewallDisabled || target.DisableFirewall {
+		return true
+	}
+
+	if isNetAdmin(Config.Load(), origin) {
+		return true
+	}
+
+	host := target.IsHostAllowed(origin.DHCP.IP, [2]byte{})
+	return host != nil && host.Type == "manual"
+}
+
+// relayP2PHandshake forwards an offer or answer to the peer the
+// message is addressed to, replacing Peer with the address of the
+// sender and adding the endpoints the sender can be reached on.
+func relayP2PHandshake(CM *UserCoreMapping, t types.ControlMessageType, msg *types.P2PHandshakeMessage) {
+	Config := Config.Load()
+	if !Config.PeerToPeer || !LANEnabled {
+		return
+	}
+	if CM.DHCP == nil || CM.P2PAddr == nil {
+		return
+	}
+
+	// Server LAN feature is hardcoded to 10.0.X.X
+	if msg.Peer[0] != 10 || msg.Peer[1] != 0 {
+		return
+	}
+	target := VPLIPToCore[msg.Peer[0]][msg.Peer[1]][msg.Peer[2]][msg.Peer[3]]
+	if target == nil || target == CM || target.DHCP == nil || target.P2PAddr == nil {
+		return
+	}
+
+	if !p2pAllowed(CM, target) || !p2pAllowed(target, CM) {
+		INFO("p2p not allowed between:", CM.DHCP.IP, target.DHCP.IP)
+		return
+	}
+
+	msg.Peer = CM.DHCP.IP
+	msg.Endpoints = append([]string{sockaddrToString(CM.P2PAddr)}, CM.P2PLocal...)
+
+	err := sendControlMessage(target, t, msg)
+	if err != nil {
+		WARN("unable to relay p2p handshake:", err)
+	}
+}
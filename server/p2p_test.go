@@ -0,0 +1,89 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_p2pAllowed(t *testing.T) {
+	Config.Store(&types.ServerConfig{NetAdmins: []string{"admin"}})
+	lanFirewallDisabled = false
+
+	newCM := func(ip [4]byte) *UserCoreMapping {
+		return &UserCoreMapping{DHCP: &types.DHCPRecord{IP: ip}}
+	}
+
+	tests := []struct {
+		name   string
+		origin func() *UserCoreMapping
+		target func() *UserCoreMapping
+		want   bool
+	}{
+		{
+			name:   "firewall enabled",
+			origin: func() *UserCoreMapping { return newCM([4]byte{10, 0, 0, 2}) },
+			target: func() *UserCoreMapping { return newCM([4]byte{10, 0, 0, 3}) },
+			want:   false,
+		},
+		{
+			name:   "target firewall disabled",
+			origin: func() *UserCoreMapping { return newCM([4]byte{10, 0, 0, 2}) },
+			target: func() *UserCoreMapping {
+				cm := newCM([4]byte{10, 0, 0, 3})
+				cm.DisableFirewall = true
+				return cm
+			},
+			want: true,
+		},
+		{
+			name: "origin is net admin",
+			origin: func() *UserCoreMapping {
+				cm := newCM([4]byte{10, 0, 0, 2})
+				cm.ID = "admin"
+				return cm
+			},
+			target: func() *UserCoreMapping { return newCM([4]byte{10, 0, 0, 3}) },
+			want:   true,
+		},
+		{
+			name:   "manual allowed host",
+			origin: func() *UserCoreMapping { return newCM([4]byte{10, 0, 0, 2}) },
+			target: func() *UserCoreMapping {
+				cm := newCM([4]byte{10, 0, 0, 3})
+				cm.AllowedHosts = []*AllowedHost{{IP: [4]byte{10, 0, 0, 2}, Type: "manual"}}
+				return cm
+			},
+			want: true,
+		},
+		{
+			name:   "auto allowed host",
+			origin: func() *UserCoreMapping { return newCM([4]byte{10, 0, 0, 2}) },
+			target: func() *UserCoreMapping {
+				cm := newCM([4]byte{10, 0, 0, 3})
+				cm.AllowedHosts = []*AllowedHost{{IP: [4]byte{10, 0, 0, 2}, Type: "auto"}}
+				return cm
+			},
+			want: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := p2pAllowed(tc.origin(), tc.target()); got != tc.want {
+				t.Errorf("p2pAllowed() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func Test_sockaddrToString(t *testing.T) {
+	addr := &syscall.SockaddrInet4{Addr: [4]byte{1, 2, 3, 4}, Port: 5000}
+	if got := sockaddrToString(addr); got != "1.2.3.4:5000" {
+		t.Errorf("sockaddrToString() = %s", got)
+	}
+	if got := sockaddrToString(&syscall.SockaddrInet6{}); got != "" {
+		t.Errorf("expected empty string for ipv6, got %s", got)
+	}
+}
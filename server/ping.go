@@ -4,10 +4,6 @@ import (
 	"encoding/binary"
 	"syscall"
 	"time"
-
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/disk"
-	"github.com/shirou/gopsutil/mem"
 )
 
 var PingPongStatsBuffer = []byte{
@@ -17,26 +13,14 @@ var PingPongStatsBuffer = []byte{
 }
 
 func PopulatePingBufferWithStats() {
-	cpuPercent, err := cpu.Percent(0, false)
-	if err != nil {
-		ERR("Unable to get cpu percent", err)
-		return
-	}
-	PingPongStatsBuffer[0] = byte(int(cpuPercent[0]))
-
-	memStats, err := mem.VirtualMemory()
-	if err != nil {
-		ERR("Unable to get mem stats", err)
-		return
-	}
-	PingPongStatsBuffer[1] = byte(int(memStats.UsedPercent))
-
-	diskUsage, err := disk.Usage("/")
+	cpuPercent, ramPercent, diskPercent, err := systemStats()
 	if err != nil {
-		ERR("Unable to get disk usage", err)
+		ERR("Unable to get system stats", err)
 		return
 	}
-	PingPongStatsBuffer[2] = byte(int(diskUsage.UsedPercent))
+	PingPongStatsBuffer[0] = byte(cpuPercent)
+	PingPongStatsBuffer[1] = byte(ramPercent)
+	PingPongStatsBuffer[2] = byte(diskPercent)
 }
 
 func NukeClient(index int) {
@@ -47,18 +31,7 @@ func NukeClient(index int) {
 		return
 	}
 
-	if cm.PortRange != nil {
-		for i, v := range portToCoreMapping {
-			if v == nil {
-				continue
-			}
-
-			if v.StartPort == cm.PortRange.StartPort {
-				WARN("removing port range:", v.StartPort)
-				portToCoreMapping[i].Client = nil
-			}
-		}
-	}
+	releaseAllPortBlocks(cm)
 
 	// Not removing yet, but there is no need to un-assign from the lan due to DHCP lease timer.
 	// if clientCoreMappings[index].DHCP != nil {
@@ -66,10 +39,25 @@ func NukeClient(index int) {
 	// VPLIPToCore[ip[0]][ip[1]][ip[2]][ip[3]] = nil
 	// }
 
+	if removeSiteNetworks(cm) {
+		pushSiteNetworks(cm)
+	}
+
+	// Sessions that failed during setup were never announced
+	if cm.ToSignal != nil {
+		e := sessionEvent(index, cm)
+		e.Seconds = int64(time.Since(cm.Created).Seconds())
+		publishEvent(EventSessionDisconnect, e)
+	}
+
 	close(clientCoreMappings[index].ToUser)
 	close(clientCoreMappings[index].FromUser)
-	clientCoreMappings[index].FromSignal.ShouldStop.Store(true)
-	clientCoreMappings[index].ToSignal.ShouldStop.Store(true)
+	if cm.FromSignal != nil {
+		cm.FromSignal.ShouldStop.Store(true)
+	}
+	if cm.ToSignal != nil {
+		cm.ToSignal.ShouldStop.Store(true)
+	}
 	clientCoreMappings[index] = nil
 }
 
@@ -101,6 +89,7 @@ func pingActiveUsers() {
 
 		if time.Since(u.LastPingFromClient).Minutes() > float64(cfg.PingTimeoutMinutes) {
 			LOG("Ping timeout:", index, "last seen:", time.Since(u.LastPingFromClient).Minutes(), "minutes ago")
+			publishEvent(EventSessionPingTimeout, sessionEvent(index, u))
 			NukeClient(index)
 			continue
 		}
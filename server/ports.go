@@ -2,38 +2,169 @@ package main
 
 import (
 	"errors"
+	"slices"
+	"sync"
 
 	"github.com/tunnels-is/tunnels/types"
 )
 
-func allocatePorts(CRR *types.ServerConnectResponse, index int) (err error) {
+// Ports between StartPort and EndPort are split into small blocks.
+// Every session that requests ports gets a single block on connect,
+// more blocks are handed out over the control channel when the client
+// runs low on ports and returned by the client once they are idle.
+var (
+	portMutex  sync.Mutex
+	portBlocks []*PortRange
+)
+
+func GeneratePortAllocation() (err error) {
 	Config := Config.Load()
-	var startPort uint16 = 0
-	var endPort uint16 = 0
-	for i := range portToCoreMapping {
-		if i < int(Config.StartPort) {
-			continue
+	if Config.EndPort <= Config.StartPort {
+		return errors.New("end port must be larger then start port")
+	}
+	if Config.EndPort > 65535 || Config.StartPort < 1 {
+		return errors.New("port range must be between 1 and 65535")
+	}
+
+	portMutex.Lock()
+	defer portMutex.Unlock()
+
+	portBlocks = nil
+	for start := Config.StartPort; start <= Config.EndPort; start += Config.PortBlockSize {
+		PR := &PortRange{
+			StartPort: uint16(start),
+			EndPort:   uint16(min(start+Config.PortBlockSize-1, Config.EndPort)),
+		}
+		for i := int(PR.StartPort); i <= int(PR.EndPort); i++ {
+			portToCoreMapping[i] = PR
 		}
+		portBlocks = append(portBlocks, PR)
+	}
+
+	return nil
+}
+
+func freePortBlocks() (free int) {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+	for _, v := range portBlocks {
+		if v.Client == nil {
+			free++
+		}
+	}
+	return free
+}
+
+// allocatePortBlock assigns the first free block to CM
+func allocatePortBlock(CM *UserCoreMapping) (PR *PortRange, err error) {
+	Config := Config.Load()
+
+	portMutex.Lock()
+	defer portMutex.Unlock()
+
+	if len(CM.PortBlocks) >= Config.MaxUserPortBlocks {
+		return nil, errors.New("maximum number of port blocks reached")
+	}
+
+	for _, v := range portBlocks {
+		if v.Client == nil {
+			v.Client = CM
+			CM.PortBlocks = append(CM.PortBlocks, v)
+			if CM.PortRange == nil {
+				CM.PortRange = v
+			}
+			return v, nil
+		}
+	}
 
-		if portToCoreMapping[i] == nil {
-			// WARN("PORT TO CLIENT MAPPING IS NIL: ", i)
+	return nil, errors.New("No port mappings available on the server")
+}
+
+// releasePortBlock returns a block owned by CM, the first
+// block stays assigned until the session is removed.
+func releasePortBlock(CM *UserCoreMapping, startPort uint16) bool {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+
+	for i, v := range CM.PortBlocks {
+		if v.StartPort != startPort || v == CM.PortRange {
 			continue
 		}
+		v.Client = nil
+		CM.PortBlocks = slices.Delete(CM.PortBlocks, i, i+1)
+		return true
+	}
+	return false
+}
+
+func releaseAllPortBlocks(CM *UserCoreMapping) {
+	portMutex.Lock()
+	defer portMutex.Unlock()
 
-		if portToCoreMapping[i].Client == nil {
-			portToCoreMapping[i].Client = clientCoreMappings[index]
-			clientCoreMappings[index].PortRange = portToCoreMapping[i]
-			startPort = portToCoreMapping[i].StartPort
-			endPort = portToCoreMapping[i].EndPort
-			break
+	for _, v := range CM.PortBlocks {
+		if v.Client == CM {
+			WARN("removing port range:", v.StartPort)
+			v.Client = nil
 		}
 	}
+	CM.PortBlocks = nil
+}
 
-	if startPort == 0 {
-		return errors.New("No port mappings available on the server")
+func portBlockList(CM *UserCoreMapping) (blocks []types.PortBlock) {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+
+	for _, v := range CM.PortBlocks {
+		blocks = append(blocks, types.PortBlock{
+			StartPort: v.StartPort,
+			EndPort:   v.EndPort,
+		})
+	}
+	return blocks
+}
+
+func allocatePorts(CRR *types.ServerConnectResponse, index int) (err error) {
+	PR, err := allocatePortBlock(clientCoreMappings[index])
+	if err != nil {
+		return err
 	}
 
-	CRR.StartPort = startPort
-	CRR.EndPort = endPort
+	CRR.StartPort = PR.StartPort
+	CRR.EndPort = PR.EndPort
 	return nil
 }
+
+func handlePortRequest(CM *UserCoreMapping) {
+	if CM.PortRange == nil {
+		return
+	}
+
+	PR, err := allocatePortBlock(CM)
+	if err != nil {
+		WARN("unable to allocate port block:", err)
+	} else {
+		INFO("allocated port block:", PR.StartPort, PR.EndPort)
+	}
+
+	err = sendControlMessage(CM, types.ControlPortBlocks, &types.PortBlocksMessage{
+		Blocks: portBlockList(CM),
+	})
+	if err != nil {
+		WARN("unable to send port blocks:", err)
+	}
+}
+
+func handlePortRelease(CM *UserCoreMapping, msg *types.PortBlocksMessage) {
+	for _, v := range msg.Blocks {
+		if releasePortBlock(CM, v.StartPort) {
+			INFO("released port block:", v.StartPort, v.EndPort)
+		}
+	}
+
+	err := sendControlMessage(CM, types.ControlPortBlocks, &types.PortBlocksMessage{
+		Blocks: portBlockList(CM),
+	})
+	if err != nil {
+		WARN("unable to send port blocks:", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func setupPortTest(t *testing.T, start, end, size, max int) {
+	t.Helper()
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	Config.Store(&types.ServerConfig{
+		StartPort:         start,
+		EndPort:           end,
+		PortBlockSize:     size,
+		MaxUserPortBlocks: max,
+	})
+	if err := GeneratePortAllocation(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() {
+		for i := range portToCoreMapping {
+			portToCoreMapping[i] = nil
+		}
+		portBlocks = nil
+	})
+}
+
+func Test_GeneratePortAllocation(t *testing.T) {
+	setupPortTest(t, 2000, 2999, 300, 4)
+
+	if len(portBlocks) != 4 {
+		t.Fatalf("expected 4 blocks, got %d", len(portBlocks))
+	}
+	last := portBlocks[3]
+	if last.StartPort != 2900 || last.EndPort != 2999 {
+		t.Errorf("expected last block to be truncated to 2900-2999, got %d-%d", last.StartPort, last.EndPort)
+	}
+	if portToCoreMapping[2299] != portBlocks[0] || portToCoreMapping[2300] != portBlocks[1] {
+		t.Error("ports are not mapped to the correct block")
+	}
+	if portToCoreMapping[1999] != nil || portToCoreMapping[3000] != nil {
+		t.Error("ports outside the range should not be mapped")
+	}
+}
+
+func Test_allocatePortBlock(t *testing.T) {
+	setupPortTest(t, 2000, 2999, 250, 2)
+	a := new(UserCoreMapping)
+	b := new(UserCoreMapping)
+
+	first, err := allocatePortBlock(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PortRange != first {
+		t.Error("first block should be the session port range")
+	}
+	if _, err = allocatePortBlock(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = allocatePortBlock(a); err == nil {
+		t.Error("expected the per user block limit to be enforced")
+	}
+
+	if _, err = allocatePortBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = allocatePortBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if freePortBlocks() != 0 {
+		t.Errorf("expected no free blocks, got %d", freePortBlocks())
+	}
+
+	if releasePortBlock(a, first.StartPort) {
+		t.Error("the first block should not be released")
+	}
+	second := a.PortBlocks[1]
+	if !releasePortBlock(a, second.StartPort) {
+		t.Error("expected the second block to be released")
+	}
+	if releasePortBlock(b, second.StartPort) {
+		t.Error("a block can only be released by it's owner")
+	}
+	if freePortBlocks() != 1 || len(portBlockList(a)) != 1 {
+		t.Error("expected the released block to be free")
+	}
+
+	releaseAllPortBlocks(b)
+	if freePortBlocks() != 3 || len(b.PortBlocks) != 0 {
+		t.Error("expected all blocks owned by b to be free")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	sig "os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/tunnels-is/tunnels/types"
+	"golang.org/x/sys/unix"
+)
+
+// The config file is reloaded when it changes on disk or when the
+// server receives SIGHUP. Every field that differs from the running
+// config is classified as live or restart-required. Live fields are
+// applied right away, restart-required fields keep their running value
+// until the server is restarted.
+
+const configReloadDelay = 500 * time.Millisecond
+
+// liveConfigFields are read from Config on every use, or pushed
+// to connected clients when they change.
+var liveConfigFields = map[string]bool{
+	"NetAdmins":           true,
+	"DNSRecords":          true,
+	"DNSServers":          true,
+	"DNSRoutes":           true,
+	"Routes":              true,
+	"ServerBandwidthMbps": true,
+	"UserBandwidthMbps":   true,
+	"InternetAccess":      true,
+	"LocalNetworkAccess":  true,
+	"UserMaxConnections":  true,
+	"PingTimeoutMinutes":  true,
+	"DHCPTimeoutHours":    true,
+	"Hostname":            true,
+	"LogAPIHosts":         true,
+	"ClientVersion":       true,
+	"DisableLanFirewall":  true,
+	"LANMulticastRate":    true,
+	"PeerToPeer":          true,
+	"MaxSiteNetworks":     true,
+	"SiteNetworkGrants":   true,
+	"MaxUserPortBlocks":   true,
+	"AdminAPIKey":         true,
+	"MetricsToken":        true,
+	"SigningKeys":         true,
+	"VerifyKeys":          true,
+	"KeyOverlapHours":     true,
+	"EventSinks":          true,
+	"EventSecret":         true,
+	"ControllerURL":       true,
+	"ServerID":            true,
+}
+
+// clientConfigFields are sent to clients in a ControlConfigUpdate
+var clientConfigFields = map[string]bool{
+	"DNSRecords":          true,
+	"DNSServers":          true,
+	"DNSRoutes":           true,
+	"Routes":              true,
+	"ServerBandwidthMbps": true,
+	"UserBandwidthMbps":   true,
+	"InternetAccess":      true,
+	"LocalNetworkAccess":  true,
+}
+
+var secretConfigFields = map[string]bool{
+	"AdminAPIKey":  true,
+	"DBurl":        true,
+	"TwoFactorKey": true,
+	"PayKey":       true,
+	"CertPem":      true,
+	"SignPem":      true,
+	"KeyPem":       true,
+	"MetricsToken": true,
+	"CertPems":     true,
+	"KeyPems":      true,
+	"SigningKeys":  true,
+	"EventSinks":   true,
+	"EventSecret":  true,
+}
+
+type ConfigChange struct {
+	Field string
+	Live  bool
+	Old   json.RawMessage
+	New   json.RawMessage
+}
+
+type ConfigReload struct {
+	Time            time.Time
+	Trigger         string
+	Changes         []*ConfigChange
+	RestartRequired bool
+	Error           string `json:",omitempty"`
+}
+
+var (
+	configReloadMutex sync.Mutex
+	lastConfigReload  atomic.Pointer[ConfigReload]
+)
+
+// diffServerConfig compares the exported fields of two configs using their
+// JSON encoding, which ignores parsed values like NetIPNet.
+func diffServerConfig(running *types.ServerConfig, loaded *types.ServerConfig) (changes []*ConfigChange) {
+	ov := reflect.ValueOf(running).Elem()
+	nv := reflect.ValueOf(loaded).Elem()
+
+	for i := range ov.NumField() {
+		field := ov.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		ob, err := json.Marshal(ov.Field(i).Interface())
+		if err != nil {
+			continue
+		}
+		nb, err := json.Marshal(nv.Field(i).Interface())
+		if err != nil {
+			continue
+		}
+		if string(ob) == string(nb) {
+			continue
+		}
+
+		change := &ConfigChange{
+			Field: field.Name,
+			Live:  liveConfigFields[field.Name],
+			Old:   ob,
+			New:   nb,
+		}
+		if secretConfigFields[field.Name] {
+			change.Old = json.RawMessage(`"redacted"`)
+			change.New = json.RawMessage(`"redacted"`)
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// keepRestartFields copies restart-required fields from the running
+// config so the stored config always matches what is actually in use.
+func keepRestartFields(running *types.ServerConfig, loaded *types.ServerConfig, changes []*ConfigChange) {
+	ov := reflect.ValueOf(running).Elem()
+	nv := reflect.ValueOf(loaded).Elem()
+	for _, v := range changes {
+		if v.Live {
+			continue
+		}
+		nv.FieldByName(v.Field).Set(ov.FieldByName(v.Field))
+	}
+}
+
+func reloadServerConfig(trigger string) (r *ConfigReload) {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+
+	r = &ConfigReload{
+		Time:    time.Now(),
+		Trigger: trigger,
+	}
+	defer lastConfigReload.Store(r)
+
+	newConfig, err := readServerConfig(serverConfigPath)
+	if err != nil {
+		r.Error = err.Error()
+		ERR("config reload failed, keeping the running config:", err)
+		return r
+	}
+
+	oldConfig := Config.Load()
+	r.Changes = diffServerConfig(oldConfig, newConfig)
+	if len(r.Changes) == 0 {
+		INFO("config reloaded (", trigger, "), no changes")
+		return r
+	}
+
+	keepRestartFields(oldConfig, newConfig, r.Changes)
+	defer publishEvent(EventConfigReload, r)
+	pushToClients := false
+	keysChanged := false
+	sinksChanged := false
+	for _, v := range r.Changes {
+		if v.Live {
+			INFO("config changed:", v.Field, string(v.Old), "->", string(v.New))
+			pushToClients = pushToClients || clientConfigFields[v.Field]
+			keysChanged = keysChanged || v.Field == "SigningKeys" || v.Field == "VerifyKeys"
+			sinksChanged = sinksChanged || v.Field == "EventSinks"
+		} else {
+			r.RestartRequired = true
+			WARN("config changed, restart required:", v.Field, string(v.Old), "->", string(v.New))
+		}
+	}
+
+	Config.Store(newConfig)
+	if LANEnabled && newConfig.Lan != nil {
+		lanFirewallDisabled = newConfig.DisableLanFirewall
+	}
+	if pushToClients {
+		pushConfigUpdate(newConfig)
+	}
+	if keysChanged {
+		err = reloadSigningKeys()
+		if err != nil {
+			r.Error = err.Error()
+			ERR("unable to reload signing keys, keeping the current keys:", err)
+		}
+	}
+	if sinksChanged {
+		err = reloadEventSinks()
+		if err != nil {
+			r.Error = err.Error()
+			ERR("unable to reload event sinks, keeping the current sinks:", err)
+		}
+	}
+
+	return r
+}
+
+func pushConfigUpdate(Config *types.ServerConfig) {
+	msg := &types.ConfigUpdateMessage{
+		AvailableMbps:      Config.ServerBandwidthMbps,
+		AvailableUserMbps:  Config.UserBandwidthMbps,
+		InternetAccess:     Config.InternetAccess,
+		LocalNetworkAccess: Config.LocalNetworkAccess,
+		DNSRecords:         Config.DNSRecords,
+		Routes:             Config.Routes,
+		DNSServers:         Config.DNSServers,
+		DNSRoutes:          Config.DNSRoutes,
+	}
+
+	for i := range clientCoreMappings {
+		CM := clientCoreMappings[i]
+		if CM == nil || CM.EH == nil || CM.Addr == nil {
+			continue
+		}
+		err := sendControlMessage(CM, types.ControlConfigUpdate, msg)
+		if err != nil {
+			WARN("unable to send config update:", i, err)
+		}
+	}
+}
+
+// watchServerConfig reloads the config on SIGHUP and when
+// the config file is written or replaced.
+func watchServerConfig() {
+	hup := make(chan os.Signal, 1)
+	sig.Notify(hup, syscall.SIGHUP)
+	defer sig.Stop(hup)
+
+	ctx := *CTX.Load()
+	events := make(chan struct{}, 1)
+	err := watchFiles(ctx, []string{serverConfigPath}, events)
+	if err != nil {
+		WARN("unable to watch config file, reload with SIGHUP:", err)
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			reloadServerConfig("sighup")
+		case <-events:
+			debounce = time.After(configReloadDelay)
+		case <-debounce:
+			debounce = nil
+			reloadServerConfig("inotify")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchFiles sends on events when one of the files is written or
+// replaced. The parent directories are watched instead of the files
+// because most editors and deploy tools replace files when saving.
+// The watcher is closed when ctx is cancelled.
+func watchFiles(ctx context.Context, paths []string, events chan struct{}) (err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[int32]map[string]bool)
+	for _, path := range paths {
+		wd, err := unix.InotifyAddWatch(fd, filepath.Dir(path),
+			unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE)
+		if err != nil {
+			_ = unix.Close(fd)
+			return err
+		}
+		if names[int32(wd)] == nil {
+			names[int32(wd)] = make(map[string]bool)
+		}
+		names[int32(wd)][filepath.Base(path)] = true
+	}
+
+	// The non-blocking descriptor goes through the runtime poller,
+	// closing the file unblocks the pending read.
+	watcher := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		_ = watcher.Close()
+	}()
+
+	go func() {
+		defer BasicRecover()
+
+		buf := make([]byte, 4096)
+		for {
+			n, err := watcher.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					WARN("file watcher stopped:", err)
+					_ = watcher.Close()
+				}
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				start := offset + unix.SizeofInotifyEvent
+				end := start + int(event.Len)
+				offset = end
+				if end > n {
+					break
+				}
+				if !names[event.Wd][unix.ByteSliceToString(buf[start:end])] {
+					continue
+				}
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// API_ConfigReload returns the result of the last reload,
+// a POST request reloads the config before responding.
+func API_ConfigReload(w http.ResponseWriter, r *http.Request) {
+	defer BasicRecover()
+	if !HTTP_validateKey(r) {
+		senderr(w, 401, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		last := lastConfigReload.Load()
+		if last == nil {
+			senderr(w, 404, "config has not been reloaded")
+			return
+		}
+		sendObject(w, last)
+	case http.MethodPost:
+		sendObject(w, reloadServerConfig("api"))
+	default:
+		senderr(w, 405, "method not allowed")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_diffServerConfig(t *testing.T) {
+	base := func() *types.ServerConfig {
+		return &types.ServerConfig{
+			Features:       []types.Feature{types.VPN},
+			StartPort:      2000,
+			EndPort:        3000,
+			InternetAccess: true,
+			NetAdmins:      []string{"admin"},
+			AdminAPIKey:    "key",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(C *types.ServerConfig)
+		field  string
+		live   bool
+	}{
+		{"no changes", func(C *types.ServerConfig) {}, "", false},
+		{"internet access", func(C *types.ServerConfig) { C.InternetAccess = false }, "InternetAccess", true},
+		{"net admins", func(C *types.ServerConfig) { C.NetAdmins = append(C.NetAdmins, "other") }, "NetAdmins", true},
+		{"routes", func(C *types.ServerConfig) { C.Routes = []*types.Route{{Address: "1.1.1.1/32"}} }, "Routes", true},
+		{"port range", func(C *types.ServerConfig) { C.EndPort = 4000 }, "EndPort", false},
+		{"features", func(C *types.ServerConfig) { C.Features = append(C.Features, types.LAN) }, "Features", false},
+		{"lan", func(C *types.ServerConfig) { C.Lan = &types.Network{Network: "10.0.0.0/16"} }, "Lan", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := base()
+			tt.modify(loaded)
+			changes := diffServerConfig(base(), loaded)
+			if tt.field == "" {
+				if len(changes) != 0 {
+					t.Fatalf("expected no changes, got %d", len(changes))
+				}
+				return
+			}
+			if len(changes) != 1 {
+				t.Fatalf("expected 1 change, got %d", len(changes))
+			}
+			if changes[0].Field != tt.field || changes[0].Live != tt.live {
+				t.Errorf("expected %s (live: %t), got %s (live: %t)", tt.field, tt.live, changes[0].Field, changes[0].Live)
+			}
+		})
+	}
+}
+
+func Test_diffServerConfig_redactsSecrets(t *testing.T) {
+	running := &types.ServerConfig{AdminAPIKey: "old-key"}
+	loaded := &types.ServerConfig{AdminAPIKey: "new-key"}
+
+	changes := diffServerConfig(running, loaded)
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 change, got %d", len(changes))
+	}
+	out, _ := json.Marshal(changes[0])
+	if string(changes[0].Old) != `"redacted"` || string(changes[0].New) != `"redacted"` {
+		t.Errorf("secret was not redacted: %s", out)
+	}
+}
+
+func Test_reloadServerConfig(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	previousPath := serverConfigPath
+	serverConfigPath = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { serverConfigPath = previousPath })
+
+	running := &types.ServerConfig{
+		Features:       []types.Feature{types.VPN},
+		StartPort:      2000,
+		EndPort:        3000,
+		InternetAccess: true,
+	}
+	if err := validateConfig(running); err != nil {
+		t.Fatal(err)
+	}
+	Config.Store(running)
+
+	write := func(C *types.ServerConfig) {
+		b, err := json.Marshal(C)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(serverConfigPath, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(&types.ServerConfig{
+		Features:       []types.Feature{types.VPN},
+		StartPort:      2000,
+		EndPort:        5000,
+		InternetAccess: false,
+	})
+
+	r := reloadServerConfig("test")
+	if r.Error != "" {
+		t.Fatalf("unexpected error: %s", r.Error)
+	}
+	if !r.RestartRequired {
+		t.Error("expected a restart to be required for EndPort")
+	}
+	C := Config.Load()
+	if C.InternetAccess {
+		t.Error("live change to InternetAccess was not applied")
+	}
+	if C.EndPort != 3000 {
+		t.Errorf("restart-required EndPort should keep its running value, got %d", C.EndPort)
+	}
+	if lastConfigReload.Load() != r {
+		t.Error("last reload was not stored")
+	}
+
+	// Invalid configs are rejected and the running config is kept
+	write(&types.ServerConfig{InternetAccess: true})
+	r = reloadServerConfig("test")
+	if r.Error == "" {
+		t.Error("expected an error for a config without features")
+	}
+	if Config.Load() != C {
+		t.Error("running config was replaced by an invalid config")
+	}
+}
+
+func Test_watchFiles(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	events := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := watchFiles(ctx, []string{path}, events); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+		t.Fatal("unexpected event for another file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event for the config file")
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-events:
+	default:
+	}
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+		t.Fatal("unexpected event after the watcher was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
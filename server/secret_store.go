@@ -1,54 +1,301 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tunnels-is/tunnels/types"
+	"golang.org/x/sync/singleflight"
 )
 
-func loadStringSliceKey(key string) []string {
-	config := Config.Load()
-	switch config.SecretStore {
+// SecretProvider returns the value of a secret, a secret that
+// does not exist is returned as an empty string without an error.
+type SecretProvider interface {
+	Get(key string) (string, error)
+}
+
+var secretProvider atomic.Pointer[SecretProvider]
+
+// initSecretProvider creates the provider for the configured secret
+// store. The store can not be changed without a restart.
+func initSecretProvider() (err error) {
+	p, err := newSecretProvider(Config.Load())
+	if err != nil {
+		return err
+	}
+	secretProvider.Store(&p)
+	return nil
+}
+
+func newSecretProvider(C *types.ServerConfig) (p SecretProvider, err error) {
+	switch C.SecretStore {
+	case types.EnvStore, "":
+		return envSecrets{}, nil
 	case types.ConfigStore:
+		return configSecrets{}, nil
+	case types.FileStore:
+		dir := C.SecretDir
+		if dir == "" {
+			dir = "/run/secrets"
+		}
+		return &fileSecrets{Dir: dir}, nil
+	case types.SystemdStore:
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, errors.New("CREDENTIALS_DIRECTORY is not set, is LoadCredential configured in the unit file?")
+		}
+		return &fileSecrets{Dir: dir}, nil
+	case types.HTTPStore:
+		if C.SecretURL == "" {
+			return nil, errors.New("SecretURL is required for the http secret store")
+		}
+		return newHTTPSecrets(
+			C.SecretURL,
+			os.Getenv("SECRET_STORE_TOKEN"),
+			time.Duration(C.SecretTTLSeconds)*time.Second,
+		), nil
+	}
+	return nil, fmt.Errorf("unknown secret store: %s", C.SecretStore)
+}
+
+func loadSecret(key string) (v string) {
+	var p SecretProvider
+	if sp := secretProvider.Load(); sp != nil {
+		p = *sp
+	} else {
+		var err error
+		p, err = newSecretProvider(Config.Load())
+		if err != nil {
+			WARN("unable to create secret provider:", err)
+			return ""
+		}
+	}
+
+	v, err := p.Get(key)
+	if err != nil {
+		WARN("unable to load secret:", key, err)
+		return ""
+	}
+	return v
+}
+
+// loadStringSliceKey loads a list of values, stores other
+// than "config" keep the list as a comma separated string.
+func loadStringSliceKey(key string) (list []string) {
+	config := Config.Load()
+	if config.SecretStore == types.ConfigStore {
 		switch key {
 		case "CertPems":
 			return config.CertPems
 		case "KeyPems":
 			return config.KeyPems
 		}
-		return config.KeyPems
-	case types.EnvStore:
-		return strings.Split(os.Getenv(key), ",")
+		return []string{}
+	}
+
+	for v := range strings.SplitSeq(loadSecret(key), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
 	}
+	return list
+}
 
-	return []string{}
+// loadPEM returns the PEM encoded data for a key or certificate. The
+// value can be a PEM block or the path to a file containing one.
+func loadPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
 }
 
-func loadSecret(key string) (v string) {
+func loadSecretPEM(key string) ([]byte, error) {
+	v := loadSecret(key)
+	if v == "" {
+		return nil, fmt.Errorf("secret %s is not set", key)
+	}
+	return loadPEM(v)
+}
+
+type envSecrets struct{}
+
+func (envSecrets) Get(key string) (string, error) {
+	return os.Getenv(key), nil
+}
+
+// configSecrets reads the secret fields of the running config
+type configSecrets struct{}
+
+func (configSecrets) Get(key string) (string, error) {
 	config := Config.Load()
-	switch config.SecretStore {
-	case types.ConfigStore:
-		config := Config.Load()
-		switch key {
-		case "KeyPem":
-			return config.KeyPem
-		case "CertPem":
-			return config.CertPem
-		case "SignPem":
-			return config.SignPem
-		case "AdminAPIKey":
-			return config.AdminAPIKey
-		case "TwoFactorKey":
-			return config.TwoFactorKey
-		case "DBurl":
-			return config.DBurl
-		default:
-			return ""
+	switch key {
+	case "KeyPem":
+		return config.KeyPem, nil
+	case "CertPem":
+		return config.CertPem, nil
+	case "SignPem":
+		return config.SignPem, nil
+	case "AdminAPIKey":
+		return config.AdminAPIKey, nil
+	case "TwoFactorKey":
+		return config.TwoFactorKey, nil
+	case "DBurl":
+		return config.DBurl, nil
+	case "PayKey":
+		return config.PayKey, nil
+	case "MetricsToken":
+		return config.MetricsToken, nil
+	case "EventSecret":
+		return config.EventSecret, nil
+	}
+	return "", nil
+}
+
+// fileSecrets reads one file per secret, named after the key. This
+// is the layout used by docker/podman secrets and systemd credentials.
+type fileSecrets struct {
+	Dir string
+}
+
+func (f *fileSecrets) Get(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid secret name: %q", key)
+	}
+	b, err := os.ReadFile(filepath.Join(f.Dir, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// httpSecrets fetches secrets from a key/value HTTP API. The response
+// can be a Vault KV v1 or v2 document with the secret stored under
+// "value", or a plain {"value": "..."} object.
+type httpSecrets struct {
+	URL    string
+	Token  string
+	TTL    time.Duration
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*cachedSecret
+	group singleflight.Group
+}
+
+func newHTTPSecrets(baseURL string, token string, ttl time.Duration) *httpSecrets {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &httpSecrets{
+		URL:    strings.TrimSuffix(baseURL, "/"),
+		Token:  token,
+		TTL:    ttl,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		cache:  make(map[string]*cachedSecret),
+	}
+}
+
+type httpSecretResponse struct {
+	Value string `json:"value"`
+	Data  struct {
+		Value string `json:"value"`
+		Data  struct {
+			Value string `json:"value"`
+		} `json:"data"`
+	} `json:"data"`
+}
+
+// Get returns the cached secret or fetches it, the lock is not held
+// during the fetch so a slow secret store only delays callers that
+// need the same expired secret.
+func (h *httpSecrets) Get(key string) (string, error) {
+	h.mu.Lock()
+	cached := h.cache[key]
+	h.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	v, err, _ := h.group.Do(key, func() (any, error) {
+		v, err := h.fetch(key)
+		if err != nil {
+			return "", err
+		}
+		h.mu.Lock()
+		h.cache[key] = &cachedSecret{
+			value:   v,
+			expires: time.Now().Add(h.TTL),
 		}
-	case types.EnvStore:
-		return os.Getenv(key)
+		h.mu.Unlock()
+		return v, nil
+	})
+	if err != nil {
+		// A stale value is better than no value while the
+		// secret store is unreachable.
+		if cached != nil {
+			WARN("unable to refresh secret, using cached value:", key, err)
+			return cached.value, nil
+		}
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func (h *httpSecrets) fetch(key string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, h.URL+"/"+url.PathEscape(key), nil)
+	if err != nil {
+		return "", err
 	}
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+		req.Header.Set("X-Vault-Token", h.Token)
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-	return ""
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secret store returned %s", resp.Status)
+	}
+
+	sr := new(httpSecretResponse)
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(sr)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case sr.Data.Data.Value != "":
+		return sr.Data.Data.Value, nil
+	case sr.Data.Value != "":
+		return sr.Data.Value, nil
+	}
+	return sr.Value, nil
 }
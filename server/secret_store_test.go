@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_newSecretProvider(t *testing.T) {
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+
+	tests := []struct {
+		name      string
+		config    *types.ServerConfig
+		expectErr bool
+	}{
+		{"env", &types.ServerConfig{SecretStore: types.EnvStore}, false},
+		{"config", &types.ServerConfig{SecretStore: types.ConfigStore}, false},
+		{"file", &types.ServerConfig{SecretStore: types.FileStore}, false},
+		{"systemd without credentials", &types.ServerConfig{SecretStore: types.SystemdStore}, true},
+		{"http without url", &types.ServerConfig{SecretStore: types.HTTPStore}, true},
+		{"http", &types.ServerConfig{SecretStore: types.HTTPStore, SecretURL: "http://127.0.0.1"}, false},
+		{"unknown", &types.ServerConfig{SecretStore: "vault"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSecretProvider(tt.config)
+			if tt.expectErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func Test_fileSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "DBurl"), []byte("mongodb://db\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	for _, store := range []types.SecretStore{types.FileStore, types.SystemdStore} {
+		t.Run(string(store), func(t *testing.T) {
+			p, err := newSecretProvider(&types.ServerConfig{SecretStore: store, SecretDir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := p.Get("DBurl")
+			if err != nil || v != "mongodb://db" {
+				t.Errorf("expected mongodb://db, got %q (%v)", v, err)
+			}
+			v, err = p.Get("PayKey")
+			if err != nil || v != "" {
+				t.Errorf("expected a missing secret to be empty, got %q (%v)", v, err)
+			}
+			if _, err = p.Get("../DBurl"); err == nil {
+				t.Error("expected an error for a path outside the secret directory")
+			}
+		})
+	}
+}
+
+func Test_httpSecrets(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	var requests atomic.Int32
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/secrets/TwoFactorKey":
+			_, _ = w.Write([]byte(`{"data":{"data":{"value":"kv2"},"metadata":{"version":1}}}`))
+		case "/secrets/DBurl":
+			_, _ = w.Write([]byte(`{"data":{"value":"kv1"}}`))
+		case "/secrets/PayKey":
+			_, _ = w.Write([]byte(`{"value":"plain"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	h := newHTTPSecrets(srv.URL+"/secrets/", "token", time.Minute)
+	for key, expected := range map[string]string{
+		"TwoFactorKey": "kv2",
+		"DBurl":        "kv1",
+		"PayKey":       "plain",
+		"KeyPem":       "",
+	} {
+		v, err := h.Get(key)
+		if err != nil || v != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", key, expected, v, err)
+		}
+	}
+
+	before := requests.Load()
+	_, _ = h.Get("DBurl")
+	if requests.Load() != before {
+		t.Error("cached secret was fetched again before the TTL expired")
+	}
+
+	// Expired secrets fall back to the cached value while the store is down
+	down.Store(true)
+	h.cache["DBurl"].expires = time.Now().Add(-time.Second)
+	v, err := h.Get("DBurl")
+	if err != nil || v != "kv1" {
+		t.Errorf("expected the stale value, got %q (%v)", v, err)
+	}
+	if _, err = h.Get("MetricsToken"); err == nil {
+		t.Error("expected an error for an uncached secret while the store is down")
+	}
+
+	unauthorized := newHTTPSecrets(srv.URL+"/secrets", "wrong", time.Minute)
+	down.Store(false)
+	if _, err = unauthorized.Get("DBurl"); err == nil {
+		t.Error("expected an error for an invalid token")
+	}
+}
+
+func Test_httpSecrets_SlowFetch(t *testing.T) {
+	var requests atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/PayKey" {
+			_, _ = w.Write([]byte(`{"value":"plain"}`))
+			return
+		}
+		if requests.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		_, _ = w.Write([]byte(`{"value":"slow"}`))
+	}))
+	defer srv.Close()
+
+	h := newHTTPSecrets(srv.URL, "", time.Minute)
+	if _, err := h.Get("PayKey"); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan string, 2)
+	for range 2 {
+		go func() {
+			v, _ := h.Get("DBurl")
+			results <- v
+		}()
+	}
+	<-started
+
+	// Other secrets are served while DBurl is being fetched
+	done := make(chan struct{})
+	go func() {
+		_, _ = h.Get("PayKey")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached secret was blocked by a slow fetch")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for range 2 {
+		if v := <-results; v != "slow" {
+			t.Errorf("expected %q, got %q", "slow", v)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected a single fetch, got %d", n)
+	}
+}
+
+func Test_loadStringSliceKey(t *testing.T) {
+	t.Setenv("KeyPems", " a.pem, ,b.pem")
+	t.Setenv("CertPems", "")
+	Config.Store(&types.ServerConfig{SecretStore: types.EnvStore})
+
+	keys := loadStringSliceKey("KeyPems")
+	if len(keys) != 2 || keys[0] != "a.pem" || keys[1] != "b.pem" {
+		t.Errorf("unexpected KeyPems: %q", keys)
+	}
+	if certs := loadStringSliceKey("CertPems"); len(certs) != 0 {
+		t.Errorf("expected no CertPems, got %q", certs)
+	}
+
+	Config.Store(&types.ServerConfig{SecretStore: types.ConfigStore, CertPems: []string{"c.pem"}})
+	if certs := loadStringSliceKey("CertPems"); len(certs) != 1 || certs[0] != "c.pem" {
+		t.Errorf("unexpected CertPems: %q", certs)
+	}
+	if other := loadStringSliceKey("Other"); len(other) != 0 {
+		t.Errorf("expected unknown keys to be empty, got %q", other)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Sessions are listed on /v3/sessions and read or removed on
+// /v3/sessions/{index}. UserID and DeviceID are the hashes stored on
+// the session, the list can be filtered with ?user=<hash>.
+
+type Session struct {
+	Index              int
+	UserID             string
+	DeviceID           string
+	Version            int
+	Created            time.Time
+	LastPingFromClient time.Time
+	Address            string `json:",omitempty"`
+	LANAddress         string `json:",omitempty"`
+	Hostname           string `json:",omitempty"`
+	StartPort          uint16
+	EndPort            uint16
+	PortBlocks         int
+	SiteNetworks       int
+	IngressQueue       int
+	EgressQueue        int
+	CPU                byte
+	RAM                byte
+	Disk               byte
+}
+
+type KickRequest struct {
+	Reason string
+}
+
+const defaultKickReason = "removed by an administrator"
+
+func newSession(index int, CM *UserCoreMapping) (s *Session) {
+	s = &Session{
+		Index:              index,
+		UserID:             CM.ID,
+		DeviceID:           CM.DeviceToken,
+		Version:            CM.Version,
+		Created:            CM.Created,
+		LastPingFromClient: CM.LastPingFromClient,
+		PortBlocks:         len(CM.PortBlocks),
+		SiteNetworks:       len(CM.SiteNetworks),
+		IngressQueue:       len(CM.ToUser),
+		EgressQueue:        len(CM.FromUser),
+		CPU:                CM.CPU,
+		RAM:                CM.RAM,
+		Disk:               CM.Disk,
+	}
+	if CM.Addr != nil {
+		s.Address = sockaddrToString(CM.Addr)
+	}
+	if CM.DHCP != nil {
+		s.LANAddress = fmt.Sprintf("%d.%d.%d.%d", CM.DHCP.IP[0], CM.DHCP.IP[1], CM.DHCP.IP[2], CM.DHCP.IP[3])
+		s.Hostname = CM.DHCP.Hostname
+	}
+	if CM.PortRange != nil {
+		s.StartPort = CM.PortRange.StartPort
+		s.EndPort = CM.PortRange.EndPort
+	}
+	return s
+}
+
+func listSessions(userID string) (sessions []*Session) {
+	sessions = make([]*Session, 0)
+	for i := range clientCoreMappings {
+		CM := clientCoreMappings[i]
+		if CM == nil {
+			continue
+		}
+		if userID != "" && CM.ID != userID {
+			continue
+		}
+		sessions = append(sessions, newSession(i, CM))
+	}
+	return sessions
+}
+
+// kickSession tells the client why it is being removed, the session
+// is removed even if the message can not be sent.
+func kickSession(index int, reason string) (err error) {
+	if index < 0 || index >= len(clientCoreMappings) {
+		return errors.New("session not found")
+	}
+	CM := clientCoreMappings[index]
+	if CM == nil {
+		return errors.New("session not found")
+	}
+	if reason == "" {
+		reason = defaultKickReason
+	}
+
+	err = sendControlMessage(CM, types.ControlKick, &types.KickMessage{Reason: reason})
+	if err != nil {
+		LOG("unable to send kick message:", index, err)
+	}
+
+	e := sessionEvent(index, CM)
+	e.Reason = reason
+	publishEvent(EventSessionKick, e)
+
+	INFO("kicking session:", index, reason)
+	CM.Delete.Do(func() {
+		NukeClient(index)
+	})
+	return nil
+}
+
+func API_Sessions(w http.ResponseWriter, r *http.Request) {
+	defer BasicRecover()
+	if !HTTP_validateKey(r) {
+		senderr(w, 401, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		senderr(w, 405, "method not allowed")
+		return
+	}
+	sendObject(w, listSessions(r.URL.Query().Get("user")))
+}
+
+func API_Session(w http.ResponseWriter, r *http.Request) {
+	defer BasicRecover()
+	if !HTTP_validateKey(r) {
+		senderr(w, 401, "Unauthorized")
+		return
+	}
+
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(clientCoreMappings) {
+		senderr(w, 400, "invalid session index")
+		return
+	}
+	CM := clientCoreMappings[index]
+	if CM == nil {
+		senderr(w, 404, "session not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sendObject(w, newSession(index, CM))
+	case http.MethodDelete:
+		F := new(KickRequest)
+		if r.ContentLength != 0 {
+			err = decodeBody(r, F)
+			if err != nil {
+				senderr(w, 400, err.Error())
+				return
+			}
+		}
+		err = kickSession(index, F.Reason)
+		if err != nil {
+			senderr(w, 404, err.Error())
+			return
+		}
+		w.WriteHeader(200)
+	default:
+		senderr(w, 405, "method not allowed")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func Test_API_Sessions(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	Config.Store(&types.ServerConfig{AdminAPIKey: "key"})
+
+	newCM := func(user string) *UserCoreMapping {
+		return &UserCoreMapping{
+			ID:          user,
+			DeviceToken: "device-" + user,
+			Created:     time.Now(),
+			PortRange:   &PortRange{StartPort: 2000, EndPort: 2499},
+			ToUser:      make(chan []byte, 1),
+			FromUser:    make(chan Packet, 1),
+		}
+	}
+	clientCoreMappings[20] = newCM("a")
+	clientCoreMappings[21] = newCM("b")
+	t.Cleanup(func() {
+		clientCoreMappings[20] = nil
+		clientCoreMappings[21] = nil
+	})
+
+	call := func(handler http.HandlerFunc, method string, path string, index string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-KEY", "key")
+		if index != "" {
+			req.SetPathValue("index", index)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected []int
+	}{
+		{"all sessions", "/v3/sessions", []int{20, 21}},
+		{"by user", "/v3/sessions?user=b", []int{21}},
+		{"unknown user", "/v3/sessions?user=c", []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := call(API_Sessions, http.MethodGet, tt.path, "", "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rec.Code)
+			}
+			var sessions []*Session
+			if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != len(tt.expected) {
+				t.Fatalf("expected %d sessions, got %d", len(tt.expected), len(sessions))
+			}
+			for i, v := range sessions {
+				if v.Index != tt.expected[i] {
+					t.Errorf("expected index %d, got %d", tt.expected[i], v.Index)
+				}
+			}
+		})
+	}
+
+	rec := call(API_Session, http.MethodGet, "/v3/sessions/20", "20", "")
+	var s Session
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.UserID != "a" || s.DeviceID != "device-a" || s.StartPort != 2000 || s.EndPort != 2499 {
+		t.Errorf("unexpected session: %+v", s)
+	}
+
+	rec = call(API_Session, http.MethodDelete, "/v3/sessions/20", "20", `{"Reason":"test"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if clientCoreMappings[20] != nil {
+		t.Error("session was not removed")
+	}
+
+	for _, v := range []struct {
+		method   string
+		index    string
+		expected int
+	}{
+		{http.MethodGet, "20", http.StatusNotFound},
+		{http.MethodDelete, "20", http.StatusNotFound},
+		{http.MethodGet, "x", http.StatusBadRequest},
+		{http.MethodGet, "70000", http.StatusBadRequest},
+	} {
+		if rec = call(API_Session, v.method, "/v3/sessions/"+v.index, v.index, ""); rec.Code != v.expected {
+			t.Errorf("%s %s: expected %d, got %d", v.method, v.index, v.expected, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v3/sessions", nil)
+	rec = httptest.NewRecorder()
+	API_Sessions(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without an API key, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/tunnels-is/tunnels/certs"
+	"github.com/tunnels-is/tunnels/crypt"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// Connect requests are signed by the controller and handshakes by the
+// VPN server, both with their primary signing key. Signatures carry the
+// key ID (a fingerprint of the public key) and are verified against
+// every key that is valid at that moment, which lets a key be replaced
+// while clients and servers still know the old one.
+//
+// Rotating a key:
+//
+//  1. `server -generateKey` creates a new key in keys/ and adds it to
+//     SigningKeys. It is published on /v3/keys but not used yet.
+//  2. Add the new key to PubKeys of the server on the controller, and
+//     to VerifyKeys on the VPN servers if this is a controller.
+//  3. Wait for the overlap period, KeyOverlapHours (default 7 days).
+//  4. `server -promoteKey <ID>` makes the new key primary. The previous
+//     primary key stays valid for another KeyOverlapHours.
+//  5. Remove the old key once it has expired.
+//
+// KeyPem/CertPem is also the API certificate, Server.PubKey keeps
+// pointing at it when signing keys are rotated.
+
+const defaultKeyOverlapHours = 7 * 24
+
+type signingKey struct {
+	ID        string
+	Private   any
+	Public    any
+	CertPEM   []byte
+	NotBefore time.Time
+	NotAfter  time.Time
+	Primary   bool
+}
+
+func (k *signingKey) validAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+var (
+	// keys owned by this server
+	signingKeys atomic.Pointer[[]*signingKey]
+	// keys accepted on connect requests
+	verifyKeys atomic.Pointer[[]*signingKey]
+)
+
+func loadSigningKey(keyPEM []byte, certPEM []byte) (k *signingKey, err error) {
+	k = new(signingKey)
+	if keyPEM != nil {
+		k.Private, _, err = crypt.LoadPrivateKeyBytes(keyPEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+	k.Public, _, err = crypt.LoadPublicKeyBytes(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	k.ID, err = crypt.KeyID(k.Public)
+	if err != nil {
+		return nil, err
+	}
+	k.CertPEM = certPEM
+	return k, nil
+}
+
+// loadSigningKeys loads KeyPem/CertPem followed by SigningKeys
+func loadSigningKeys(C *types.ServerConfig) (keys []*signingKey, err error) {
+	keyPEM, err := loadSecretPEM("KeyPem")
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := loadSecretPEM("CertPem")
+	if err != nil {
+		return nil, err
+	}
+	base, err := loadSigningKey(keyPEM, certPEM)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, base)
+
+	hasPrimary := false
+	for _, v := range C.SigningKeys {
+		var k *signingKey
+		if v.KeyPem == "" && v.CertPem == "" {
+			for _, ek := range keys {
+				if ek.ID == v.ID {
+					k = ek
+				}
+			}
+			if k == nil {
+				return nil, fmt.Errorf("signing key %s has no KeyPem/CertPem", v.ID)
+			}
+		} else {
+			keyPEM, err := loadPEM(v.KeyPem)
+			if err != nil {
+				return nil, err
+			}
+			certPEM, err := loadPEM(v.CertPem)
+			if err != nil {
+				return nil, err
+			}
+			k, err = loadSigningKey(keyPEM, certPEM)
+			if err != nil {
+				return nil, err
+			}
+			if v.ID != "" && v.ID != k.ID {
+				return nil, fmt.Errorf("signing key %s has ID %s", v.ID, k.ID)
+			}
+			if k.ID == base.ID {
+				k = base
+			} else {
+				keys = append(keys, k)
+			}
+		}
+		k.NotBefore = v.NotBefore
+		k.NotAfter = v.NotAfter
+		k.Primary = v.Primary
+		hasPrimary = hasPrimary || v.Primary
+	}
+	if !hasPrimary {
+		base.Primary = true
+	}
+
+	return keys, nil
+}
+
+// loadVerifyKeys returns the keys accepted on connect requests, a
+// server with AUTH and VPN enabled accepts its own signing keys.
+func loadVerifyKeys(C *types.ServerConfig, own []*signingKey) (keys []*signingKey, err error) {
+	if AUTHEnabled && VPNEnabled {
+		return own, nil
+	}
+
+	signPEM, err := loadSecretPEM("SignPem")
+	if err != nil {
+		return nil, err
+	}
+	k, err := loadSigningKey(nil, signPEM)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, k)
+
+	for _, v := range C.VerifyKeys {
+		certPEM, err := loadPEM(v.PEM)
+		if err != nil {
+			return nil, err
+		}
+		k, err := loadSigningKey(nil, certPEM)
+		if err != nil {
+			return nil, err
+		}
+		if v.ID != "" && v.ID != k.ID {
+			return nil, fmt.Errorf("verify key %s has ID %s", v.ID, k.ID)
+		}
+		k.NotBefore = v.NotBefore
+		k.NotAfter = v.NotAfter
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// reloadSigningKeys replaces the signing and verification keys, the
+// current keys are kept if any of the new ones can not be loaded.
+func reloadSigningKeys() (err error) {
+	C := Config.Load()
+	own, err := loadSigningKeys(C)
+	if err != nil {
+		return err
+	}
+	verify, err := loadVerifyKeys(C, own)
+	if err != nil {
+		return err
+	}
+	signingKeys.Store(&own)
+	verifyKeys.Store(&verify)
+
+	for _, k := range own {
+		if k.Primary && !k.validAt(time.Now()) {
+			WARN("primary signing key is outside of its validity window:", k.ID)
+		}
+	}
+	return nil
+}
+
+func primarySigningKey() (*signingKey, error) {
+	keys := signingKeys.Load()
+	if keys == nil {
+		return nil, errors.New("no signing keys loaded")
+	}
+	for _, k := range *keys {
+		if k.Primary && k.validAt(time.Now()) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("no valid primary signing key")
+}
+
+// signData signs with the primary signing key
+func signData(data []byte) (signature []byte, keyID string, err error) {
+	k, err := primarySigningKey()
+	if err != nil {
+		return nil, "", err
+	}
+	signature, err = crypt.SignData(data, k.Private)
+	if err != nil {
+		return nil, "", err
+	}
+	return signature, k.ID, nil
+}
+
+// verifyConnectRequest checks the signature against the key with the
+// same ID, requests without an ID are checked against every valid key.
+func verifyConnectRequest(SCR *types.SignedConnectRequest) (err error) {
+	keys := verifyKeys.Load()
+	if keys == nil {
+		return errors.New("no verification keys loaded")
+	}
+
+	now := time.Now()
+	err = fmt.Errorf("unknown signing key: %s", SCR.KeyID)
+	for _, k := range *keys {
+		if SCR.KeyID != "" && k.ID != SCR.KeyID {
+			continue
+		}
+		if !k.validAt(now) {
+			err = fmt.Errorf("signing key %s is not valid", k.ID)
+			continue
+		}
+		err = crypt.VerifySignature(SCR.Payload, SCR.Signature, k.Public)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// publishedKeys returns the signing keys that have not expired, clients
+// should know a key before it becomes primary.
+func publishedKeys() (keys []*types.PublicKey) {
+	own := signingKeys.Load()
+	if own == nil {
+		return keys
+	}
+	now := time.Now()
+	for _, k := range *own {
+		if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) {
+			continue
+		}
+		keys = append(keys, &types.PublicKey{
+			ID:        k.ID,
+			PEM:       string(k.CertPEM),
+			NotBefore: k.NotBefore,
+			NotAfter:  k.NotAfter,
+		})
+	}
+	return keys
+}
+
+func API_SigningKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		senderr(w, 405, "method not allowed")
+		return
+	}
+	sendObject(w, publishedKeys())
+}
+
+func keyOverlap(C *types.ServerConfig) time.Duration {
+	return time.Duration(C.KeyOverlapHours) * time.Hour
+}
+
+// generateSigningKey creates a new key next to the config file and adds
+// it to SigningKeys, the key is not used for signing until promoted.
+func generateSigningKey() (key *types.SigningKey, err error) {
+	dir := filepath.Join(filepath.Dir(serverConfigPath), "keys")
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	CR, err := certs.MakeCertV2(certs.ECDSA, "", "", []string{}, []string{}, "", time.Time{}, false)
+	if err != nil {
+		return nil, err
+	}
+	id, err := crypt.KeyID(CR.Pub)
+	if err != nil {
+		return nil, err
+	}
+
+	key = &types.SigningKey{
+		ID:        id,
+		KeyPem:    filepath.Join(dir, id+".key"),
+		CertPem:   filepath.Join(dir, id+".pem"),
+		NotBefore: time.Now(),
+	}
+	err = os.WriteFile(key.KeyPem, CR.KeyPem, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(key.CertPem, CR.CertPem, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	C := Config.Load()
+	C.SigningKeys = append(C.SigningKeys, key)
+	Config.Store(C)
+	return key, SaveServerConfig(serverConfigPath)
+}
+
+// promoteSigningKey makes a key primary, the previous primary key
+// expires after the overlap period.
+func promoteSigningKey(id string) (err error) {
+	C := Config.Load()
+	keys, err := loadSigningKeys(C)
+	if err != nil {
+		return err
+	}
+
+	var previous *signingKey
+	var next *types.SigningKey
+	for _, k := range keys {
+		if k.Primary {
+			previous = k
+		}
+	}
+	for _, v := range C.SigningKeys {
+		if v.ID == id {
+			next = v
+		}
+	}
+	if next == nil {
+		return fmt.Errorf("signing key %s not found in SigningKeys", id)
+	}
+	if previous != nil && previous.ID == id {
+		return fmt.Errorf("signing key %s is already primary", id)
+	}
+
+	overlap := keyOverlap(C)
+	if time.Since(next.NotBefore) < overlap {
+		WARN("signing key was published less than", overlap, "ago, clients might not know it yet")
+	}
+
+	next.Primary = true
+	next.NotAfter = time.Time{}
+	if previous != nil {
+		found := false
+		for _, v := range C.SigningKeys {
+			if v.ID == previous.ID {
+				v.Primary = false
+				v.NotAfter = time.Now().Add(overlap)
+				found = true
+			}
+		}
+		if !found {
+			C.SigningKeys = append(C.SigningKeys, &types.SigningKey{
+				ID:       previous.ID,
+				NotAfter: time.Now().Add(overlap),
+			})
+		}
+	}
+
+	Config.Store(C)
+	return SaveServerConfig(serverConfigPath)
+}
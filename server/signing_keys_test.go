@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tunnels-is/tunnels/certs"
+	"github.com/tunnels-is/tunnels/crypt"
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func writeTestSigningKey(t *testing.T, dir string, name string) *types.SigningKey {
+	t.Helper()
+	CR, err := certs.MakeCertV2(certs.ECDSA, "", "", []string{}, []string{}, "", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := crypt.KeyID(CR.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &types.SigningKey{
+		ID:      id,
+		KeyPem:  filepath.Join(dir, name+".key"),
+		CertPem: filepath.Join(dir, name+".pem"),
+	}
+	if err := os.WriteFile(key.KeyPem, CR.KeyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key.CertPem, CR.CertPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func setupSigningKeys(t *testing.T) (base *types.SigningKey, C *types.ServerConfig) {
+	t.Helper()
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	previousAuth, previousVPN := AUTHEnabled, VPNEnabled
+	AUTHEnabled, VPNEnabled = true, true
+	t.Cleanup(func() {
+		AUTHEnabled, VPNEnabled = previousAuth, previousVPN
+		signingKeys.Store(nil)
+		verifyKeys.Store(nil)
+	})
+
+	dir := t.TempDir()
+	base = writeTestSigningKey(t, dir, "base")
+	C = &types.ServerConfig{
+		Features:    []types.Feature{types.VPN, types.AUTH},
+		SecretStore: types.ConfigStore,
+		KeyPem:      base.KeyPem,
+		CertPem:     base.CertPem,
+	}
+	return base, C
+}
+
+func signTestRequest(t *testing.T) *types.SignedConnectRequest {
+	t.Helper()
+	SCR := &types.SignedConnectRequest{Payload: []byte(`{"UserID":"test"}`)}
+	var err error
+	SCR.Signature, SCR.KeyID, err = signData(SCR.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SCR
+}
+
+func Test_signingKeyRotation(t *testing.T) {
+	base, C := setupSigningKeys(t)
+	next := writeTestSigningKey(t, t.TempDir(), "next")
+	C.SigningKeys = []*types.SigningKey{next}
+	Config.Store(C)
+
+	if err := reloadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is published but KeyPem is still used for signing
+	published := publishedKeys()
+	if len(published) != 2 || published[0].ID != base.ID || published[1].ID != next.ID {
+		t.Fatalf("unexpected published keys: %+v", published)
+	}
+	oldSCR := signTestRequest(t)
+	if oldSCR.KeyID != base.ID {
+		t.Errorf("expected signature from %s, got %s", base.ID, oldSCR.KeyID)
+	}
+
+	// Promote the new key and keep the old one valid for the overlap
+	next.Primary = true
+	C.SigningKeys = append(C.SigningKeys, &types.SigningKey{
+		ID:       base.ID,
+		NotAfter: time.Now().Add(time.Hour),
+	})
+	if err := reloadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	newSCR := signTestRequest(t)
+	if newSCR.KeyID != next.ID {
+		t.Errorf("expected signature from %s, got %s", next.ID, newSCR.KeyID)
+	}
+	for _, SCR := range []*types.SignedConnectRequest{oldSCR, newSCR} {
+		if err := verifyConnectRequest(SCR); err != nil {
+			t.Errorf("signature from %s was rejected: %s", SCR.KeyID, err)
+		}
+	}
+
+	// Requests without a key ID are checked against every key
+	legacy := *oldSCR
+	legacy.KeyID = ""
+	if err := verifyConnectRequest(&legacy); err != nil {
+		t.Errorf("signature without a key ID was rejected: %s", err)
+	}
+
+	// After the overlap the old key is no longer accepted or published
+	C.SigningKeys[1].NotAfter = time.Now().Add(-time.Second)
+	if err := reloadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyConnectRequest(oldSCR); err == nil {
+		t.Error("expected the expired key to be rejected")
+	}
+	if err := verifyConnectRequest(&legacy); err == nil {
+		t.Error("expected a signature from the expired key to be rejected")
+	}
+	if published := publishedKeys(); len(published) != 1 || published[0].ID != next.ID {
+		t.Errorf("unexpected published keys after expiry: %+v", published)
+	}
+
+	unknown := *newSCR
+	unknown.KeyID = "0000000000000000"
+	if err := verifyConnectRequest(&unknown); err == nil {
+		t.Error("expected an unknown key ID to be rejected")
+	}
+}
+
+func Test_loadSigningKeys_errors(t *testing.T) {
+	base, C := setupSigningKeys(t)
+	other := writeTestSigningKey(t, t.TempDir(), "other")
+
+	tests := []struct {
+		name string
+		keys []*types.SigningKey
+	}{
+		{"unknown window entry", []*types.SigningKey{{ID: "0000000000000000"}}},
+		{"wrong ID", []*types.SigningKey{{ID: base.ID, KeyPem: other.KeyPem, CertPem: other.CertPem}}},
+		{"missing file", []*types.SigningKey{{KeyPem: "missing.key", CertPem: "missing.pem"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			C.SigningKeys = tt.keys
+			if _, err := loadSigningKeys(C); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func Test_generateAndPromoteSigningKey(t *testing.T) {
+	base, C := setupSigningKeys(t)
+	previousPath := serverConfigPath
+	serverConfigPath = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { serverConfigPath = previousPath })
+	if err := validateConfig(C); err != nil {
+		t.Fatal(err)
+	}
+	Config.Store(C)
+
+	key, err := generateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(key.KeyPem); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := promoteSigningKey(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := promoteSigningKey(key.ID); err == nil {
+		t.Error("expected an error when promoting the primary key")
+	}
+
+	b, err := os.ReadFile(serverConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := new(types.ServerConfig)
+	if err := json.Unmarshal(b, saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.SigningKeys) != 2 {
+		t.Fatalf("expected 2 signing keys, got %d", len(saved.SigningKeys))
+	}
+	promoted, previous := saved.SigningKeys[0], saved.SigningKeys[1]
+	if promoted.ID != key.ID || !promoted.Primary {
+		t.Errorf("key %s was not promoted: %+v", key.ID, promoted)
+	}
+	if previous.ID != base.ID || previous.Primary {
+		t.Errorf("unexpected previous key: %+v", previous)
+	}
+	overlap := time.Until(previous.NotAfter)
+	if overlap < time.Duration(defaultKeyOverlapHours-1)*time.Hour || overlap > time.Duration(defaultKeyOverlapHours)*time.Hour {
+		t.Errorf("previous key expires in %s, expected the overlap period", overlap)
+	}
+}
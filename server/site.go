@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+// SiteRoute is a network advertised by a site-to-site client.
+// Network is the range other peers use to reach it, which is
+// the Nat range when the client is natting an overlapping network.
+type SiteRoute struct {
+	Tag     string
+	Network *net.IPNet
+	Client  *UserCoreMapping
+}
+
+var (
+	siteMutex  = sync.Mutex{}
+	siteRoutes atomic.Pointer[[]*SiteRoute]
+)
+
+func init() {
+	siteRoutes.Store(&[]*SiteRoute{})
+}
+
+func networksOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func parseSiteNetwork(n *types.Network) (advertised *net.IPNet, err error) {
+	if n == nil || n.Network == "" {
+		return nil, errors.New("site network is empty")
+	}
+
+	_, network, err := net.ParseCIDR(n.Network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid site network (%s): %s", n.Network, err)
+	}
+	advertised = network
+
+	if n.Nat != "" {
+		_, nat, err := net.ParseCIDR(n.Nat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid site nat (%s): %s", n.Nat, err)
+		}
+		ns, _ := network.Mask.Size()
+		nn, _ := nat.Mask.Size()
+		if ns != nn {
+			return nil, fmt.Errorf("site network (%s) and nat (%s) must be the same size", n.Network, n.Nat)
+		}
+		advertised = nat
+	}
+
+	if advertised.IP.To4() == nil {
+		return nil, fmt.Errorf("site network (%s) is not IPv4", advertised)
+	}
+	if !advertised.IP.IsPrivate() {
+		return nil, fmt.Errorf("site network (%s) is not a private network", advertised)
+	}
+	if ones, _ := advertised.Mask.Size(); ones < 8 {
+		return nil, fmt.Errorf("site network (%s) is too large", advertised)
+	}
+
+	return advertised, nil
+}
+
+func isNetAdmin(C *types.ServerConfig, CM *UserCoreMapping) bool {
+	for _, entity := range C.NetAdmins {
+		if entity == CM.DeviceToken || entity == CM.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// siteNetworkAllowed reports whether CM may advertise the network.
+// NetAdmins may advertise any network, everyone else needs a grant
+// that contains the whole network.
+func siteNetworkAllowed(C *types.ServerConfig, CM *UserCoreMapping, advertised *net.IPNet) bool {
+	if isNetAdmin(C, CM) {
+		return true
+	}
+	ones, _ := advertised.Mask.Size()
+	for _, g := range C.SiteNetworkGrants {
+		if g == nil || g.Identifier == "" {
+			continue
+		}
+		if g.Identifier != CM.DeviceToken && g.Identifier != CM.ID {
+			continue
+		}
+		for _, n := range g.Networks {
+			_, granted, err := net.ParseCIDR(n)
+			if err != nil {
+				continue
+			}
+			gones, _ := granted.Mask.Size()
+			if gones <= ones && granted.Contains(advertised.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// installSiteNetworks validates the networks advertised by a client and adds them
+// to the site routing table. Clients need to be NetAdmins or have a grant for
+// every network they advertise. Advertised networks can not overlap the LAN,
+// the server subnets or networks advertised by other clients, overlapping
+// networks need to be advertised with a Nat range.
+func installSiteNetworks(CM *UserCoreMapping, networks []*types.Network) (err error) {
+	Config := Config.Load()
+	if !Config.SiteToSite {
+		return errors.New("site-to-site is disabled on this server")
+	}
+	if len(networks) > Config.MaxSiteNetworks {
+		return fmt.Errorf("too many site networks, maximum is %d", Config.MaxSiteNetworks)
+	}
+
+	reserved := make([]*net.IPNet, 0)
+	if VPLNetwork != nil {
+		reserved = append(reserved, VPLNetwork)
+	}
+	for _, v := range Config.SubNets {
+		for _, n := range []string{v.Network, v.Nat} {
+			if n == "" {
+				continue
+			}
+			_, sn, err := net.ParseCIDR(n)
+			if err == nil {
+				reserved = append(reserved, sn)
+			}
+		}
+	}
+
+	siteMutex.Lock()
+	defer siteMutex.Unlock()
+
+	current := *siteRoutes.Load()
+	newRoutes := make([]*SiteRoute, 0, len(current)+len(networks))
+	for _, v := range current {
+		if v.Client == CM {
+			continue
+		}
+		newRoutes = append(newRoutes, v)
+	}
+
+	for _, n := range networks {
+		advertised, err := parseSiteNetwork(n)
+		if err != nil {
+			return err
+		}
+		if !siteNetworkAllowed(Config, CM, advertised) {
+			return fmt.Errorf("site network (%s) is not allowed for this device", advertised)
+		}
+		if InterfaceIP != nil && advertised.Contains(InterfaceIP) {
+			return fmt.Errorf("site network (%s) contains the server address", advertised)
+		}
+		for _, r := range reserved {
+			if networksOverlap(advertised, r) {
+				return fmt.Errorf("site network (%s) overlaps server network (%s), use Nat to remap it", advertised, r)
+			}
+		}
+		for _, r := range newRoutes {
+			if networksOverlap(advertised, r.Network) {
+				return fmt.Errorf("site network (%s) overlaps site network (%s), use Nat to remap it", advertised, r.Network)
+			}
+		}
+
+		newRoutes = append(newRoutes, &SiteRoute{
+			Tag:     n.Tag,
+			Network: advertised,
+			Client:  CM,
+		})
+	}
+
+	siteRoutes.Store(&newRoutes)
+	CM.SiteNetworks = networks
+	return nil
+}
+
+func removeSiteNetworks(CM *UserCoreMapping) (removed bool) {
+	siteMutex.Lock()
+	defer siteMutex.Unlock()
+
+	current := *siteRoutes.Load()
+	newRoutes := make([]*SiteRoute, 0, len(current))
+	for _, v := range current {
+		if v.Client == CM {
+			removed = true
+			continue
+		}
+		newRoutes = append(newRoutes, v)
+	}
+
+	if removed {
+		siteRoutes.Store(&newRoutes)
+	}
+	return removed
+}
+
+// lookupSiteRoute returns the client behind the most specific
+// site network containing ip, or nil.
+func lookupSiteRoute(ip [4]byte) (CM *UserCoreMapping) {
+	routes := *siteRoutes.Load()
+	if len(routes) == 0 {
+		return nil
+	}
+
+	longest := -1
+	for _, v := range routes {
+		if !v.Network.Contains(ip[:]) {
+			continue
+		}
+		ones, _ := v.Network.Mask.Size()
+		if ones > longest {
+			longest = ones
+			CM = v.Client
+		}
+	}
+	return CM
+}
+
+// siteNetworkList returns the site networks reachable by CM,
+// networks advertised by CM itself are left out.
+func siteNetworkList(CM *UserCoreMapping) (list []*types.Network) {
+	list = make([]*types.Network, 0)
+	for _, v := range *siteRoutes.Load() {
+		if v.Client == CM {
+			continue
+		}
+		list = append(list, &types.Network{
+			Tag:     v.Tag,
+			Network: v.Network.String(),
+		})
+	}
+	return list
+}
+
+func pushSiteNetworks(skip *UserCoreMapping) {
+	for i := range clientCoreMappings {
+		CM := clientCoreMappings[i]
+		if CM == nil || CM == skip || CM.Addr == nil {
+			continue
+		}
+		err := sendControlMessage(CM, types.ControlSiteNetworks, &types.SiteNetworksMessage{
+			Networks: siteNetworkList(CM),
+		})
+		if err != nil {
+			WARN("unable to push site networks to index:", i, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tunnels-is/tunnels/types"
+)
+
+func setupSiteTest(t *testing.T) {
+	t.Helper()
+	Config.Store(&types.ServerConfig{
+		SiteToSite:      true,
+		MaxSiteNetworks: 10,
+		SubNets: []*types.Network{
+			{Network: "172.16.0.0/24"},
+		},
+		NetAdmins: []string{"admin"},
+		SiteNetworkGrants: []*types.SiteNetworkGrant{
+			{Identifier: "site-a", Networks: []string{"192.168.1.0/24"}},
+			{Identifier: "site-b", Networks: []string{"192.168.0.0/16", "172.16.0.0/12", "8.8.8.0/24", "10.0.0.0/8"}},
+		},
+	})
+	_, VPLNetwork, _ = net.ParseCIDR("10.0.0.0/16")
+	siteRoutes.Store(&[]*SiteRoute{})
+	t.Cleanup(func() {
+		VPLNetwork = nil
+		siteRoutes.Store(&[]*SiteRoute{})
+	})
+}
+
+func Test_installSiteNetworks(t *testing.T) {
+	setupSiteTest(t)
+	siteA := &UserCoreMapping{DeviceToken: "site-a"}
+	siteB := &UserCoreMapping{ID: "site-b"}
+
+	err := installSiteNetworks(siteA, []*types.Network{
+		{Tag: "office", Network: "192.168.1.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		networks []*types.Network
+		wantErr  bool
+	}{
+		{name: "overlaps other site", networks: []*types.Network{{Network: "192.168.1.0/24"}}, wantErr: true},
+		{name: "overlaps lan", networks: []*types.Network{{Network: "10.0.5.0/24"}}, wantErr: true},
+		{name: "overlaps subnet", networks: []*types.Network{{Network: "172.16.0.0/16"}}, wantErr: true},
+		{name: "public network", networks: []*types.Network{{Network: "8.8.8.0/24"}}, wantErr: true},
+		{name: "nat size mismatch", networks: []*types.Network{{Network: "192.168.1.0/24", Nat: "192.168.50.0/23"}}, wantErr: true},
+		{name: "overlap remapped with nat", networks: []*types.Network{{Network: "192.168.1.0/24", Nat: "192.168.50.0/24"}}, wantErr: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := installSiteNetworks(siteB, tc.networks)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("installSiteNetworks() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if lookupSiteRoute([4]byte{192, 168, 1, 10}) != siteA {
+		t.Error("expected 192.168.1.10 to route to site A")
+	}
+	if lookupSiteRoute([4]byte{192, 168, 50, 10}) != siteB {
+		t.Error("expected 192.168.50.10 to route to site B")
+	}
+	if lookupSiteRoute([4]byte{192, 168, 2, 10}) != nil {
+		t.Error("expected 192.168.2.10 to have no site route")
+	}
+
+	list := siteNetworkList(siteA)
+	if len(list) != 1 || list[0].Network != "192.168.50.0/24" {
+		t.Errorf("unexpected site network list for site A: %v", list)
+	}
+
+	if !removeSiteNetworks(siteA) {
+		t.Error("expected site A networks to be removed")
+	}
+	if lookupSiteRoute([4]byte{192, 168, 1, 10}) != nil {
+		t.Error("expected site A route to be gone")
+	}
+}
+
+func Test_installSiteNetworks_Grants(t *testing.T) {
+	setupSiteTest(t)
+
+	tests := []struct {
+		name    string
+		client  *UserCoreMapping
+		network *types.Network
+		wantErr bool
+	}{
+		{name: "no grant", client: &UserCoreMapping{ID: "user"}, network: &types.Network{Network: "192.168.1.0/24"}, wantErr: true},
+		{name: "inside grant", client: &UserCoreMapping{DeviceToken: "site-a"}, network: &types.Network{Network: "192.168.1.128/25"}},
+		{name: "larger than grant", client: &UserCoreMapping{DeviceToken: "site-a"}, network: &types.Network{Network: "192.168.0.0/23"}, wantErr: true},
+		{name: "outside grant", client: &UserCoreMapping{DeviceToken: "site-a"}, network: &types.Network{Network: "192.168.2.0/24"}, wantErr: true},
+		{name: "nat range is checked", client: &UserCoreMapping{DeviceToken: "site-a"}, network: &types.Network{Network: "192.168.1.0/24", Nat: "192.168.9.0/24"}, wantErr: true},
+		{name: "net admin", client: &UserCoreMapping{ID: "admin"}, network: &types.Network{Network: "192.168.200.0/24"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := installSiteNetworks(tc.client, []*types.Network{tc.network})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("installSiteNetworks() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			removeSiteNetworks(tc.client)
+		})
+	}
+}
+
+func Test_installSiteNetworks_Disabled(t *testing.T) {
+	setupSiteTest(t)
+	Config.Store(&types.ServerConfig{MaxSiteNetworks: 10})
+
+	err := installSiteNetworks(new(UserCoreMapping), []*types.Network{
+		{Network: "192.168.1.0/24"},
+	})
+	if err == nil {
+		t.Error("expected an error when site-to-site is disabled")
+	}
+}
+
+func Test_lookupSiteRoute_LongestPrefix(t *testing.T) {
+	setupSiteTest(t)
+	wide := new(UserCoreMapping)
+	narrow := new(UserCoreMapping)
+	_, n1, _ := net.ParseCIDR("192.168.0.0/16")
+	_, n2, _ := net.ParseCIDR("192.168.7.0/24")
+	siteRoutes.Store(&[]*SiteRoute{
+		{Network: n1, Client: wide},
+		{Network: n2, Client: narrow},
+	})
+
+	if lookupSiteRoute([4]byte{192, 168, 7, 1}) != narrow {
+		t.Error("expected the most specific route to win")
+	}
+	if lookupSiteRoute([4]byte{192, 168, 8, 1}) != wide {
+		t.Error("expected the wide route to match")
+	}
+}
@@ -69,6 +69,7 @@ func CreateClientCoreMapping(CRR *types.ServerConnectResponse, CR *types.Control
 				clientCoreMappings[i].DeviceToken = hashIdentifier(CR.DeviceKey)
 			}
 
+			clientCoreMappings[i].Version = CR.Version
 			clientCoreMappings[i].EH = EH
 			clientCoreMappings[i].Created = time.Now()
 			clientCoreMappings[i].ToUser = make(chan []byte, 500_000)
@@ -95,6 +96,20 @@ func CreateClientCoreMapping(CRR *types.ServerConnectResponse, CR *types.Control
 			return 0, err
 		}
 		LOG(fmt.Sprintf("Assigned Index (%d)", index))
+
+		if len(CR.SiteNetworks) > 0 {
+			err = installSiteNetworks(clientCoreMappings[index], CR.SiteNetworks)
+			if err != nil {
+				WARN("Unable to install site networks:", err)
+				NukeClient(index)
+				return 0, err
+			}
+			pushSiteNetworks(clientCoreMappings[index])
+		}
+		CRR.SiteNetworks = siteNetworkList(clientCoreMappings[index])
+	} else if len(CR.SiteNetworks) > 0 {
+		NukeClient(index)
+		return 0, errors.New("site-to-site requires the LAN feature")
 	}
 
 	if CR.RequestingPorts {
@@ -177,6 +192,7 @@ func ExternalTCPListener() {
 		select {
 		case PM.Client.ToUser <- CopySlice(buffer[:n]):
 		default:
+			metricDropsTCP.Add(1)
 			WARN("TCP: packet channel full: ", DSTP)
 		}
 	}
@@ -252,6 +268,7 @@ func ExternalUDPListener() {
 		select {
 		case PM.Client.ToUser <- CopySlice(buffer[:n]):
 		default:
+			metricDropsUDP.Add(1)
 			WARN("UDP: packet channel full: ", DSTP)
 		}
 	}
@@ -298,6 +315,7 @@ func DataSocketListener() {
 			ERR(err)
 			return
 		}
+		metricBytesFromUsers.Add(uint64(n))
 		id = binary.BigEndian.Uint16(buff[0:2])
 		if clientCoreMappings[id] != nil {
 			clientCoreMappings[id].FromUser <- Packet{
@@ -341,7 +359,7 @@ func fromUserChannel(index int) {
 	var FIN byte
 	var SYN byte
 	var targetCM *UserCoreMapping
-	Config := Config.Load()
+	var cfg *types.ServerConfig
 
 	for {
 		payload, ok = <-CM.FromUser
@@ -349,6 +367,7 @@ func fromUserChannel(index int) {
 			shouldRestart = false
 			return
 		}
+		cfg = Config.Load()
 
 		if len(payload.data) > len(staging) {
 			panic("PAYLOAD BIGGER THEN STAGING .. THIS SHOULD NEVR HAPPEN")
@@ -361,10 +380,18 @@ func fromUserChannel(index int) {
 			payload.data[0:2],
 		)
 		if err != nil {
+			metricAuthFailures.Add(1)
 			ERR("Authentication error:", err)
 			continue
 		}
 
+		// Control messages can arrive from other sockets owned
+		// by the client, so they do not update the client address.
+		if types.IsControlMessage(PACKET) {
+			handleControlMessage(CM, payload.addr, CopySlice(PACKET))
+			continue
+		}
+
 		CM.Addr = payload.addr
 		if len(PACKET) < 20 {
 			switch PACKET[0] {
@@ -388,18 +415,33 @@ func fromUserChannel(index int) {
 		}
 
 		NIP = PACKET[16:20]
-		if LANEnabled && (NIP[0] == 10 && NIP[1] == 0) {
+		if LANEnabled {
 			D4[0] = NIP[0]
 			D4[1] = NIP[1]
 			D4[2] = NIP[2]
 			D4[3] = NIP[3]
 
-			targetCM = VPLIPToCore[D4[0]][D4[1]][D4[2]][D4[3]]
-			if targetCM == nil {
-				CM.DelHost(D4, "auto")
+			if PACKET[9] == 2 {
+				handleIGMP(CM, PACKET, cfg.LANMulticastGroups)
+				continue
+			}
+
+			if isLANMulticast(D4) && forwardLANMulticast(CM, PACKET, D4, cfg) {
 				continue
 			}
 
+			if NIP[0] == 10 && NIP[1] == 0 {
+				targetCM = VPLIPToCore[D4[0]][D4[1]][D4[2]][D4[3]]
+				if targetCM == nil {
+					CM.DelHost(D4, "auto")
+					continue
+				}
+			} else {
+				targetCM = lookupSiteRoute(D4)
+			}
+		}
+
+		if targetCM != nil {
 			l := (PACKET[0] & 0x0F) * 4
 			D4Port[0] = PACKET[l+2]
 			D4Port[1] = PACKET[l+3]
@@ -418,18 +460,19 @@ func fromUserChannel(index int) {
 			select {
 			case targetCM.ToUser <- CopySlice(PACKET):
 			default:
+				metricDropsLAN.Add(1)
 				WARN("Client channel full:", PACKET[12:16], ">", D4)
 			}
 			continue
 		}
 
-		if !Config.LocalNetworkAccess {
+		if !cfg.LocalNetworkAccess {
 			if IS_LOCAL(NIP) {
 				continue
 			}
 		}
 
-		if !Config.InternetAccess {
+		if !cfg.InternetAccess {
 			if !IS_LOCAL(NIP) {
 				continue
 			}
@@ -498,10 +541,11 @@ func toUserChannel(index int) {
 	var FIN byte
 	var RST byte
 	var originCM *UserCoreMapping
+	var isLAN bool
 	var isAdmin bool
 	var headLength byte
 	var activeHost *AllowedHost
-	Config := Config.Load()
+	var cfg *types.ServerConfig
 
 	for {
 		PACKET, ok = <-CM.ToUser
@@ -516,12 +560,30 @@ func toUserChannel(index int) {
 
 		// Server LAN feature is hardcoded to 10.0.X.X
 		// We might change this later
-		if LANEnabled && (PACKET[12] == 10 && PACKET[13] == 0) {
-			originCM = VPLIPToCore[PACKET[12]][PACKET[13]][PACKET[14]][PACKET[15]]
+		originCM = nil
+		isLAN = false
+		if LANEnabled {
+			S4[0] = PACKET[12]
+			S4[1] = PACKET[13]
+			S4[2] = PACKET[14]
+			S4[3] = PACKET[15]
+			if S4[0] == 10 && S4[1] == 0 {
+				isLAN = true
+				originCM = VPLIPToCore[S4[0]][S4[1]][S4[2]][S4[3]]
+			} else {
+				originCM = lookupSiteRoute(S4)
+				isLAN = originCM != nil
+			}
+		}
+
+		// Broadcast and multicast packets have already been
+		// filtered by the forwarding rules in fromUserChannel.
+		if isLAN && !isLANMulticast([4]byte(PACKET[16:20])) {
 			if !lanFirewallDisabled && !CM.DisableFirewall {
 				isAdmin = false
 				if originCM != nil {
-					for _, entity := range Config.NetAdmins {
+					cfg = Config.Load()
+					for _, entity := range cfg.NetAdmins {
 						if entity == originCM.DeviceToken || entity == originCM.ID {
 							isAdmin = true
 							break
@@ -534,11 +596,6 @@ func toUserChannel(index int) {
 					S4Port[0] = PACKET[headLength]
 					S4Port[1] = PACKET[headLength+1]
 
-					S4[0] = PACKET[12]
-					S4[1] = PACKET[13]
-					S4[2] = PACKET[14]
-					S4[3] = PACKET[15]
-
 					activeHost = CM.IsHostAllowed(S4, S4Port)
 					if activeHost == nil {
 						continue
@@ -559,13 +616,13 @@ func toUserChannel(index int) {
 			}
 		}
 
-		err = syscall.Sendto(dataSocketFD,
-			CM.EH.SEAL.Seal2(PACKET, CM.Uindex),
-			0, CM.Addr)
+		out := CM.EH.SEAL.Seal2(PACKET, CM.Uindex)
+		err = syscall.Sendto(dataSocketFD, out, 0, CM.Addr)
 		if err != nil {
 			WARN("dataSocketFD sendTo err:", err)
 			return
 		}
+		metricBytesToUsers.Add(uint64(len(out)))
 	}
 }
 
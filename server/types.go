@@ -32,6 +32,7 @@ type UserCoreMapping struct {
 	DeviceToken        string
 	Version            int
 	PortRange          *PortRange
+	PortBlocks         []*PortRange
 	LastPingFromClient time.Time
 	EH                 *crypt.SocketWrapper
 	Uindex             []byte
@@ -44,11 +45,22 @@ type UserCoreMapping struct {
 
 	Addr syscall.Sockaddr
 
+	// Peer to peer endpoints
+	P2PAddr  syscall.Sockaddr
+	P2PLocal []string
+
 	APIToken        string
 	Allowedm        sync.Mutex
 	AllowedHosts    []*AllowedHost
 	DHCP            *types.DHCPRecord
 	DisableFirewall bool
+	SiteNetworks    []*types.Network
+
+	// LAN multicast groups joined with IGMP
+	Groupsm         sync.Mutex
+	Groups          map[[4]byte]time.Time
+	MulticastWindow time.Time
+	MulticastCount  int
 
 	CPU  byte
 	RAM  byte
@@ -0,0 +1,131 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/tunnels-is/tunnels/crypt"
+)
+
+// ControlMessageByte marks an in-band control message on the data channel.
+// IPv4 packets always start with 0x4X and ping packets never start with
+// 0xF0, so the first byte is enough to tell them apart.
+const ControlMessageByte byte = 0xF0
+
+type ControlMessageType byte
+
+const (
+	// ControlSiteNetworks carries the full list of site-to-site networks
+	// currently installed on the server.
+	ControlSiteNetworks ControlMessageType = iota + 1
+	// ControlP2PRegister is sent by the client from its peer to peer
+	// socket so the server can learn the public endpoint of that socket.
+	ControlP2PRegister
+	// ControlP2POffer and ControlP2PAnswer carry the peer to peer key
+	// exchange, relayed by the server between two LAN clients.
+	ControlP2POffer
+	ControlP2PAnswer
+	// ControlPortRequest asks the server for another port block,
+	// ControlPortRelease returns idle blocks and ControlPortBlocks
+	// carries the full list of blocks assigned to the client.
+	ControlPortRequest
+	ControlPortRelease
+	ControlPortBlocks
+	// ControlConfigUpdate carries server settings that changed
+	// after a config reload.
+	ControlConfigUpdate
+	// ControlMigrate asks the client to reconnect because the server
+	// is draining, ControlDisconnect is sent by the client to end its
+	// session before it reconnects.
+	ControlMigrate
+	ControlDisconnect
+	// ControlKick tells the client that an admin removed its session
+	ControlKick
+)
+
+type SiteNetworksMessage struct {
+	Networks []*Network `json:"Networks"`
+}
+
+type P2PRegisterMessage struct {
+	LocalEndpoints []string `json:"LocalEndpoints"`
+}
+
+// P2PHandshakeMessage is used for both offers and answers.
+// Peer is the LAN address of the other client, the server replaces
+// it with the address of the sender before relaying the message and
+// fills in the endpoints the sender can be reached on.
+type P2PHandshakeMessage struct {
+	Peer      [4]byte       `json:"Peer"`
+	Endpoints []string      `json:"Endpoints"`
+	EncType   crypt.EncType `json:"EncType"`
+
+	X25519Pub       []byte `json:"X25519Pub"`
+	Mlkem1024Encap  []byte `json:"Mlkem1024Encap,omitempty"`
+	Mlkem1024Cipher []byte `json:"Mlkem1024Cipher,omitempty"`
+}
+
+// PortBlock is an inclusive range of NAT ports on the server
+type PortBlock struct {
+	StartPort uint16 `json:"StartPort"`
+	EndPort   uint16 `json:"EndPort"`
+}
+
+type PortBlocksMessage struct {
+	Blocks []PortBlock `json:"Blocks"`
+}
+
+// ConfigUpdateMessage contains the parts of the connect response
+// that can change while a client is connected.
+type ConfigUpdateMessage struct {
+	AvailableMbps      int  `json:"AvailableMbps"`
+	AvailableUserMbps  int  `json:"AvailableUserMbps"`
+	InternetAccess     bool `json:"InternetAccess"`
+	LocalNetworkAccess bool `json:"LocalNetworkAccess"`
+
+	DNSRecords []*DNSRecord `json:"DNSRecords"`
+	Routes     []*Route     `json:"Routes"`
+	DNSServers []string     `json:"DNSServers"`
+	DNSRoutes  []*DNSRoute  `json:"DNSRoutes"`
+}
+
+// MigrateMessage tells the client to move to ServerID, or to reconnect
+// to the same server once it is back if ServerID is empty.
+type MigrateMessage struct {
+	ServerID string `json:"ServerID,omitempty"`
+	Reason   string `json:"Reason"`
+}
+
+// KickMessage is sent before the server removes the session
+type KickMessage struct {
+	Reason string `json:"Reason"`
+}
+
+// MarshalControlMessage encodes a control message: the marker byte,
+// the message type and a JSON payload.
+func MarshalControlMessage(t ControlMessageType, payload any) (out []byte, err error) {
+	pb, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	out = make([]byte, 0, len(pb)+2)
+	out = append(out, ControlMessageByte, byte(t))
+	out = append(out, pb...)
+	return out, nil
+}
+
+func IsControlMessage(packet []byte) bool {
+	return len(packet) > 1 && packet[0] == ControlMessageByte
+}
+
+// UnmarshalControlMessage decodes the payload of a control message into target
+func UnmarshalControlMessage(packet []byte, target any) (t ControlMessageType, err error) {
+	if !IsControlMessage(packet) {
+		return 0, errors.New("not a control message")
+	}
+	t = ControlMessageType(packet[1])
+	if target == nil || len(packet) == 2 {
+		return t, nil
+	}
+	return t, json.Unmarshal(packet[2:], target)
+}
@@ -58,8 +58,38 @@ type ServerConfig struct {
 	Routes             []*Route
 	SubNets            []*Network
 
+	// Site-to-site: lets clients advertise networks behind them
+	SiteToSite      bool
+	MaxSiteNetworks int
+	// NetAdmins can advertise any network, other users and devices
+	// only the networks granted to them here.
+	SiteNetworkGrants []*SiteNetworkGrant
+
+	// Lets the server broker direct connections between LAN clients
+	PeerToPeer bool
+
+	// Drain mode waits up to DrainTimeoutSeconds for clients to leave,
+	// clients are asked to move to MigrateServerID if it is set.
+	DrainTimeoutSeconds int
+	MigrateServerID     string
+
+	// VPN servers with a ControllerURL send a signed heartbeat to the
+	// controller every HeartbeatSeconds, ServerID is the ID of this
+	// server on the controller.
+	ControllerURL    string
+	ServerID         string
+	HeartbeatSeconds int
+
+	// LAN broadcast and multicast forwarding, the rate is the
+	// maximum number of packets per second a single client can send.
+	LANBroadcast       bool
+	LANMulticastGroups []*MulticastGroup
+	LANMulticastRate   int
+
 	StartPort           int
 	EndPort             int
+	PortBlockSize       int
+	MaxUserPortBlocks   int
 	UserMaxConnections  int
 	InternetAccess      bool
 	LocalNetworkAccess  bool
@@ -68,9 +98,40 @@ type ServerConfig struct {
 
 	DNSRecords []*DNSRecord
 	DNSServers []string
+	DNSRoutes  []*DNSRoute
+
+	// Prometheus metrics are served on MetricsIP:MetricsPort when
+	// MetricsPort is set, otherwise on the API server at /metrics
+	// but only if a MetricsToken has been configured. MetricsIP
+	// defaults to 127.0.0.1, other addresses need a MetricsToken.
+	MetricsIP   string
+	MetricsPort string
+
+	// ACME certificates for the API are requested for ACMEDomains when
+	// ACMEDirectory is set. TLS-ALPN-01 challenges are answered on the
+	// API port, HTTP-01 challenges on ACMEHTTPPort when it is set.
+	ACMEDirectory string
+	ACMEDomains   []string
+	ACMEEmail     string
+	ACMECacheDir  string
+	ACMEHTTPPort  string
 
 	SecretStore SecretStore
+	// SecretDir is used by the "file" store and defaults to /run/secrets,
+	// the "systemd" store reads from $CREDENTIALS_DIRECTORY instead.
+	SecretDir string
+	// SecretURL is used by the "http" store, secrets are fetched from
+	// SecretURL/<key> and cached for SecretTTLSeconds. The access token
+	// is read from the SECRET_STORE_TOKEN environment variable.
+	SecretURL        string
+	SecretTTLSeconds int
+
+	// Server events are delivered to every EventSink, webhooks are
+	// signed with EventSecret when it is set.
+	EventSinks []*EventSink
+
 	// If SecretStore set to "config"
+	EventSecret  string
 	AdminAPIKey  string
 	DBurl        string
 	TwoFactorKey string
@@ -78,17 +139,60 @@ type ServerConfig struct {
 	CertPem      string
 	SignPem      string
 	KeyPem       string
+	MetricsToken string
 
 	// Enables multiple key/pairs for API SNI rotation
 	CertPems []string
 	KeyPems  []string
+
+	// Signing key rotation. KeyPem/CertPem is the primary signing key
+	// unless one of SigningKeys is marked Primary. VerifyKeys are the
+	// controller keys accepted in addition to SignPem. Replaced keys
+	// stay valid for KeyOverlapHours, see server/signing_keys.go.
+	SigningKeys     []*SigningKey
+	VerifyKeys      []*PublicKey
+	KeyOverlapHours int
+}
+
+// SigningKey is a key used to sign connect requests and handshakes.
+// An entry without KeyPem and CertPem sets the validity window of
+// the KeyPem/CertPem key with the same ID.
+type SigningKey struct {
+	ID        string
+	KeyPem    string
+	CertPem   string
+	NotBefore time.Time
+	NotAfter  time.Time
+	Primary   bool
+}
+
+// EventSink is a webhook (URL) or a JSON lines file (Path). Events
+// matches event types, "session.*" matches every session event and
+// an empty list matches all events.
+type EventSink struct {
+	Type       EventSinkType
+	URL        string
+	Path       string
+	Events     []string
+	MaxRetries int
+	QueueSize  int
 }
 
+type EventSinkType string
+
+const (
+	WebhookSink EventSinkType = "webhook"
+	FileSink    EventSinkType = "file"
+)
+
 type SecretStore string
 
 const (
-	EnvStore    SecretStore = "env"
-	ConfigStore SecretStore = "config"
+	EnvStore     SecretStore = "env"
+	ConfigStore  SecretStore = "config"
+	FileStore    SecretStore = "file"
+	SystemdStore SecretStore = "systemd"
+	HTTPStore    SecretStore = "http"
 )
 
 type Device struct {
@@ -113,7 +217,104 @@ type Server struct {
 	Port     string               `json:"Port" bson:"Port"`
 	DataPort string               `json:"DataPort" bson:"DataPort"`
 	PubKey   string               `json:"PubKey,omitempty" bson:"PubKey"`
+	PubKeys  []*PublicKey         `json:"PubKeys,omitempty" bson:"PubKeys"`
 	Groups   []primitive.ObjectID `json:"Groups,omitempty" bson:"Groups"`
+
+	// Status is set by the controller from the last heartbeat
+	Status *ServerStatus `json:"Status,omitempty" bson:"-"`
+}
+
+// ServerReport is sent to the controller by a VPN server on every
+// heartbeat, the payload of a SignedServerReport.
+type ServerReport struct {
+	ServerID         primitive.ObjectID
+	Time             time.Time
+	Started          time.Time
+	IntervalSeconds  int
+	Version          string
+	Sessions         int
+	CPU              int
+	RAM              int
+	Disk             int
+	RXBytesPerSecond uint64
+	TXBytesPerSecond uint64
+	BandwidthMbps    int
+	Draining         bool
+}
+
+// SignedServerReport is signed with the primary signing key of the
+// VPN server and verified against the PubKey/PubKeys of the server.
+type SignedServerReport struct {
+	KeyID     string `json:",omitempty"`
+	Signature []byte
+	Payload   []byte
+}
+
+// ServerStatus is the live state of a server as seen by the controller
+type ServerStatus struct {
+	Online           bool
+	LastSeen         time.Time
+	Started          time.Time
+	Version          string
+	Sessions         int
+	CPU              int
+	RAM              int
+	Disk             int
+	RXBytesPerSecond uint64
+	TXBytesPerSecond uint64
+	BandwidthMbps    int
+	Draining         bool
+}
+
+// ServerOverloadPercent is the CPU, RAM or bandwidth usage at which a
+// server is considered overloaded.
+const ServerOverloadPercent = 90
+
+func (s *ServerStatus) Overloaded() bool {
+	if s.CPU >= ServerOverloadPercent || s.RAM >= ServerOverloadPercent {
+		return true
+	}
+	if s.BandwidthMbps > 0 {
+		mbps := (s.RXBytesPerSecond + s.TXBytesPerSecond) * 8 / 1_000_000
+		if mbps*100 >= uint64(s.BandwidthMbps)*ServerOverloadPercent {
+			return true
+		}
+	}
+	return false
+}
+
+// Unavailable returns the reason new sessions should not be sent to
+// the server, or an empty string.
+func (s *ServerStatus) Unavailable() string {
+	switch {
+	case !s.Online:
+		return "offline"
+	case s.Draining:
+		return "draining"
+	case s.Overloaded():
+		return "overloaded"
+	}
+	return ""
+}
+
+// PublicKey is a signing key published by a server or controller. The
+// key is accepted between NotBefore and NotAfter, a zero time is not
+// checked. PEM is a certificate, or a path to one in a server config.
+type PublicKey struct {
+	ID        string    `json:"ID" bson:"ID"`
+	PEM       string    `json:"PEM" bson:"PEM"`
+	NotBefore time.Time `json:"NotBefore,omitzero" bson:"NotBefore"`
+	NotAfter  time.Time `json:"NotAfter,omitzero" bson:"NotAfter"`
+}
+
+func (k *PublicKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
 }
 
 type TwoFAPending struct {
@@ -138,11 +339,68 @@ type Network struct {
 	NatIPNet *net.IPNet `json:"-"`
 }
 
+// MulticastGroup is a multicast address or range forwarded inside the LAN.
+// If JoinRequired is set, packets are only forwarded to clients that have
+// joined the group with IGMP, otherwise they are sent to every client.
+type MulticastGroup struct {
+	Group        string `json:"Group"`
+	JoinRequired bool   `json:"JoinRequired"`
+
+	NetIPNet *net.IPNet `json:"-"`
+}
+
+// DNSRecordDefaultTTL is used for records without a TTL
+const DNSRecordDefaultTTL = 30
+
+// DNSRecord answers queries for Domain, and for every subdomain when
+// Wildcard is set. IP holds both IPv4 (A) and IPv6 (AAAA) addresses,
+// reverse lookups for the addresses are answered with Domain. When
+// CNAME is set every other answer is ignored and the target is resolved
+// by the DNS proxy.
 type DNSRecord struct {
-	Domain   string   `json:"Domain" bson:"Domain"`
-	Wildcard bool     `json:"Wildcard" bson:"Wildcard"`
-	IP       []string `json:"IP" bson:"IP"`
-	TXT      []string `json:"TXT" bson:"TXT"`
+	Domain   string    `json:"Domain" bson:"Domain"`
+	Wildcard bool      `json:"Wildcard" bson:"Wildcard"`
+	IP       []string  `json:"IP" bson:"IP"`
+	TXT      []string  `json:"TXT" bson:"TXT"`
+	CNAME    string    `json:"CNAME,omitempty" bson:"CNAME,omitempty"`
+	MX       []*DNSMX  `json:"MX,omitempty" bson:"MX,omitempty"`
+	SRV      []*DNSSRV `json:"SRV,omitempty" bson:"SRV,omitempty"`
+	TTL      uint32    `json:"TTL,omitempty" bson:"TTL,omitempty"`
+}
+
+type DNSMX struct {
+	Preference uint16 `json:"Preference" bson:"Preference"`
+	Host       string `json:"Host" bson:"Host"`
+}
+
+type DNSSRV struct {
+	Priority uint16 `json:"Priority" bson:"Priority"`
+	Weight   uint16 `json:"Weight" bson:"Weight"`
+	Port     uint16 `json:"Port" bson:"Port"`
+	Target   string `json:"Target" bson:"Target"`
+}
+
+// HasAnswers is false for records that only send the domain to the
+// DNS servers of the tunnel.
+func (r *DNSRecord) HasAnswers() bool {
+	return len(r.IP) > 0 || len(r.TXT) > 0 || r.CNAME != "" || len(r.MX) > 0 || len(r.SRV) > 0
+}
+
+func (r *DNSRecord) RecordTTL() uint32 {
+	if r.TTL == 0 {
+		return DNSRecordDefaultTTL
+	}
+	return r.TTL
+}
+
+// DNSRoute sends queries for Domain and its subdomains to the DNS
+// servers of the tunnel. When more than one connected tunnel routes a
+// domain the route with the highest Priority is used, then the longest
+// Domain. Exclude sends matching queries to the default DNS servers.
+type DNSRoute struct {
+	Domain   string `json:"Domain" bson:"Domain"`
+	Priority int    `json:"Priority" bson:"Priority"`
+	Exclude  bool   `json:"Exclude" bson:"Exclude"`
 }
 
 type DeviceListResponse struct {
@@ -165,6 +423,8 @@ type ListDevice struct {
 }
 
 type SignedConnectRequest struct {
+	// KeyID is the ID of the controller key that made the signature
+	KeyID          string `json:",omitempty"`
 	Signature      []byte
 	Payload        []byte
 	X25519PeerPub  []byte
@@ -176,9 +436,10 @@ type ServerConnectResponse struct {
 	Mlkem1024Cipher []byte
 	// ServerHandshake          []byte
 	ServerHandshakeSignature []byte
-	Index                    int `json:"Index"`
-	AvailableMbps            int `json:"AvailableMbps"`
-	AvailableUserMbps        int `json:"AvailableUserMbps"`
+	ServerHandshakeKeyID     string `json:",omitempty"`
+	Index                    int    `json:"Index"`
+	AvailableMbps            int    `json:"AvailableMbps"`
+	AvailableUserMbps        int    `json:"AvailableUserMbps"`
 
 	InternetAccess     bool `json:"InternetAccess"`
 	LocalNetworkAccess bool `json:"LocalNetworkAccess"`
@@ -192,6 +453,14 @@ type ServerConnectResponse struct {
 	Networks   []*Network   `json:"Networks"`
 	Routes     []*Route     `json:"Routes"`
 	DNSServers []string     `json:"DNSServers"`
+	DNSRoutes  []*DNSRoute  `json:"DNSRoutes"`
+
+	// Networks advertised by site-to-site clients, reachable through the server
+	SiteNetworks []*Network `json:"SiteNetworks"`
+
+	// Broadcast and multicast groups forwarded inside the LAN
+	LANBroadcast       bool              `json:"LANBroadcast"`
+	LANMulticastGroups []*MulticastGroup `json:"LANMulticastGroups"`
 
 	DHCP *DHCPRecord `json:"DHCP"`
 	LAN  *Network    `json:"LANNetwork"`
@@ -212,10 +481,21 @@ func CreateCRRFromServer(S *ServerConfig) (CRR *ServerConnectResponse) {
 		Networks:           S.SubNets,
 		Routes:             S.Routes,
 		DNSServers:         S.DNSServers,
+		DNSRoutes:          S.DNSRoutes,
 		LAN:                S.Lan,
+		LANBroadcast:       S.LANBroadcast,
+		LANMulticastGroups: S.LANMulticastGroups,
 	}
 }
 
+// SiteNetworkGrant lets a user or device advertise site networks inside
+// Networks. Identifier is a hashed user ID, device token or device key,
+// the same as the entries in NetAdmins.
+type SiteNetworkGrant struct {
+	Identifier string
+	Networks   []string
+}
+
 type ControllerConnectRequest struct {
 	DeviceKey   string             `json:"DeviceKey"`
 	DeviceToken string             `json:"DeviceToken"`
@@ -230,6 +510,10 @@ type ControllerConnectRequest struct {
 	Created time.Time `json:"Created"`
 
 	RequestingPorts bool `json:"RequestingPorts"`
+
+	// Site-to-site: networks behind this device. If Nat is set, the
+	// network is advertised to other peers using the Nat range.
+	SiteNetworks []*Network `json:"SiteNetworks"`
 }
 
 type DHCPRecord struct {